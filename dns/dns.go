@@ -0,0 +1,157 @@
+// Package dns is the programmatic interface of the server: DNS messages and
+// their records, a client sending queries, handlers answering the queries of
+// a zone, and the server itself for programs that embed it.
+//
+// It is a facade over the implementation in internal/server, which the
+// dns-server binary in app/ runs. The types are the same, so handlers and
+// zones registered here are served by the binary when a file dropped next to
+// app/main.go registers them from an init function:
+//
+//	func init() {
+//		dns.HandleFunc("lab.example", func(w dns.ResponseWriter, r *dns.Msg) {
+//			var m dns.Msg
+//			m.SetReply(r).AddAnswer(dns.A("lab.example", net.IPv4(10, 0, 0, 1), 60))
+//			w.WriteMsg(&m)
+//		})
+//	}
+package dns
+
+import (
+	"net"
+
+	"github.com/codecrafters-io/dns-server-starter-go/internal/server"
+)
+
+// Msg is a DNS message, a query or a response. Pack derives the counts of the
+// header from the sections.
+type Msg = server.Msg
+
+type (
+	DNSHeader         = server.DNSHeader
+	DNSQuestion       = server.DNSQuestion
+	DNSResourceRecord = server.DNSResourceRecord
+	DNSResponse       = server.DNSResponse
+)
+
+// Rcode is the response code in the low four bits of the flags.
+type Rcode = server.Rcode
+
+// Opcode is the kind of query, in bits 11 to 14 of the flags.
+type Opcode = server.Opcode
+
+// Record types.
+const (
+	TypeA     = server.TypeA
+	TypeNS    = server.TypeNS
+	TypeCNAME = server.TypeCNAME
+	TypeSOA   = server.TypeSOA
+	TypeNULL  = server.TypeNULL
+	TypePTR   = server.TypePTR
+	TypeMX    = server.TypeMX
+	TypeTXT   = server.TypeTXT
+	TypeAAAA  = server.TypeAAAA
+	TypeSRV   = server.TypeSRV
+	TypeDNAME = server.TypeDNAME
+	TypeOPT   = server.TypeOPT
+	TypeIXFR  = server.TypeIXFR
+	TypeAXFR  = server.TypeAXFR
+	TypeANY   = server.TypeANY
+)
+
+// Classes.
+const (
+	ClassIN   = server.ClassIN
+	ClassCH   = server.ClassCH
+	ClassHS   = server.ClassHS
+	ClassNONE = server.ClassNONE
+	ClassANY  = server.ClassANY
+)
+
+// Response codes.
+const (
+	RcodeSuccess  = server.RcodeSuccess
+	RcodeFormErr  = server.RcodeFormErr
+	RcodeServFail = server.RcodeServFail
+	RcodeNXDomain = server.RcodeNXDomain
+	RcodeNotImp   = server.RcodeNotImp
+	RcodeRefused  = server.RcodeRefused
+	RcodeYXDomain = server.RcodeYXDomain
+	RcodeBadVers  = server.RcodeBadVers
+)
+
+// Opcodes.
+const (
+	OpcodeQuery  = server.OpcodeQuery
+	OpcodeIQuery = server.OpcodeIQuery
+	OpcodeStatus = server.OpcodeStatus
+	OpcodeNotify = server.OpcodeNotify
+	OpcodeUpdate = server.OpcodeUpdate
+)
+
+// Name is a domain name in canonical form, comparable with ==.
+type Name = server.Name
+
+// RootName is the name of the root, ".".
+const RootName = server.RootName
+
+// ParseName parses a name in presentation format, with or without the
+// trailing dot; "" and "." are the root.
+func ParseName(s string) (Name, error) { return server.ParseName(s) }
+
+// NameFromWire returns the Name of an uncompressed label sequence, as parsing
+// leaves them in questions and records.
+func NameFromWire(sequence []byte) Name { return server.NameFromWire(sequence) }
+
+// Resource is the data of a resource record as a typed value.
+type Resource = server.Resource
+
+type (
+	AResource       = server.AResource
+	AAAAResource    = server.AAAAResource
+	NSResource      = server.NSResource
+	CNAMEResource   = server.CNAMEResource
+	DNAMEResource   = server.DNAMEResource
+	PTRResource     = server.PTRResource
+	MXResource      = server.MXResource
+	SRVResource     = server.SRVResource
+	SOAResource     = server.SOAResource
+	TXTResource     = server.TXTResource
+	UnknownResource = server.UnknownResource
+)
+
+// NewRecord returns a record of class IN of name holding res. The builders
+// below are shorthands for it, all of class IN too.
+func NewRecord(name string, ttl uint32, res Resource) (DNSResourceRecord, error) {
+	return server.NewRecord(name, ttl, res)
+}
+
+// A returns an A record of name for the IPv4 address ip.
+func A(name string, ip net.IP, ttl uint32) DNSResourceRecord { return server.A(name, ip, ttl) }
+
+// AAAA returns an AAAA record of name for the IPv6 address ip.
+func AAAA(name string, ip net.IP, ttl uint32) DNSResourceRecord { return server.AAAA(name, ip, ttl) }
+
+// CNAME returns a record making name an alias of target.
+func CNAME(name, target string, ttl uint32) DNSResourceRecord {
+	return server.CNAME(name, target, ttl)
+}
+
+// PTR returns a record pointing name, usually in in-addr.arpa, to target.
+func PTR(name, target string, ttl uint32) DNSResourceRecord { return server.PTR(name, target, ttl) }
+
+// MX returns a mail exchanger record of name.
+func MX(name string, preference uint16, host string, ttl uint32) DNSResourceRecord {
+	return server.MX(name, preference, host, ttl)
+}
+
+// TXT returns a TXT record of name holding text, split into character
+// strings as needed.
+func TXT(name, text string, ttl uint32) DNSResourceRecord { return server.TXT(name, text, ttl) }
+
+// EDNSOption is an option in the data of an OPT record, RFC 6891 6.1.2.
+type EDNSOption = server.EDNSOption
+
+// ParseEDNSOptions splits the data of an OPT record into its options.
+func ParseEDNSOptions(opt DNSResourceRecord) ([]EDNSOption, error) {
+	return server.ParseEDNSOptions(opt)
+}
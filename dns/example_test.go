@@ -0,0 +1,44 @@
+package dns_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/codecrafters-io/dns-server-starter-go/dns"
+)
+
+// A program, or an integration test, runs a server on an ephemeral port,
+// fills a zone and queries it.
+func ExampleServer() {
+	srv, err := dns.NewServer("-listen", "127.0.0.1:0,tcp://127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv.Zone("lab.local").AddA("host", net.IPv4(10, 0, 0, 1), 300)
+	if err := srv.Start(); err != nil {
+		log.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+
+	var query dns.Msg
+	query.SetQuestion("host.lab.local", dns.TypeA)
+	r, err := dns.Exchange(context.Background(), &query, srv.Addr().String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, record := range r.Answers {
+		fmt.Println(record)
+	}
+	// Output:
+	// host.lab.local.	300	IN	A	10.0.0.1
+}
+
+func ExampleHandleFunc() {
+	dns.HandleFunc("lab.example", func(w dns.ResponseWriter, r *dns.Msg) {
+		var m dns.Msg
+		m.SetReply(r).AddAnswer(dns.A("lab.example", net.IPv4(10, 0, 0, 1), 60))
+		w.WriteMsg(&m)
+	})
+}
@@ -0,0 +1,30 @@
+package dns
+
+import "github.com/codecrafters-io/dns-server-starter-go/internal/server"
+
+// The converters let the server be mixed with code written for
+// github.com/miekg/dns without the module depending on it: messages cross
+// over in wire format through the Pack and Unpack methods of *dns.Msg, and
+// records through their text form, DNSResourceRecord.String, which dns.NewRR
+// reads.
+
+// miekgMsg is a *dns.Msg as the converters see it.
+type miekgMsg interface {
+	Pack() ([]byte, error)
+	Unpack(msg []byte) error
+}
+
+// FromMiekg converts a *dns.Msg, or anything else packing a message, into a
+// Msg.
+func FromMiekg(m interface{ Pack() ([]byte, error) }) (*Msg, error) { return server.FromMiekg(m) }
+
+// ToMiekg converts m into dst, a *dns.Msg.
+func ToMiekg(m *Msg, dst interface{ Unpack(msg []byte) error }) error { return server.ToMiekg(m, dst) }
+
+// MiekgHandler adapts a handler written against *dns.Msg, returning the
+// response rather than writing it, to a Handler; newMsg returns an empty
+// message, new(dns.Msg). A nil response, or one that doesn't convert, is
+// answered SERVFAIL.
+func MiekgHandler[M miekgMsg](newMsg func() M, serve func(r M) M) Handler {
+	return server.MiekgHandler(newMsg, serve)
+}
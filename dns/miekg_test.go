@@ -0,0 +1,46 @@
+package dns_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/codecrafters-io/dns-server-starter-go/dns"
+)
+
+// wireMsg stands in for a *dns.Msg of github.com/miekg/dns, keeping the
+// message in wire format.
+type wireMsg struct{ data []byte }
+
+func (m *wireMsg) Pack() ([]byte, error)   { return m.data, nil }
+func (m *wireMsg) Unpack(msg []byte) error { m.data = append([]byte(nil), msg...); return nil }
+
+func TestMiekgRoundTrip(t *testing.T) {
+	mx, err := dns.NewRecord("lab.example", 300, &dns.MXResource{Preference: 10, Exchange: "mail.lab.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var query, m dns.Msg
+	query.SetQuestion("lab.example", dns.TypeMX)
+	m.SetReply(&query).AddAnswer(mx)
+	m.AddAdditional(dns.A("mail.lab.example", net.IPv4(10, 0, 0, 25), 300))
+
+	var dm wireMsg
+	if err := dns.ToMiekg(&m, &dm); err != nil {
+		t.Fatal(err)
+	}
+	back, err := dns.FromMiekg(&dm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(back.Answers) != 1 || len(back.Additional) != 1 {
+		t.Fatalf("%d answers and %d additional records, want one each", len(back.Answers), len(back.Additional))
+	}
+	for _, tt := range []struct{ got, want string }{
+		{back.Answers[0].String(), "lab.example.\t300\tIN\tMX\t10 mail.lab.example."},
+		{back.Additional[0].String(), "mail.lab.example.\t300\tIN\tA\t10.0.0.25"},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("record %q, want %q", tt.got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package dns
+
+import (
+	"context"
+
+	"github.com/codecrafters-io/dns-server-starter-go/internal/server"
+)
+
+// A ResponseWriter sends the response to a query over the transport it came
+// in on.
+type ResponseWriter = server.ResponseWriter
+
+// A Handler answers the queries of the zones it is registered for.
+type Handler = server.Handler
+
+// HandlerFunc adapts a function to a Handler.
+type HandlerFunc = server.HandlerFunc
+
+// ServeMux routes queries to the handler of the most specific zone containing
+// the name of the first question.
+type ServeMux = server.ServeMux
+
+// NewServeMux returns an empty mux.
+func NewServeMux() *ServeMux { return server.NewServeMux() }
+
+// DefaultServeMux is the mux the dns-server binary consults for every query
+// that passed the access checks and policies.
+var DefaultServeMux = server.DefaultServeMux
+
+// Handle registers h for zone on DefaultServeMux.
+func Handle(zone string, h Handler) { server.Handle(zone, h) }
+
+// HandleFunc registers f for zone on DefaultServeMux.
+func HandleFunc(zone string, f func(w ResponseWriter, r *Msg)) { server.HandleFunc(zone, f) }
+
+// Middleware wraps a Handler, answering some queries itself and passing the
+// others on.
+type Middleware = server.Middleware
+
+// Chain returns h wrapped in middleware, the first one outermost.
+func Chain(h Handler, middleware ...Middleware) Handler { return server.Chain(h, middleware...) }
+
+// PluginSetup instantiates a plugin with the arguments of a -plugin line.
+type PluginSetup = server.PluginSetup
+
+// RegisterPlugin makes a plugin available to -plugin under name. It panics if
+// name is taken.
+func RegisterPlugin(name string, setup PluginSetup) { server.RegisterPlugin(name, setup) }
+
+// Plugins returns the names of the registered plugins, sorted.
+func Plugins() []string { return server.Plugins() }
+
+// An EDNSOptionHandler implements an EDNS option the OPT codec doesn't know.
+type EDNSOptionHandler = server.EDNSOptionHandler
+
+// EDNSOptionFuncs adapts a pair of functions to an EDNSOptionHandler.
+type EDNSOptionFuncs = server.EDNSOptionFuncs
+
+// RegisterEDNSOption makes h handle the EDNS option code in queries and
+// responses. It panics if code is registered already.
+func RegisterEDNSOption(code uint16, h EDNSOptionHandler) { server.RegisterEDNSOption(code, h) }
+
+// EDNSOptionValue returns the value parsed from the option code of the query
+// answered through w, or reports false when the query had none.
+func EDNSOptionValue(w ResponseWriter, code uint16) (any, bool) {
+	return server.EDNSOptionValue(w, code)
+}
+
+// SetEDNSOption sets the option code of the OPT record of the response to the
+// query answered through w; nil data leaves the option out.
+func SetEDNSOption(w ResponseWriter, code uint16, data []byte) {
+	server.SetEDNSOption(w, code, data)
+}
+
+// Zone holds records registered at runtime, answered authoritatively.
+type Zone = server.Zone
+
+// NewZone returns an empty zone for name, to be registered with
+// ServeMux.Handle.
+func NewZone(name string) *Zone { return server.NewZone(name) }
+
+// Server is a DNS server a Go program starts and stops itself; see
+// ExampleServer.
+type Server = server.Server
+
+// ErrServerClosed is returned by ListenAndServe and Start once Shutdown was
+// called.
+var ErrServerClosed = server.ErrServerClosed
+
+// NewServer returns a server configured by args, the command line options of
+// the dns-server binary, such as "-listen", "127.0.0.1:0".
+func NewServer(args ...string) (*Server, error) { return server.NewServer(args...) }
+
+// Client sends queries to a DNS server and returns its responses. The zero
+// value asks over UDP and retries over TCP when the response is truncated.
+type Client = server.Client
+
+// Exchange sends m to the server at addr, a host:port, with the zero Client
+// and waits for the response.
+func Exchange(ctx context.Context, m *Msg, addr string) (*Msg, error) {
+	return server.Exchange(ctx, m, addr)
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ACLAction decides what happens to a client that is rejected by an ACL.
+type ACLAction int
+
+const (
+	ACLRefuse ACLAction = iota // answer with RCODE REFUSED
+	ACLDrop                    // silently drop the query
+)
+
+func parseACLAction(s string) (ACLAction, error) {
+	switch strings.ToLower(s) {
+	case "refuse", "refused":
+		return ACLRefuse, nil
+	case "drop":
+		return ACLDrop, nil
+	}
+	return ACLRefuse, fmt.Errorf("unknown ACL action %q (want refuse or drop)", s)
+}
+
+// ACL is an allow/deny list of client networks. Deny entries win over allow
+// entries, and an empty allow list admits every client that isn't denied.
+type ACL struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// Permits reports whether the client address passes the ACL. A nil ACL
+// permits everyone.
+func (a *ACL) Permits(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	for _, network := range a.Deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.Allow) == 0 {
+		return true
+	}
+	for _, network := range a.Allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRList parses a comma separated list of networks. Bare addresses are
+// accepted and treated as a single host network.
+func parseCIDRList(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		network, err := parseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// cidrListFlag is a flag holding a comma separated list of networks, checked
+// when the flag is set.
+type cidrListFlag struct {
+	networks *[]*net.IPNet
+}
+
+func (f *cidrListFlag) String() string {
+	if f.networks == nil {
+		return ""
+	}
+	var list []string
+	for _, network := range *f.networks {
+		list = append(list, network.String())
+	}
+	return strings.Join(list, ",")
+}
+
+func (f *cidrListFlag) Set(value string) error {
+	networks, err := parseCIDRList(value)
+	if err != nil {
+		return err
+	}
+	*f.networks = networks
+	return nil
+}
+
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", s)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network %q: %w", s, err)
+	}
+	return network, nil
+}
+
+// ZoneACLs holds the ACLs that apply to queries below a zone. The longest
+// matching zone wins.
+type ZoneACLs map[Name]*ACL
+
+// Lookup returns the ACL of the closest enclosing zone of name, or nil when no
+// zone ACL applies.
+func (z ZoneACLs) Lookup(name Name) *ACL {
+	acl, _ := closestZone(name, z)
+	return acl
+}
+
+// zoneACLFlag collects repeated "zone=cidr,cidr" flag values into ZoneACLs,
+// filling either the allow or the deny side.
+type zoneACLFlag struct {
+	acls ZoneACLs
+	deny bool
+}
+
+func (f *zoneACLFlag) String() string { return "" }
+
+func (f *zoneACLFlag) Set(value string) error {
+	origin, list, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected zone=cidr[,cidr...], got %q", value)
+	}
+	zone, err := ParseName(origin)
+	if err != nil {
+		return err
+	}
+	networks, err := parseCIDRList(list)
+	if err != nil {
+		return err
+	}
+	acl := f.acls[zone]
+	if acl == nil {
+		acl = &ACL{}
+		f.acls[zone] = acl
+	}
+	if f.deny {
+		acl.Deny = append(acl.Deny, networks...)
+	} else {
+		acl.Allow = append(acl.Allow, networks...)
+	}
+	return nil
+}
+
+// canonicalName lowercases a domain name and strips the trailing dot so names
+// can be compared as plain strings. Unicode labels are converted to their
+// xn-- form, the one queries carry; a name that doesn't convert is left to
+// fail where it is encoded.
+func canonicalName(name string) string {
+	if ascii, err := idnaToASCII(name); err == nil {
+		name = ascii
+	}
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// inZone reports whether name equals zone or is below it. Both are expected
+// in canonical form; the empty zone is the root and contains every name.
+func inZone(name, zone string) bool {
+	if zone == "" || name == zone {
+		return true
+	}
+	return strings.HasSuffix(name, "."+zone)
+}
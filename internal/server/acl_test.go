@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestListenerACL(t *testing.T) {
+	s := newTestServer(t, "-listen", "127.0.0.1:5300,tcp://127.0.0.1:5300", "-allow", "10.0.0.0/8",
+		"-listen-allow", "tcp://127.0.0.1:5300=192.0.2.0/24", "-record", "host.lab A 10.0.0.1")
+	var query Msg
+	query.SetQuestion("host.lab", TypeA)
+	for _, tt := range []struct {
+		listener listenEndpoint
+		want     Rcode
+	}{
+		{listenEndpoint{Network: "udp", Host: "127.0.0.1", Port: "5300"}, RcodeRefused},
+		{listenEndpoint{Network: "tcp", Host: "127.0.0.1", Port: "5300"}, RcodeSuccess},
+		{listenEndpoint{}, RcodeRefused},
+	} {
+		var replies [][]byte
+		s.handle(context.Background(), query.Pack(), testClient, tt.listener, func(response []byte) error {
+			replies = append(replies, append([]byte(nil), response...))
+			return nil
+		})
+		if len(replies) != 1 {
+			t.Fatalf("%s: %d replies, want 1", tt.listener, len(replies))
+		}
+		response, _, err := parseDNSResponse(nil, replies[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := response.Header.Rcode(); got != tt.want {
+			t.Errorf("%s: rcode %v, want %v", tt.listener, got, tt.want)
+		}
+	}
+}
+
+func TestListenerACLNeedsEndpoint(t *testing.T) {
+	if _, err := NewServer("-listen", "127.0.0.1:5300", "-listen-deny", "tcp://127.0.0.1:5300=192.0.2.0/24"); err == nil {
+		t.Error("NewServer accepted an ACL for an endpoint that isn't listened on")
+	}
+	if _, err := NewServer("-listen", "127.0.0.1:5300@vpn", "-listen-deny", "127.0.0.1:5300@vpn=192.0.2.0/24"); err == nil {
+		t.Error("NewServer accepted an endpoint with a group in -listen-deny")
+	}
+}
+
+func TestZoneACLs(t *testing.T) {
+	acls := ZoneACLs{}
+	for _, tt := range []struct {
+		value string
+		deny  bool
+	}{
+		{"lab=192.0.2.0/24", false},
+		{"Secret.Lab.=192.0.2.7", true},
+		{`a\.b.lab=198.51.100.0/24`, false},
+	} {
+		if err := (&zoneACLFlag{acls: acls, deny: tt.deny}).Set(tt.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, value := range []string{"lab", "bad..zone=192.0.2.0/24", "lab=192.0.2.300"} {
+		if err := (&zoneACLFlag{acls: ZoneACLs{}}).Set(value); err == nil {
+			t.Errorf("%q accepted", value)
+		}
+	}
+
+	for _, tt := range []struct {
+		name, ip string
+		want     bool
+	}{
+		{"host.lab", "192.0.2.1", true},
+		{"host.lab", "198.51.100.1", false},
+		{"HOST.SECRET.lab", "192.0.2.7", false}, // the longest zone wins
+		{"host.secret.lab", "192.0.2.8", true},
+		{`x.a\.b.lab`, "198.51.100.1", true},
+		{"x.a.b.lab", "198.51.100.1", false}, // the dot is no label boundary
+		{"host.other", "203.0.113.1", true},  // no zone ACL
+	} {
+		if got := acls.Lookup(mustParseName(tt.name)).Permits(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("%s from %s permitted %v, want %v", tt.name, tt.ip, got, tt.want)
+		}
+	}
+}
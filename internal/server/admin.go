@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/codecrafters-io/dns-server-starter-go/internal/slog"
+)
+
+// serveAdmin binds addr and runs the operational HTTP endpoints on it in the
+// background. Binding happens before it returns, so it may still use
+// privileges that are dropped afterwards. The name tells the listeners apart
+// in the log. An address of the form unix:/path listens on a unix socket only
+// the server's user may connect to.
+func serveAdmin(name, addr string, handler http.Handler) (*http.Server, error) {
+	listener, err := listenAdmin(addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Addr: addr, Handler: handler}
+	slog.Info(name+" endpoints listening", "addr", addr)
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			slog.Error(name+" listener failed", "err", err)
+		}
+	}()
+	return server, nil
+}
+
+func listenAdmin(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, "unix:")
+	// a socket left behind by an earlier run would make the bind fail
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// isUnixAdminAddr reports whether addr, as -admin takes it, is a unix
+// socket, which only the server's user may connect to. Any TCP address, even
+// a loopback one, is reachable from every local user and from the pages
+// their browsers load.
+func isUnixAdminAddr(addr string) bool {
+	return strings.HasPrefix(addr, "unix:")
+}
+
+// rejectCrossSite refuses requests that change something when a browser
+// says they come from another site, so a page can't drive the admin API
+// with a form or a fetch carrying the user's credentials. Reads stay open,
+// and clients that aren't browsers send neither header.
+func rejectCrossSite(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" && site != "none" {
+			http.Error(w, "cross-site request refused", http.StatusForbidden)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" {
+			u, err := url.Parse(origin)
+			if err != nil || u.Host != r.Host {
+				http.Error(w, "cross-origin request refused", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeJSON sends v as an indented JSON document.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		slog.Warn("failed to write admin response", "err", err)
+	}
+}
+
+// profilingMux serves the net/http/pprof profiles under /debug/pprof/. They
+// live on their own listener so profiling can stay off the admin address.
+func profilingMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsUnixAdminAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"unix:/run/dns-server/admin.sock": true,
+		"127.0.0.1:8053":                  false,
+		"[::1]:8053":                      false,
+		"localhost:8053":                  false,
+		":8053":                           false,
+	} {
+		if got := isUnixAdminAddr(addr); got != want {
+			t.Errorf("isUnixAdminAddr(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestRejectCrossSite(t *testing.T) {
+	handler := rejectCrossSite(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range []struct {
+		method, origin, fetchSite string
+		want                      int
+	}{
+		{http.MethodPost, "", "", http.StatusOK}, // ctl and curl
+		{http.MethodPost, "http://127.0.0.1:8053", "same-origin", http.StatusOK},
+		{http.MethodPost, "", "none", http.StatusOK},
+		{http.MethodPost, "http://evil.example", "", http.StatusForbidden},
+		{http.MethodPost, "", "cross-site", http.StatusForbidden},
+		{http.MethodPost, "", "same-site", http.StatusForbidden},
+		{http.MethodDelete, "http://evil.example", "cross-site", http.StatusForbidden},
+		{http.MethodPost, "null", "", http.StatusForbidden},
+		{http.MethodGet, "http://evil.example", "cross-site", http.StatusOK},
+	} {
+		r := httptest.NewRequest(tt.method, "http://127.0.0.1:8053/blocking?enabled=off", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if tt.fetchSite != "" {
+			r.Header.Set("Sec-Fetch-Site", tt.fetchSite)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s from %q (%q): status %d, want %d", tt.method, tt.origin, tt.fetchSite, w.Code, tt.want)
+		}
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	handler := requireToken("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range []struct {
+		path, authorization string
+		want                int
+	}{
+		{"/stats", "", http.StatusUnauthorized},
+		{"/stats", "Bearer wrong", http.StatusUnauthorized},
+		{"/stats", "secret", http.StatusUnauthorized},
+		{"/stats", "Bearer secret", http.StatusOK},
+		{"/healthz", "", http.StatusOK},
+		{"/readyz", "", http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.authorization != "" {
+			r.Header.Set("Authorization", tt.authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s with %q: status %d, want %d", tt.path, tt.authorization, w.Code, tt.want)
+		}
+	}
+}
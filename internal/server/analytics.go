@@ -0,0 +1,297 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// analyticsBuckets is the window of the rolling analytics in minutes,
+	// one bucket of counters per minute.
+	analyticsBuckets = 10
+	// maxAnalyticsClients and maxAnalyticsDomains cap the clients and domains
+	// tracked unless the memory budget lowers them; beyond them the least
+	// recently seen is forgotten.
+	maxAnalyticsClients = 10000
+	maxAnalyticsDomains = 10000
+	// maxAnalyticsNames caps the distinct names remembered per client or
+	// domain.
+	maxAnalyticsNames = 1000
+	// evictionSample is how many entries are looked at to find one to
+	// forget when a table of the analytics or the traffic is full.
+	evictionSample = 32
+	// analyticsMinQueries is how many queries a client or domain needs in the
+	// window before it is scored at all.
+	analyticsMinQueries = 20
+	// analyticsBurst is the queries in a minute below which a client is not
+	// bursting, whatever its average.
+	analyticsBurst = 300
+	// defaultTopScores is how many clients and domains the report lists by
+	// default.
+	defaultTopScores = 20
+)
+
+// Analytics keeps rolling per-client and per-domain statistics of the last
+// ten minutes of queries, and scores them for the signs of a host infected
+// with malware using a domain generation algorithm (DGA): many NXDOMAIN
+// answers, names that look generated, bursts of queries. It runs beside
+// Stats, which counts since startup, and like it is kept over reloads.
+type Analytics struct {
+	mu         sync.Mutex
+	clients    map[string]*activity
+	domains    map[string]*activity
+	maxClients int
+	maxDomains int
+}
+
+// activity is the rolling statistics of a client or a domain.
+type activity struct {
+	buckets [analyticsBuckets]activityBucket
+	names   map[string]int64 // distinct domains of a client or clients of a domain, to the minute last seen
+	seen    int64            // minute last seen
+}
+
+// activityBucket counts the queries of one minute.
+type activityBucket struct {
+	minute    int64
+	queries   int
+	nxdomain  int
+	generated int // queries for names that look generated
+	dga       int // of those, answered NXDOMAIN
+}
+
+func NewAnalytics() *Analytics {
+	return &Analytics{clients: make(map[string]*activity), domains: make(map[string]*activity), maxClients: maxAnalyticsClients, maxDomains: maxAnalyticsDomains}
+}
+
+// limit lowers the clients and domains tracked to entries between them. It
+// is called before the first query is recorded.
+func (a *Analytics) limit(entries int) {
+	a.maxClients, a.maxDomains = halves(entries)
+}
+
+// Limit returns the number of clients and domains that may be tracked.
+func (a *Analytics) Limit() int {
+	return a.maxClients + a.maxDomains
+}
+
+// record adds a query from client for name, answered with rcode or dropped
+// when rcode is negative.
+func (a *Analytics) record(client, name string, rcode int, now time.Time) {
+	if a == nil || name == "" {
+		return
+	}
+	minute := now.Unix() / 60
+	domain := statsZone(name)
+	generated := looksGenerated(domain)
+	nxdomain := rcode == int(RcodeNXDomain)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.activity(a.clients, client, a.maxClients, minute).add(domain, minute, nxdomain, generated)
+	a.activity(a.domains, domain, a.maxDomains, minute).add(client, minute, nxdomain, generated)
+}
+
+// activity returns the statistics of key in table, making room for new ones
+// by forgetting the least recently seen.
+func (a *Analytics) activity(table map[string]*activity, key string, limit int, minute int64) *activity {
+	act, ok := table[key]
+	if ok {
+		return act
+	}
+	if len(table) >= limit {
+		// the oldest of a sample, as scanning all of them for every new
+		// client of a random name flood would be too slow
+		var oldest string
+		sampled := 0
+		for k, other := range table {
+			if oldest == "" || other.seen < table[oldest].seen {
+				oldest = k
+			}
+			if sampled++; sampled == evictionSample {
+				break
+			}
+		}
+		delete(table, oldest)
+	}
+	act = &activity{names: make(map[string]int64)}
+	table[key] = act
+	return act
+}
+
+func (act *activity) add(name string, minute int64, nxdomain, generated bool) {
+	b := &act.buckets[minute%analyticsBuckets]
+	if b.minute > minute {
+		// counted a window late, the bucket is a later minute's now
+		return
+	}
+	if minute > act.seen {
+		act.seen = minute
+	}
+	if b.minute != minute {
+		*b = activityBucket{minute: minute}
+	}
+	b.queries++
+	if nxdomain {
+		b.nxdomain++
+	}
+	if generated {
+		b.generated++
+		if nxdomain {
+			b.dga++
+		}
+	}
+	if _, ok := act.names[name]; !ok && len(act.names) >= maxAnalyticsNames {
+		var oldest string
+		sampled := 0
+		for other, last := range act.names {
+			if oldest == "" || last < act.names[oldest] {
+				oldest = other
+			}
+			if sampled++; sampled == evictionSample {
+				break
+			}
+		}
+		delete(act.names, oldest)
+	}
+	act.names[name] = minute
+}
+
+// ActivityScore is the rolling statistics of a client or domain with its
+// score, from 0 for nothing unusual to 100, and the reasons for it.
+type ActivityScore struct {
+	Key       string   `json:"key"`
+	Queries   int      `json:"queries"`
+	NXDomain  float64  `json:"nxdomain_ratio"`
+	Generated float64  `json:"generated_ratio"`
+	Distinct  int      `json:"distinct"`
+	PeakQPM   int      `json:"peak_per_minute"`
+	Score     int      `json:"score"`
+	Reasons   []string `json:"reasons,omitempty"`
+}
+
+// score sums the buckets of the window ending at minute and scores them.
+func (act *activity) score(key string, minute int64) ActivityScore {
+	s := ActivityScore{Key: key}
+	var nxdomain, generated, dga int
+	for _, b := range act.buckets {
+		if minute-b.minute >= analyticsBuckets {
+			continue
+		}
+		s.Queries += b.queries
+		nxdomain += b.nxdomain
+		generated += b.generated
+		dga += b.dga
+		if b.queries > s.PeakQPM {
+			s.PeakQPM = b.queries
+		}
+	}
+	for _, last := range act.names {
+		if minute-last < analyticsBuckets {
+			s.Distinct++
+		}
+	}
+	if s.Queries == 0 {
+		return s
+	}
+	s.NXDomain = float64(nxdomain) / float64(s.Queries)
+	s.Generated = float64(generated) / float64(s.Queries)
+	if s.Queries < analyticsMinQueries {
+		return s
+	}
+
+	score := 0.0
+	if s.NXDomain >= 0.25 {
+		score += 30 * s.NXDomain
+		s.Reasons = append(s.Reasons, "many NXDOMAIN answers")
+	}
+	if ratio := float64(dga) / float64(s.Queries); ratio >= 0.1 {
+		score += 50 * ratio
+		s.Reasons = append(s.Reasons, "NXDOMAIN for names that look generated")
+	} else if s.Generated >= 0.25 {
+		score += 20 * s.Generated
+		s.Reasons = append(s.Reasons, "names that look generated")
+	}
+	if mean := float64(s.Queries) / analyticsBuckets; s.PeakQPM >= analyticsBurst && float64(s.PeakQPM) >= 4*mean {
+		score += 20 * (1 - mean/float64(s.PeakQPM))
+		s.Reasons = append(s.Reasons, "bursts of queries")
+	}
+	s.Score = int(score + 0.5)
+	return s
+}
+
+// AnalyticsReport is the scored clients and domains as shown by the admin
+// API, the highest scores first.
+type AnalyticsReport struct {
+	Window  string          `json:"window"`
+	Clients []ActivityScore `json:"clients"`
+	Domains []ActivityScore `json:"domains"`
+}
+
+// Report scores the clients and domains active in the window ending at now
+// and lists the top of each with the highest scores, then the most queries.
+func (a *Analytics) Report(top int, now time.Time) AnalyticsReport {
+	report := AnalyticsReport{Window: (analyticsBuckets * time.Minute).String()}
+	if a == nil {
+		return report
+	}
+	minute := now.Unix() / 60
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	report.Clients = topScores(a.clients, top, minute)
+	report.Domains = topScores(a.domains, top, minute)
+	return report
+}
+
+func topScores(table map[string]*activity, top int, minute int64) []ActivityScore {
+	scores := make([]ActivityScore, 0, len(table))
+	for key, act := range table {
+		if s := act.score(key, minute); s.Queries > 0 {
+			scores = append(scores, s)
+		}
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].Score != scores[j].Score {
+			return scores[i].Score > scores[j].Score
+		}
+		if scores[i].Queries != scores[j].Queries {
+			return scores[i].Queries > scores[j].Queries
+		}
+		return scores[i].Key < scores[j].Key
+	})
+	if len(scores) > top {
+		scores = scores[:top]
+	}
+	return scores
+}
+
+// Tracked returns the number of clients and domains tracked.
+func (a *Analytics) Tracked() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.clients) + len(a.domains)
+}
+
+// looksGenerated reports whether the label of domain below its top level
+// domain looks made up by an algorithm rather than by people: long, and
+// random in its letters or mixing in many digits.
+func looksGenerated(domain string) bool {
+	label, _, _ := strings.Cut(domain, ".")
+	if len(label) < 10 {
+		return false
+	}
+	var vowels, digits int
+	for i := 0; i < len(label); i++ {
+		switch c := label[i]; {
+		case strings.IndexByte("aeiouy", c) >= 0:
+			vowels++
+		case c >= '0' && c <= '9':
+			digits++
+		}
+	}
+	vowelRatio := float64(vowels) / float64(len(label))
+	digitRatio := float64(digits) / float64(len(label))
+	return shannonEntropy(label) >= 3.2 && (vowelRatio < 0.25 || digitRatio >= 0.2)
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dgaName returns the i-th of a series of generated looking domains, as a
+// DGA would make them: 14 distinct consonants in no order a person would
+// pick.
+func dgaName(i int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprint(i)))
+	letters := []byte("bcdfghjklmnpqrstvwxz")
+	for j := len(letters) - 1; j > 0; j-- {
+		k := int(sum[j]) % (j + 1)
+		letters[j], letters[k] = letters[k], letters[j]
+	}
+	return string(letters[:14]) + ".com"
+}
+
+func TestLooksGenerated(t *testing.T) {
+	for name, want := range map[string]bool{
+		"google.com":            false,
+		"example.org":           false,
+		"wikipedia.org":         false,
+		"stackoverflow.com":     false,
+		"short.com":             false,
+		"xkqjzvbnmwrt.com":      true,
+		"a8f3k29d0x7c.net":      true,
+		"q3x9v7k2m8z4w1.info":   true,
+		"cloudflare-dns.com":    false,
+		"www.thisisfine.co":     false,
+		"mnbvcxzlkjhg.ru":       true,
+		"aaaaaaaaaaaaaaaa.com":  false, // long but not random
+		"ab12cd34ef56gh78.com":  true,
+		"international.example": false,
+	} {
+		if got := looksGenerated(name); got != want {
+			t.Errorf("looksGenerated(%q) = %v, want %v", name, got, want)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if !looksGenerated(dgaName(i)) {
+			t.Fatalf("dgaName(%d) = %s doesn't look generated", i, dgaName(i))
+		}
+	}
+}
+
+func TestAnalyticsCounters(t *testing.T) {
+	a := NewAnalytics()
+	now := time.Date(2024, 1, 1, 12, 0, 30, 0, time.UTC)
+	// 30 queries over three minutes, a third of them NXDOMAIN, for names of
+	// two domains; one dropped
+	for i := 0; i < 30; i++ {
+		rcode := int(RcodeSuccess)
+		if i%3 == 0 {
+			rcode = int(RcodeNXDomain)
+		}
+		name := fmt.Sprintf("host%d.example.com", i%4)
+		if i%5 == 0 {
+			name = "www.example.org"
+		}
+		a.record("192.0.2.1", name, rcode, now.Add(time.Duration(i%3)*time.Minute))
+	}
+	a.record("192.0.2.1", "www.example.org", -1, now)
+	// a window late, in the slot of the last minute: not counted
+	a.record("192.0.2.1", "www.example.org", int(RcodeSuccess), now.Add(-8*time.Minute))
+	a.record("192.0.2.1", "", int(RcodeSuccess), now) // no question, not counted
+
+	report := a.Report(10, now.Add(2*time.Minute))
+	if report.Window != "10m0s" {
+		t.Errorf("window %s, want 10m0s", report.Window)
+	}
+	if len(report.Clients) != 1 || len(report.Domains) != 2 {
+		t.Fatalf("report %+v, want one client and two domains", report)
+	}
+	client := report.Clients[0]
+	if client.Key != "192.0.2.1" || client.Queries != 31 || client.Distinct != 2 || client.PeakQPM != 11 {
+		t.Errorf("client %+v, want 31 queries for 2 domains, 11 at most in a minute", client)
+	}
+	if client.NXDomain != 10.0/31 || client.Generated != 0 {
+		t.Errorf("client ratios %g NXDOMAIN and %g generated, want 10/31 and 0", client.NXDomain, client.Generated)
+	}
+	if client.Score != 10 || strings.Join(client.Reasons, ",") != "many NXDOMAIN answers" {
+		t.Errorf("client score %d for %q, want 10 for its NXDOMAIN answers", client.Score, client.Reasons)
+	}
+	domains := map[string]ActivityScore{}
+	for _, d := range report.Domains {
+		domains[d.Key] = d
+	}
+	if d := domains["example.com"]; d.Queries != 24 || d.Distinct != 1 {
+		t.Errorf("example.com %+v, want 24 queries from one client", d)
+	}
+	if d := domains["example.org"]; d.Queries != 7 || d.Score != 0 {
+		t.Errorf("example.org %+v, want 7 queries under the minimum for a score", d)
+	}
+
+	// the buckets roll: ten minutes on, the first minute of the queries has
+	// left the window, and two minutes later all of them
+	if c := a.Report(10, now.Add(10*time.Minute)).Clients; len(c) != 1 || c[0].Queries != 20 {
+		t.Errorf("clients %+v ten minutes after the first, want the 20 queries of the later minutes", c)
+	}
+	if c := a.Report(10, now.Add(12*time.Minute)).Clients; len(c) != 0 {
+		t.Errorf("clients %+v after the window, want none", c)
+	}
+}
+
+func TestAnalyticsTopN(t *testing.T) {
+	a := NewAnalytics()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 40; i++ {
+		// an infected host, its generated names answered NXDOMAIN
+		a.record("10.0.0.66", dgaName(i), int(RcodeNXDomain), now)
+		// a host mistyping names
+		rcode := int(RcodeSuccess)
+		if i%2 == 0 {
+			rcode = int(RcodeNXDomain)
+		}
+		a.record("10.0.0.2", fmt.Sprintf("intranet%d.example.com", i), rcode, now)
+		// quiet hosts, ordered by how much they ask
+		for j := 0; j < 3; j++ {
+			a.record(fmt.Sprintf("10.0.0.%d", 10+j), "www.example.com", int(RcodeSuccess), now.Add(time.Duration(j)*time.Second))
+		}
+		a.record("10.0.0.12", "www.example.org", int(RcodeSuccess), now)
+	}
+	// a burst: 400 queries in one minute against a quiet rest of the window
+	for i := 0; i < 400; i++ {
+		a.record("10.0.0.99", "www.example.net", int(RcodeSuccess), now)
+	}
+	a.record("10.0.0.99", "www.example.net", int(RcodeSuccess), now.Add(-9*time.Minute))
+
+	report := a.Report(4, now)
+	var got []string
+	for _, s := range report.Clients {
+		got = append(got, fmt.Sprintf("%s %d %s", s.Key, s.Score, strings.Join(s.Reasons, "+")))
+	}
+	want := []string{
+		"10.0.0.66 80 many NXDOMAIN answers+NXDOMAIN for names that look generated",
+		"10.0.0.99 18 bursts of queries",
+		"10.0.0.2 15 many NXDOMAIN answers",
+		"10.0.0.12 0 ",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("top clients\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	// every generated name is its own domain, each too quiet to score
+	if len(report.Domains) != 4 || report.Domains[0].Key != "example.net" || report.Domains[0].Score != 18 {
+		t.Errorf("top domains %+v, want example.net first for its burst", report.Domains)
+	}
+	if r := a.Report(0, now); len(r.Clients) != 0 || len(r.Domains) != 0 {
+		t.Errorf("top 0: %+v, want empty lists", r)
+	}
+}
+
+func TestAnalyticsForgetsOldestClients(t *testing.T) {
+	a := NewAnalytics()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	a.record("192.0.2.1", "www.example.com", int(RcodeSuccess), now)
+	for i := 0; i < maxAnalyticsClients; i++ {
+		a.record(fmt.Sprintf("10.%d.%d.%d", i>>16, i>>8&0xff, i&0xff), "www.example.com", int(RcodeSuccess), now.Add(time.Minute))
+	}
+	if n := len(a.clients); n != maxAnalyticsClients {
+		t.Errorf("%d clients tracked, want the limit of %d", n, maxAnalyticsClients)
+	}
+	if a.Tracked() != maxAnalyticsClients+1 {
+		t.Errorf("%d tracked, want the clients and the one domain", a.Tracked())
+	}
+}
+
+func TestAnalyticsAPI(t *testing.T) {
+	a := NewAnalytics()
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		a.record(fmt.Sprintf("192.0.2.%d", i), "www.example.com", int(RcodeSuccess), now)
+	}
+	mux := http.NewServeMux()
+	(&controlAPI{analytics: a}).register(mux)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/analytics?top=2", nil))
+	var report AnalyticsReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("%v in %s", err, w.Body)
+	}
+	if len(report.Clients) != 2 || report.Clients[0].Key != "192.0.2.0" || len(report.Domains) != 1 {
+		t.Errorf("report %+v, want the first two clients and the domain", report)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/analytics?top=-1", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status %d for top=-1, want 400", w.Code)
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/internal/slog"
+)
+
+// AuditEntry records one blocked query.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Client string    `json:"client"`
+	Group  string    `json:"group"`
+	Name   string    `json:"name"`
+	Type   string    `json:"type"`
+	Rule   string    `json:"rule"`
+	List   string    `json:"list,omitempty"`
+}
+
+// AuditLog keeps the most recent blocked queries in a ring buffer for the
+// admin API and optionally appends every entry to a log file as JSON lines.
+type AuditLog struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+	next    int
+	full    bool
+	file    *rotatingFile
+}
+
+func NewAuditLog(size int, file *rotatingFile) *AuditLog {
+	if size < 1 {
+		size = 1
+	}
+	return &AuditLog{entries: make([]AuditEntry, size), file: file}
+}
+
+// Record adds an entry. A nil AuditLog discards it.
+func (a *AuditLog) Record(entry AuditEntry) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.entries[a.next] = entry
+	a.next = (a.next + 1) % len(a.entries)
+	if a.next == 0 {
+		a.full = true
+	}
+	a.mu.Unlock()
+
+	if a.file != nil {
+		line, _ := json.Marshal(entry)
+		if _, err := a.file.Write(append(line, '\n')); err != nil {
+			slog.Error("failed to write audit log", "err", err)
+		}
+	}
+}
+
+// Recent returns up to limit entries, newest first, whose client equals
+// client and whose name contains name; empty filters match everything.
+func (a *AuditLog) Recent(client, name string, limit int) []AuditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	count := a.next
+	if a.full {
+		count = len(a.entries)
+	}
+	name = canonicalName(name)
+	result := make([]AuditEntry, 0)
+	for i := 1; i <= count && len(result) < limit; i++ {
+		entry := a.entries[(a.next-i+len(a.entries))%len(a.entries)]
+		if client != "" && entry.Client != client {
+			continue
+		}
+		if name != "" && !strings.Contains(canonicalName(entry.Name), name) {
+			continue
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+// Size returns the number of entries kept and the size of the ring.
+func (a *AuditLog) Size() (int, int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.full {
+		return len(a.entries), len(a.entries)
+	}
+	return a.next, len(a.entries)
+}
+
+// ServeHTTP answers GET /audit?client=&name=&limit= with matching entries.
+func (a *AuditLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	writeJSON(w, a.Recent(r.URL.Query().Get("client"), r.URL.Query().Get("name"), limit))
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditLogRing(t *testing.T) {
+	a := NewAuditLog(3, nil)
+	if kept, size := a.Size(); kept != 0 || size != 3 {
+		t.Errorf("empty log keeps %d of %d, want 0 of 3", kept, size)
+	}
+	for _, entry := range []AuditEntry{
+		{Client: "192.0.2.1", Name: "ads.example"},
+		{Client: "192.0.2.2", Name: "tracker.example"},
+		{Client: "192.0.2.1", Name: "Tracker.Example."},
+		{Client: "192.0.2.1", Name: "ads.example.net"},
+	} {
+		a.Record(entry)
+	}
+	if kept, size := a.Size(); kept != 3 || size != 3 {
+		t.Errorf("full log keeps %d of %d, want 3 of 3", kept, size)
+	}
+	for _, tt := range []struct {
+		client, name string
+		limit        int
+		want         []string
+	}{
+		// the oldest entry fell out of the ring
+		{"", "", 10, []string{"ads.example.net", "Tracker.Example.", "tracker.example"}},
+		{"", "", 2, []string{"ads.example.net", "Tracker.Example."}},
+		{"192.0.2.1", "", 10, []string{"ads.example.net", "Tracker.Example."}},
+		{"", "TRACKER.example", 10, []string{"Tracker.Example.", "tracker.example"}},
+		{"192.0.2.2", "ads", 10, nil},
+	} {
+		entries := a.Recent(tt.client, tt.name, tt.limit)
+		if entries == nil {
+			t.Errorf("Recent(%q, %q) = nil, want an empty list for JSON", tt.client, tt.name)
+		}
+		var got []string
+		for _, entry := range entries {
+			got = append(got, entry.Name)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("Recent(%q, %q, %d) = %q, want %q", tt.client, tt.name, tt.limit, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("Recent(%q, %q, %d) = %q, want %q", tt.client, tt.name, tt.limit, got, tt.want)
+				break
+			}
+		}
+	}
+
+	var none *AuditLog
+	none.Record(AuditEntry{Name: "ignored.example"}) // doesn't panic
+}
+
+func TestAuditLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	file, err := openRotatingFile(path, 10<<20, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a := NewAuditLog(1, file)
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	want := []AuditEntry{
+		{Time: at, Client: "192.0.2.1", Group: "kids", Name: "ads.example", Type: "A", Rule: "ads.example", List: "https://lists.example/ads.txt"},
+		{Time: at.Add(time.Second), Client: "2001:db8::1", Group: "default", Name: "tracker.example", Type: "AAAA", Rule: "tracker.example"},
+	}
+	for _, entry := range want {
+		a.Record(entry)
+	}
+
+	// every entry reaches the file, not only those the ring keeps
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	var got []AuditEntry
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		got = append(got, entry)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("%d lines, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("line %d is %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestAuditBlockedQueries(t *testing.T) {
+	srv := newTestServer(t, "-block-domain", "ads.example", "-record", "host.lan A 10.0.0.1")
+	for _, name := range []string{"www.ads.example", "host.lan"} {
+		var query Msg
+		query.SetQuestion(name, TypeAAAA)
+		srv.exchangeTest(t, &query)
+	}
+	entries := srv.audit.Recent("", "", 10)
+	if len(entries) != 1 {
+		t.Fatalf("audit entries %+v, want the blocked query only", entries)
+	}
+	entry := entries[0]
+	if entry.Client != testClient.IP.String() || entry.Name != "www.ads.example" || entry.Type != "AAAA" || entry.Rule == "" || entry.Time.IsZero() {
+		t.Errorf("audit entry %+v", entry)
+	}
+
+	// the admin API serves the same entries
+	for _, tt := range []struct {
+		query   string
+		status  int
+		entries int
+	}{
+		{"", http.StatusOK, 1},
+		{"?name=ads&limit=5", http.StatusOK, 1},
+		{"?client=192.0.2.99", http.StatusOK, 0},
+		{"?limit=0", http.StatusBadRequest, 0},
+		{"?limit=many", http.StatusBadRequest, 0},
+	} {
+		w := httptest.NewRecorder()
+		srv.audit.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/audit"+tt.query, nil))
+		if w.Code != tt.status {
+			t.Errorf("/audit%s: status %d, want %d", tt.query, w.Code, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var served []AuditEntry
+		if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil || len(served) != tt.entries {
+			t.Errorf("/audit%s: %s, %v, want %d entries", tt.query, w.Body, err, tt.entries)
+		}
+	}
+}
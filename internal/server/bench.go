@@ -0,0 +1,361 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const benchUsage = `usage: %s bench [flags] [name...] [-- server options...]
+
+Load tests a server the way dnsperf does: sends queries for the names of -d,
+or the arguments, at -qps for -duration from -c concurrent clients, each
+waiting for its response before sending the next, and prints the throughput,
+the response codes and the latency percentiles. The names are sent in turn
+and start over at the end of the list. A line of -d is a name and an
+optional type, A by default; # starts a comment.
+
+The queries go to a running server with -server, or to this server started
+in process on a loopback port with the server options after --, to see what
+a change does to its performance. Queries still unanswered at -timeout count
+as lost.
+
+Flags:
+`
+
+// runBench is the bench subcommand. It returns the exit status.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	target := fs.String("server", "", "address of a running server to load (default: this server in process)")
+	network := fs.String("net", "udp", "transport, udp, tcp or tcp-tls")
+	dataFile := fs.String("d", "", "file of the names to query, one per line with an optional type; - for standard input")
+	qps := fs.Int("qps", 0, "queries sent per second (default: as fast as the responses come)")
+	concurrency := fs.Int("c", 10, "queries in flight at most")
+	duration := fs.Duration("duration", 10*time.Second, "how long to send queries for")
+	count := fs.Int("n", 0, "stop after sending this many queries (default: no limit)")
+	timeout := fs.Duration("timeout", defaultExchangeTimeout, "how long to wait for a response before counting the query as lost")
+	bufsize := fs.Int("bufsize", defaultMaxUDPSize, "EDNS payload size advertised in the queries, 0 for no EDNS")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), benchUsage, os.Args[0])
+		fs.PrintDefaults()
+	}
+	var serverArgs []string
+	inProcess := false
+	for i, arg := range args {
+		if arg == "--" {
+			args, serverArgs, inProcess = args[:i], args[i+1:], true
+			break
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *concurrency < 1 || *qps < 0 || *duration <= 0 || *count < 0 || *bufsize < 0 {
+		fmt.Fprintln(os.Stderr, "-c must be positive, -duration too, and -qps, -n and -bufsize not negative")
+		return 2
+	}
+
+	questions, err := benchQuestions(*dataFile, fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if len(questions) == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	addr := *target
+	if addr == "" || inProcess {
+		// the server logs every query
+		setupLogging("error", "text", os.Stderr)
+		srv, err := NewServer(append([]string{"-listen", "127.0.0.1:0,tcp://127.0.0.1:0"}, serverArgs...)...)
+		if err == nil {
+			err = srv.Start()
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		defer srv.Shutdown(context.Background())
+		addr = srv.Addr().String()
+	}
+
+	b := &bench{
+		client:    &Client{Net: *network, Timeout: *timeout, UDPSize: *bufsize},
+		addr:      addr,
+		questions: questions,
+	}
+	fmt.Printf("Sending queries to %s over %s for %s from %d clients", addr, *network, *duration, *concurrency)
+	if *qps > 0 {
+		fmt.Printf(" at %d queries per second", *qps)
+	}
+	fmt.Println()
+	b.run(*concurrency, *qps, *count, *duration)
+	b.report(os.Stdout)
+	if b.completed.Load() == 0 {
+		return 1
+	}
+	return 0
+}
+
+// benchQuestions reads the questions of a bench run from the data file, or
+// from the names given as arguments.
+func benchQuestions(path string, names []string) ([]DNSQuestion, error) {
+	var lines []string
+	switch {
+	case path == "-":
+		read, err := benchLines(os.Stdin)
+		if err != nil {
+			return nil, err
+		}
+		lines = read
+	case path != "":
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		if lines, err = benchLines(file); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	lines = append(lines, names...)
+
+	questions := make([]DNSQuestion, 0, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("%q: want name [type]", line)
+		}
+		name, err := encodeDomainName(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		var qtype uint16 = TypeA
+		if len(fields) == 2 {
+			if qtype, err = parseType(fields[1]); err != nil {
+				return nil, err
+			}
+		}
+		questions = append(questions, DNSQuestion{Name: name, Type: qtype, Class: ClassIN})
+	}
+	return questions, nil
+}
+
+func benchLines(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// bench is a load test of the bench subcommand in progress.
+type bench struct {
+	client    *Client
+	addr      string
+	questions []DNSQuestion
+
+	next      atomic.Uint64 // index of the next question, wrapping around
+	sent      atomic.Uint64
+	completed atomic.Uint64
+	lost      atomic.Uint64 // timed out
+	failed    atomic.Uint64 // other errors, such as refused connections
+
+	mu        sync.Mutex
+	rcodes    map[Rcode]uint64
+	latencies []time.Duration // of the completed queries
+	took      time.Duration
+}
+
+// run sends queries from concurrency clients until duration passes or count
+// queries were sent, paced to qps if not 0.
+func (b *bench) run(concurrency, qps, count int, duration time.Duration) {
+	b.rcodes = make(map[Rcode]uint64)
+	start := time.Now()
+	deadline := start.Add(duration)
+
+	// with -qps the clients wait for a tick of the pacer before each query
+	var ticks chan struct{}
+	done := make(chan struct{})
+	if qps > 0 {
+		ticks = make(chan struct{}, concurrency)
+		go func() {
+			interval := time.Second / time.Duration(qps)
+			for i := 1; ; i++ {
+				select {
+				case ticks <- struct{}{}:
+				case <-done:
+					return
+				}
+				// paced against the start rather than the last tick so
+				// sleeping late doesn't lower the rate
+				if wait := time.Until(start.Add(time.Duration(i) * interval)); wait > 0 {
+					time.Sleep(wait)
+				}
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var latencies []time.Duration
+			rcodes := make(map[Rcode]uint64)
+			for time.Now().Before(deadline) {
+				if ticks != nil {
+					select {
+					case <-ticks:
+					case <-time.After(time.Until(deadline)):
+						continue
+					}
+				}
+				if n := b.sent.Add(1); count > 0 && n > uint64(count) {
+					b.sent.Add(^uint64(0))
+					break
+				}
+				latency, rcode, err := b.exchange()
+				var netErr net.Error
+				switch {
+				case errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout():
+					b.lost.Add(1)
+				case err != nil:
+					b.failed.Add(1)
+				default:
+					b.completed.Add(1)
+					latencies = append(latencies, latency)
+					rcodes[rcode]++
+				}
+			}
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.latencies = append(b.latencies, latencies...)
+			for rcode, n := range rcodes {
+				b.rcodes[rcode] += n
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	b.took = time.Since(start)
+}
+
+// exchange sends the next query and returns how long the response took.
+func (b *bench) exchange() (time.Duration, Rcode, error) {
+	question := b.questions[(b.next.Add(1)-1)%uint64(len(b.questions))]
+	m := Msg{
+		Header:   DNSHeader{ID: newID(), Flags: flagRD, QDCount: 1},
+		Question: []DNSQuestion{question},
+	}
+	start := time.Now()
+	r, err := b.client.Exchange(context.Background(), &m, b.addr)
+	if err != nil {
+		return 0, 0, err
+	}
+	return time.Since(start), r.Header.Rcode(), nil
+}
+
+// report prints the results of the run in the layout of dnsperf.
+func (b *bench) report(w io.Writer) {
+	sent, completed := b.sent.Load(), b.completed.Load()
+	share := func(n uint64) string {
+		if sent == 0 {
+			return "0.00%"
+		}
+		return fmt.Sprintf("%.2f%%", 100*float64(n)/float64(sent))
+	}
+	fmt.Fprintf(w, "\nStatistics:\n\n")
+	fmt.Fprintf(w, "  Queries sent:         %d\n", sent)
+	fmt.Fprintf(w, "  Queries completed:    %d (%s)\n", completed, share(completed))
+	fmt.Fprintf(w, "  Queries lost:         %d (%s)\n", b.lost.Load(), share(b.lost.Load()))
+	fmt.Fprintf(w, "  Queries failed:       %d (%s)\n", b.failed.Load(), share(b.failed.Load()))
+
+	rcodes := make([]Rcode, 0, len(b.rcodes))
+	for rcode := range b.rcodes {
+		rcodes = append(rcodes, rcode)
+	}
+	sort.Slice(rcodes, func(i, j int) bool { return rcodes[i] < rcodes[j] })
+	parts := make([]string, len(rcodes))
+	for i, rcode := range rcodes {
+		parts[i] = fmt.Sprintf("%s %d (%.2f%%)", rcode, b.rcodes[rcode], 100*float64(b.rcodes[rcode])/float64(completed))
+	}
+	fmt.Fprintln(w)
+	if completed > 0 {
+		fmt.Fprintf(w, "  Response codes:       %s\n", strings.Join(parts, ", "))
+	}
+	fmt.Fprintf(w, "  Run time (s):         %.3f\n", b.took.Seconds())
+	fmt.Fprintf(w, "  Queries per second:   %.1f\n", float64(completed)/b.took.Seconds())
+	if len(b.latencies) == 0 {
+		return
+	}
+
+	latency := summarizeLatencies(b.latencies)
+	fmt.Fprintf(w, "\n  Average latency (ms): %.3f (min %.3f, max %.3f)\n", latency.mean, latency.min, latency.max)
+	fmt.Fprintf(w, "  Latency StdDev (ms):  %.3f\n", latency.stddev)
+	for i, p := range benchPercentiles {
+		fmt.Fprintf(w, "  Latency p%-5s (ms):  %.3f\n", fmt.Sprint(p), latency.percentiles[i])
+	}
+}
+
+// benchPercentiles are the latency percentiles a run reports.
+var benchPercentiles = []float64{50, 90, 99, 99.9}
+
+// benchLatency sums up the latencies of a run, in milliseconds.
+type benchLatency struct {
+	min, max, mean, stddev float64
+	percentiles            []float64 // at benchPercentiles
+}
+
+// summarizeLatencies sums up latencies, of which there is at least one.
+func summarizeLatencies(latencies []time.Duration) benchLatency {
+	sorted := append([]time.Duration(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var sum, squares float64
+	for _, latency := range sorted {
+		ms := benchMs(latency)
+		sum += ms
+		squares += ms * ms
+	}
+	n := float64(len(sorted))
+	summary := benchLatency{
+		min:  benchMs(sorted[0]),
+		max:  benchMs(sorted[len(sorted)-1]),
+		mean: sum / n,
+	}
+	summary.stddev = math.Sqrt(math.Max(0, squares/n-summary.mean*summary.mean))
+	for _, p := range benchPercentiles {
+		summary.percentiles = append(summary.percentiles, benchMs(benchPercentile(sorted, p)))
+	}
+	return summary
+}
+
+// benchPercentile returns the p-th percentile of sorted latencies, by the
+// nearest rank.
+func benchPercentile(sorted []time.Duration, p float64) time.Duration {
+	// less a hair, for 99.9/100*1000 comes out a little over 999
+	rank := int(math.Ceil(p/100*float64(len(sorted)) - 1e-9))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func benchMs(d time.Duration) float64 { return d.Seconds() * 1000 }
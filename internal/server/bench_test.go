@@ -0,0 +1,122 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBenchPercentile(t *testing.T) {
+	ms := func(n int) time.Duration { return time.Duration(n) * time.Millisecond }
+	var thousand []time.Duration
+	for i := 1; i <= 1000; i++ {
+		thousand = append(thousand, ms(i))
+	}
+	for _, tt := range []struct {
+		sorted []time.Duration
+		p      float64
+		want   time.Duration
+	}{
+		{thousand, 50, ms(500)},
+		{thousand, 90, ms(900)},
+		{thousand, 99, ms(990)},
+		{thousand, 99.9, ms(999)},
+		{thousand, 100, ms(1000)},
+		{thousand, 0, ms(1)},
+		{thousand[:10], 50, ms(5)},
+		{thousand[:10], 99, ms(10)},
+		{thousand[:3], 50, ms(2)},
+		{thousand[:1], 99.9, ms(1)},
+	} {
+		if got := benchPercentile(tt.sorted, tt.p); got != tt.want {
+			t.Errorf("p%v of %d samples: %v, want %v", tt.p, len(tt.sorted), got, tt.want)
+		}
+	}
+}
+
+func TestSummarizeLatencies(t *testing.T) {
+	latencies := []time.Duration{4 * time.Millisecond, time.Millisecond, 3 * time.Millisecond, 2 * time.Millisecond, 10 * time.Millisecond}
+	got := summarizeLatencies(latencies)
+	if got.min != 1 || got.max != 10 || got.mean != 4 || got.stddev < 3.162 || got.stddev > 3.163 {
+		t.Errorf("summary %+v, want min 1, max 10, mean 4 and stddev 3.162", got)
+	}
+	if want := []float64{3, 10, 10, 10}; len(got.percentiles) != len(want) || got.percentiles[0] != want[0] || got.percentiles[1] != want[1] || got.percentiles[3] != want[3] {
+		t.Errorf("percentiles %v, want %v", got.percentiles, want)
+	}
+	if latencies[0] != 4*time.Millisecond {
+		t.Errorf("latencies sorted in place: %v", latencies)
+	}
+}
+
+func TestBenchReport(t *testing.T) {
+	b := &bench{
+		rcodes:    map[Rcode]uint64{RcodeNXDomain: 1, RcodeSuccess: 4},
+		latencies: []time.Duration{4 * time.Millisecond, time.Millisecond, 3 * time.Millisecond, 2 * time.Millisecond, 10 * time.Millisecond},
+		took:      2 * time.Second,
+	}
+	b.sent.Store(10)
+	b.completed.Store(5)
+	b.lost.Store(3)
+	b.failed.Store(2)
+	var out bytes.Buffer
+	b.report(&out)
+	want := `
+Statistics:
+
+  Queries sent:         10
+  Queries completed:    5 (50.00%)
+  Queries lost:         3 (30.00%)
+  Queries failed:       2 (20.00%)
+
+  Response codes:       NOERROR 4 (80.00%), NXDOMAIN 1 (20.00%)
+  Run time (s):         2.000
+  Queries per second:   2.5
+
+  Average latency (ms): 4.000 (min 1.000, max 10.000)
+  Latency StdDev (ms):  3.162
+  Latency p50    (ms):  3.000
+  Latency p90    (ms):  10.000
+  Latency p99    (ms):  10.000
+  Latency p99.9  (ms):  10.000
+`
+	if out.String() != want {
+		t.Errorf("report\n%s\nwant\n%s", out.String(), want)
+	}
+
+	// nothing answered
+	b = &bench{rcodes: map[Rcode]uint64{}, took: time.Second}
+	b.sent.Store(3)
+	b.lost.Store(3)
+	out.Reset()
+	b.report(&out)
+	if got := out.String(); strings.Contains(got, "Response codes") || strings.Contains(got, "latency") || !strings.Contains(got, "  Queries lost:         3 (100.00%)\n") {
+		t.Errorf("report of a run without responses\n%s", got)
+	}
+}
+
+func TestBenchQuestions(t *testing.T) {
+	lines, err := benchLines(strings.NewReader("example.com\n# a comment\n\n  host.lan  AAAA # trailing\n"))
+	if err != nil || strings.Join(lines, "|") != "example.com|host.lan  AAAA" {
+		t.Fatalf("lines %q, %v", lines, err)
+	}
+	questions, err := benchQuestions("", append(lines, "mail.lan mx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, q := range questions {
+		got = append(got, domainName(q.Name)+" "+typeName(q.Type))
+	}
+	if want := "example.com A|host.lan AAAA|mail.lan MX"; strings.Join(got, "|") != want {
+		t.Errorf("questions %q, want %s", got, want)
+	}
+	for _, names := range [][]string{{"a b c"}, {"host.lan BOGUS"}, {"bad..name"}} {
+		if _, err := benchQuestions("", names); err == nil {
+			t.Errorf("%q accepted", names)
+		}
+	}
+	if _, err := benchQuestions("testdata/no-such-file", nil); err == nil {
+		t.Error("missing data file accepted")
+	}
+}
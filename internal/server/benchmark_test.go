@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The benchmarks of the hot path, to be compared across changes with
+// benchstat:
+//
+//	go test -run '^$' -bench . -count 10 ./internal/server > old.txt
+//
+// The server keeps no response cache, so there is no cache hit benchmark;
+// HandleLocal is the closest path.
+
+// benchForwardedQuery asks for www.example.com IN A, benchLocalQuery for
+// version.bind CH TXT.
+var (
+	benchForwardedQuery = []byte{
+		0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		3, 'w', 'w', 'w', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+		0x00, 0x01, 0x00, 0x01,
+	}
+	benchLocalQuery = []byte{
+		0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		7, 'v', 'e', 'r', 's', 'i', 'o', 'n', 4, 'b', 'i', 'n', 'd', 0,
+		0x00, 0x10, 0x00, 0x03,
+	}
+)
+
+func BenchmarkParseQuery(b *testing.B) {
+	b.ReportAllocs()
+	names := make([]byte, 0, messageSize)
+	for i := 0; i < b.N; i++ {
+		if _, err := parseDNSHeader(benchForwardedQuery); err != nil {
+			b.Fatal(err)
+		}
+		if _, _, _, err := parseDNSQuestion(names[:0], benchForwardedQuery, 12); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseResponse(b *testing.B) {
+	b.ReportAllocs()
+	response := benchResponse(benchForwardedQuery)
+	records := make([]byte, 0, messageSize)
+	for i := 0; i < b.N; i++ {
+		if _, _, err := parseDNSResponse(records[:0], response); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPackResponse(b *testing.B) {
+	b.ReportAllocs()
+	response, _, err := parseDNSResponse(nil, benchResponse(benchForwardedQuery))
+	if err != nil {
+		b.Fatal(err)
+	}
+	buf := make([]byte, 0, messageSize)
+	for i := 0; i < b.N; i++ {
+		appendDNSResponse(buf[:0], response)
+	}
+}
+
+// BenchmarkHandleLocal answers a CHAOS query, the path of locally answered
+// queries, calling the handler directly and leaving the sockets out.
+func BenchmarkHandleLocal(b *testing.B) { benchHandle(b, benchLocalQuery) }
+
+// BenchmarkHandleForwarded answers a query through a loopback upstream.
+func BenchmarkHandleForwarded(b *testing.B) { benchHandle(b, benchForwardedQuery) }
+
+// BenchmarkUDPLocal is BenchmarkHandleLocal over UDP from parallel clients.
+func BenchmarkUDPLocal(b *testing.B) { benchUDP(b, benchLocalQuery) }
+
+// BenchmarkUDPForwarded is BenchmarkHandleForwarded over UDP from parallel
+// clients.
+func BenchmarkUDPForwarded(b *testing.B) { benchUDP(b, benchForwardedQuery) }
+
+func benchHandle(b *testing.B, query []byte) {
+	srv := benchServer(b)
+	source := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53000}
+	var answered int
+	reply := func([]byte) error {
+		answered++
+		return nil
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		srv.handle(context.Background(), query, source, listenEndpoint{}, reply)
+	}
+	b.StopTimer()
+	if answered != b.N {
+		b.Fatalf("%d of %d queries answered", answered, b.N)
+	}
+}
+
+// benchUDP is a small load generator: parallel clients send the query to a
+// server listening on loopback, each waiting for the answer before sending
+// the next one.
+func benchUDP(b *testing.B, query []byte) {
+	addr := startTestServer(b, benchServer(b, "-listen", "127.0.0.1:0"))
+	var lost atomic.Int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		client, err := net.Dial("udp", addr)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		defer client.Close()
+		buf := make([]byte, messageSize)
+		for pb.Next() {
+			client.SetDeadline(time.Now().Add(time.Second))
+			if _, err := client.Write(query); err != nil {
+				lost.Add(1)
+				continue
+			}
+			if _, err := client.Read(buf); err != nil {
+				lost.Add(1)
+			}
+		}
+	})
+	b.StopTimer()
+	if n := lost.Load(); n > 0 {
+		b.Logf("%d queries lost", n)
+	}
+}
+
+// benchServer returns a server configured by args, forwarding to an upstream
+// on loopback that answers every query with two A records.
+func benchServer(b *testing.B, args ...string) *server {
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { upstream.Close() })
+	go func() {
+		buf := make([]byte, messageSize)
+		for {
+			size, client, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			upstream.WriteTo(benchResponse(buf[:size]), client)
+		}
+	}()
+	return newTestServer(b, append([]string{"-resolver", upstream.LocalAddr().String(), "-max-inflight", "0"}, args...)...)
+}
+
+// benchResponse answers query, which has a single question, with two A
+// records whose names point back at the question. The OPT record the server
+// adds to upstream queries is left out.
+func benchResponse(query []byte) []byte {
+	_, _, end, err := parseDNSQuestion(nil, query, 12)
+	if err != nil {
+		return nil
+	}
+	response := append([]byte(nil), query[:end]...)
+	response[2] |= 0x80
+	binary.BigEndian.PutUint16(response[6:], 2)
+	binary.BigEndian.PutUint16(response[10:], 0)
+	for _, ip := range [][4]byte{{192, 0, 2, 1}, {192, 0, 2, 2}} {
+		response = append(response, 0xC0, 12, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x01, 0x2C, 0x00, 0x04)
+		response = append(response, ip[:]...)
+	}
+	return response
+}
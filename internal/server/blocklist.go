@@ -0,0 +1,294 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/internal/slog"
+)
+
+// maxBlocklistSize caps a single downloaded list.
+const maxBlocklistSize = 64 << 20
+
+// BlocklistSource is one downloaded list. Its fields are guarded by the mutex
+// of the Blocklists it belongs to.
+type BlocklistSource struct {
+	URL string
+
+	etag         string
+	lastModified string
+	domains      []string
+	ignored      int // domains left out of the table by the memory budget
+	updated      time.Time
+	checked      time.Time
+	err          error
+}
+
+// BlocklistStatus is the state of a source as shown by the status report.
+type BlocklistStatus struct {
+	URL         string    `json:"url"`
+	Domains     int       `json:"domains"`
+	Ignored     int       `json:"ignored,omitempty"`
+	LastUpdate  time.Time `json:"last_update"`
+	LastChecked time.Time `json:"last_checked"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Blocklists periodically downloads domain lists and keeps a merged lookup
+// table of all of them. The table is rebuilt on the side and swapped in
+// atomically, so lookups never see a half-loaded list.
+type Blocklists struct {
+	Sources  []*BlocklistSource
+	Interval time.Duration
+	// MaxBytes caps the estimated size of the domains kept, 0 for no cap.
+	// The domains beyond it are left out, last source first.
+	MaxBytes int64
+
+	mu      sync.Mutex // serialises refreshes and guards the sources
+	client  *http.Client
+	set     atomic.Pointer[map[string]*BlocklistSource]
+	domains atomic.Int64 // size of set
+	size    atomic.Int64 // estimated bytes of set
+	stop    chan struct{}
+}
+
+func NewBlocklists(urls []string, interval time.Duration) *Blocklists {
+	b := &Blocklists{
+		Interval: interval,
+		client:   &http.Client{Timeout: time.Minute},
+		stop:     make(chan struct{}),
+	}
+	for _, url := range urls {
+		b.Sources = append(b.Sources, &BlocklistSource{URL: url})
+	}
+	return b
+}
+
+// Lookup reports whether name or one of its parents is on a list, and which
+// list it came from.
+func (b *Blocklists) Lookup(name string) (string, *BlocklistSource) {
+	if b == nil {
+		return "", nil
+	}
+	set := b.set.Load()
+	if set == nil {
+		return "", nil
+	}
+	name = canonicalName(name)
+	for {
+		if source, ok := (*set)[name]; ok {
+			return name, source
+		}
+		dot := strings.IndexByte(name, '.')
+		if dot < 0 {
+			return "", nil
+		}
+		name = name[dot+1:]
+	}
+}
+
+// Loaded reports whether the first refresh has completed.
+func (b *Blocklists) Loaded() bool {
+	return b.set.Load() != nil
+}
+
+// Run refreshes the lists every Interval until Stop is called. The first
+// refresh is left to the caller.
+func (b *Blocklists) Run() {
+	ticker := time.NewTicker(b.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.Refresh()
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// Stop ends Run, e.g. once a reload replaced the lists.
+func (b *Blocklists) Stop() {
+	close(b.stop)
+}
+
+// Refresh downloads every source that changed and swaps in a new table. A
+// source that fails to download keeps its previous contents.
+func (b *Blocklists) Refresh() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	changed := false
+	for _, source := range b.Sources {
+		updated, err := b.fetch(source)
+		source.checked = time.Now()
+		source.err = err
+		if err != nil {
+			slog.Warn("failed to refresh blocklist", "url", source.URL, "err", err)
+			continue
+		}
+		if updated {
+			source.updated = source.checked
+			changed = true
+			slog.Info("loaded blocklist", "url", source.URL, "domains", len(source.domains))
+		}
+	}
+	if !changed && b.set.Load() != nil {
+		return
+	}
+
+	// the sources keep every domain they downloaded, the budget only limits
+	// what goes in the table, so the ones left out come back when another
+	// list shrinks
+	set := make(map[string]*BlocklistSource)
+	var size int64
+	full := false
+	for _, source := range b.Sources {
+		source.ignored = 0
+		for i, domain := range source.domains {
+			if full || b.MaxBytes > 0 && size+blocklistDomainMemory+int64(len(domain)) > b.MaxBytes {
+				full = true
+				source.ignored = len(source.domains) - i
+				slog.Error("blocklists exceed their share of the memory budget, ignoring the rest",
+					"url", source.URL, "ignored", source.ignored, "budget", b.MaxBytes)
+				break
+			}
+			if _, ok := set[domain]; !ok {
+				set[domain] = source
+				size += blocklistDomainMemory + int64(len(domain))
+			}
+		}
+	}
+	b.set.Store(&set)
+	b.domains.Store(int64(len(set)))
+	b.size.Store(size)
+}
+
+// Memory returns the number of domains in the lookup table and their
+// estimated size in bytes.
+func (b *Blocklists) Memory() (int, int64) {
+	return int(b.domains.Load()), b.size.Load()
+}
+
+// fetch downloads a source unless it is unchanged since the last download,
+// using ETag and Last-Modified for http sources and the file modification
+// time for local paths.
+func (b *Blocklists) fetch(source *BlocklistSource) (bool, error) {
+	if !strings.HasPrefix(source.URL, "http://") && !strings.HasPrefix(source.URL, "https://") {
+		path := strings.TrimPrefix(source.URL, "file://")
+		info, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+		modified := info.ModTime().UTC().Format(http.TimeFormat)
+		if modified == source.lastModified {
+			return false, nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return false, err
+		}
+		defer file.Close()
+		domains, err := parseBlocklist(io.LimitReader(file, maxBlocklistSize))
+		if err != nil {
+			return false, err
+		}
+		source.domains, source.lastModified = domains, modified
+		return true, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, source.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	if source.etag != "" {
+		req.Header.Set("If-None-Match", source.etag)
+	}
+	if source.lastModified != "" {
+		req.Header.Set("If-Modified-Since", source.lastModified)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return false, nil
+	case http.StatusOK:
+	default:
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	domains, err := parseBlocklist(io.LimitReader(resp.Body, maxBlocklistSize))
+	if err != nil {
+		return false, err
+	}
+	source.domains = domains
+	source.etag = resp.Header.Get("ETag")
+	source.lastModified = resp.Header.Get("Last-Modified")
+	return true, nil
+}
+
+// Status returns the state of every source for the status report.
+func (b *Blocklists) Status() []BlocklistStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := make([]BlocklistStatus, 0, len(b.Sources))
+	for _, source := range b.Sources {
+		s := BlocklistStatus{
+			URL:         source.URL,
+			Domains:     len(source.domains),
+			Ignored:     source.ignored,
+			LastUpdate:  source.updated,
+			LastChecked: source.checked,
+		}
+		if source.err != nil {
+			s.Error = source.err.Error()
+		}
+		status = append(status, s)
+	}
+	return status
+}
+
+// parseBlocklist reads the common list formats: hosts files
+// ("0.0.0.0 ads.example.com"), plain domain lists and the domain-only subset
+// of adblock syntax ("||ads.example.com^"). Comments start with # or !.
+func parseBlocklist(r io.Reader) ([]string, error) {
+	var domains []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+			continue
+		}
+		if strings.HasPrefix(line, "||") {
+			domain := strings.TrimSuffix(line[2:], "^")
+			if strings.HasSuffix(line, "^") && !strings.ContainsAny(domain, "/*$") {
+				domains = append(domains, canonicalName(domain))
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		domain := fields[0]
+		if len(fields) > 1 {
+			domain = fields[1] // hosts file: address then name
+		}
+		domain = canonicalName(domain)
+		if domain == "localhost" || domain == "" || strings.ContainsAny(domain, "/:*") {
+			continue
+		}
+		domains = append(domains, domain)
+	}
+	return domains, scanner.Err()
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseBlocklist(t *testing.T) {
+	list := `# hosts file
+0.0.0.0 ads.example.com
+127.0.0.1 Tracker.Example.NET # inline comment
+plain.example.org
+! adblock
+||adblock.example^
+||path.example/banner^
+[Adblock Plus 2.0]
+`
+	domains, err := parseBlocklist(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"ads.example.com", "tracker.example.net", "plain.example.org", "adblock.example"}
+	if strings.Join(domains, " ") != strings.Join(want, " ") {
+		t.Errorf("domains %q, want %q", domains, want)
+	}
+}
+
+// writeBlocklist writes domains to path with a modification time of its
+// own, as sources are reloaded when it changes.
+func writeBlocklist(t *testing.T, path string, modified time.Time, domains ...string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(strings.Join(domains, "\n")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlocklistConditionalRefresh(t *testing.T) {
+	var mu sync.Mutex
+	etag, list, status := `"v1"`, "ads.example\n", 0
+	var requests []http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.Header.Clone())
+		switch {
+		case status != 0:
+			w.WriteHeader(status)
+		case r.Header.Get("If-None-Match") == etag:
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Last-Modified", "Fri, 01 Mar 2024 12:00:00 GMT")
+			w.Write([]byte(list))
+		}
+	}))
+	defer srv.Close()
+	lastRequest := func() http.Header {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests[len(requests)-1]
+	}
+
+	b := NewBlocklists([]string{srv.URL}, time.Hour)
+	b.Refresh()
+	if h := lastRequest(); h.Get("If-None-Match") != "" || h.Get("If-Modified-Since") != "" {
+		t.Errorf("first request conditional: %v", h)
+	}
+	loaded, table := b.Status()[0], b.set.Load()
+
+	// unchanged: the list is kept as it was, not parsed and swapped again
+	b.Refresh()
+	h := lastRequest()
+	if h.Get("If-None-Match") != `"v1"` || h.Get("If-Modified-Since") != "Fri, 01 Mar 2024 12:00:00 GMT" {
+		t.Errorf("refresh sent If-None-Match %q, If-Modified-Since %q", h.Get("If-None-Match"), h.Get("If-Modified-Since"))
+	}
+	status304 := b.Status()[0]
+	if b.set.Load() != table || status304.Domains != 1 || !status304.LastUpdate.Equal(loaded.LastUpdate) || status304.Error != "" {
+		t.Errorf("after 304: status %+v, table replaced %v; want the list of %+v kept", status304, b.set.Load() != table, loaded)
+	}
+	if _, source := b.Lookup("ads.example"); source == nil {
+		t.Error("ads.example not blocked after 304")
+	}
+
+	// a failed refresh keeps the list too
+	mu.Lock()
+	status = http.StatusInternalServerError
+	mu.Unlock()
+	b.Refresh()
+	if _, source := b.Lookup("ads.example"); source == nil || b.Status()[0].Error == "" {
+		t.Errorf("after a failure: blocked %v, status %+v", source != nil, b.Status()[0])
+	}
+
+	// a changed list is downloaded again
+	mu.Lock()
+	etag, list, status = `"v2"`, "tracker.example\n", 0
+	mu.Unlock()
+	b.Refresh()
+	if _, source := b.Lookup("tracker.example"); source == nil || b.set.Load() == table {
+		t.Error("the changed list wasn't loaded")
+	}
+	if _, source := b.Lookup("ads.example"); source != nil {
+		t.Error("ads.example still blocked after the list dropped it")
+	}
+}
+
+func TestBlocklistBudgetKeepsSourceDomains(t *testing.T) {
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first.txt"), filepath.Join(dir, "second.txt")
+	start := time.Now().Add(-time.Hour)
+	writeBlocklist(t, first, start, "a1.example", "a2.example")
+	writeBlocklist(t, second, start, "b1.example", "b2.example")
+
+	b := NewBlocklists([]string{first, second}, time.Hour)
+	// room for three names of ten bytes
+	b.MaxBytes = 3 * (blocklistDomainMemory + 10)
+	b.Refresh()
+	if _, source := b.Lookup("b2.example"); source != nil {
+		t.Fatal("b2.example loaded over the budget")
+	}
+	if status := b.Status()[1]; status.Domains != 2 || status.Ignored != 1 {
+		t.Errorf("second list has %d domains, %d ignored; want 2 and 1", status.Domains, status.Ignored)
+	}
+
+	// the first list shrinking makes room for the name left out before
+	writeBlocklist(t, first, start.Add(time.Minute), "a1.example")
+	b.Refresh()
+	for _, name := range []string{"a1.example", "b1.example", "b2.example"} {
+		if _, source := b.Lookup(name); source == nil {
+			t.Errorf("%s not blocked once the budget allows it", name)
+		}
+	}
+	if status := b.Status()[1]; status.Ignored != 0 {
+		t.Errorf("%d domains of the second list ignored, want none", status.Ignored)
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import "sync"
+
+const (
+	// messageSize is the length of the pooled message buffers, the largest
+	// UDP message without EDNS.
+	messageSize = 512
+	// bufferCapacity leaves room in them for an EDNS response of the default
+	// -max-udp-size.
+	bufferCapacity = defaultMaxUDPSize
+)
+
+// messageBuffers recycles the buffers queries are read into, upstream
+// responses are received in and answers are packed in, which would
+// otherwise be allocated for every packet. It holds *[]byte so putting a
+// buffer back does not allocate.
+var messageBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, messageSize, bufferCapacity)
+		return &buf
+	},
+}
+
+// getBuffer takes a messageSize buffer from the pool. Up to bufferCapacity
+// bytes may be used by reslicing it.
+func getBuffer() *[]byte {
+	return messageBuffers.Get().(*[]byte)
+}
+
+// getSizedBuffer returns a buffer of length size, from the pool when it
+// fits in one.
+func getSizedBuffer(size int) *[]byte {
+	if size > bufferCapacity {
+		buf := make([]byte, size)
+		return &buf
+	}
+	buf := getBuffer()
+	*buf = (*buf)[:size]
+	return buf
+}
+
+// putBuffer returns buf to the pool. Nothing may use it afterwards. Buffers
+// of another capacity than the pooled ones are left to the garbage collector.
+func putBuffer(buf *[]byte) {
+	if cap(*buf) != bufferCapacity {
+		return
+	}
+	*buf = (*buf)[:messageSize]
+	messageBuffers.Put(buf)
+}
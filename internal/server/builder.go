@@ -0,0 +1,133 @@
+package server
+
+import (
+	"net"
+)
+
+// The methods below build messages without the count bookkeeping: every
+// record added is counted in the header, and Pack sets the counts from the
+// sections whatever they say. They return the message for chaining, e.g.
+//
+//	var m Msg
+//	m.SetReply(r).AddAnswer(A(name, ip, 300))
+//	w.WriteMsg(&m)
+
+// SetReply makes m an empty answer to query: its ID, opcode and RD copied, QR
+// set, the question echoed and the rcode NOERROR.
+func (m *DNSResponse) SetReply(query *DNSResponse) *DNSResponse {
+	*m = DNSResponse{
+		Header: DNSHeader{
+			ID:      query.Header.ID,
+			Flags:   responseFlags(query.Header.Flags, RcodeSuccess),
+			QDCount: uint16(len(query.Question)),
+		},
+		Question: query.Question,
+	}
+	return m
+}
+
+// SetQuestion makes m a recursive query for name and qtype in class IN.
+func (m *DNSResponse) SetQuestion(name string, qtype uint16) *DNSResponse {
+	*m = DNSResponse{
+		Header:   DNSHeader{ID: m.Header.ID, Flags: flagRD, QDCount: 1},
+		Question: []DNSQuestion{{Name: labelSequence(name), Type: qtype, Class: ClassIN}},
+	}
+	return m
+}
+
+// SetRcode sets the response code.
+func (m *DNSResponse) SetRcode(rcode Rcode) *DNSResponse {
+	m.Header.SetRcode(rcode)
+	return m
+}
+
+// SetAuthoritative sets or clears AA.
+func (m *DNSResponse) SetAuthoritative(aa bool) *DNSResponse {
+	m.Header.Flags &^= flagAA
+	if aa {
+		m.Header.Flags |= flagAA
+	}
+	return m
+}
+
+// AddAnswer appends records to the answer section.
+func (m *DNSResponse) AddAnswer(records ...DNSResourceRecord) *DNSResponse {
+	m.Answers = append(m.Answers, records...)
+	m.Header.ANCount = uint16(len(m.Answers))
+	return m
+}
+
+// AddAuthority appends records to the authority section.
+func (m *DNSResponse) AddAuthority(records ...DNSResourceRecord) *DNSResponse {
+	m.Authority = append(m.Authority, records...)
+	m.Header.NSCount = uint16(len(m.Authority))
+	return m
+}
+
+// AddAdditional appends records to the additional section.
+func (m *DNSResponse) AddAdditional(records ...DNSResourceRecord) *DNSResponse {
+	m.Additional = append(m.Additional, records...)
+	m.Header.ARCount = uint16(len(m.Additional))
+	return m
+}
+
+// Pack sets the counts of the header from the sections and packs m.
+func (m *DNSResponse) Pack() []byte {
+	return m.AppendPack(nil)
+}
+
+// AppendPack is Pack appending to dst, which only grows when too small.
+func (m *DNSResponse) AppendPack(dst []byte) []byte {
+	m.Header.QDCount = uint16(len(m.Question))
+	m.Header.ANCount = uint16(len(m.Answers))
+	m.Header.NSCount = uint16(len(m.Authority))
+	m.Header.ARCount = uint16(len(m.Additional))
+	return appendDNSResponse(dst, *m)
+}
+
+// Records of class IN for the builder, named in presentation format. The
+// names and targets are expected valid, e.g. constants; parseLocalRecord
+// checks the ones users write.
+
+// A returns an A record of name for the IPv4 address ip.
+func A(name string, ip net.IP, ttl uint32) DNSResourceRecord {
+	return newRecord(name, ttl, &AResource{IP: ip})
+}
+
+// AAAA returns an AAAA record of name for the IPv6 address ip.
+func AAAA(name string, ip net.IP, ttl uint32) DNSResourceRecord {
+	return newRecord(name, ttl, &AAAAResource{IP: ip})
+}
+
+// CNAME returns a record making name an alias of target.
+func CNAME(name, target string, ttl uint32) DNSResourceRecord {
+	return newRecord(name, ttl, &CNAMEResource{Target: target})
+}
+
+// PTR returns a record pointing name, usually in in-addr.arpa, to target.
+func PTR(name, target string, ttl uint32) DNSResourceRecord {
+	return newRecord(name, ttl, &PTRResource{Target: target})
+}
+
+// MX returns a mail exchanger record of name.
+func MX(name string, preference uint16, host string, ttl uint32) DNSResourceRecord {
+	return newRecord(name, ttl, &MXResource{Preference: preference, Exchange: host})
+}
+
+// TXT returns a TXT record of name holding text, split into character
+// strings as needed.
+func TXT(name, text string, ttl uint32) DNSResourceRecord {
+	return newRecord(name, ttl, &TXTResource{Text: txtStrings(text)})
+}
+
+func newRecord(name string, ttl uint32, res Resource) DNSResourceRecord {
+	rdata := packResource(res)
+	return DNSResourceRecord{
+		Name:     labelSequence(name),
+		Type:     res.Type(),
+		Class:    ClassIN,
+		TTL:      ttl,
+		RDLength: uint16(len(rdata)),
+		RData:    rdata,
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRecordsSurvivePackAndParse(t *testing.T) {
+	resources := []Resource{
+		&AResource{IP: net.IPv4(192, 0, 2, 1)},
+		&AAAAResource{IP: net.ParseIP("2001:db8::1")},
+		&NSResource{Host: "ns1.example."},
+		&CNAMEResource{Target: "target.example."},
+		&DNAMEResource{Target: "other.example."},
+		&PTRResource{Target: "host.example."},
+		&MXResource{Preference: 10, Exchange: "mail.example."},
+		&SRVResource{Priority: 1, Weight: 5, Port: 5060, Target: "sip.example."},
+		&SOAResource{MName: "ns1.example.", RName: "hostmaster.example.", Serial: 2026031501, Refresh: 7200, Retry: 900, Expire: 1209600, Minimum: 300},
+		&TXTResource{Text: []string{"v=spf1 -all", strings.Repeat("x", 255)}},
+	}
+	var m Msg
+	m.SetQuestion("example", TypeANY)
+	for _, res := range resources {
+		record, err := NewRecord("example", 3600, res)
+		if err != nil {
+			t.Fatalf("NewRecord(%T): %v", res, err)
+		}
+		m.AddAnswer(record)
+	}
+	parsed, _, err := parseDNSResponse(nil, m.Pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.Answers) != len(resources) || parsed.Header.ANCount != uint16(len(resources)) {
+		t.Fatalf("%d answers counted %d, want %d", len(parsed.Answers), parsed.Header.ANCount, len(resources))
+	}
+	for i, record := range parsed.Answers {
+		res, err := record.Resource()
+		if err != nil {
+			t.Errorf("answer %d: %v", i, err)
+			continue
+		}
+		if res.Type() != resources[i].Type() || res.String() != resources[i].String() {
+			t.Errorf("answer %d parsed as %s %s, want %s %s", i, typeName(res.Type()), res, typeName(resources[i].Type()), resources[i])
+		}
+	}
+}
+
+func TestTXTSplitsLongText(t *testing.T) {
+	text := strings.Repeat("a", 300)
+	res, err := TXT("example", text, 60).Resource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	strs := res.(*TXTResource).Text
+	if len(strs) != 2 || len(strs[0]) != 255 || strings.Join(strs, "") != text {
+		t.Errorf("300 bytes split into strings of %d and %d bytes", len(strs[0]), len(strs[len(strs)-1]))
+	}
+	if _, err := NewRecord("example", 60, &TXTResource{Text: []string{strings.Repeat("a", 256)}}); err == nil {
+		t.Error("NewRecord accepted a TXT string of 256 bytes")
+	}
+}
+
+func TestSetReply(t *testing.T) {
+	var query Msg
+	query.SetQuestion("www.example", TypeAAAA)
+	query.Header.ID = 0xBEEF
+	var m Msg
+	m.SetReply(&query).SetRcode(RcodeNXDomain).SetAuthoritative(true)
+	parsed, _, err := parseDNSResponse(nil, m.Pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := parsed.Header
+	if header.ID != 0xBEEF || header.Flags&flagQR == 0 || header.Flags&flagRD == 0 || header.Flags&flagAA == 0 || header.Rcode() != RcodeNXDomain {
+		t.Errorf("header %+v, want the query's ID with QR, RD, AA and NXDOMAIN", header)
+	}
+	if len(parsed.Question) != 1 || domainName(parsed.Question[0].Name) != "www.example" || parsed.Question[0].Type != TypeAAAA {
+		t.Errorf("question %v, want the query's", parsed.Question)
+	}
+}
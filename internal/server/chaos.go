@@ -0,0 +1,58 @@
+package server
+
+import "os"
+
+// Chaos answers the CHAOS class TXT queries monitoring and ops tooling use
+// to identify a server, e.g. "dig CH TXT version.bind". An empty value
+// refuses the names it would answer.
+type Chaos struct {
+	Version string // version.bind and version.server
+	ID      string // hostname.bind and id.server
+}
+
+// defaultChaosID is the host name, which is what id.server usually answers.
+func defaultChaosID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return hostname
+}
+
+// Answer returns the TXT record answering question, or false when the name
+// isn't one of the introspection names or its value is empty.
+func (c *Chaos) Answer(question DNSQuestion) (DNSResourceRecord, bool) {
+	if question.Type != TypeTXT && question.Type != TypeANY {
+		return DNSResourceRecord{}, false
+	}
+	var value string
+	switch canonicalName(domainName(question.Name)) {
+	case "version.bind", "version.server":
+		value = c.Version
+	case "hostname.bind", "id.server":
+		value = c.ID
+	}
+	if value == "" {
+		return DNSResourceRecord{}, false
+	}
+	rdata := packResource(&TXTResource{Text: txtStrings(value)})
+	return DNSResourceRecord{
+		Name:     question.Name,
+		Type:     TypeTXT,
+		Class:    ClassCH,
+		TTL:      0,
+		RDLength: uint16(len(rdata)),
+		RData:    rdata,
+	}, true
+}
+
+// chaosQuery reports whether the query asks CHAOS class questions, which are
+// answered locally and never forwarded.
+func chaosQuery(questions []DNSQuestion) bool {
+	for _, question := range questions {
+		if question.Class == ClassCH {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestChaosAnswer(t *testing.T) {
+	c := &Chaos{Version: "dns-server 1.2", ID: "ns1"}
+	for _, tt := range []struct {
+		name  string
+		qtype uint16
+		want  string // empty for no answer
+	}{
+		{"version.bind", TypeTXT, `"dns-server 1.2"`},
+		{"VERSION.Server", TypeTXT, `"dns-server 1.2"`},
+		{"hostname.bind", TypeANY, `"ns1"`},
+		{"id.server", TypeTXT, `"ns1"`},
+		{"id.server", TypeA, ""},
+		{"authors.bind", TypeTXT, ""},
+		{"www.version.bind", TypeTXT, ""},
+	} {
+		record, ok := c.Answer(DNSQuestion{Name: labelSequence(tt.name), Type: tt.qtype, Class: ClassCH})
+		if ok != (tt.want != "") {
+			t.Errorf("%s %s answered %v, want %q", tt.name, typeName(tt.qtype), ok, tt.want)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		res, err := record.Resource()
+		if err != nil || res.String() != tt.want || record.Type != TypeTXT || record.Class != ClassCH || domainName(record.Name) != tt.name {
+			t.Errorf("%s %s answered %s, %v, want TXT %s", tt.name, typeName(tt.qtype), record, err, tt.want)
+		}
+	}
+
+	// an empty value refuses the names it would answer
+	if _, ok := (&Chaos{ID: "ns1"}).Answer(DNSQuestion{Name: labelSequence("version.bind"), Type: TypeTXT, Class: ClassCH}); ok {
+		t.Error("version.bind answered with an empty version")
+	}
+	if _, ok := (&Chaos{Version: "1.2"}).Answer(DNSQuestion{Name: labelSequence("id.server"), Type: TypeTXT, Class: ClassCH}); ok {
+		t.Error("id.server answered with an empty id")
+	}
+}
+
+func TestChaosQueries(t *testing.T) {
+	var forwarded atomic.Int32
+	upstream := udpResponder(t, func(query *Msg) []*Msg {
+		forwarded.Add(1)
+		var m Msg
+		m.SetReply(query)
+		return []*Msg{&m}
+	})
+	srv := newTestServer(t, "-resolver", upstream, "-chaos-version", "dns-server 1.2", "-chaos-id", "")
+	for _, tt := range []struct {
+		questions []DNSQuestion
+		rcode     Rcode
+		answers   []string
+	}{
+		{[]DNSQuestion{{Name: labelSequence("version.bind"), Type: TypeTXT, Class: ClassCH}}, RcodeSuccess, []string{`"dns-server 1.2"`}},
+		{[]DNSQuestion{{Name: labelSequence("version.server"), Type: TypeANY, Class: ClassCH}}, RcodeSuccess, []string{`"dns-server 1.2"`}},
+		{[]DNSQuestion{
+			{Name: labelSequence("version.bind"), Type: TypeTXT, Class: ClassCH},
+			{Name: labelSequence("version.server"), Type: TypeTXT, Class: ClassCH},
+		}, RcodeSuccess, []string{`"dns-server 1.2"`, `"dns-server 1.2"`}},
+		// -chaos-id is empty
+		{[]DNSQuestion{{Name: labelSequence("hostname.bind"), Type: TypeTXT, Class: ClassCH}}, RcodeRefused, nil},
+		{[]DNSQuestion{{Name: labelSequence("id.server"), Type: TypeTXT, Class: ClassCH}}, RcodeRefused, nil},
+		{[]DNSQuestion{{Name: labelSequence("authors.bind"), Type: TypeTXT, Class: ClassCH}}, RcodeRefused, nil},
+		{[]DNSQuestion{{Name: labelSequence("www.example.com"), Type: TypeA, Class: ClassCH}}, RcodeRefused, nil},
+		// a CHAOS question doesn't get an IN one forwarded
+		{[]DNSQuestion{
+			{Name: labelSequence("version.bind"), Type: TypeTXT, Class: ClassCH},
+			{Name: labelSequence("www.example.com"), Type: TypeA, Class: ClassIN},
+		}, RcodeRefused, nil},
+		{[]DNSQuestion{
+			{Name: labelSequence("www.example.com"), Type: TypeA, Class: ClassIN},
+			{Name: labelSequence("version.bind"), Type: TypeTXT, Class: ClassCH},
+		}, RcodeRefused, nil},
+	} {
+		var query Msg
+		query.SetQuestion("placeholder", TypeA)
+		query.Question = tt.questions
+		query.Header.QDCount = uint16(len(tt.questions))
+		r := srv.exchangeTest(t, &query)
+		var answers []string
+		for _, answer := range r.Answers {
+			res, err := answer.Resource()
+			if err != nil || answer.Class != ClassCH {
+				t.Errorf("%v: answer %s, %v", tt.questions, answer, err)
+				continue
+			}
+			answers = append(answers, res.String())
+		}
+		if r.Header.Rcode() != tt.rcode || len(answers) != len(tt.answers) {
+			t.Errorf("%v: %v with %q, want %v with %q", tt.questions, r.Header.Rcode(), answers, tt.rcode, tt.answers)
+			continue
+		}
+		for i := range answers {
+			if answers[i] != tt.answers[i] {
+				t.Errorf("%v: answers %q, want %q", tt.questions, answers, tt.answers)
+				break
+			}
+		}
+		if tt.rcode == RcodeSuccess && r.Header.Flags&flagAA == 0 {
+			t.Errorf("%v: answered %s, want AA", tt.questions, flagNames(r.Header.Flags))
+		}
+	}
+	if n := forwarded.Load(); n != 0 {
+		t.Errorf("%d CHAOS queries forwarded", n)
+	}
+	// while the IN ones are
+	var query Msg
+	query.SetQuestion("version.bind", TypeTXT)
+	srv.exchangeTest(t, &query)
+	if n := forwarded.Load(); n != 1 {
+		t.Errorf("%d IN queries forwarded, want 1", n)
+	}
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// defaultExchangeTimeout bounds an exchange of a Client without a Timeout.
+const defaultExchangeTimeout = 2 * time.Second
+
+var (
+	errNotResponse      = errors.New("message is not a response")
+	errQuestionMismatch = errors.New("response is for another question")
+)
+
+// Client sends queries to a DNS server and returns its responses. It is how
+// the forwarder and the health checks reach the upstreams; the zero value
+// asks over UDP, retries over TCP when the response is truncated and gives
+// up after defaultExchangeTimeout.
+type Client struct {
+	// Net is "udp", the default, "tcp" or "tcp-tls" for DNS over TLS, RFC
+	// 7858.
+	Net string
+	// Timeout bounds an exchange, including the retry over TCP, when the
+	// context has no earlier deadline. 0 is defaultExchangeTimeout.
+	Timeout time.Duration
+	// UDPSize is the payload size advertised in an OPT record added to
+	// queries without one, and the size of the buffer UDP responses are
+	// read into. 0 adds no OPT, leaving responses to 512 bytes.
+	UDPSize int
+	// TLSConfig is the TLS configuration of tcp-tls. nil verifies the
+	// certificate against the host of the address.
+	TLSConfig *tls.Config
+}
+
+// Exchange sends m to the server at addr, a host:port, and waits for the
+// response. The response must have the ID of m and its question; UDP
+// datagrams that don't are ignored as spoofed or late.
+func Exchange(ctx context.Context, m *Msg, addr string) (*Msg, error) {
+	return new(Client).Exchange(ctx, m, addr)
+}
+
+// Exchange sends m to the server at addr, a host:port, and waits for the
+// response. See the package level Exchange.
+func (c *Client) Exchange(ctx context.Context, m *Msg, addr string) (*Msg, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultExchangeTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	query := *m
+	data := query.Pack()
+	if _, ok := findOPT(m.Additional); !ok && c.UDPSize > 0 {
+		data = addOPT(data, c.UDPSize, RcodeSuccess)
+	}
+
+	var network string
+	switch c.Net {
+	case "", "udp":
+		size := c.UDPSize
+		if size < minUDPSize {
+			size = minUDPSize
+		}
+		buf := getSizedBuffer(size)
+		defer putBuffer(buf)
+		r, err := c.exchangeUDP(ctx, &query, data, addr, *buf)
+		if err != nil || r.Header.Flags&flagTC == 0 {
+			return r, err
+		}
+		// the answer is complete over TCP, RFC 7766 5
+		network = "tcp"
+	case "tcp", "tcp-tls":
+		network = c.Net
+	default:
+		return nil, fmt.Errorf("unknown network %q (want udp, tcp or tcp-tls)", c.Net)
+	}
+	response, err := c.exchangeStream(ctx, network, data, addr)
+	if err != nil {
+		return nil, err
+	}
+	r, _, err := parseDNSResponse(nil, response)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(&query, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// exchangeUDP exchanges a message over UDP, reading the datagrams into buf
+// until one answers query.
+func (c *Client) exchangeUDP(ctx context.Context, query *Msg, data []byte, addr string, buf []byte) (*Msg, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+	if _, err := conn.Write(data); err != nil {
+		return nil, err
+	}
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+		// datagrams that don't answer the query are skipped, someone may be
+		// guessing IDs to get an answer of their own accepted, or they are a
+		// late answer to an earlier query; the deadline ends the wait
+		if n < 12 || buf[0] != data[0] || buf[1] != data[1] {
+			continue
+		}
+		r, _, err := parseDNSResponse(nil, buf[:n])
+		if err == nil && checkResponse(query, &r) == nil {
+			return &r, nil
+		}
+	}
+}
+
+// exchangeStream exchanges a message over a TCP or TLS connection, each
+// message preceded by its length, RFC 1035 4.2.2.
+func (c *Client) exchangeStream(ctx context.Context, network string, data []byte, addr string) ([]byte, error) {
+	var conn net.Conn
+	var err error
+	if network == "tcp-tls" {
+		dialer := tls.Dialer{Config: c.TLSConfig}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+	framed := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(data)), uint16(len(data)))
+	if _, err := conn.Write(append(framed, data...)); err != nil {
+		return nil, contextError(ctx, err)
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, contextError(ctx, err)
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return response, nil
+}
+
+// checkResponse reports whether r answers query: a response with its ID and
+// its question, names compared case-insensitively as servers may answer in
+// another case.
+func checkResponse(query, r *Msg) error {
+	if r.Header.Flags&flagQR == 0 {
+		return errNotResponse
+	}
+	if r.Header.ID != query.Header.ID {
+		return fmt.Errorf("response ID %d, want %d", r.Header.ID, query.Header.ID)
+	}
+	// FORMERR and the like may come without the question
+	if len(r.Question) == 0 && r.Header.Rcode() != RcodeSuccess {
+		return nil
+	}
+	if len(r.Question) != len(query.Question) {
+		return errQuestionMismatch
+	}
+	for i, question := range r.Question {
+		asked := query.Question[i]
+		if question.Type != asked.Type || question.Class != asked.Class || !equalNames(question.Name, asked.Name) {
+			return errQuestionMismatch
+		}
+	}
+	return nil
+}
+
+// closeOnDone interrupts conn when ctx is done, by expiring its deadline
+// right away, until stop is called.
+func closeOnDone(ctx context.Context, conn net.Conn) (stop func()) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// contextError prefers the error of a done context to the timeout it
+// caused on the connection. The connection has the deadline of the context,
+// which may pass on the socket a moment before the context's own timer fires.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	var netErr net.Error
+	if deadline, ok := ctx.Deadline(); ok && errors.As(err, &netErr) && netErr.Timeout() && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// newID returns a random message ID, unpredictable so off-path attackers
+// can't forge responses to the upstream queries.
+func newID() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
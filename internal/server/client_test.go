@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// udpResponder answers each query read on a local UDP socket with the
+// datagrams respond returns, sent in order.
+func udpResponder(t *testing.T, respond func(query *Msg) []*Msg) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query, _, err := parseDNSResponse(nil, buf[:n])
+			if err != nil {
+				continue
+			}
+			for _, m := range respond(&query) {
+				conn.WriteTo(m.Pack(), addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestExchangeSkipsDatagramsForOtherQuestions(t *testing.T) {
+	addr := udpResponder(t, func(query *Msg) []*Msg {
+		// the ID guessed right but for another name, then the answer
+		var spoofed Msg
+		spoofed.SetReply(query).Question = []DNSQuestion{{Name: labelSequence("evil.example"), Type: TypeA, Class: ClassIN}}
+		spoofed.AddAnswer(A("evil.example", net.IPv4(203, 0, 113, 66), 60))
+		var answer Msg
+		answer.SetReply(query).AddAnswer(A("www.example", net.IPv4(192, 0, 2, 1), 60))
+		return []*Msg{&spoofed, &answer}
+	})
+	var query Msg
+	query.SetQuestion("www.example", TypeA)
+	r, err := (&Client{Timeout: time.Second}).Exchange(context.Background(), &query, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answers) != 1 || !net.IP(r.Answers[0].RData).Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("answers %v, want www.example A 192.0.2.1", r.Answers)
+	}
+}
+
+func TestExchangeTimesOutWithoutAnAnswer(t *testing.T) {
+	addr := udpResponder(t, func(query *Msg) []*Msg {
+		var other Msg
+		other.SetReply(query).Header.ID++
+		return []*Msg{&other}
+	})
+	var query Msg
+	query.SetQuestion("www.example", TypeA)
+	_, err := (&Client{Timeout: 100 * time.Millisecond}).Exchange(context.Background(), &query, addr)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Exchange: %v, want the deadline exceeded", err)
+	}
+}
+
+func TestExchangeRetriesTruncatedOverTCP(t *testing.T) {
+	srv := newTestServer(t, "-listen", "127.0.0.1:0,tcp://127.0.0.1:0")
+	zone := srv.Zone("lab.example")
+	for i := 0; i < 40; i++ {
+		zone.AddTXT("big", "a character string long enough that forty of them overflow a datagram", 60)
+	}
+	addr := startTestServer(t, srv)
+
+	var query Msg
+	query.SetQuestion("big.lab.example", TypeTXT)
+	r, err := (&Client{Timeout: time.Second}).Exchange(context.Background(), &query, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Header.Flags&flagTC != 0 || len(r.Answers) != 40 {
+		t.Errorf("got %d answers, TC %v; want all 40 over TCP", len(r.Answers), r.Header.Flags&flagTC != 0)
+	}
+}
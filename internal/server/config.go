@@ -0,0 +1,311 @@
+package server
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configKey ties a config file key to the flag it sets. Array values of a
+// repeatable flag set it once per item; other flags get the items joined
+// with commas.
+type configKey struct {
+	flag   string
+	repeat bool
+}
+
+// configKeys lists every key the config file accepts, by table. A flag given
+// on the command line overrides the file value of its key.
+var configKeys = map[string]map[string]configKey{
+	"server": {
+		"listen":           {flag: "listen"},
+		"listen_addr_file": {flag: "listen-addr-file"},
+		"udp_sockets":      {flag: "udp-sockets"},
+		"udp_batch":        {flag: "udp-batch"},
+		"admin":            {flag: "admin"},
+		"admin_token_file": {flag: "admin-token-file"},
+		"admin_rules_file": {flag: "admin-rules-file"},
+		"pprof":            {flag: "pprof"},
+		"shutdown_timeout": {flag: "shutdown-timeout"},
+		"max_inflight":     {flag: "max-inflight"},
+		"overload_action":  {flag: "overload-action"},
+		"memory_budget":    {flag: "memory-budget"},
+		"max_udp_size":     {flag: "max-udp-size"},
+		"pipeline":         {flag: "pipeline"},
+		"query_timeout":    {flag: "query-timeout"},
+		"plugins":          {flag: "plugin", repeat: true},
+		"user":             {flag: "user"},
+		"chroot":           {flag: "chroot"},
+		"daemon":           {flag: "daemon"},
+		"pid_file":         {flag: "pid-file"},
+	},
+	"upstream": {
+		"resolver": {flag: "resolver"},
+		"timeout":  {flag: "upstream-timeout"},
+	},
+	"local": {
+		"records": {flag: "record", repeat: true},
+		"pools":   {flag: "pool", repeat: true},
+	},
+	"acl": {
+		"allow":        {flag: "allow"},
+		"deny":         {flag: "deny"},
+		"action":       {flag: "acl-action"},
+		"zone_allow":   {flag: "zone-allow", repeat: true},
+		"zone_deny":    {flag: "zone-deny", repeat: true},
+		"listen_allow": {flag: "listen-allow", repeat: true},
+		"listen_deny":  {flag: "listen-deny", repeat: true},
+	},
+	"rate_limit": {
+		"qps":          {flag: "rate-limit"},
+		"burst":        {flag: "rate-burst"},
+		"action":       {flag: "rate-action"},
+		"prefix_v4":    {flag: "rate-prefix-v4"},
+		"prefix_v6":    {flag: "rate-prefix-v6"},
+		"tarpit_delay": {flag: "rate-tarpit-delay"},
+	},
+	"tunnel": {
+		"detect":     {flag: "tunnel-detect"},
+		"action":     {flag: "tunnel-action"},
+		"max_label":  {flag: "tunnel-max-label"},
+		"entropy":    {flag: "tunnel-entropy"},
+		"subdomains": {flag: "tunnel-subdomains"},
+		"txt_rate":   {flag: "tunnel-txt-rate"},
+		"hold":       {flag: "tunnel-hold"},
+		"limit":      {flag: "tunnel-limit"},
+	},
+	"filtering": {
+		"block":               {flag: "block-domain", repeat: true},
+		"allow":               {flag: "allow-domain", repeat: true},
+		"blocklists":          {flag: "blocklist", repeat: true},
+		"blocklist_refresh":   {flag: "blocklist-refresh"},
+		"safe_search":         {flag: "safe-search"},
+		"safe_search_clients": {flag: "safe-search-clients"},
+		"qtype_rules":         {flag: "qtype-rule", repeat: true},
+		"hooks":               {flag: "hook", repeat: true},
+		"rewrites":            {flag: "rewrite", repeat: true},
+	},
+	"chaos": {
+		"version": {flag: "chaos-version"},
+		"id":      {flag: "chaos-id"},
+	},
+	"logging": {
+		"level":              {flag: "log-level"},
+		"format":             {flag: "log-format"},
+		"file":               {flag: "log-file"},
+		"slow_query":         {flag: "slow-query"},
+		"query_log":          {flag: "query-log"},
+		"query_log_max_size": {flag: "query-log-max-size"},
+		"query_log_max_age":  {flag: "query-log-max-age"},
+		"query_log_backups":  {flag: "query-log-backups"},
+		"query_log_compress": {flag: "query-log-compress"},
+		"query_log_sample":   {flag: "query-log-sample"},
+		"quarantine_dir":     {flag: "quarantine-dir"},
+		"quarantine_max":     {flag: "quarantine-max"},
+		"audit_log":          {flag: "audit-log"},
+		"audit_size":         {flag: "audit-size"},
+		"recent_queries":     {flag: "recent-queries"},
+		"history_dir":        {flag: "history-dir"},
+		"history_retention":  {flag: "history-retention"},
+	},
+}
+
+// loadConfig applies a TOML config file to the flags of fs that were not set
+// on the command line. Errors name the file, line and key at fault.
+func loadConfig(path string, fs *flag.FlagSet) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	tables, err := parseTOML(string(data))
+	if err != nil {
+		if syntaxErr, ok := err.(*tomlError); ok {
+			return fmt.Errorf("%s:%d: %s", path, syntaxErr.Line, syntaxErr.Msg)
+		}
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	for _, table := range tables {
+		if table.Name == "group" {
+			if explicit["group"] {
+				continue
+			}
+			spec, err := groupSpec(table)
+			if err == nil {
+				err = fs.Set("group", spec)
+			}
+			if err != nil {
+				return fmt.Errorf("%s:%d: [[group]]: %w", path, table.Line, err)
+			}
+			continue
+		}
+		keys, ok := configKeys[table.Name]
+		if !ok {
+			if table.Name == "" && len(table.Keys) == 0 {
+				continue
+			}
+			where, line := fmt.Sprintf("table [%s]", table.Name), table.Line
+			if table.Name == "" {
+				where = fmt.Sprintf("key %q outside of a table", table.Keys[0])
+				line = table.Lines[table.Keys[0]]
+			}
+			return fmt.Errorf("%s:%d: unknown %s (valid tables: %s)", path, line, where, validTables())
+		}
+		for _, key := range table.Keys {
+			line := table.Lines[key]
+			target, ok := keys[key]
+			if !ok {
+				return fmt.Errorf("%s:%d: unknown key %q in [%s] (valid keys: %s)", path, line, key, table.Name, sortedKeys(keys))
+			}
+			if explicit[target.flag] {
+				continue
+			}
+			if err := setFlagFromConfig(fs, target, table.Values[key]); err != nil {
+				return fmt.Errorf("%s:%d: %s.%s: %w", path, line, table.Name, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+func setFlagFromConfig(fs *flag.FlagSet, target configKey, value any) error {
+	items, isArray := value.([]any)
+	if !isArray {
+		s, err := configString(value)
+		if err != nil {
+			return err
+		}
+		return setFlag(fs, target.flag, s)
+	}
+	var values []string
+	for _, item := range items {
+		s, err := configString(item)
+		if err != nil {
+			return err
+		}
+		values = append(values, s)
+	}
+	if !target.repeat {
+		return setFlag(fs, target.flag, strings.Join(values, ","))
+	}
+	for _, s := range values {
+		if err := setFlag(fs, target.flag, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setFlag sets a flag to a value of the config file, naming the value in the
+// error as the flag package only does for the command line.
+func setFlag(fs *flag.FlagSet, name, value string) error {
+	if err := fs.Set(name, value); err != nil {
+		return fmt.Errorf("invalid value %q: %w", value, err)
+	}
+	return nil
+}
+
+func configString(value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", value)
+}
+
+// groupSpec turns a [[group]] table into the -group flag syntax.
+func groupSpec(table *tomlTable) (string, error) {
+	var fields []string
+	for _, key := range table.Keys {
+		name := strings.ReplaceAll(key, "_", "-")
+		items, isArray := table.Values[key].([]any)
+		if !isArray {
+			items = []any{table.Values[key]}
+		}
+		var values []string
+		for _, item := range items {
+			s, err := configString(item)
+			if err != nil {
+				return "", fmt.Errorf("%s: %w", key, err)
+			}
+			values = append(values, s)
+		}
+		if name == "clients" {
+			values = []string{strings.Join(values, ",")}
+		}
+		for _, s := range values {
+			fields = append(fields, name+"="+quoteField(s))
+		}
+	}
+	return strings.Join(fields, " "), nil
+}
+
+func validTables() string {
+	names := []string{"[[group]]"}
+	for name := range configKeys {
+		names = append(names, "["+name+"]")
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func sortedKeys(keys map[string]configKey) string {
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// quoteField quotes s so splitFields reads it back as a single field.
+func quoteField(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// splitFields splits s on whitespace like strings.Fields, except inside
+// double quotes, so key="value with spaces" stays one field. Backslash
+// escapes the next character inside quotes.
+func splitFields(s string) ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	inField, inQuote := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case inQuote && c == '\\' && i+1 < len(s):
+			i++
+			field.WriteByte(s[i])
+		case c == '"':
+			inQuote, inField = !inQuote, true
+		case !inQuote && (c == ' ' || c == '\t' || c == '\n'):
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteByte(c)
+			inField = true
+		}
+	}
+	if inQuote {
+		return nil, fmt.Errorf("unterminated quote in %q", s)
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"flag"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	writeConfig(t, path, `
+[server]
+max_inflight = 100
+plugins = ["a.example log", "b.example log"]
+
+[rate_limit]
+qps = 2.5
+
+[acl]
+allow = ["10.0.0.0/8", "192.168.0.0/16"]
+
+[[group]]
+name = "kids"
+clients = ["10.0.1.0/24", "10.0.2.0/24"]
+block = ["tiktok.com", "youtube.com@mon-fri 21:00-07:00"]
+safe_search = true
+
+[[group]]
+name = "guests"
+clients = "10.0.9.0/24"
+log = false
+`)
+	opts, err := parseOptions([]string{"-config", path, "-max-inflight", "7"}, flag.ContinueOnError, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.maxInflight != 7 {
+		t.Errorf("-max-inflight %d, want the command line to win", opts.maxInflight)
+	}
+	if opts.rateQPS != 2.5 {
+		t.Errorf("-rate-limit %g, want 2.5", opts.rateQPS)
+	}
+	if len(opts.pluginSpecs) != 2 {
+		t.Errorf("plugins %q, want one -plugin per item", opts.pluginSpecs)
+	}
+	if len(opts.listenerACL.Allow) != 2 {
+		t.Errorf("allow %v, want both networks", opts.listenerACL.Allow)
+	}
+	want := []string{
+		`name="kids" clients="10.0.1.0/24,10.0.2.0/24" block="tiktok.com" block="youtube.com@mon-fri 21:00-07:00" safe-search="true"`,
+		`name="guests" clients="10.0.9.0/24" log="false"`,
+	}
+	if got := []string(opts.groupSpecs); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("groups\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{"[server]\nmax_inflight = 1979-05-27", `:2: dates and times are not supported, quote "1979-05-27"`},
+		{"[servre]\nlisten = []", ":1: unknown table [servre] (valid tables: [[group]], [acl], "},
+		{"listen = []", `:1: unknown key "listen" outside of a table`},
+		{"[server]\n\nlisen = []", `:3: unknown key "lisen" in [server] (valid keys: admin, `},
+		{"[server]\nmax_inflight = \"many\"", `:2: server.max_inflight: invalid value "many": parse error`},
+		{"[[group]]\nclients = \"10.0.0.0/8\"", `:1: [[group]]: group "clients=\"10.0.0.0/8\"" needs a name`},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "config.toml")
+		writeConfig(t, path, tt.config)
+		_, err := parseOptions([]string{"-config", path}, flag.ContinueOnError, nil)
+		if err == nil || !strings.Contains(err.Error(), path+tt.err) {
+			t.Errorf("config %q: error %v, want %q", tt.config, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/internal/slog"
+)
+
+// blockingSwitch turns filtering off for every client, for good or until a
+// deadline, e.g. while checking whether a blocklist breaks a site.
+type blockingSwitch struct {
+	mu       sync.Mutex
+	disabled bool
+	until    time.Time // zero when disabled for good
+}
+
+// Enabled reports whether blocking applies at now.
+func (b *blockingSwitch) Enabled(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.disabled && !b.until.IsZero() && !now.Before(b.until) {
+		b.disabled = false
+	}
+	return !b.disabled
+}
+
+// Set turns blocking on, or off for duration, where zero means until it is
+// turned on again.
+func (b *blockingSwitch) Set(enabled bool, duration time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.disabled = !enabled
+	b.until = time.Time{}
+	if !enabled && duration > 0 {
+		b.until = time.Now().Add(duration)
+	}
+}
+
+func (b *blockingSwitch) status() map[string]any {
+	enabled := b.Enabled(time.Now())
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := map[string]any{"enabled": enabled}
+	if !enabled && !b.until.IsZero() {
+		status["until"] = b.until
+	}
+	return status
+}
+
+// controlAPI serves the admin commands that change or inspect the running
+// server: reload, blocking, rules, stats, analytics, traffic, rate limit,
+// recent queries, zones, zone export, pools, cache, log level and client
+// debug.
+type controlAPI struct {
+	reload    *reloader
+	blocking  *blockingSwitch
+	stats     *Stats
+	analytics *Analytics
+	traffic   *Traffic
+	logLevel  *slog.LevelVar
+	debug     *debugClients
+	mux       *ServeMux // whose zones are exported
+}
+
+func (c *controlAPI) register(mux *http.ServeMux) {
+	mux.HandleFunc("/reload", c.handleReload)
+	mux.HandleFunc("/blocking", c.handleBlocking)
+	mux.HandleFunc("/stats", c.handleStats)
+	mux.HandleFunc("/analytics", c.handleAnalytics)
+	mux.HandleFunc("/traffic", c.handleTraffic)
+	mux.HandleFunc("/zones", c.handleZones)
+	mux.HandleFunc("/zones/export", c.handleZoneExport)
+	mux.HandleFunc("/pools", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, c.reload.current.Load().pools.Status())
+	})
+	mux.HandleFunc("/rate-limit", c.handleRateLimit)
+	mux.HandleFunc("/tunnels", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, c.reload.current.Load().tunnel.Flagged(time.Now()))
+	})
+	mux.HandleFunc("/log-level", c.handleLogLevel)
+	mux.HandleFunc("/debug-clients", c.handleDebugClients)
+}
+
+func (c *controlAPI) handleReload(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	if err := c.reload.Reload(); err != nil {
+		slog.Error("configuration reload rejected", "err", err)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		writeJSON(w, map[string]any{"reloaded": false, "error": err.Error()})
+		return
+	}
+	writeJSON(w, map[string]any{"reloaded": true})
+}
+
+// handleBlocking reports the blocking switch, or sets it on POST with
+// ?enabled=on|off and an optional &for=duration when turning it off.
+func (c *controlAPI) handleBlocking(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		enabled, err := parseSwitch(r.FormValue("enabled"))
+		if err != nil {
+			http.Error(w, "enabled: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var duration time.Duration
+		if value := r.FormValue("for"); value != "" {
+			if duration, err = time.ParseDuration(value); err != nil || duration < 0 {
+				http.Error(w, fmt.Sprintf("invalid duration %q", value), http.StatusBadRequest)
+				return
+			}
+		}
+		c.blocking.Set(enabled, duration)
+		slog.Info("blocking switched", "enabled", enabled, "for", duration)
+	}
+	writeJSON(w, c.blocking.status())
+}
+
+// handleStats reports the query counters; ?zones=N lists the N busiest
+// zones instead of the default number.
+func (c *controlAPI) handleStats(w http.ResponseWriter, r *http.Request) {
+	top := defaultTopZones
+	if value := r.FormValue("zones"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("invalid zone count %q", value), http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+	writeJSON(w, c.stats.Snapshot(top))
+}
+
+// handleAnalytics reports the scored clients and domains; ?top=N lists N of
+// each instead of the default number.
+func (c *controlAPI) handleAnalytics(w http.ResponseWriter, r *http.Request) {
+	top := defaultTopScores
+	if value := r.FormValue("top"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("invalid count %q", value), http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+	writeJSON(w, c.analytics.Report(top, time.Now()))
+}
+
+// handleTraffic reports the top clients, names and blocked names and the
+// query rates; ?window= sets the window, 5m by default, and ?top=N the
+// length of the lists.
+func (c *controlAPI) handleTraffic(w http.ResponseWriter, r *http.Request) {
+	window, top := 5*time.Minute, defaultTopTraffic
+	if value := r.FormValue("window"); value != "" {
+		var err error
+		if window, err = parseTrafficWindow(value); err != nil {
+			http.Error(w, fmt.Sprintf("invalid window %q: %v", value, err), http.StatusBadRequest)
+			return
+		}
+	}
+	if value := r.FormValue("top"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("invalid count %q", value), http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+	writeJSON(w, c.traffic.Report(window, top, time.Now()))
+}
+
+// handleRateLimit reports the queries -rate-limit refused and the clients
+// limited most in the last minute; ?top=N lists N of them instead of the
+// default number.
+func (c *controlAPI) handleRateLimit(w http.ResponseWriter, r *http.Request) {
+	limiter := c.reload.current.Load().limiter
+	if limiter == nil {
+		http.Error(w, "rate limiting is off, see -rate-limit", http.StatusNotFound)
+		return
+	}
+	top := defaultTopLimited
+	if value := r.FormValue("top"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("invalid count %q", value), http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+	writeJSON(w, limiter.Report(top))
+}
+
+// handleLogLevel reports the log level, or sets it on POST with ?level=.
+// A reload sets it back to the configured level.
+func (c *controlAPI) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(r.FormValue("level"))); err != nil {
+			http.Error(w, fmt.Sprintf("invalid log level %q (want debug, info, warn or error)", r.FormValue("level")), http.StatusBadRequest)
+			return
+		}
+		c.logLevel.Set(level)
+		slog.Warn("log level changed", "level", level.String())
+	}
+	writeJSON(w, map[string]any{"level": c.logLevel.Level().String()})
+}
+
+// handleDebugClients lists the clients in debug mode, or on POST with
+// ?client=ip puts one in debug mode for &for=duration (10m by default), or
+// takes it out with &for=0.
+func (c *controlAPI) handleDebugClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		ip := net.ParseIP(r.FormValue("client"))
+		if ip == nil {
+			http.Error(w, fmt.Sprintf("invalid client address %q", r.FormValue("client")), http.StatusBadRequest)
+			return
+		}
+		duration := 10 * time.Minute
+		if value := r.FormValue("for"); value != "" {
+			var err error
+			if duration, err = time.ParseDuration(value); err != nil {
+				http.Error(w, fmt.Sprintf("invalid duration %q", value), http.StatusBadRequest)
+				return
+			}
+		}
+		c.debug.Set(ip, duration)
+		slog.Info("client debug mode switched", "client", ip.String(), "for", duration)
+	}
+	writeJSON(w, c.debug.List())
+}
+
+// handleZones lists the zones the running configuration has rules for.
+func (c *controlAPI) handleZones(w http.ResponseWriter, r *http.Request) {
+	p := c.reload.current.Load()
+	acl := make([]string, 0, len(p.zoneACLs))
+	for zone := range p.zoneACLs {
+		acl = append(acl, domainName(zone.Wire()))
+	}
+	sort.Strings(acl)
+	rewrites := make(map[string]string, len(p.rewriter))
+	for zone, rule := range p.rewriter {
+		rewrites[domainName(zone.Wire())] = domainName(rule.To.Wire())
+	}
+	qtype := make([]string, 0)
+	for _, rule := range p.qtypePolicy {
+		if rule.Zone != "" && !containsString(qtype, rule.Zone) {
+			qtype = append(qtype, rule.Zone)
+		}
+	}
+	writeJSON(w, map[string]any{"acl": acl, "rewrite": rewrites, "qtype": qtype})
+}
+
+// handleZoneExport writes the records served for ?zone= as a master file:
+// those of the zone registered on the mux and the local records in it.
+func (c *controlAPI) handleZoneExport(w http.ResponseWriter, r *http.Request) {
+	zone, err := ParseName(r.FormValue("zone"))
+	if err != nil || r.FormValue("zone") == "" {
+		http.Error(w, "zone: want a zone name", http.StatusBadRequest)
+		return
+	}
+	records, ok := zoneRecords(zone, c.mux, c.reload.current.Load().opts.records)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no records served for %s", zone), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/dns; charset=utf-8") // RFC 4027
+	if err := writeZoneFile(w, zone, records); err != nil {
+		// the status is sent, the client sees a truncated file
+		slog.Warn("failed to write zone export", "zone", zone, "err", err)
+	}
+}
+
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// requireToken lets only requests carrying "Authorization: Bearer token"
+// through to next. The health checks stay open for load balancers and
+// orchestrators.
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || isDashboardPage(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		authorization := r.Header.Get("Authorization")
+		given := strings.TrimPrefix(authorization, "Bearer ")
+		if !strings.HasPrefix(authorization, "Bearer ") || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dns-server"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readToken reads a token file, ignoring surrounding whitespace.
+func readToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return token, nil
+}
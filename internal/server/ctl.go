@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const ctlUsage = `usage: %s ctl [flags] command [args]
+
+Commands:
+  reload                      reload the configuration file
+  blocking                    show whether blocking is on
+  blocking on                 turn blocking on
+  blocking off [duration]     turn blocking off, for good or e.g. for 10m
+  rules                       list the block and allow rules added at runtime
+  rules block|allow rule      add a block or allow rule for every group that filters
+  rules remove block|allow rule
+                              remove a rule added at runtime
+  queries [name]              show the recent queries, or those for names containing name
+  history [name] [since]      search the query history for names containing name, of the last 24h or e.g. 168h
+  stats [zones]               show query counters, listing the given number of busiest zones
+  analytics [top]             score the clients and domains of the last 10m for signs of DGA malware
+  traffic [window] [top]      show the top clients, names and blocked names of the last 5m or the window, and the query rates
+  zones                       list the zones the configuration has rules for
+  export-zone zone            print the records served for a zone as a master file
+  pools                       show the backends of the pools and their health
+  rate-limit [top]            count the rate limited queries and list the clients limited most in the last minute
+  tunnels                     list the clients flagged as tunneling and why
+  memory                      show the memory budget and the estimated usage against it
+  log-level [level]           show or set the log level: debug, info, warn or error
+  debug-client                list the clients in debug mode
+  debug-client ip [duration]  log the queries of a client in full, for 10m or the duration (0 ends it)
+
+Flags:
+`
+
+// runCtl is the ctl subcommand, a small client of the admin endpoints. It
+// prints the server's JSON reply and returns the exit status.
+func runCtl(args []string) int {
+	fs := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	adminAddr := fs.String("admin", envOr("DNS_SERVER_ADMIN", "127.0.0.1:8053"), "address of the admin endpoints, host:port or unix:/path (env DNS_SERVER_ADMIN)")
+	tokenFile := fs.String("token-file", "", "file holding the admin token (env DNS_SERVER_ADMIN_TOKEN holds the token itself)")
+	timeout := fs.Duration("timeout", 30*time.Second, "how long to wait for the server")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), ctlUsage, os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	method, path, query := http.MethodGet, "", url.Values{}
+	command, rest := fs.Arg(0), fs.Args()[1:]
+	switch {
+	case command == "reload" && len(rest) == 0:
+		method, path = http.MethodPost, "/reload"
+	case command == "rules" && len(rest) == 0:
+		path = "/rules"
+	case command == "rules" && len(rest) == 2 && (rest[0] == "block" || rest[0] == "allow"):
+		method, path = http.MethodPost, "/rules"
+		query.Set("action", rest[0])
+		query.Set("rule", rest[1])
+	case command == "rules" && len(rest) == 3 && rest[0] == "remove":
+		method, path = http.MethodDelete, "/rules"
+		query.Set("action", rest[1])
+		query.Set("rule", rest[2])
+	case command == "queries" && len(rest) <= 1:
+		path = "/queries"
+		if len(rest) == 1 {
+			query.Set("name", rest[0])
+		}
+	case command == "history" && len(rest) <= 2:
+		path = "/history"
+		query.Set("from", "24h")
+		if len(rest) > 0 {
+			query.Set("name", rest[0])
+		}
+		if len(rest) == 2 {
+			query.Set("from", rest[1])
+		}
+	case command == "stats" && len(rest) <= 1:
+		path = "/stats"
+		if len(rest) == 1 {
+			query.Set("zones", rest[0])
+		}
+	case command == "analytics" && len(rest) <= 1:
+		path = "/analytics"
+		if len(rest) == 1 {
+			query.Set("top", rest[0])
+		}
+	case command == "traffic" && len(rest) <= 2:
+		path = "/traffic"
+		if len(rest) > 0 {
+			query.Set("window", rest[0])
+		}
+		if len(rest) == 2 {
+			query.Set("top", rest[1])
+		}
+	case command == "zones" && len(rest) == 0:
+		path = "/zones"
+	case command == "export-zone" && len(rest) == 1:
+		path = "/zones/export"
+		query.Set("zone", rest[0])
+	case command == "pools" && len(rest) == 0:
+		path = "/pools"
+	case command == "rate-limit" && len(rest) <= 1:
+		path = "/rate-limit"
+		if len(rest) == 1 {
+			query.Set("top", rest[0])
+		}
+	case command == "tunnels" && len(rest) == 0:
+		path = "/tunnels"
+	case command == "memory" && len(rest) == 0:
+		path = "/memory"
+	case command == "blocking" && len(rest) == 0:
+		path = "/blocking"
+	case command == "blocking" && (len(rest) == 1 || len(rest) == 2 && rest[0] == "off"):
+		method, path = http.MethodPost, "/blocking"
+		query.Set("enabled", rest[0])
+		if len(rest) == 2 {
+			query.Set("for", rest[1])
+		}
+	case command == "log-level" && len(rest) <= 1:
+		path = "/log-level"
+		if len(rest) == 1 {
+			method = http.MethodPost
+			query.Set("level", rest[0])
+		}
+	case command == "debug-client" && len(rest) <= 2:
+		path = "/debug-clients"
+		if len(rest) > 0 {
+			method = http.MethodPost
+			query.Set("client", rest[0])
+		}
+		if len(rest) == 2 {
+			query.Set("for", rest[1])
+		}
+	default:
+		fs.Usage()
+		return 2
+	}
+
+	token := os.Getenv("DNS_SERVER_ADMIN_TOKEN")
+	if *tokenFile != "" {
+		var err error
+		if token, err = readToken(*tokenFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	base := "http://" + *adminAddr
+	if strings.HasPrefix(*adminAddr, "unix:") {
+		socket := strings.TrimPrefix(*adminAddr, "unix:")
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}
+		base = "http://admin"
+	}
+	target := base + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	io.Copy(os.Stdout, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		fmt.Fprintln(os.Stderr, "server answered", resp.Status)
+		return 1
+	}
+	return 0
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
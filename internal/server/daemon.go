@@ -0,0 +1,198 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// daemonReadyEnv tells a server started by -daemon which descriptor to report
+// on once it is serving, so the starting process can exit with its status.
+const daemonReadyEnv = "DNS_SERVER_DAEMON_READY"
+
+// startDaemon runs the server again in the background, detached from the
+// terminal in a session of its own, and waits until it is serving or has
+// failed. It returns the exit status of the starting process.
+func startDaemon(logFile string) int {
+	executable, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer ready.Close()
+
+	// the log file also catches what the runtime writes to stderr, e.g.
+	// panics; without one the output of the daemon is discarded
+	output, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if logFile != "" {
+		output, err = openLogFile(logFile)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer output.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonReadyEnv+"=3")
+	cmd.Stdout, cmd.Stderr = output, output
+	cmd.ExtraFiles = []*os.File{readyWriter}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	readyWriter.Close()
+
+	line, _ := bufio.NewReader(ready).ReadString('\n')
+	if strings.TrimSpace(line) != "ready" {
+		// the daemon closed the pipe without being ready, it failed to start
+		err := cmd.Wait()
+		hint := "see the log file " + logFile
+		if logFile == "" {
+			hint = "run it in the foreground or give -log-file to see why"
+		}
+		fmt.Fprintf(os.Stderr, "server failed to start (%v), %s\n", err, hint)
+		return 1
+	}
+	cmd.Process.Release()
+	return 0
+}
+
+// notifyDaemonReady tells the process that started the server with -daemon
+// that it is serving. It does nothing in the foreground.
+func notifyDaemonReady() {
+	fd, err := strconv.Atoi(os.Getenv(daemonReadyEnv))
+	if err != nil {
+		return
+	}
+	os.Unsetenv(daemonReadyEnv)
+	ready := os.NewFile(uintptr(fd), "daemon-ready")
+	fmt.Fprintln(ready, "ready")
+	ready.Close()
+}
+
+// inDaemon reports whether this process is the background server started by
+// -daemon, as opposed to the one that starts it.
+func inDaemon() bool {
+	return os.Getenv(daemonReadyEnv) != ""
+}
+
+// openLogFile opens the file the log is appended to with -log-file.
+func openLogFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+}
+
+// pidFile is the PID file of a running server. It stays locked as long as the
+// server runs, which is how a second server and -s tell it is alive.
+type pidFile struct {
+	path string
+	file *os.File
+}
+
+// createPIDFile locks path and writes the process ID into it, refusing when
+// another server holds the lock. A file left over by a crashed server is
+// reused.
+func createPIDFile(path string) (*pidFile, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if pid, readErr := readPID(path); readErr == nil {
+			return nil, fmt.Errorf("already running with PID %d (%s)", pid, path)
+		}
+		return nil, fmt.Errorf("already running (%s is locked)", path)
+	}
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(file, "%d\n", os.Getpid()); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &pidFile{path: path, file: file}, nil
+}
+
+// Remove deletes the PID file and releases the lock. Removing fails
+// harmlessly when privileges were dropped, the next start reuses the file.
+func (p *pidFile) Remove() {
+	os.Remove(p.path)
+	p.file.Close()
+}
+
+func readPID(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("%s holds no PID", path)
+	}
+	return pid, nil
+}
+
+// serverRunning reports whether a server holds the lock of the PID file.
+func serverRunning(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err != nil {
+		return true
+	}
+	syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	return false
+}
+
+// signalServer is -s: it sends the server named by the PID file stop
+// (SIGTERM) or reload (SIGHUP). stop waits up to timeout for the server to
+// exit.
+func signalServer(path, command string, timeout time.Duration) error {
+	if path == "" {
+		return errors.New("-s needs the -pid-file of the server")
+	}
+	var sig syscall.Signal
+	switch command {
+	case "stop":
+		sig = syscall.SIGTERM
+	case "reload":
+		sig = syscall.SIGHUP
+	default:
+		return fmt.Errorf("unknown signal %q (want stop or reload)", command)
+	}
+	if !serverRunning(path) {
+		return fmt.Errorf("no server is running (%s is not locked)", path)
+	}
+	pid, err := readPID(path)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Kill(pid, sig); err != nil {
+		return fmt.Errorf("signal PID %d: %w", pid, err)
+	}
+	if sig != syscall.SIGTERM {
+		return nil
+	}
+	for deadline := time.Now().Add(timeout); serverRunning(path); time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("PID %d still running after %s", pid, timeout)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPIDFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dns-server.pid")
+	own := strconv.Itoa(os.Getpid()) + "\n"
+
+	// left over by a crashed server, longer than what replaces it
+	if err := os.WriteFile(path, []byte("4194304\nstale\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if serverRunning(path) {
+		t.Error("stale PID file taken for a running server")
+	}
+	pid, err := createPIDFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != own {
+		t.Errorf("PID file holds %q, want %q", data, own)
+	}
+	if !serverRunning(path) {
+		t.Error("locked PID file not taken for a running server")
+	}
+
+	// the lock is on the open file, so a second one conflicts in the same
+	// process as well
+	if second, err := createPIDFile(path); err == nil {
+		second.Remove()
+		t.Error("second server started")
+	} else if want := "already running with PID " + strings.TrimSpace(own); !strings.Contains(err.Error(), want) {
+		t.Errorf("second server: %v, want %q", err, want)
+	}
+	if data, _ := os.ReadFile(path); string(data) != own {
+		t.Errorf("PID file holds %q after the refused start", data)
+	}
+
+	pid.Remove()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("PID file left behind: %v", err)
+	}
+	if serverRunning(path) {
+		t.Error("removed PID file taken for a running server")
+	}
+}
+
+func TestSignalServer(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing.pid")
+	stale := filepath.Join(dir, "stale.pid")
+	if err := os.WriteFile(stale, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		path, command, want string
+	}{
+		{"", "stop", "needs the -pid-file"},
+		{missing, "stop", "no server is running"},
+		{missing, "reload", "no server is running"},
+		{stale, "stop", "no server is running"}, // not locked, whatever PID it holds
+		{stale, "restart", "unknown signal"},
+	} {
+		if err := signalServer(tt.path, tt.command, time.Second); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("-s %s with %q: %v, want it to say %q", tt.command, tt.path, err, tt.want)
+		}
+	}
+
+	// the current process plays the server
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	path := filepath.Join(dir, "dns-server.pid")
+	pid, err := createPIDFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pid.Remove()
+
+	if err := signalServer(path, "reload", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case sig := <-signals:
+		if sig != syscall.SIGHUP {
+			t.Errorf("reload sent %v", sig)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reload sent no signal")
+	}
+
+	// a server that doesn't exit
+	if err := signalServer(path, "stop", 100*time.Millisecond); err == nil || !strings.Contains(err.Error(), "still running after 100ms") {
+		t.Errorf("stop of a server that doesn't exit: %v", err)
+	}
+	if sig := <-signals; sig != syscall.SIGTERM {
+		t.Errorf("stop sent %v", sig)
+	}
+
+	// one that does, once it gets the signal
+	go func() {
+		<-signals
+		pid.Remove()
+	}()
+	if err := signalServer(path, "stop", 5*time.Second); err != nil {
+		t.Errorf("stop: %v", err)
+	}
+}
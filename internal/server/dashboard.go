@@ -0,0 +1,42 @@
+package server
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// dashboardFiles is the web dashboard served from the admin endpoints. The
+// pages hold no data of their own: the script fetches everything from the
+// admin API, with the token the user enters when the API asks for one.
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// dashboard serves the pages of the dashboard and answers 404 for any other
+// path it is asked for, being the catch-all of the admin mux.
+func dashboard() http.Handler {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	fileServer := http.FileServer(http.FS(files))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isDashboardPage(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Security-Policy", "default-src 'self'")
+		fileServer.ServeHTTP(w, r)
+	})
+}
+
+// isDashboardPage reports whether path is one of the static pages of the
+// dashboard, which are served without the admin token.
+func isDashboardPage(path string) bool {
+	switch path {
+	case "/", "/dashboard.js", "/dashboard.css":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+// The dashboard polls the admin API and renders what it answers. Names come
+// from clients, so everything is added as text, never as markup.
+"use strict";
+
+const rcodes = ["NOERROR", "FORMERR", "SERVFAIL", "NXDOMAIN", "NOTIMP", "REFUSED"];
+const $ = (id) => document.getElementById(id);
+
+let token = localStorage.getItem("dns-admin-token") || "";
+
+// api calls an admin endpoint, asking for the token when the server wants
+// one, and returns the decoded JSON.
+async function api(path, method = "GET") {
+  for (;;) {
+    const headers = token ? { Authorization: "Bearer " + token } : {};
+    const response = await fetch(path, { method, headers });
+    if (response.status === 401) {
+      const entered = prompt("Admin token");
+      if (entered === null) {
+        throw new Error("the admin API needs a token");
+      }
+      token = entered.trim();
+      localStorage.setItem("dns-admin-token", token);
+      continue;
+    }
+    const body = await response.text();
+    let data = null;
+    try {
+      data = JSON.parse(body);
+    } catch (e) {
+      // errors come as plain text
+    }
+    if (!response.ok) {
+      throw new Error((data && data.error) || body.trim() || response.statusText);
+    }
+    return data;
+  }
+}
+
+function show(text) {
+  $("message").textContent = text;
+  $("message").hidden = !text;
+}
+
+function fill(table, headings, rows) {
+  table.replaceChildren();
+  const head = table.insertRow();
+  for (const [title, number] of headings) {
+    const th = document.createElement("th");
+    th.textContent = title;
+    if (number) th.className = "number";
+    head.appendChild(th);
+  }
+  for (const row of rows) {
+    const tr = table.insertRow();
+    if (row.className) tr.className = row.className;
+    row.cells.forEach((cell, i) => {
+      const td = tr.insertCell();
+      if (cell instanceof Node) {
+        td.appendChild(cell);
+      } else {
+        td.textContent = cell;
+      }
+      if (headings[i][1]) td.className = "number";
+    });
+  }
+}
+
+function topTable(table, entries, title) {
+  fill(table, [[title], ["Queries", true], ["Blocked", true]],
+    entries.map((e) => ({ cells: [e.name, e.queries, e.blocked] })));
+}
+
+function graph(points) {
+  const svg = $("graph");
+  svg.replaceChildren();
+  const max = Math.max(1, ...points.map((p) => p.queries));
+  const width = 600 / points.length;
+  points.forEach((p, i) => {
+    for (const [value, className] of [[p.queries, "queries"], [p.blocked, "blocked"]]) {
+      const height = (value / max) * 150;
+      const rect = document.createElementNS("http://www.w3.org/2000/svg", "rect");
+      rect.setAttribute("x", i * width + 1);
+      rect.setAttribute("y", 160 - height);
+      rect.setAttribute("width", Math.max(1, width - 2));
+      rect.setAttribute("height", height);
+      rect.setAttribute("class", className);
+      const title = document.createElementNS("http://www.w3.org/2000/svg", "title");
+      title.textContent = new Date(p.time).toLocaleTimeString() + ": " + p.queries + " queries, " + p.blocked + " blocked";
+      rect.appendChild(title);
+      svg.appendChild(rect);
+    }
+  });
+}
+
+async function refreshTraffic() {
+  const traffic = await api("/traffic?window=" + $("window").value);
+  $("queries").textContent = traffic.queries;
+  $("blocked").textContent = traffic.blocked;
+  $("blocked-share").textContent = traffic.queries ? (100 * traffic.blocked / traffic.queries).toFixed(1) + "%" : "–";
+  $("rates").textContent = ["1m", "5m", "15m", "1h"].map((w) => traffic.rates[w].toFixed(2)).join(" / ");
+  graph(traffic.per_minute);
+  topTable($("top-clients"), traffic.top_clients, "Client");
+  topTable($("top-domains"), traffic.top_domains, "Domain");
+  topTable($("top-blocked"), traffic.top_blocked, "Domain");
+}
+
+async function refreshRecent() {
+  const name = encodeURIComponent($("filter").value.trim());
+  const entries = await api("/queries?limit=50&name=" + name);
+  fill($("recent"), [["Time"], ["Client"], ["Group"], ["Name"], ["Type"], ["Result"], ["ms", true]],
+    entries.map((e) => ({
+      className: e.blocked ? "blocked" : "",
+      cells: [
+        new Date(e.time).toLocaleTimeString(), e.client, e.group, e.qname_unicode || e.qname || "", e.qtype || "",
+        e.dropped ? "dropped: " + e.dropped : e.blocked ? "blocked" : rcodes[e.rcode] || "RCODE" + e.rcode,
+        e.duration_ms.toFixed(1),
+      ],
+    })));
+}
+
+async function refreshBlocking() {
+  const status = await api("/blocking");
+  const badge = $("blocking");
+  badge.className = "badge " + (status.enabled ? "on" : "off");
+  badge.textContent = status.enabled ? "blocking on" :
+    status.until ? "blocking off until " + new Date(status.until).toLocaleTimeString() : "blocking off";
+}
+
+function renderRules(rules) {
+  const rows = [];
+  for (const action of ["block", "allow"]) {
+    for (const rule of rules[action]) {
+      const remove = document.createElement("button");
+      remove.textContent = "Remove";
+      remove.onclick = () => run(async () => {
+        renderRules(await api("/rules?action=" + action + "&rule=" + encodeURIComponent(rule), "DELETE"));
+      });
+      rows.push({ cells: [action, rule, remove] });
+    }
+  }
+  fill($("rules"), [["Action"], ["Rule"], [""]], rows);
+}
+
+// run calls f and shows its error, if any.
+async function run(f) {
+  try {
+    await f();
+  } catch (e) {
+    show(e.message);
+  }
+}
+
+async function refresh() {
+  await run(async () => {
+    await Promise.all([refreshTraffic(), refreshRecent(), refreshBlocking()]);
+  });
+}
+
+$("block-on").onclick = () => run(async () => {
+  await api("/blocking?enabled=on", "POST");
+  show("");
+  await refreshBlocking();
+});
+$("block-off-5m").onclick = () => run(async () => {
+  await api("/blocking?enabled=off&for=5m", "POST");
+  await refreshBlocking();
+});
+$("block-off").onclick = () => run(async () => {
+  await api("/blocking?enabled=off", "POST");
+  await refreshBlocking();
+});
+$("reload").onclick = () => run(async () => {
+  await api("/reload", "POST");
+  show("Configuration reloaded.");
+});
+$("window").onchange = refresh;
+$("filter").oninput = () => run(refreshRecent);
+$("rule-form").onsubmit = (event) => {
+  event.preventDefault();
+  run(async () => {
+    const path = "/rules?action=" + $("rule-action").value + "&rule=" + encodeURIComponent($("rule").value.trim());
+    renderRules(await api(path, "POST"));
+    $("rule").value = "";
+    show("");
+  });
+};
+
+refresh();
+run(async () => renderRules(await api("/rules")));
+setInterval(refresh, 5000);
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/codecrafters-io/dns-server-starter-go/internal/slog"
+)
+
+const (
+	// minUDPSize is the UDP payload every client can take, RFC 1035 4.2.1.
+	minUDPSize = 512
+	// defaultMaxUDPSize is the default of -max-udp-size, the size the DNS
+	// flag day 2020 recommends to stay clear of IP fragmentation.
+	defaultMaxUDPSize = 1232
+	// maxTCPSize is the largest message the two byte length prefix allows.
+	maxTCPSize = 65535
+)
+
+// skipDNSName returns the offset after the name at offset in msg without
+// decoding it. A compression pointer ends the name.
+func skipDNSName(msg []byte, offset int) (int, error) {
+	for {
+		if offset >= len(msg) {
+			return 0, errShortMessage
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			return offset + 1, nil
+		case length&0xC0 == 0xC0:
+			if offset+2 > len(msg) {
+				return 0, errShortMessage
+			}
+			return offset + 2, nil
+		case length&0xC0 != 0:
+			return 0, fmt.Errorf("unsupported label type %#x", length&0xC0)
+		}
+		offset += 1 + length
+	}
+}
+
+// findOPT returns the OPT record among the additional records of a message,
+// or reports false when there is none.
+func findOPT(additional []DNSResourceRecord) (DNSResourceRecord, bool) {
+	for _, record := range additional {
+		if record.Type == TypeOPT {
+			return record, true
+		}
+	}
+	return DNSResourceRecord{}, false
+}
+
+// ednsPayloadSize returns the UDP payload size advertised by the OPT record
+// among the additional records of a message (RFC 6891), or reports false
+// when there is none.
+func ednsPayloadSize(additional []DNSResourceRecord) (int, bool) {
+	opt, ok := findOPT(additional)
+	return int(opt.Class), ok
+}
+
+// ednsVersion returns the EDNS version of an OPT record, the second byte of
+// its TTL.
+func ednsVersion(opt DNSResourceRecord) uint8 {
+	return uint8(opt.TTL >> 16)
+}
+
+// responseLimit is the size the response to a query may have: whatever the
+// length prefix allows over TCP and over UDP the payload size the client
+// advertises, at least 512 bytes and at most maxUDPSize.
+func responseLimit(additional []DNSResourceRecord, source net.Addr, maxUDPSize int) int {
+	if _, ok := source.(*net.TCPAddr); ok {
+		return maxTCPSize
+	}
+	size, ok := ednsPayloadSize(additional)
+	if !ok || size < minUDPSize {
+		return minUDPSize
+	}
+	if size > maxUDPSize {
+		return maxUDPSize
+	}
+	return size
+}
+
+// optRecordSize is the size of an OPT record without options.
+const optRecordSize = 11
+
+// appendOPT appends an OPT record advertising size as the UDP payload this
+// server can receive, with options. The bits of rcode above the four of the
+// header go into the TTL, RFC 6891 6.1.3.
+func appendOPT(dst []byte, size int, rcode Rcode, options []EDNSOption) []byte {
+	dst = append(dst, 0) // root
+	dst = binary.BigEndian.AppendUint16(dst, TypeOPT)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(size))
+	dst = append(dst, byte(rcode>>4), 0, 0, 0) // extended rcode, version 0, flags
+	dst = binary.BigEndian.AppendUint16(dst, uint16(ednsOptionsSize(options)))
+	return appendEDNSOptions(dst, options)
+}
+
+// addOPT appends an OPT record to the packed message msg and counts it, with
+// the low bits of rcode in the header.
+func addOPT(msg []byte, size int, rcode Rcode, options ...EDNSOption) []byte {
+	header, err := parseDNSHeader(msg)
+	if err != nil {
+		return msg
+	}
+	binary.BigEndian.PutUint16(msg[2:], header.Flags&^rcodeMask|uint16(rcode)&rcodeMask)
+	binary.BigEndian.PutUint16(msg[10:], header.ARCount+1)
+	return appendOPT(msg, size, rcode, options)
+}
+
+// truncateResponse cuts msg down to its header and question section and sets
+// TC, telling the client to ask again over TCP. The records are dropped as a
+// whole rather than leaving an incomplete set the client might cache.
+func truncateResponse(msg []byte) []byte {
+	header, err := parseDNSHeader(msg)
+	if err != nil {
+		return msg
+	}
+	offset := 12
+	for i := 0; i < int(header.QDCount); i++ {
+		if offset, err = skipDNSName(msg, offset); err != nil || offset+4 > len(msg) {
+			// unreachable for a response packed by the server
+			offset, header.QDCount = 12, 0
+			break
+		}
+		offset += 4
+	}
+	msg = msg[:offset]
+	binary.BigEndian.PutUint16(msg[2:], header.Flags|flagTC)
+	binary.BigEndian.PutUint16(msg[4:], header.QDCount)
+	for i := 6; i < 12; i++ {
+		msg[i] = 0
+	}
+	return msg
+}
+
+// answerTruncated answers a UDP query that was larger than -max-udp-size and
+// got cut off with an empty response with TC set, so the client asks again
+// over TCP where it fits. Responses and queries cut off within the header
+// are dropped.
+func (s *server) answerTruncated(msg []byte, source net.Addr, reply func([]byte) error) {
+	header, err := parseDNSHeader(msg)
+	if err != nil || header.Flags&flagQR != 0 {
+		reason := rejectShort
+		if err == nil {
+			reason = rejectResponse
+		}
+		s.stats.reject(reason)
+		s.stats.record("", "", -1)
+		return
+	}
+	slog.Debug("query too large for UDP, asking for TCP", "client", source.String(), "size", len(msg))
+	response := make([]byte, 12)
+	binary.BigEndian.PutUint16(response, header.ID)
+	binary.BigEndian.PutUint16(response[2:], responseFlags(header.Flags, RcodeSuccess)|flagTC)
+	if err := reply(response); err != nil {
+		slog.Error("failed to send response", "client", source.String(), "err", err)
+	}
+	s.stats.record("", "", int(RcodeSuccess))
+}
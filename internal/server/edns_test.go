@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// ednsServer returns a server answering n.test with count A records, 22
+// bytes each in a response, with -max-udp-size 1232.
+func ednsServer(t *testing.T, count int) *server {
+	t.Helper()
+	srv := newTestServer(t, "-max-udp-size", "1232")
+	zone := srv.Zone("test")
+	for i := 0; i < count; i++ {
+		if err := zone.AddA("n", net.IPv4(10, 0, byte(i>>8), byte(i)), 60); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return srv
+}
+
+func TestResponseLimit(t *testing.T) {
+	udp, tcp := &net.UDPAddr{}, &net.TCPAddr{}
+	opt := func(size int) []DNSResourceRecord {
+		return []DNSResourceRecord{{Type: TypeOPT, Class: uint16(size)}}
+	}
+	tests := []struct {
+		name       string
+		additional []DNSResourceRecord
+		source     net.Addr
+		want       int
+	}{
+		{"no OPT", nil, udp, 512},
+		{"below 512", opt(100), udp, 512},
+		{"zero", opt(0), udp, 512},
+		{"512", opt(512), udp, 512},
+		{"between", opt(1000), udp, 1000},
+		{"at the maximum", opt(1232), udp, 1232},
+		{"above the maximum", opt(4096), udp, 1232},
+		{"TCP without OPT", nil, tcp, 65535},
+		{"TCP with OPT", opt(1000), tcp, 65535},
+	}
+	for _, tt := range tests {
+		if got := responseLimit(tt.additional, tt.source, 1232); got != tt.want {
+			t.Errorf("%s: limit %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEDNSResponseSize(t *testing.T) {
+	// the response to n.test is 24 bytes plus 22 per record, plus an OPT of
+	// 11 bytes for clients with EDNS
+	tests := []struct {
+		name      string
+		records   int
+		advertise int // 0 for no OPT
+		truncated bool
+	}{
+		{"no OPT, fits 512", 22, 0, false},
+		{"no OPT, over 512", 23, 0, true},
+		{"below 512, fits 512", 21, 100, false},
+		{"below 512, over 512", 22, 100, true},
+		{"1000 fits", 43, 1000, false},
+		{"1000 over", 44, 1000, true},
+		{"above the maximum, fits 1232", 54, 4096, false},
+		{"above the maximum, over 1232", 55, 4096, true},
+		{"far over", 500, 4096, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := ednsServer(t, tt.records)
+			var query Msg
+			query.SetQuestion("n.test", TypeA)
+			data := query.Pack()
+			if tt.advertise > 0 {
+				data = addOPT(data, tt.advertise, RcodeSuccess)
+			}
+			replies := srv.handleTest(data)
+			if len(replies) != 1 {
+				t.Fatalf("%d replies, want 1", len(replies))
+			}
+			limit := responseLimit(nil, testClient, 1232)
+			if tt.advertise > 0 {
+				limit = responseLimit([]DNSResourceRecord{{Type: TypeOPT, Class: uint16(tt.advertise)}}, testClient, 1232)
+			}
+			if len(replies[0]) > limit {
+				t.Errorf("response of %d bytes, over the limit of %d", len(replies[0]), limit)
+			}
+			r, _, err := parseDNSResponse(nil, replies[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tc := r.Header.Flags&flagTC != 0
+			if tc != tt.truncated {
+				t.Errorf("TC %v, want %v", tc, tt.truncated)
+			}
+			wantAnswers := tt.records
+			if tt.truncated {
+				wantAnswers = 0
+			}
+			if len(r.Answers) != wantAnswers || len(r.Authority) != 0 {
+				t.Errorf("%d answers and %d authority records, want %d and none", len(r.Answers), len(r.Authority), wantAnswers)
+			}
+			if len(r.Question) != 1 {
+				t.Errorf("%d questions, want the question kept", len(r.Question))
+			}
+
+			// the OPT survives the truncation, and advertises the size the
+			// server takes rather than echoing the client's
+			opt, ok := findOPT(r.Additional)
+			switch {
+			case tt.advertise == 0 && (ok || len(r.Additional) != 0):
+				t.Errorf("additional %v to a client without EDNS", r.Additional)
+			case tt.advertise > 0 && !ok:
+				t.Error("no OPT in the response")
+			case tt.advertise > 0 && (len(r.Additional) != 1 || opt.Class != 1232 || ednsVersion(opt) != 0):
+				t.Errorf("additional %v, want only an OPT advertising 1232 bytes", r.Additional)
+			}
+		})
+	}
+}
+
+func TestEDNSOverTCPIsNotTruncated(t *testing.T) {
+	srv := ednsServer(t, 500)
+	var query Msg
+	query.SetQuestion("n.test", TypeA)
+	data := addOPT(query.Pack(), 512, RcodeSuccess)
+	var replies [][]byte
+	srv.handle(context.Background(), data, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 53), Port: 53000}, listenEndpoint{}, func(response []byte) error {
+		replies = append(replies, append([]byte(nil), response...))
+		return nil
+	})
+	if len(replies) != 1 {
+		t.Fatalf("%d replies, want 1", len(replies))
+	}
+	r, _, err := parseDNSResponse(nil, replies[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Header.Flags&flagTC != 0 || len(r.Answers) != 500 {
+		t.Errorf("TC %v with %d answers over TCP, want all 500", r.Header.Flags&flagTC != 0, len(r.Answers))
+	}
+	if _, ok := findOPT(r.Additional); !ok {
+		t.Error("no OPT in the response")
+	}
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// EDNSOption is an option in the data of an OPT record, RFC 6891 6.1.2.
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// ParseEDNSOptions splits the data of an OPT record into its options, whose
+// data points into the record's.
+func ParseEDNSOptions(opt DNSResourceRecord) ([]EDNSOption, error) {
+	var options []EDNSOption
+	for data := opt.RData; len(data) > 0; {
+		if len(data) < 4 {
+			return nil, errors.New("truncated EDNS option")
+		}
+		code, length := binary.BigEndian.Uint16(data), int(binary.BigEndian.Uint16(data[2:]))
+		if len(data) < 4+length {
+			return nil, fmt.Errorf("EDNS option %d longer than the OPT record", code)
+		}
+		options = append(options, EDNSOption{Code: code, Data: data[4 : 4+length : 4+length]})
+		data = data[4+length:]
+	}
+	return options, nil
+}
+
+// appendEDNSOptions appends options in the wire format of OPT record data.
+func appendEDNSOptions(dst []byte, options []EDNSOption) []byte {
+	for _, option := range options {
+		dst = binary.BigEndian.AppendUint16(dst, option.Code)
+		dst = binary.BigEndian.AppendUint16(dst, uint16(len(option.Data)))
+		dst = append(dst, option.Data...)
+	}
+	return dst
+}
+
+// ednsOptionsSize returns the size of options in OPT record data.
+func ednsOptionsSize(options []EDNSOption) int {
+	size := 0
+	for _, option := range options {
+		size += 4 + len(option.Data)
+	}
+	return size
+}
+
+// An EDNSOptionHandler implements an EDNS option the OPT codec doesn't know,
+// such as a client identifier or telemetry private to a network.
+type EDNSOptionHandler interface {
+	// ParseOption decodes the data of the option in a query, before the
+	// query goes through the pipeline; handlers and middleware get the value
+	// from EDNSOptionValue. data is only valid until ParseOption returns.
+	// An error answers the query with FORMERR.
+	ParseOption(data []byte) (any, error)
+	// ResponseOption returns the data of the option for the OPT record of
+	// the response to a query with EDNS, given the value ParseOption
+	// returned, nil when the query didn't carry the option. It reports false
+	// to add none.
+	ResponseOption(w ResponseWriter, value any) ([]byte, bool)
+}
+
+// ednsOptionRegistry is the registered handlers, replaced as a whole on
+// registration so queries read it without locking.
+type ednsOptionRegistry struct {
+	handlers map[uint16]EDNSOptionHandler
+	codes    []uint16 // sorted, the order options are added to responses in
+}
+
+var (
+	ednsOptionsMu sync.Mutex // serializes registrations
+	ednsOptions   atomic.Pointer[ednsOptionRegistry]
+)
+
+// RegisterEDNSOption makes h handle the EDNS option code in queries and
+// responses, the way RegisterPlugin adds a plugin: from an init function of
+// a file dropped next to app/main.go.
+//
+//	func init() {
+//		// echo a client identifier back to the clients that send one
+//		dns.RegisterEDNSOption(65001, dns.EDNSOptionFuncs{
+//			Parse: func(data []byte) (any, error) { return string(data), nil },
+//			Respond: func(w dns.ResponseWriter, value any) ([]byte, bool) {
+//				id, ok := value.(string)
+//				return []byte(id), ok
+//			},
+//		})
+//	}
+//
+// It panics if code is registered already.
+func RegisterEDNSOption(code uint16, h EDNSOptionHandler) {
+	ednsOptionsMu.Lock()
+	defer ednsOptionsMu.Unlock()
+	registry := &ednsOptionRegistry{handlers: map[uint16]EDNSOptionHandler{code: h}}
+	if previous := ednsOptions.Load(); previous != nil {
+		if _, ok := previous.handlers[code]; ok {
+			panic(fmt.Sprintf("EDNS option %d registered twice", code))
+		}
+		for c, handler := range previous.handlers {
+			registry.handlers[c] = handler
+		}
+	}
+	for c := range registry.handlers {
+		registry.codes = append(registry.codes, c)
+	}
+	sort.Slice(registry.codes, func(i, j int) bool { return registry.codes[i] < registry.codes[j] })
+	ednsOptions.Store(registry)
+}
+
+// EDNSOptionFuncs adapts a pair of functions to an EDNSOptionHandler. A nil
+// Parse keeps a copy of the data as the value, a nil Respond adds nothing to
+// responses.
+type EDNSOptionFuncs struct {
+	Parse   func(data []byte) (any, error)
+	Respond func(w ResponseWriter, value any) ([]byte, bool)
+}
+
+func (f EDNSOptionFuncs) ParseOption(data []byte) (any, error) {
+	if f.Parse == nil {
+		return append([]byte(nil), data...), nil
+	}
+	return f.Parse(data)
+}
+
+func (f EDNSOptionFuncs) ResponseOption(w ResponseWriter, value any) ([]byte, bool) {
+	if f.Respond == nil {
+		return nil, false
+	}
+	return f.Respond(w, value)
+}
+
+// EDNSOptionValue returns the value the handler registered for code parsed
+// from the option in the query answered through w, or reports false when
+// the query had none.
+func EDNSOptionValue(w ResponseWriter, code uint16) (any, bool) {
+	value, ok := queryOf(w).ednsValues[code]
+	return value, ok
+}
+
+// SetEDNSOption sets the option code of the OPT record of the response to
+// the query answered through w, in place of what the handler registered for
+// code would add; nil data leaves the option out. Responses to queries
+// without EDNS carry no OPT record and so no options.
+func SetEDNSOption(w ResponseWriter, code uint16, data []byte) {
+	q := queryOf(w)
+	if q.ednsSet == nil {
+		q.ednsSet = make(map[uint16][]byte)
+	}
+	q.ednsSet[code] = data
+}
+
+// parseEDNSOptions hands the options of the OPT record of the query to their
+// handlers.
+func (q *query) parseEDNSOptions(opt DNSResourceRecord) error {
+	registry := ednsOptions.Load()
+	if registry == nil {
+		return nil
+	}
+	options, err := ParseEDNSOptions(opt)
+	if err != nil {
+		return err
+	}
+	for _, option := range options {
+		h, ok := registry.handlers[option.Code]
+		if !ok {
+			continue // unknown options are ignored, RFC 6891 6.1.2
+		}
+		value, err := h.ParseOption(option.Data)
+		if err != nil {
+			return fmt.Errorf("EDNS option %d: %w", option.Code, err)
+		}
+		if q.ednsValues == nil {
+			q.ednsValues = make(map[uint16]any)
+		}
+		q.ednsValues[option.Code] = value
+	}
+	return nil
+}
+
+// responseOptions returns the options of the OPT record of the response:
+// those the handlers add, then those set with SetEDNSOption, each by code.
+func (q *query) responseOptions() []EDNSOption {
+	registry := ednsOptions.Load()
+	if registry == nil && q.ednsSet == nil {
+		return nil
+	}
+	var options []EDNSOption
+	if registry != nil {
+		for _, code := range registry.codes {
+			if _, ok := q.ednsSet[code]; ok {
+				continue
+			}
+			if data, ok := registry.handlers[code].ResponseOption(q, q.ednsValues[code]); ok {
+				options = append(options, EDNSOption{Code: code, Data: data})
+			}
+		}
+	}
+	set := make([]uint16, 0, len(q.ednsSet))
+	for code, data := range q.ednsSet {
+		if data != nil {
+			set = append(set, code)
+		}
+	}
+	sort.Slice(set, func(i, j int) bool { return set[i] < set[j] })
+	for _, code := range set {
+		options = append(options, EDNSOption{Code: code, Data: q.ednsSet[code]})
+	}
+	return options
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// withEDNSOptions runs the test with the registry as it is, restoring it
+// afterwards so the options registered by one test don't leak into others.
+func withEDNSOptions(t *testing.T) {
+	t.Helper()
+	saved := ednsOptions.Load()
+	t.Cleanup(func() { ednsOptions.Store(saved) })
+}
+
+// optionServer returns a server answering option.test with a TXT record
+// holding the value of option code 65001 in the query, as EDNSOptionValue
+// gives it.
+func optionServer(t *testing.T) *server {
+	t.Helper()
+	srv := newTestServer(t)
+	srv.mux.HandleFunc("option.test", func(w ResponseWriter, r *Msg) {
+		value, ok := EDNSOptionValue(w, 65001)
+		txt, _ := NewRecord("option.test", 0, &TXTResource{Text: []string{fmt.Sprintf("%v %v", value, ok)}})
+		var m Msg
+		m.SetReply(r).AddAnswer(txt)
+		if value == "override" {
+			SetEDNSOption(w, 65001, []byte("set"))
+			SetEDNSOption(w, 65003, []byte("extra"))
+		}
+		w.WriteMsg(&m)
+	})
+	return srv
+}
+
+// optionQuery asks srv about option.test with options in the OPT record, or
+// without EDNS for nil options, and returns the response.
+func optionQuery(t *testing.T, srv *server, options []EDNSOption) *Msg {
+	t.Helper()
+	var query Msg
+	query.SetQuestion("option.test", TypeTXT)
+	data := query.Pack()
+	if options != nil {
+		data = addOPT(data, 1232, RcodeSuccess, options...)
+	}
+	replies := srv.handleTest(data)
+	if len(replies) != 1 {
+		t.Fatalf("%d replies, want 1", len(replies))
+	}
+	r, _, err := parseDNSResponse(nil, replies[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &r
+}
+
+// responseOptions returns the options of the OPT record of r as "code=data"
+// strings.
+func responseOptions(t *testing.T, r *Msg) []string {
+	t.Helper()
+	opt, ok := findOPT(r.Additional)
+	if !ok {
+		return nil
+	}
+	options, err := ParseEDNSOptions(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s []string
+	for _, option := range options {
+		s = append(s, fmt.Sprintf("%d=%s", option.Code, option.Data))
+	}
+	return s
+}
+
+func registerEchoOption(code uint16) {
+	RegisterEDNSOption(code, EDNSOptionFuncs{
+		Parse: func(data []byte) (any, error) {
+			if string(data) == "bad" {
+				return nil, errors.New("bad value")
+			}
+			return string(data), nil
+		},
+		Respond: func(w ResponseWriter, value any) ([]byte, bool) {
+			s, ok := value.(string)
+			return []byte(s), ok
+		},
+	})
+}
+
+func TestEDNSOptionRegistry(t *testing.T) {
+	withEDNSOptions(t)
+	registerEchoOption(65001)
+	// a handler with neither function keeps the data and adds nothing
+	RegisterEDNSOption(65000, EDNSOptionFuncs{})
+	srv := optionServer(t)
+
+	tests := []struct {
+		name    string
+		options []EDNSOption
+		value   string
+		want    []string
+	}{
+		{"registered option", []EDNSOption{{65001, []byte("abc")}}, "abc true", []string{"65001=abc"}},
+		{"unknown option", []EDNSOption{{65002, []byte("x")}}, "<nil> false", nil},
+		{"unknown with registered", []EDNSOption{{65002, []byte("x")}, {65001, []byte("abc")}}, "abc true", []string{"65001=abc"}},
+		{"no options", []EDNSOption{}, "<nil> false", nil},
+		{"without funcs", []EDNSOption{{65000, []byte("kept")}}, "<nil> false", nil},
+		{"set by the handler", []EDNSOption{{65001, []byte("override")}}, "override true", []string{"65001=set", "65003=extra"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := optionQuery(t, srv, tt.options)
+			if r.Header.Rcode() != RcodeSuccess || len(r.Answers) != 1 {
+				t.Fatalf("rcode %v with %d answers", r.Header.Rcode(), len(r.Answers))
+			}
+			if got := r.Answers[0].String(); got != fmt.Sprintf("option.test.\t0\tIN\tTXT\t%q", tt.value) {
+				t.Errorf("handler saw %s, want %q", got, tt.value)
+			}
+			if got := responseOptions(t, r); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("response options %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// without EDNS there is no OPT to carry options
+	r := optionQuery(t, srv, nil)
+	if len(r.Additional) != 0 {
+		t.Errorf("additional %v to a query without EDNS", r.Additional)
+	}
+}
+
+func TestEDNSOptionRejected(t *testing.T) {
+	withEDNSOptions(t)
+	registerEchoOption(65001)
+	srv := optionServer(t)
+
+	tests := []struct {
+		name string
+		opt  []byte
+	}{
+		{"parse error", appendEDNSOptions(nil, []EDNSOption{{65001, []byte("bad")}})},
+		{"truncated option", []byte{0xfd, 0xe9, 0, 10, 'a'}},
+		{"truncated code", []byte{0xfd}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var query Msg
+			query.SetQuestion("option.test", TypeTXT)
+			query.AddAdditional(DNSResourceRecord{Name: []byte{0}, Type: TypeOPT, Class: 1232, RData: tt.opt})
+			r := srv.exchangeTest(t, &query)
+			if r.Header.Rcode() != RcodeFormErr {
+				t.Errorf("rcode %v, want FORMERR", r.Header.Rcode())
+			}
+		})
+	}
+}
+
+func TestRegisterEDNSOptionTwicePanics(t *testing.T) {
+	withEDNSOptions(t)
+	registerEchoOption(65001)
+	defer func() {
+		if recovered := recover(); recovered != "EDNS option 65001 registered twice" {
+			t.Errorf("recovered %v, want the duplicate registration refused", recovered)
+		}
+		// the first registration stays
+		if _, ok := ednsOptions.Load().handlers[65001].(EDNSOptionFuncs); !ok {
+			t.Error("registry lost the first handler")
+		}
+	}()
+	RegisterEDNSOption(65001, EDNSOptionFuncs{})
+}
+
+func TestEDNSOptionsSortedByCode(t *testing.T) {
+	withEDNSOptions(t)
+	for _, code := range []uint16{65010, 65005, 65020} {
+		RegisterEDNSOption(code, EDNSOptionFuncs{})
+	}
+	codes := ednsOptions.Load().codes
+	for i := 1; i < len(codes); i++ {
+		if codes[i-1] >= codes[i] {
+			t.Fatalf("codes %v, want them sorted", codes)
+		}
+	}
+}
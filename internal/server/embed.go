@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net"
+	"sync"
+)
+
+// ErrServerClosed is returned by ListenAndServe and Start once Shutdown was
+// called.
+var ErrServerClosed = errors.New("server closed")
+
+// Server is a DNS server a Go program starts and stops itself, such as an
+// integration test spinning one up on an ephemeral port; ExampleServer of the
+// dns package shows one.
+//
+// It takes the command line options of the binary, the config file
+// included, and answers queries the way it does, but with a mux of its own
+// rather than DefaultServeMux. The log level and format, the admin endpoints,
+// the PID file, daemon and privilege options are left to the program, and so
+// are DNS_SERVER_LISTEN and the memory limit of the Go runtime: the program's
+// environment and garbage collector aren't the server's to take over.
+type Server struct {
+	srv *server
+
+	mu          sync.Mutex
+	started     bool
+	closed      bool
+	packetConns []net.PacketConn
+	listeners   []net.Listener
+}
+
+// NewServer returns a server configured by args, command line options such
+// as "-listen", "127.0.0.1:0". It doesn't listen until Start or
+// ListenAndServe.
+func NewServer(args ...string) (*Server, error) {
+	srv, err := newBareServer(args...)
+	if err != nil {
+		return nil, err
+	}
+	srv.mux = NewServeMux()
+	srv.udpBatch = srv.reload.current.Load().opts.udpBatch
+	return &Server{srv: srv}, nil
+}
+
+// Mux returns the mux the server consults for zones answered by handlers.
+func (s *Server) Mux() *ServeMux { return s.srv.mux }
+
+// Zone returns the zone of name answered by the server, see ServeMux.Zone.
+func (s *Server) Zone(name string) *Zone { return s.srv.Zone(name) }
+
+// Start binds the -listen addresses and serves them in the background. Once
+// it returns, Addr reports where the server listens.
+func (s *Server) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrServerClosed
+	}
+	if s.started {
+		return errors.New("server already started")
+	}
+	p := s.srv.reload.current.Load()
+	packetConns, listeners, endpoints, err := bindListenEndpoints(p.opts.listen, p.opts.udpSockets)
+	if err != nil {
+		return err
+	}
+	s.srv.listenerEndpoints = endpoints
+	s.started = true
+	s.packetConns, s.listeners = packetConns, listeners
+	p.start(nil)
+	s.srv.serve(packetConns, listeners)
+	return nil
+}
+
+// ListenAndServe starts the server and blocks until Shutdown is called, then
+// returns ErrServerClosed.
+func (s *Server) ListenAndServe() error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+	s.srv.serving.Wait()
+	return ErrServerClosed
+}
+
+// Addr returns the address of the first socket the server listens on, UDP
+// before TCP, with the port actually bound when -listen asked for port 0.
+// TCP endpoints on port 0 share the port of UDP ones on the same host. It
+// returns nil before Start.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.packetConns) > 0 {
+		return s.packetConns[0].LocalAddr()
+	}
+	if len(s.listeners) > 0 {
+		return s.listeners[0].Addr()
+	}
+	return nil
+}
+
+// Shutdown stops reading queries, waits for the ones in flight to be
+// answered and closes the sockets. When ctx is done first the sockets are
+// closed anyway and its error returned. A shut down server can't be started
+// again.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	started := s.started
+	s.mu.Unlock()
+	if !started {
+		return nil
+	}
+
+	s.srv.shutdown()
+	drained := make(chan struct{})
+	go func() {
+		s.srv.serving.Wait()
+		s.srv.inflight.Wait()
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	for _, conn := range s.packetConns {
+		conn.Close()
+	}
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	s.srv.reload.current.Load().stop(nil)
+	return err
+}
+
+// newBareServer builds a server from args with what handle needs and nothing
+// else: no listeners, admin API or background work.
+func newBareServer(args ...string) (*server, error) {
+	opts, err := parseOptions(args, flag.ContinueOnError, nil)
+	if err != nil {
+		return nil, err
+	}
+	p, err := newPolicy(opts, nil)
+	if err != nil {
+		return nil, err
+	}
+	health := &HealthChecker{Upstreams: p.upstreams}
+	reload := &reloader{args: args, embedded: true, health: health}
+	reload.current.Store(p)
+	analytics, traffic := NewAnalytics(), NewTraffic()
+	p.budget.limitTracking(analytics, traffic)
+	return &server{
+		reload:    reload,
+		audit:     NewAuditLog(opts.auditSize, nil),
+		health:    health,
+		stats:     NewStats(),
+		analytics: analytics,
+		traffic:   traffic,
+		blocking:  &blockingSwitch{},
+		debug:     &debugClients{},
+		mux:       DefaultServeMux,
+	}, nil
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"math"
+	"runtime/debug"
+	"testing"
+)
+
+func TestServerIgnoresListenEnvironment(t *testing.T) {
+	t.Setenv("DNS_SERVER_LISTEN", "not an address")
+	if _, err := NewServer("-listen", "127.0.0.1:0"); err != nil {
+		t.Fatalf("NewServer read DNS_SERVER_LISTEN: %v", err)
+	}
+}
+
+func TestServerLeavesMemoryLimit(t *testing.T) {
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		t.Skipf("memory limit already set to %d", limit)
+	}
+	srv := newTestServer(t, "-listen", "127.0.0.1:0", "-memory-budget", "64")
+	startTestServer(t, srv)
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		debug.SetMemoryLimit(math.MaxInt64)
+		t.Errorf("embedded server set the memory limit to %d", limit)
+	}
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"time"
+)
+
+const (
+	// maxRegexInsts caps the size of a compiled regex rule. Go regexps run in
+	// linear time, so bounding the program also bounds the cost of one match.
+	maxRegexInsts = 2000
+	// regexBudget caps the regex work done for a single query, measured in
+	// program instructions times name length, so a large pattern list can't
+	// turn every query into a CPU hog.
+	regexBudget = 1 << 22
+)
+
+// FilterAction is what a filter rule does to a matching name.
+type FilterAction int
+
+const (
+	FilterBlock FilterAction = iota
+	FilterAllow
+)
+
+func (a FilterAction) String() string {
+	if a == FilterAllow {
+		return "allow"
+	}
+	return "block"
+}
+
+// FilterRule blocks or allows a domain and everything below it, or the names
+// matching a regular expression, optionally only while its schedule is active.
+type FilterRule struct {
+	Action   FilterAction
+	Domain   string
+	Regexp   *regexp.Regexp
+	Schedule *Schedule
+	Source   string // the rule as it was written, for logs
+	List     string // URL of the blocklist the rule came from
+
+	cost int // compiled program size of Regexp
+}
+
+func (r *FilterRule) match(name string) bool {
+	if r.Regexp != nil {
+		return r.Regexp.MatchString(name)
+	}
+	return inZone(name, r.Domain)
+}
+
+// Filter decides which names are blocked. An active allow rule overrides any
+// block rule and the blocklists, so exceptions can be carved out of broad
+// block rules.
+type Filter struct {
+	Rules []*FilterRule
+	Lists *Blocklists
+}
+
+// Check reports whether name is blocked at the given time and the rule that
+// decided it. It returns nil when no rule matches. Regexp rules beyond the
+// per-query regexBudget are skipped, which checkRegexBudget keeps from
+// happening to the rules of the configuration.
+func (f *Filter) Check(name string, now time.Time) (bool, *FilterRule) {
+	if f == nil {
+		return false, nil
+	}
+	name = canonicalName(name)
+	var blockedBy *FilterRule
+	budget := regexBudget
+	for _, rule := range f.Rules {
+		if rule.Regexp != nil {
+			budget -= rule.cost * (len(name) + 1)
+			if budget < 0 {
+				continue
+			}
+		}
+		if !rule.Schedule.Active(now) || !rule.match(name) {
+			continue
+		}
+		if rule.Action == FilterAllow {
+			return false, rule
+		}
+		if blockedBy == nil {
+			blockedBy = rule
+		}
+	}
+	if blockedBy == nil {
+		if domain, source := f.Lists.Lookup(name); source != nil {
+			blockedBy = &FilterRule{Action: FilterBlock, Domain: domain, Source: domain, List: source.URL}
+		}
+	}
+	return blockedBy != nil, blockedBy
+}
+
+// parseFilterRule parses "domain" or "/regexp/", optionally followed by
+// "@schedule", e.g. "facebook.com@sun-thu 21:00-07:00" or "/^ads?[0-9]*\./".
+func parseFilterRule(action FilterAction, s string) (*FilterRule, error) {
+	rule := &FilterRule{Action: action, Source: s}
+	domain, when, scheduled := strings.Cut(s, "@")
+	if strings.HasPrefix(s, "/") {
+		end := strings.LastIndex(s, "/")
+		if end == 0 {
+			return nil, fmt.Errorf("filter rule %q has an unterminated regexp", s)
+		}
+		re, cost, err := compileFilterRegexp(s[1:end])
+		if err != nil {
+			return nil, fmt.Errorf("filter rule %q: %w", s, err)
+		}
+		rule.Regexp, rule.cost = re, cost
+		var trailing string
+		trailing, when, scheduled = strings.Cut(s[end+1:], "@")
+		if trailing != "" {
+			return nil, fmt.Errorf("filter rule %q has trailing text after the regexp", s)
+		}
+	} else {
+		rule.Domain = canonicalName(strings.TrimSpace(domain))
+		if rule.Domain == "" {
+			return nil, fmt.Errorf("filter rule %q has no domain", s)
+		}
+	}
+	if scheduled {
+		schedule, err := parseSchedule(when)
+		if err != nil {
+			return nil, err
+		}
+		rule.Schedule = schedule
+	}
+	return rule, nil
+}
+
+// checkRegexBudget returns an error when Check couldn't try all the regexp
+// rules of rules on a name of the longest length within regexBudget.
+func checkRegexBudget(rules []*FilterRule) error {
+	cost, count := 0, 0
+	for _, rule := range rules {
+		if rule.Regexp != nil {
+			cost += rule.cost * (maxNameLength + 1)
+			count++
+		}
+	}
+	if cost > regexBudget {
+		return fmt.Errorf("%d regexp rules cost %d per query on the longest names, over the budget of %d; simplify or drop some", count, cost, regexBudget)
+	}
+	return nil
+}
+
+// compileFilterRegexp compiles a case-insensitive pattern and rejects the ones
+// whose program exceeds maxRegexInsts.
+func compileFilterRegexp(pattern string) (*regexp.Regexp, int, error) {
+	parsed, err := syntax.Parse("(?i)"+pattern, syntax.Perl)
+	if err != nil {
+		return nil, 0, err
+	}
+	prog, err := syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(prog.Inst) > maxRegexInsts {
+		return nil, 0, fmt.Errorf("regexp is too complex (%d instructions, limit %d)", len(prog.Inst), maxRegexInsts)
+	}
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return nil, 0, err
+	}
+	return re, len(prog.Inst), nil
+}
+
+// filterRuleFlag collects repeated -block-domain/-allow-domain flags.
+type filterRuleFlag struct {
+	filter *Filter
+	action FilterAction
+}
+
+func (f *filterRuleFlag) String() string { return "" }
+
+func (f *filterRuleFlag) Set(value string) error {
+	rule, err := parseFilterRule(f.action, value)
+	if err != nil {
+		return err
+	}
+	f.filter.Rules = append(f.filter.Rules, rule)
+	return nil
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// budgetRules returns count regexp rules blocking names of one to four labels
+// of 40 letters.
+func budgetRules(t *testing.T, count int) []string {
+	t.Helper()
+	rules := make([]string, count)
+	for i := range rules {
+		rules[i] = fmt.Sprintf("/^([a-z]{40}\\.){%d}example%d\\.com$/", i%4+1, i)
+	}
+	return rules
+}
+
+// ruleCost is the cost of the rules of budgetRules on the longest names.
+func ruleCost(t *testing.T, rules []string) int {
+	t.Helper()
+	cost := 0
+	for _, source := range rules {
+		rule, err := parseFilterRule(FilterBlock, source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cost += rule.cost * (maxNameLength + 1)
+	}
+	return cost
+}
+
+func TestFilterRegexBudget(t *testing.T) {
+	// the largest rule set within the budget
+	all := budgetRules(t, 1000)
+	n := 0
+	for cost := 0; ; n++ {
+		if cost += ruleCost(t, all[n:n+1]); cost > regexBudget {
+			break
+		}
+	}
+	rules := all[:n]
+	args := func(rules []string) []string {
+		var args []string
+		for _, rule := range rules {
+			args = append(args, "-block-domain", rule)
+		}
+		return args
+	}
+	if _, err := NewServer(args(rules)...); err != nil {
+		t.Fatalf("%d rules within the budget rejected: %v", len(rules), err)
+	}
+
+	over := all[:n+1]
+	_, err := NewServer(args(over)...)
+	want := fmt.Sprintf("invalid -block-domain or -allow-domain: %d regexp rules cost %d per query on the longest names, over the budget of %d", len(over), ruleCost(t, over), regexBudget)
+	if err == nil || !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("error %v, want %q", err, want)
+	}
+
+	group := "name=kids clients=192.0.2.0/24 block=" + strings.Join(over, " block=")
+	if _, err := NewServer("-group", group); err == nil || !strings.Contains(err.Error(), "invalid -group kids: ") {
+		t.Errorf("group over the budget: error %v", err)
+	}
+
+	admin, err := LoadAdminRules("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range rules {
+		if err := admin.Add("block", rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := admin.Add("block", over[n]); err == nil || !strings.Contains(err.Error(), "over the budget") {
+		t.Errorf("admin rule over the budget: error %v", err)
+	}
+	if err := admin.Add("block", "plain.example.com"); err != nil {
+		t.Errorf("domain rule refused with the regexp budget spent: %v", err)
+	}
+}
+
+func TestFilterCheckSkipsRulesBeyondBudget(t *testing.T) {
+	// rules of the admin API could be built past the budget before it was
+	// checked, Check still holds each query to it
+	var filter Filter
+	for _, source := range budgetRules(t, 400) {
+		rule, err := parseFilterRule(FilterBlock, source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filter.Rules = append(filter.Rules, rule)
+	}
+	last, err := parseFilterRule(FilterBlock, "/^late\\./")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter.Rules = append(filter.Rules, last)
+
+	if blocked, rule := filter.Check("late.example.com", time.Now()); !blocked || rule != last {
+		t.Errorf("short name: blocked %v by %v, want the last rule within the budget", blocked, rule)
+	}
+	long := "late." + strings.Repeat("a", 60) + "." + strings.Repeat("b", 60) + "." + strings.Repeat("c", 60) + ".example.com"
+	if blocked, rule := filter.Check(long, time.Now()); blocked {
+		t.Errorf("long name blocked by %v beyond the budget", rule)
+	}
+}
+
+func TestParseFilterRuleErrors(t *testing.T) {
+	tests := []struct {
+		rule string
+		err  string
+	}{
+		{"/ads", "unterminated regexp"},
+		{"/ads/x", "trailing text after the regexp"},
+		{"/(ads/", "missing closing )"},
+		{"/" + strings.Repeat("[a-z]{500}", 5) + "/", "regexp is too complex"},
+		{"@mon", "has no domain"},
+		{"ads.example.com@someday", `invalid day "someday"`},
+	}
+	for _, tt := range tests {
+		_, err := parseFilterRule(FilterBlock, tt.rule)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: error %v, want %q", tt.rule, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// addGoldenSeeds seeds f with the messages of the golden corpus: queries of
+// dig and the Windows resolver, upstream responses with compressed names, a
+// pointer loop and the malformed ones. Inputs go fuzz finds that fail are
+// kept in testdata/fuzz and replayed by go test.
+func addGoldenSeeds(f *testing.F) {
+	files, err := filepath.Glob(filepath.Join("testdata", "golden", "*.txt"))
+	if err != nil || len(files) == 0 {
+		f.Fatal("no golden corpus to seed from")
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		_, msg, _, err := parseGoldenFile(data)
+		if err != nil {
+			f.Fatalf("%s: %v", file, err)
+		}
+		f.Add(msg)
+	}
+}
+
+// FuzzParseDNSResponse checks that a message that parses has sections as
+// long as the counts of its header, and packs into bytes that parse to the
+// same message; names are packed uncompressed, so the bytes may differ.
+func FuzzParseDNSResponse(f *testing.F) {
+	addGoldenSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		response, _, err := parseDNSResponse(nil, data)
+		if err != nil {
+			return
+		}
+		header := response.Header
+		if len(response.Question) != int(header.QDCount) || len(response.Answers) != int(header.ANCount) ||
+			len(response.Authority) != int(header.NSCount) || len(response.Additional) != int(header.ARCount) {
+			t.Fatal("section lengths differ from the header counts")
+		}
+		packed := appendDNSResponse(nil, response)
+		again, _, err := parseDNSResponse(nil, packed)
+		if err != nil {
+			t.Fatalf("packed as %x, which doesn't parse: %v", packed, err)
+		}
+		if !reflect.DeepEqual(messageSections(again), messageSections(response)) {
+			t.Fatalf("packed as %x, which parses differently", packed)
+		}
+	})
+}
+
+// FuzzParseDNSName checks that a name that parses is a valid label sequence
+// that survives being printed and encoded again. The first byte picks where
+// the name starts.
+func FuzzParseDNSName(f *testing.F) {
+	addGoldenSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		offset := 0
+		if len(data) > 0 {
+			offset = int(data[0]) % len(data)
+		}
+		name, next, err := parseDNSName(nil, data, offset)
+		if err != nil {
+			return
+		}
+		if next <= offset || next > len(data) {
+			t.Fatalf("name at %d ends at %d", offset, next)
+		}
+		if len(name) > maxNameLength {
+			t.Fatalf("%d byte name", len(name))
+		}
+		for i := 0; i < len(name); i += int(name[i]) + 1 {
+			if name[i] > maxLabelLength {
+				t.Fatalf("%d byte label", name[i])
+			}
+			if name[i] == 0 && i != len(name)-1 {
+				t.Fatal("empty label inside the name")
+			}
+		}
+		if name[len(name)-1] != 0 {
+			t.Fatal("name without the root label")
+		}
+		encoded, err := encodeDomainName(domainName(name))
+		if err != nil {
+			t.Fatalf("%q doesn't encode again: %v", domainName(name), err)
+		}
+		if !bytes.Equal(encoded, name) {
+			t.Fatalf("%q encodes to %x, not %x", domainName(name), encoded, name)
+		}
+	})
+}
+
+// FuzzHandle answers every input as a UDP query, with local records and no
+// upstream. Whatever is sent back must be one response that parses, matches
+// the ID and fits the client's limit.
+func FuzzHandle(f *testing.F) {
+	addGoldenSeeds(f)
+	s := newTestServer(f, "-record", "a.lan A 192.0.2.1", "-record", "a.lan TXT fuzz", "-max-inflight", "0")
+	limit := s.reload.current.Load().opts.maxUDPSize
+	f.Fuzz(func(t *testing.T, data []byte) {
+		replies := s.handleTest(data)
+		if len(replies) > 1 {
+			t.Fatalf("%d replies to one query", len(replies))
+		}
+		if len(replies) == 0 {
+			return
+		}
+		response, _, err := parseDNSResponse(nil, replies[0])
+		if err != nil {
+			t.Fatalf("reply %x doesn't parse: %v", replies[0], err)
+		}
+		if response.Header.ID != binary.BigEndian.Uint16(data) || response.Header.Flags&flagQR == 0 {
+			t.Fatalf("reply %x isn't a response to the query", replies[0])
+		}
+		var additional []DNSResourceRecord
+		if query, _, err := parseDNSResponse(nil, data); err == nil {
+			additional = query.Additional
+		}
+		if max := responseLimit(additional, testClient, limit); len(replies[0]) > max {
+			t.Fatalf("%d byte reply, over the limit of %d", len(replies[0]), max)
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// updateGolden rewrites the expectations of the golden corpus with what the
+// codec gives now, after a deliberate change of it; review the diff before
+// committing it.
+var updateGolden = flag.Bool("update", false, "rewrite the expectations of testdata/golden")
+
+// goldenSeparator ends the message of a corpus file and starts what parsing
+// it must give.
+const goldenSeparator = "--"
+
+// TestGolden checks the wire format codec against a corpus of real messages.
+// Each file in testdata/golden holds a message in hex, after comment lines
+// starting with #, then a line of -- and what parsing it must give: the
+// header, the sections record by record, and whether packing the parsed
+// message gives back the same bytes or, for messages with compressed names,
+// bytes that parse the same. A message the parser rejects expects its error.
+func TestGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "golden", "*.txt"))
+	if err != nil || len(files) == 0 {
+		t.Fatal("no corpus files in testdata/golden")
+	}
+	for _, file := range files {
+		file := file
+		t.Run(strings.TrimSuffix(filepath.Base(file), ".txt"), func(t *testing.T) {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			head, msg, expected, err := parseGoldenFile(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := goldenDump(msg)
+			switch {
+			case got == expected:
+			case *updateGolden:
+				if err := os.WriteFile(file, []byte(head+goldenSeparator+"\n"+got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			default:
+				t.Errorf("message parses differently\n--- want\n%s--- got\n%s", expected, got)
+			}
+		})
+	}
+}
+
+// parseGoldenFile splits a corpus file into the part up to the separator,
+// the message it holds and the expected dump.
+func parseGoldenFile(data []byte) (head string, msg []byte, expected string, err error) {
+	text := string(data)
+	i := strings.Index(text, "\n"+goldenSeparator+"\n")
+	if i < 0 {
+		return "", nil, "", fmt.Errorf("no %s line", goldenSeparator)
+	}
+	head, expected = text[:i+1], text[i+len(goldenSeparator)+2:]
+	var digits strings.Builder
+	for _, line := range strings.Split(head, "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		digits.WriteString(strings.Join(strings.Fields(line), ""))
+	}
+	if msg, err = hex.DecodeString(digits.String()); err != nil {
+		return "", nil, "", err
+	}
+	return head, msg, expected, nil
+}
+
+// goldenDump describes how msg parses and repacks, one line per item.
+func goldenDump(msg []byte) string {
+	var dump strings.Builder
+	response, _, err := parseDNSResponse(nil, msg)
+	if err != nil {
+		fmt.Fprintf(&dump, "error: %v\n", err)
+		return dump.String()
+	}
+	header := response.Header
+	fmt.Fprintf(&dump, "header: id=%#04x opcode=%d rcode=%s flags=%s qd=%d an=%d ns=%d ar=%d\n",
+		header.ID, header.Opcode(), header.Rcode(), flagNames(header.Flags),
+		header.QDCount, header.ANCount, header.NSCount, header.ARCount)
+	for _, question := range response.Question {
+		fmt.Fprintf(&dump, "question: %s %s %s\n", dottedName(question.Name), className(question.Class), typeName(question.Type))
+	}
+	sections := []struct {
+		name    string
+		records []DNSResourceRecord
+	}{{"answer", response.Answers}, {"authority", response.Authority}, {"additional", response.Additional}}
+	for _, section := range sections {
+		for _, record := range section.records {
+			class := className(record.Class)
+			if record.Type == TypeOPT {
+				// the class of an OPT record is the payload size
+				class = fmt.Sprintf("size=%d", record.Class)
+			}
+			fmt.Fprintf(&dump, "%s: %s %d %s %s %x\n", section.name, dottedName(record.Name), record.TTL, class, typeName(record.Type), record.RData)
+		}
+	}
+
+	packed := appendDNSResponse(nil, response)
+	switch again, _, err := parseDNSResponse(nil, packed); {
+	case bytes.Equal(packed, msg):
+		dump.WriteString("repack: exact\n")
+	case err != nil:
+		fmt.Fprintf(&dump, "repack: %d bytes that don't parse: %v\n", len(packed), err)
+	case !reflect.DeepEqual(messageSections(again), messageSections(response)):
+		fmt.Fprintf(&dump, "repack: %d bytes that parse differently\n", len(packed))
+	default:
+		fmt.Fprintf(&dump, "repack: %d bytes, same message uncompressed\n", len(packed))
+	}
+	return dump.String()
+}
+
+// messageSections is what packing a parsed message must keep, with empty
+// sections the same as missing ones.
+func messageSections(response DNSResponse) []interface{} {
+	sections := []interface{}{response.Header}
+	if len(response.Question) > 0 {
+		sections = append(sections, response.Question)
+	}
+	for _, records := range [][]DNSResourceRecord{response.Answers, response.Authority, response.Additional} {
+		if len(records) > 0 {
+			sections = append(sections, records)
+		}
+	}
+	return sections
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ClientGroup is a set of clients sharing filtering, forwarding and logging
+// settings, e.g. kids' devices with strict filtering and servers with none.
+type ClientGroup struct {
+	Name       string
+	Clients    []*net.IPNet
+	Filter     *Filter // nil disables filtering for the group
+	Resolver   string  // upstream for the group, empty uses -resolver
+	SafeSearch *bool   // overrides -safe-search when set
+	Quiet      bool    // don't log the group's queries
+	NoLocal    bool    // forward the names of local records and pools too
+}
+
+// ClientGroups is an ordered list of groups; a client belongs to the first
+// group that lists it.
+type ClientGroups []*ClientGroup
+
+// Match returns the client's group, or fallback when no group lists it.
+func (g ClientGroups) Match(ip net.IP, fallback *ClientGroup) *ClientGroup {
+	for _, group := range g {
+		for _, network := range group.Clients {
+			if network.Contains(ip) {
+				return group
+			}
+		}
+	}
+	return fallback
+}
+
+// safeSearch reports whether safe search is enforced for the client.
+func (g *ClientGroup) safeSearch(s *SafeSearch, ip net.IP) bool {
+	if g.SafeSearch != nil {
+		return *g.SafeSearch
+	}
+	return s.Applies(ip)
+}
+
+// parseClientGroup parses a group written as space separated key=value
+// pairs, e.g. "name=kids clients=10.0.1.0/24,10.0.1.7 block=tiktok.com
+// safe-search=on" or "name=servers clients=10.0.9.0/24 filtering=off log=off".
+// A group bound to a listener needs no clients, e.g. "name=vpn filtering=off
+// local=off" for -listen 10.8.0.1:53@vpn. Block and allow rules are added in front of the default filter rules, which
+// the group otherwise shares; with filtering=off there is no filter to add
+// them to, so the two don't go together.
+func parseClientGroup(s string, defaults *Filter) (*ClientGroup, error) {
+	group := &ClientGroup{}
+	filter := &Filter{}
+	filtering := true
+	fields, err := splitFields(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range fields {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected key=value, got %q", field)
+		}
+		var err error
+		switch strings.ToLower(key) {
+		case "name":
+			group.Name = value
+		case "clients":
+			var networks []*net.IPNet
+			networks, err = parseCIDRList(value)
+			group.Clients = append(group.Clients, networks...)
+		case "block", "allow":
+			action := FilterBlock
+			if strings.ToLower(key) == "allow" {
+				action = FilterAllow
+			}
+			var rule *FilterRule
+			if rule, err = parseFilterRule(action, value); err == nil {
+				filter.Rules = append(filter.Rules, rule)
+			}
+		case "filtering":
+			filtering, err = parseSwitch(value)
+		case "safe-search":
+			var on bool
+			on, err = parseSwitch(value)
+			group.SafeSearch = &on
+		case "resolver":
+			group.Resolver = value
+		case "log":
+			var on bool
+			on, err = parseSwitch(value)
+			group.Quiet = !on
+		case "local":
+			var on bool
+			on, err = parseSwitch(value)
+			group.NoLocal = !on
+		default:
+			return nil, fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("group %q: %w", s, err)
+		}
+	}
+	if group.Name == "" {
+		return nil, fmt.Errorf("group %q needs a name", s)
+	}
+	if !filtering && len(filter.Rules) > 0 {
+		return nil, fmt.Errorf("group %q: block and allow rules need filtering on", s)
+	}
+	if filtering {
+		filter.Rules = append(filter.Rules, defaults.Rules...)
+		filter.Lists = defaults.Lists
+		group.Filter = filter
+	}
+	return group, nil
+}
+
+// groupFlag collects repeated -group specs. Each spec is checked when it is
+// set, but only turned into a group once the default filter is known.
+type groupFlag []string
+
+func (f *groupFlag) String() string { return strings.Join(*f, " ") }
+
+func (f *groupFlag) Set(value string) error {
+	if _, err := parseClientGroup(value, &Filter{}); err != nil {
+		return err
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+// parseSwitch accepts the usual spellings of on and off.
+func parseSwitch(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "on", "true", "yes", "1":
+		return true, nil
+	case "off", "false", "no", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("expected on or off, got %q", s)
+}
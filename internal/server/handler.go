@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// Msg is a DNS message, a query or a response.
+type Msg = DNSResponse
+
+// A ResponseWriter sends the response to a query over the transport it came
+// in on, hiding whether that is a datagram or a length prefixed stream.
+// Only the first response is sent, and only if it answers the query: a
+// response with its ID and question. It is truncated to what the client
+// takes, with TC set, given RA and the OPT the query asks for, and counted
+// and logged like every other one.
+type ResponseWriter interface {
+	// RemoteAddr is the address of the client.
+	RemoteAddr() net.Addr
+	// Transport is "udp" or "tcp".
+	Transport() string
+	// MaxSize is the size a response may have before it is truncated:
+	// the EDNS payload size of the client over UDP, or 512 bytes without
+	// EDNS, and 65535 bytes over TCP, less the OPT record the server adds
+	// for EDNS clients.
+	MaxSize() int
+	// Context is done when the query is given up, at its deadline or when
+	// the client is gone; lookups made for it should end then too.
+	Context() context.Context
+	// WriteMsg packs and sends m.
+	WriteMsg(m *Msg) error
+	// Write sends a packed response. Neither it nor a message written
+	// carries an OPT record, the server adds one when the query has it,
+	// with the options of RegisterEDNSOption and SetEDNSOption.
+	Write(data []byte) error
+}
+
+// A Handler answers the queries of the zones it is registered for. The query
+// and its names are only valid until ServeDNS returns, which is when the
+// response must have been written.
+type Handler interface {
+	ServeDNS(w ResponseWriter, r *Msg)
+}
+
+// HandlerFunc adapts a function to a Handler.
+type HandlerFunc func(w ResponseWriter, r *Msg)
+
+func (f HandlerFunc) ServeDNS(w ResponseWriter, r *Msg) { f(w, r) }
+
+// ServeMux routes queries to the handler of the most specific zone containing
+// the name of the first question, the way http.ServeMux routes by path.
+// Queries for names outside every zone are left to the built-in resolution:
+// local records, CHAOS answers and the upstreams.
+//
+// A file dropped next to app/main.go plugs custom logic into a zone with an
+// init function, through the dns package:
+//
+//	func init() {
+//		dns.HandleFunc("lab.example", func(w dns.ResponseWriter, r *dns.Msg) {
+//			var m dns.Msg
+//			m.SetReply(r).AddAnswer(dns.A("lab.example", net.IPv4(10, 0, 0, 1), 60))
+//			w.WriteMsg(&m)
+//		})
+//	}
+type ServeMux struct {
+	mu    sync.RWMutex
+	zones map[Name]Handler
+}
+
+func NewServeMux() *ServeMux {
+	return &ServeMux{zones: make(map[Name]Handler)}
+}
+
+// DefaultServeMux is the mux the server consults for every query that passed
+// the access checks and policies.
+var DefaultServeMux = NewServeMux()
+
+// Handle registers h for zone and every name below it, replacing the handler
+// registered for the same zone before. "." is the root. It panics if zone
+// isn't a valid name, as registrations are written in the code.
+func (m *ServeMux) Handle(zone string, h Handler) {
+	name := mustParseName(zone)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.zones[name] = h
+}
+
+// HandleFunc registers f for zone.
+func (m *ServeMux) HandleFunc(zone string, f func(w ResponseWriter, r *Msg)) {
+	m.Handle(zone, HandlerFunc(f))
+}
+
+// HandleRemove removes the handler of zone.
+func (m *ServeMux) HandleRemove(zone string) {
+	name, err := ParseName(zone)
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.zones, name)
+}
+
+// Handler returns the handler for the query r, or reports false when no zone
+// contains the name of its first question.
+func (m *ServeMux) Handler(r *Msg) (Handler, bool) {
+	if len(r.Question) == 0 {
+		return nil, false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.zones) == 0 {
+		return nil, false // spares copying the name on every query
+	}
+	return closestZone(NameFromWire(r.Question[0].Name), m.zones)
+}
+
+// handler is Handler on a mux that may be nil.
+func (m *ServeMux) handler(r *Msg) (Handler, bool) {
+	if m == nil {
+		return nil, false
+	}
+	return m.Handler(r)
+}
+
+// ServeDNS hands r to the handler for it, or refuses it.
+func (m *ServeMux) ServeDNS(w ResponseWriter, r *Msg) {
+	h, ok := m.Handler(r)
+	if !ok {
+		var m Msg
+		w.WriteMsg(m.SetReply(r).SetRcode(RcodeRefused))
+		return
+	}
+	h.ServeDNS(w, r)
+}
+
+// Handle registers h for zone on DefaultServeMux.
+func Handle(zone string, h Handler) { DefaultServeMux.Handle(zone, h) }
+
+// HandleFunc registers f for zone on DefaultServeMux.
+func HandleFunc(zone string, f func(w ResponseWriter, r *Msg)) {
+	DefaultServeMux.HandleFunc(zone, f)
+}
+
+var errResponseWritten = errors.New("response already written")
+
+// transportName returns the transport of a client by the type of its
+// address.
+func transportName(addr net.Addr) string {
+	if _, ok := addr.(*net.TCPAddr); ok {
+		return "tcp"
+	}
+	return "udp"
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestWriteMsgSetsCounts(t *testing.T) {
+	srv := newTestServer(t)
+	srv.mux.HandleFunc("lab.example", func(w ResponseWriter, r *Msg) {
+		var m Msg
+		m.SetReply(r)
+		// counts the handler got wrong, too high for the question and
+		// missing for the answer
+		m.Header.QDCount = 7
+		m.Answers = append(m.Answers, A("lab.example", net.IPv4(10, 0, 0, 1), 60))
+		if err := w.WriteMsg(&m); err != nil {
+			t.Errorf("WriteMsg: %v", err)
+		}
+	})
+	var query Msg
+	query.SetQuestion("lab.example", TypeA)
+	r := srv.exchangeTest(t, &query)
+	if len(r.Question) != 1 || len(r.Answers) != 1 {
+		t.Fatalf("got %d questions and %d answers, want 1 and 1", len(r.Question), len(r.Answers))
+	}
+	if got := r.Answers[0].String(); got != "lab.example.\t60\tIN\tA\t10.0.0.1" {
+		t.Errorf("answer %q", got)
+	}
+}
+
+// namedHandler is a handler the tests can tell apart from another.
+type namedHandler string
+
+func (h namedHandler) ServeDNS(w ResponseWriter, r *Msg) {}
+
+func TestServeMuxRoutesToClosestZone(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("example", namedHandler("example"))
+	mux.Handle("lab.example", namedHandler("lab"))
+	route := func(name string) Handler {
+		var query Msg
+		query.SetQuestion(name, TypeA)
+		h, ok := mux.Handler(&query)
+		if !ok {
+			return nil
+		}
+		return h
+	}
+	for name, want := range map[string]Handler{
+		"lab.example":      namedHandler("lab"),
+		"host.LAB.Example": namedHandler("lab"),
+		"www.example":      namedHandler("example"),
+		"example":          namedHandler("example"),
+		"xlab.example":     namedHandler("example"),
+		"example.org":      nil,
+	} {
+		if got := route(name); got != want {
+			t.Errorf("%s routed to %v, want %v", name, got, want)
+		}
+	}
+	mux.HandleRemove("lab.example")
+	if got := route("host.lab.example"); got != namedHandler("example") {
+		t.Errorf("host.lab.example routed to %v after removing its zone, want example", got)
+	}
+	if _, ok := mux.Handler(&Msg{}); ok {
+		t.Error("a query without a question was routed")
+	}
+}
+
+func TestServeMuxLeavesOtherNamesToLocalRecords(t *testing.T) {
+	srv := newTestServer(t, "-record", "other.lan A 10.0.0.2")
+	srv.mux.HandleFunc("lab.example", func(w ResponseWriter, r *Msg) {
+		var m Msg
+		w.WriteMsg(m.SetReply(r).SetRcode(RcodeNXDomain))
+	})
+	var query Msg
+	query.SetQuestion("other.lan", TypeA)
+	r := srv.exchangeTest(t, &query)
+	if len(r.Answers) != 1 || r.Answers[0].String() != "other.lan.\t300\tIN\tA\t10.0.0.2" {
+		t.Errorf("other.lan answered %v, want its local record", r.Answers)
+	}
+	query.SetQuestion("www.lab.example", TypeA)
+	if r := srv.exchangeTest(t, &query); r.Header.Rcode() != RcodeNXDomain {
+		t.Errorf("www.lab.example answered %v, want the handler's NXDOMAIN", r.Header.Rcode())
+	}
+}
+
+func TestChainWrapsFirstMiddlewareOutermost(t *testing.T) {
+	var calls []string
+	middleware := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(w ResponseWriter, r *Msg) {
+				calls = append(calls, name)
+				next.ServeDNS(w, r)
+			})
+		}
+	}
+	srv := newTestServer(t)
+	srv.mux.Handle("lab.example", Chain(HandlerFunc(func(w ResponseWriter, r *Msg) {
+		calls = append(calls, "handler")
+		var m Msg
+		w.WriteMsg(m.SetReply(r))
+	}), middleware("outer"), middleware("inner")))
+	var query Msg
+	query.SetQuestion("lab.example", TypeA)
+	srv.exchangeTest(t, &query)
+	if got := strings.Join(calls, ","); got != "outer,inner,handler" {
+		t.Errorf("called %s, want outer,inner,handler", got)
+	}
+}
+
+func TestWriteMsgSendsOnlyTheFirstResponse(t *testing.T) {
+	srv := newTestServer(t)
+	srv.mux.HandleFunc("lab.example", func(w ResponseWriter, r *Msg) {
+		var m Msg
+		if err := w.WriteMsg(m.SetReply(r)); err != nil {
+			t.Errorf("first WriteMsg: %v", err)
+		}
+		if err := w.WriteMsg(m.SetRcode(RcodeServFail)); err == nil {
+			t.Error("second WriteMsg succeeded")
+		}
+	})
+	var query Msg
+	query.SetQuestion("lab.example", TypeA)
+	if r := srv.exchangeTest(t, &query); r.Header.Rcode() != RcodeSuccess {
+		t.Errorf("rcode %v, want the first response's NOERROR", r.Header.Rcode())
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	upstreamProbeTimeout = 2 * time.Second
+	// upstreamProbeCache keeps probe results around so a busy load balancer
+	// doesn't turn every /readyz into upstream traffic.
+	upstreamProbeCache = 10 * time.Second
+)
+
+// HealthChecker serves /healthz and /readyz. The server is healthy while the
+// process runs and ready once it listens, its blocklists are loaded and its
+// upstreams answer. Upstreams and Lists are guarded by mu once serving.
+type HealthChecker struct {
+	Upstreams []string
+	Lists     *Blocklists
+
+	listening atomic.Bool
+
+	mu      sync.Mutex
+	probed  time.Time
+	results map[string]error
+}
+
+// SetTargets replaces the upstreams and blocklists that are checked, and
+// forgets the cached probe results.
+func (h *HealthChecker) SetTargets(upstreams []string, lists *Blocklists) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.Upstreams, h.Lists, h.results = upstreams, lists, nil
+}
+
+// SetListening records whether the DNS listener is up.
+func (h *HealthChecker) SetListening(up bool) {
+	h.listening.Store(up)
+}
+
+// Healthz answers ok for as long as the process serves HTTP, whatever the
+// checks of Readyz say, so a restart is only called for when it hangs.
+func (h *HealthChecker) Healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// Readyz reports every check and answers 503 when any of them fails.
+func (h *HealthChecker) Readyz(w http.ResponseWriter, r *http.Request) {
+	checks := make(map[string]string)
+	ready := true
+	fail := func(name, reason string) {
+		checks[name] = reason
+		ready = false
+	}
+
+	if h.listening.Load() {
+		checks["listener"] = "ok"
+	} else {
+		fail("listener", "not listening")
+	}
+	h.mu.Lock()
+	lists := h.Lists
+	h.mu.Unlock()
+	if lists != nil {
+		if lists.Loaded() {
+			checks["blocklists"] = "ok"
+		} else {
+			fail("blocklists", "not loaded")
+		}
+	}
+	for upstream, err := range h.probeUpstreams() {
+		if err != nil {
+			fail("upstream "+upstream, err.Error())
+		} else {
+			checks["upstream "+upstream] = "ok"
+		}
+	}
+
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, map[string]any{"ready": ready, "checks": checks})
+}
+
+// probeUpstreams queries every upstream in parallel, reusing recent results.
+func (h *HealthChecker) probeUpstreams() map[string]error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.results != nil && time.Since(h.probed) < upstreamProbeCache {
+		return h.results
+	}
+
+	results := make(map[string]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, upstream := range h.Upstreams {
+		wg.Add(1)
+		go func(upstream string) {
+			defer wg.Done()
+			err := probeUpstream(upstream)
+			mu.Lock()
+			results[upstream] = err
+			mu.Unlock()
+		}(upstream)
+	}
+	wg.Wait()
+	h.results, h.probed = results, time.Now()
+	return results
+}
+
+// probeUpstream asks the upstream for the root NS records and accepts any
+// well-formed response.
+func probeUpstream(upstream string) error {
+	var probe Msg
+	probe.SetQuestion(".", TypeNS).Header.ID = newID()
+	client := Client{Timeout: upstreamProbeTimeout}
+	_, err := client.Exchange(context.Background(), &probe, upstream)
+	return err
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthz(t *testing.T) {
+	h := &HealthChecker{Upstreams: []string{"127.0.0.1:1"}}
+	w := httptest.NewRecorder()
+	h.Healthz(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "ok\n" {
+		t.Errorf("/healthz answered %d %q while not ready, want 200 ok", w.Code, w.Body)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	var probes atomic.Int32
+	upstream := udpResponder(t, func(query *Msg) []*Msg {
+		probes.Add(1)
+		var m Msg
+		m.SetReply(query)
+		return []*Msg{&m}
+	})
+	// a port nothing listens on any more
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := conn.LocalAddr().String()
+	conn.Close()
+
+	lists := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ads.example\n"))
+	}))
+	defer lists.Close()
+	loaded := NewBlocklists([]string{lists.URL}, time.Hour)
+	loaded.Refresh()
+
+	readyz := func(h *HealthChecker) (int, map[string]string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.Readyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var report struct {
+			Ready  bool              `json:"ready"`
+			Checks map[string]string `json:"checks"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatalf("%v in %s", err, w.Body)
+		}
+		if report.Ready != (w.Code == http.StatusOK) {
+			t.Errorf("ready %v with status %d", report.Ready, w.Code)
+		}
+		return w.Code, report.Checks
+	}
+
+	for _, tt := range []struct {
+		name      string
+		listening bool
+		upstreams []string
+		lists     *Blocklists
+		status    int
+		failed    string // the check that fails
+	}{
+		{"ready", true, []string{upstream}, loaded, http.StatusOK, ""},
+		{"no blocklists configured", true, []string{upstream}, nil, http.StatusOK, ""},
+		{"listener down", false, []string{upstream}, loaded, http.StatusServiceUnavailable, "listener"},
+		{"blocklists not loaded", true, []string{upstream}, NewBlocklists([]string{lists.URL}, time.Hour), http.StatusServiceUnavailable, "blocklists"},
+		{"upstream down", true, []string{upstream, down}, loaded, http.StatusServiceUnavailable, "upstream " + down},
+	} {
+		h := &HealthChecker{}
+		h.SetTargets(tt.upstreams, tt.lists)
+		h.SetListening(tt.listening)
+		status, checks := readyz(h)
+		if status != tt.status {
+			t.Errorf("%s: status %d with %v, want %d", tt.name, status, checks, tt.status)
+		}
+		for check, result := range checks {
+			if (check == tt.failed) != (result != "ok") {
+				t.Errorf("%s: checks %v, want only %q failed", tt.name, checks, tt.failed)
+				break
+			}
+		}
+		if checks["upstream "+upstream] != "ok" {
+			t.Errorf("%s: checks %v, want the upstream probed", tt.name, checks)
+		}
+	}
+
+	// the probes are reused for upstreamProbeCache
+	h := &HealthChecker{}
+	h.SetTargets([]string{upstream}, nil)
+	h.SetListening(true)
+	probes.Store(0)
+	readyz(h)
+	readyz(h)
+	if n := probes.Load(); n != 1 {
+		t.Errorf("%d probes for two checks, want 1", n)
+	}
+	h.mu.Lock()
+	h.probed = h.probed.Add(-upstreamProbeCache)
+	h.mu.Unlock()
+	readyz(h)
+	if n := probes.Load(); n != 2 {
+		t.Errorf("%d probes once the results expired, want 2", n)
+	}
+	// and forgotten when the targets change
+	h.SetTargets([]string{upstream}, nil)
+	readyz(h)
+	if n := probes.Load(); n != 3 {
+		t.Errorf("%d probes after new targets, want 3", n)
+	}
+}
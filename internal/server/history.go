@@ -0,0 +1,673 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/internal/slog"
+)
+
+const (
+	// historyQueue is how many queries wait to be written before more are
+	// skipped, so a disk that can't keep up doesn't hold up the answers.
+	historyQueue = 4096
+	// historyFlush is how often the queries written are flushed to the
+	// file, and so how far behind a crash may leave the history.
+	historyFlush = time.Second
+	// historyMaxLimit bounds the entries one /history request returns.
+	historyMaxLimit = 10000
+	// historyBlock is how many entries of a day one line of its index
+	// summarizes.
+	historyBlock = 1024
+)
+
+// History persists every query for long-term auditing in a directory, as
+// JSON lines in one file per UTC day, queries-2006-01-02.jsonl, and removes
+// the days older than Retention. Unlike the query log it doesn't rotate by
+// size or sample, so a day of traffic is kept whole and its file can be
+// pruned, copied or fed to other tools as a unit.
+//
+// Next to each day's file, queries-2006-01-02.idx indexes it in blocks of
+// historyBlock entries: the offset and size of the block, its time range and
+// the clients, types, rcodes and upstreams in it. Query reads the blocks
+// newest first and only those that may match, so it stops after the few
+// blocks holding limit entries instead of scanning every day of the
+// retention.
+type History struct {
+	Dir       string
+	Retention time.Duration // 0 keeps every day
+
+	queue   chan QueryLogEntry
+	done    chan struct{}
+	mu      sync.Mutex // guards skipped and closed
+	skipped int        // queries dropped while the writer was behind
+	closed  bool
+
+	fileMu sync.Mutex // guards the fields below, held while writing
+	day    string     // of the open file
+	file   *os.File
+	w      *bufio.Writer
+	offset int64 // of the end of the file, written or buffered
+	index  *os.File
+	iw     *bufio.Writer
+	block  *historyBlockBuilder // entries not indexed yet, nil when none
+	err    error                // of the last write, logged once
+	pruned time.Time
+}
+
+// NewHistory starts the writer. Like the quarantine, the directory is only
+// looked at when the first query is written, after privileges are dropped.
+func NewHistory(dir string, retention time.Duration) *History {
+	h := &History{Dir: dir, Retention: retention, queue: make(chan QueryLogEntry, historyQueue), done: make(chan struct{})}
+	go h.write()
+	return h
+}
+
+// Record queues entry to be written. A nil History discards everything.
+func (h *History) Record(entry QueryLogEntry) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	select {
+	case h.queue <- entry:
+	default:
+		h.skipped++
+	}
+}
+
+// Close stops the writer after the queued queries are written.
+func (h *History) Close() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.closed = true
+	close(h.queue)
+	h.mu.Unlock()
+	<-h.done
+}
+
+func (h *History) write() {
+	defer close(h.done)
+	ticker := time.NewTicker(historyFlush)
+	defer ticker.Stop()
+	for {
+		select {
+		case entry, ok := <-h.queue:
+			h.fileMu.Lock()
+			if !ok {
+				h.closeFile()
+				h.fileMu.Unlock()
+				return
+			}
+			h.append(entry)
+			h.fileMu.Unlock()
+		case <-ticker.C:
+			h.fileMu.Lock()
+			h.flush()
+			if h.Retention > 0 && time.Since(h.pruned) >= time.Hour {
+				h.prune(time.Now())
+			}
+			h.fileMu.Unlock()
+			h.mu.Lock()
+			skipped := h.skipped
+			h.skipped = 0
+			h.mu.Unlock()
+			if skipped > 0 {
+				slog.Warn("queries left out of the history, writing fell behind", "skipped", skipped)
+			}
+		}
+	}
+}
+
+// historyFile returns the name of the file of the day of t.
+func historyFile(t time.Time) string {
+	return "queries-" + t.UTC().Format("2006-01-02") + ".jsonl"
+}
+
+// append writes entry to the file of its day, opening it first if the day
+// changed.
+func (h *History) append(entry QueryLogEntry) {
+	name := historyFile(entry.Time)
+	if name != h.day {
+		h.closeFile()
+		if err := os.MkdirAll(h.Dir, 0o750); err != nil {
+			h.fail(err)
+			return
+		}
+		if err := h.open(name); err != nil {
+			h.fail(err)
+			return
+		}
+		if h.Retention > 0 {
+			h.prune(entry.Time)
+		}
+	}
+	line, _ := json.Marshal(entry)
+	line = append(line, '\n')
+	if _, err := h.w.Write(line); err != nil {
+		h.fail(err)
+		return
+	}
+	if h.block == nil {
+		h.block = newHistoryBlockBuilder(h.offset)
+	}
+	h.block.add(&entry, len(line))
+	h.offset += int64(len(line))
+	if h.block.count == historyBlock {
+		h.writeBlock()
+	}
+}
+
+// open opens the file called name and its index for appending. The lines a
+// crash left out of the index are indexed first.
+func (h *History) open(name string) error {
+	file, err := os.OpenFile(filepath.Join(h.Dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	index, indexed, err := openHistoryIndex(filepath.Join(h.Dir, indexFile(name)), info.Size())
+	if err != nil {
+		file.Close()
+		return err
+	}
+	h.day, h.file, h.w = name, file, bufio.NewWriter(file)
+	h.index, h.iw = index, bufio.NewWriter(index)
+	h.offset = indexed
+	if indexed < info.Size() {
+		err := scanHistory(filepath.Join(h.Dir, name), indexed, info.Size(), func(entry *QueryLogEntry, size int) {
+			if h.block == nil {
+				h.block = newHistoryBlockBuilder(h.offset)
+			}
+			if entry != nil {
+				h.block.add(entry, size)
+			} else {
+				h.block.index.Size += int64(size)
+			}
+			h.offset += int64(size)
+			if h.block.count == historyBlock {
+				h.writeBlock()
+			}
+		})
+		h.writeBlock()
+		if err != nil {
+			// the rest of the day isn't indexed, Query reads it whole
+			h.fail(err)
+			h.offset = info.Size()
+		}
+	}
+	return nil
+}
+
+// writeBlock adds the entries written since the last block to the index.
+func (h *History) writeBlock() {
+	if h.block == nil {
+		return
+	}
+	line, _ := json.Marshal(h.block.build())
+	h.block = nil
+	if _, err := h.iw.Write(append(line, '\n')); err != nil {
+		h.fail(err)
+	}
+}
+
+// flush writes the buffered entries, then the index lines of the blocks
+// holding them, so the index never runs ahead of the file.
+func (h *History) flush() {
+	if h.w == nil {
+		return
+	}
+	if err := h.w.Flush(); err != nil {
+		h.fail(err)
+	}
+	if err := h.iw.Flush(); err != nil {
+		h.fail(err)
+	}
+}
+
+func (h *History) closeFile() {
+	if h.file == nil {
+		return
+	}
+	h.writeBlock()
+	h.flush()
+	h.file.Close()
+	h.index.Close()
+	h.day, h.file, h.w, h.index, h.iw = "", nil, nil, nil, nil
+}
+
+// fail logs a write error unless it is the one logged last, so a full disk
+// logs once rather than per query.
+func (h *History) fail(err error) {
+	if h.err == nil || h.err.Error() != err.Error() {
+		slog.Error("failed to write query history", "err", err)
+	}
+	h.err = err
+}
+
+// prune removes the files of the days that ended more than Retention before
+// now.
+func (h *History) prune(now time.Time) {
+	h.pruned = now
+	days, err := h.days()
+	if err != nil {
+		return
+	}
+	for _, day := range days {
+		if day.AddDate(0, 0, 1).Add(h.Retention).Before(now) {
+			name := historyFile(day)
+			if err := os.Remove(filepath.Join(h.Dir, name)); err == nil {
+				slog.Info("removed query history past its retention", "file", name)
+			}
+			os.Remove(filepath.Join(h.Dir, indexFile(name)))
+		}
+	}
+}
+
+// days returns the days the directory has a file of, oldest first.
+func (h *History) days() ([]time.Time, error) {
+	paths, err := filepath.Glob(filepath.Join(h.Dir, "queries-*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	var days []time.Time
+	for _, path := range paths {
+		date := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "queries-"), ".jsonl")
+		if day, err := time.Parse("2006-01-02", date); err == nil {
+			days = append(days, day)
+		}
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	return days, nil
+}
+
+// historyFilter selects the entries /history returns. Empty fields match
+// everything.
+type historyFilter struct {
+	from, to time.Time
+	client   string
+	name     string // contained in the name
+	qtype    string
+	rcode    *int
+	blocked  *bool
+	upstream string
+}
+
+func (f *historyFilter) match(entry *QueryLogEntry) bool {
+	switch {
+	case !f.from.IsZero() && entry.Time.Before(f.from),
+		!f.to.IsZero() && !entry.Time.Before(f.to),
+		f.client != "" && entry.Client != f.client,
+		f.name != "" && !strings.Contains(canonicalName(entry.Name), f.name),
+		f.qtype != "" && !strings.EqualFold(entry.Type, f.qtype),
+		f.rcode != nil && (entry.Dropped != "" || entry.Rcode != *f.rcode),
+		f.blocked != nil && entry.Blocked != *f.blocked,
+		f.upstream != "" && entry.Upstream != f.upstream:
+		return false
+	}
+	return true
+}
+
+// Query returns up to limit entries matching filter, newest first. It reads
+// the days in the filter's range newest first and, within a day, only the
+// blocks of the index that may hold matches, so it stops as soon as limit
+// entries are found.
+func (h *History) Query(filter historyFilter, limit int) ([]QueryLogEntry, error) {
+	result := make([]QueryLogEntry, 0)
+	if h == nil {
+		return result, nil
+	}
+	h.fileMu.Lock()
+	h.flush() // the queries of the last second too
+	days, err := h.days()
+	h.fileMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(days) - 1; i >= 0 && len(result) < limit; i-- {
+		day := days[i]
+		if !filter.to.IsZero() && !day.Before(filter.to) || !filter.from.IsZero() && day.AddDate(0, 0, 1).Before(filter.from) {
+			continue
+		}
+		if result, err = h.queryDay(day, filter, limit, result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// queryDay appends the entries of a day matching filter to result, newest
+// first, until it holds limit entries. The entries past the last block of the
+// index, those of the block being written, are read first.
+func (h *History) queryDay(day time.Time, filter historyFilter, limit int, result []QueryLogEntry) ([]QueryLogEntry, error) {
+	path := filepath.Join(h.Dir, historyFile(day))
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return result, nil // pruned meanwhile
+	}
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := readHistoryIndex(filepath.Join(h.Dir, indexFile(historyFile(day))), info.Size())
+	if err != nil {
+		return nil, err
+	}
+	var indexed int64
+	if len(blocks) > 0 {
+		last := blocks[len(blocks)-1]
+		indexed = last.Offset + last.Size
+	}
+	ranges := []historyBlockIndex{{Offset: indexed, Size: info.Size() - indexed}}
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if blocks[i].mayMatch(&filter) {
+			ranges = append(ranges, blocks[i])
+		}
+	}
+	for _, r := range ranges {
+		if r.Size == 0 {
+			continue
+		}
+		var matches []QueryLogEntry
+		err := scanHistory(path, r.Offset, r.Offset+r.Size, func(entry *QueryLogEntry, size int) {
+			if entry != nil && filter.match(entry) {
+				matches = append(matches, *entry)
+			}
+		})
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i := len(matches) - 1; i >= 0 && len(result) < limit; i-- {
+			result = append(result, matches[i])
+		}
+		if len(result) >= limit {
+			break
+		}
+	}
+	return result, nil
+}
+
+// scanHistory calls f with every line of the file at path between the
+// offsets from and to: the entry, nil for a line cut off by a crash, and the
+// size of the line.
+func scanHistory(path string, from, to int64, f func(entry *QueryLogEntry, size int)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r := bufio.NewReader(io.NewSectionReader(file, from, to-from))
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			var entry QueryLogEntry
+			if json.Unmarshal(line, &entry) == nil {
+				f(&entry, len(line))
+			} else {
+				f(nil, len(line))
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// indexFile returns the name of the index of the history file called name.
+func indexFile(name string) string {
+	return strings.TrimSuffix(name, ".jsonl") + ".idx"
+}
+
+// historyBlockIndex is a line of the index of a day: where a block of
+// entries is in the day's file and what it holds.
+type historyBlockIndex struct {
+	Offset    int64     `json:"offset"`
+	Size      int64     `json:"size"`
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	Clients   []string  `json:"clients"`
+	Types     []string  `json:"types"`
+	Rcodes    []int     `json:"rcodes"` // of the entries answered, not dropped
+	Upstreams []string  `json:"upstreams"`
+	Blocked   bool      `json:"blocked"` // some entry was blocked
+}
+
+// mayMatch reports whether the block may hold entries matching filter. The
+// name isn't indexed, it is checked on the entries.
+func (b *historyBlockIndex) mayMatch(f *historyFilter) bool {
+	switch {
+	case !f.from.IsZero() && b.To.Before(f.from),
+		!f.to.IsZero() && !b.From.Before(f.to),
+		f.client != "" && !containsString(b.Clients, f.client),
+		f.qtype != "" && !containsFold(b.Types, f.qtype),
+		f.rcode != nil && !containsInt(b.Rcodes, *f.rcode),
+		f.blocked != nil && *f.blocked && !b.Blocked,
+		f.upstream != "" && !containsString(b.Upstreams, f.upstream):
+		return false
+	}
+	return true
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(list []int, n int) bool {
+	for _, item := range list {
+		if item == n {
+			return true
+		}
+	}
+	return false
+}
+
+// historyBlockBuilder collects the index line of the block being written.
+type historyBlockBuilder struct {
+	index     historyBlockIndex
+	count     int
+	clients   map[string]bool
+	types     map[string]bool
+	rcodes    map[int]bool
+	upstreams map[string]bool
+}
+
+func newHistoryBlockBuilder(offset int64) *historyBlockBuilder {
+	return &historyBlockBuilder{index: historyBlockIndex{Offset: offset}, clients: map[string]bool{}, types: map[string]bool{}, rcodes: map[int]bool{}, upstreams: map[string]bool{}}
+}
+
+// add adds an entry whose line takes size bytes.
+func (b *historyBlockBuilder) add(entry *QueryLogEntry, size int) {
+	if b.count == 0 || entry.Time.Before(b.index.From) {
+		b.index.From = entry.Time
+	}
+	if b.count == 0 || entry.Time.After(b.index.To) {
+		b.index.To = entry.Time
+	}
+	b.count++
+	b.index.Size += int64(size)
+	b.clients[entry.Client] = true
+	b.types[strings.ToUpper(entry.Type)] = true
+	if entry.Dropped == "" {
+		b.rcodes[entry.Rcode] = true
+	}
+	if entry.Upstream != "" {
+		b.upstreams[entry.Upstream] = true
+	}
+	b.index.Blocked = b.index.Blocked || entry.Blocked
+}
+
+func (b *historyBlockBuilder) build() *historyBlockIndex {
+	index := b.index
+	index.Clients = sortedSet(b.clients)
+	index.Types = sortedSet(b.types)
+	index.Upstreams = sortedSet(b.upstreams)
+	for rcode := range b.rcodes {
+		index.Rcodes = append(index.Rcodes, rcode)
+	}
+	sort.Ints(index.Rcodes)
+	return &index
+}
+
+func sortedSet(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// readHistoryIndex returns the blocks of the index at path that lie within
+// the first size bytes of the day's file, oldest first. A day without an
+// index has no blocks and is read whole.
+func readHistoryIndex(path string, size int64) ([]historyBlockIndex, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var blocks []historyBlockIndex
+	var end int64
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 4096), 16<<20)
+	for scanner.Scan() {
+		var block historyBlockIndex
+		// a block must follow the previous one and fit the file
+		if json.Unmarshal(scanner.Bytes(), &block) != nil || block.Offset != end || block.Offset+block.Size > size {
+			break
+		}
+		blocks = append(blocks, block)
+		end = block.Offset + block.Size
+	}
+	return blocks, scanner.Err()
+}
+
+// openHistoryIndex opens the index at path for appending to a day's file of
+// size bytes and returns the offset up to which the index covers the file.
+// Lines a crash cut off or left ahead of the file are removed first.
+func openHistoryIndex(path string, size int64) (*os.File, int64, error) {
+	blocks, err := readHistoryIndex(path, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	var valid []byte
+	var indexed int64
+	for _, block := range blocks {
+		line, _ := json.Marshal(block)
+		valid = append(append(valid, line...), '\n')
+		indexed = block.Offset + block.Size
+	}
+	if info, err := os.Stat(path); err == nil && info.Size() != int64(len(valid)) {
+		if err := os.WriteFile(path, valid, 0o640); err != nil {
+			return nil, 0, err
+		}
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, 0, err
+	}
+	return file, indexed, nil
+}
+
+// ServeHTTP answers GET /history?from=&to=&client=&name=&type=&rcode=
+// &blocked=&upstream=&limit= with matching entries, newest first. from and
+// to are RFC 3339 times or durations back from now, e.g. 24h.
+func (h *History) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h == nil {
+		http.Error(w, "no query history, see -history-dir", http.StatusNotFound)
+		return
+	}
+	values := r.URL.Query()
+	filter, limit, err := parseHistoryFilter(values, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := h.Query(filter, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, entries)
+}
+
+func parseHistoryFilter(values map[string][]string, now time.Time) (historyFilter, int, error) {
+	get := func(key string) string {
+		if v := values[key]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	filter := historyFilter{client: get("client"), name: canonicalName(get("name")), qtype: get("type"), upstream: get("upstream")}
+	for _, bound := range []struct {
+		key string
+		t   *time.Time
+	}{{"from", &filter.from}, {"to", &filter.to}} {
+		s := get(bound.key)
+		if s == "" {
+			continue
+		}
+		if ago, err := time.ParseDuration(s); err == nil {
+			*bound.t = now.Add(-ago)
+		} else if *bound.t, err = time.Parse(time.RFC3339, s); err != nil {
+			return filter, 0, fmt.Errorf("invalid %s %q, want an RFC 3339 time or a duration", bound.key, s)
+		}
+	}
+	if s := get("rcode"); s != "" {
+		rcode, err := parseRcode(s)
+		if err != nil {
+			return filter, 0, err
+		}
+		n := int(rcode)
+		filter.rcode = &n
+	}
+	if s := get("blocked"); s != "" {
+		blocked, err := strconv.ParseBool(s)
+		if err != nil {
+			return filter, 0, fmt.Errorf("invalid blocked %q", s)
+		}
+		filter.blocked = &blocked
+	}
+	limit := 100
+	if s := get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > historyMaxLimit {
+			return filter, 0, fmt.Errorf("invalid limit %q, want 1 to %d", s, historyMaxLimit)
+		}
+		limit = n
+	}
+	return filter, limit, nil
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// recordHistory writes n entries a second apart from start, every 100th of
+// them from the client 192.0.2.7, and closes the history.
+func recordHistory(dir string, start time.Time, n int) {
+	h := NewHistory(dir, 0)
+	for i := 0; i < n; i++ {
+		client := "192.0.2.1"
+		if i%100 == 0 {
+			client = "192.0.2.7"
+		}
+		for len(h.queue) == cap(h.queue) {
+			time.Sleep(time.Millisecond) // don't let the writer skip any
+		}
+		h.Record(QueryLogEntry{Time: start.Add(time.Duration(i) * time.Second), Client: client, Name: fmt.Sprintf("q%d.example", i), Type: "A"})
+	}
+	h.Close()
+}
+
+func TestHistoryQueryUsesIndex(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	recordHistory(dir, start, 3000)
+	blocks, err := readHistoryIndex(filepath.Join(dir, "queries-2026-03-01.idx"), 1<<40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 3 {
+		t.Fatalf("%d blocks indexed, want 3", len(blocks))
+	}
+
+	h := &History{Dir: dir}
+	entries, err := h.Query(historyFilter{client: "192.0.2.7"}, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 20 {
+		t.Fatalf("%d entries, want 20", len(entries))
+	}
+	for i, entry := range entries {
+		if want := fmt.Sprintf("q%d.example", 2900-100*i); entry.Name != want {
+			t.Errorf("entry %d is %s, want %s", i, entry.Name, want)
+		}
+	}
+
+	// a filter no block can match reads no entries at all
+	rcode := int(RcodeServFail)
+	for _, block := range blocks {
+		if block.mayMatch(&historyFilter{rcode: &rcode}) {
+			t.Errorf("block at %d may hold SERVFAIL answers, it has rcodes %v", block.Offset, block.Rcodes)
+		}
+	}
+}
+
+func TestHistoryReindexesAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	recordHistory(dir, start, 1500)
+	// lose the last index line and leave half a line in the file
+	index := filepath.Join(dir, "queries-2026-03-01.idx")
+	data, err := os.ReadFile(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(index, data[:len(data)-10], 0o640); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(filepath.Join(dir, "queries-2026-03-01.jsonl"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"time":"2026-03-01T01:00:00Z","cli` + "\n")
+	file.Close()
+
+	recordHistory(dir, start.Add(1500*time.Second), 1500)
+	blocks, err := readHistoryIndex(index, 1<<40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var end int64
+	for _, block := range blocks {
+		end = block.Offset + block.Size
+	}
+	info, err := os.Stat(filepath.Join(dir, "queries-2026-03-01.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if end != info.Size() {
+		t.Errorf("index covers %d bytes of %d", end, info.Size())
+	}
+	entries, err := (&History{Dir: dir}).Query(historyFilter{client: "192.0.2.7"}, historyMaxLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 30 {
+		t.Errorf("%d entries of 192.0.2.7, want 30", len(entries))
+	}
+}
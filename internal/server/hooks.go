@@ -0,0 +1,465 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HookAction is what a hook does to the queries its condition matches.
+type HookAction int
+
+const (
+	HookPass     HookAction = iota // go on down the pipeline, skipping the remaining hooks
+	HookRefuse                     // answer REFUSED
+	HookDrop                       // silently drop the query
+	HookNXDomain                   // answer NXDOMAIN
+	HookServFail                   // answer SERVFAIL
+	HookNoData                     // answer NOERROR without records
+)
+
+var hookActions = map[string]HookAction{
+	"pass":     HookPass,
+	"refuse":   HookRefuse,
+	"drop":     HookDrop,
+	"nxdomain": HookNXDomain,
+	"servfail": HookServFail,
+	"nodata":   HookNoData,
+}
+
+// Hook is a per-query rule written in a small expression language and
+// evaluated against every question, e.g.
+//
+//	if qtype == TXT and client in 10.0.0.0/8 then refuse
+//	if qname in corp.example and not group in (staff, admins) then nxdomain
+//	if length > 100 or qname matches "^[a-z0-9]{30,}\." then drop
+//
+// Conditions combine comparisons with and, or, not and parentheses. The
+// variables are qname (without the trailing dot), qtype, qclass, client,
+// group, proto (udp or tcp), labels and length (of qname), hour (0-23) and
+// weekday (mon-sun), in local time. Other words are literals; quote them to
+// use the name of a variable or characters of the syntax.
+//
+// == and != compare without regard to case, <, <=, > and >= compare
+// numbers. in tests membership in a literal or a parenthesized, comma
+// separated list of them: networks and addresses for client, zones for
+// qname, equality otherwise. matches tests a regular expression.
+type Hook struct {
+	Source string
+	Action HookAction
+
+	cond func(env *hookEnv) bool
+}
+
+// hookEnv is what the variables of a hook read, for one question.
+type hookEnv struct {
+	question DNSQuestion
+	ip       net.IP
+	group    string
+	proto    string
+	now      time.Time
+
+	qname string // computed once, see name
+}
+
+func (env *hookEnv) name() string {
+	if env.qname == "" {
+		env.qname = canonicalName(domainName(env.question.Name))
+	}
+	return env.qname
+}
+
+// hookVariables are the variables of the expression language.
+var hookVariables = map[string]func(env *hookEnv) string{
+	"qname":  (*hookEnv).name,
+	"qtype":  func(env *hookEnv) string { return typeName(env.question.Type) },
+	"qclass": func(env *hookEnv) string { return className(env.question.Class) },
+	"client": func(env *hookEnv) string { return env.ip.String() },
+	"group":  func(env *hookEnv) string { return env.group },
+	"proto":  func(env *hookEnv) string { return env.proto },
+	"labels": func(env *hookEnv) string {
+		if env.name() == "" {
+			return "0"
+		}
+		return strconv.Itoa(strings.Count(env.name(), ".") + 1)
+	},
+	"length":  func(env *hookEnv) string { return strconv.Itoa(len(env.name())) },
+	"hour":    func(env *hookEnv) string { return strconv.Itoa(env.now.Hour()) },
+	"weekday": func(env *hookEnv) string { return strings.ToLower(env.now.Weekday().String()[:3]) },
+}
+
+// Hooks are evaluated in order; the first whose condition matches decides.
+type Hooks []*Hook
+
+// Match returns the first hook matching question, or nil.
+func (h Hooks) Match(env *hookEnv) *Hook {
+	for _, hook := range h {
+		if hook.cond(env) {
+			return hook
+		}
+	}
+	return nil
+}
+
+// parseHook compiles a hook written "if condition then action".
+func parseHook(s string) (*Hook, error) {
+	tokens, err := tokenizeHook(s)
+	if err != nil {
+		return nil, fmt.Errorf("hook %q: %w", s, err)
+	}
+	p := &hookParser{tokens: tokens}
+	hook, err := p.hook()
+	if err != nil {
+		return nil, fmt.Errorf("hook %q: %w", s, err)
+	}
+	hook.Source = s
+	return hook, nil
+}
+
+// hookToken is a token of a hook: a word, a quoted string, or an operator
+// or parenthesis, which have quoted false and one of the spellings of
+// tokenizeHook.
+type hookToken struct {
+	text   string
+	quoted bool
+}
+
+// tokenizeHook splits a hook into tokens.
+func tokenizeHook(s string) ([]hookToken, error) {
+	var tokens []hookToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '"':
+			// \" and \\ are the only escapes, so regular expressions need
+			// no doubled backslashes
+			var text strings.Builder
+			end := i + 1
+			for ; end < len(s) && s[end] != '"'; end++ {
+				if s[end] == '\\' && end+1 < len(s) && (s[end+1] == '"' || s[end+1] == '\\') {
+					end++
+				}
+				text.WriteByte(s[end])
+			}
+			if end == len(s) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, hookToken{text: text.String(), quoted: true})
+			i = end + 1
+		case strings.HasPrefix(s[i:], "=="), strings.HasPrefix(s[i:], "!="), strings.HasPrefix(s[i:], "<="), strings.HasPrefix(s[i:], ">="):
+			tokens = append(tokens, hookToken{text: s[i : i+2]})
+			i += 2
+		case strings.IndexByte("()<>,", c) >= 0:
+			tokens = append(tokens, hookToken{text: s[i : i+1]})
+			i++
+		default:
+			end := i
+			for end < len(s) && strings.IndexByte(" \t\"()<>,=!", s[end]) < 0 {
+				end++
+			}
+			if end == i {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			tokens = append(tokens, hookToken{text: s[i:end]})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// hookParser compiles the tokens of a hook by recursive descent:
+//
+//	hook    = "if" or "then" action
+//	or      = and { "or" and }
+//	and     = unary { "and" unary }
+//	unary   = "not" unary | "(" or ")" | operand compare
+//	compare = ("==" | "!=" | "<" | "<=" | ">" | ">=") operand
+//	        | "in" (literal | "(" literal { "," literal } ")")
+//	        | "matches" literal
+type hookParser struct {
+	tokens []hookToken
+	pos    int
+}
+
+func (p *hookParser) peek() (hookToken, bool) {
+	if p.pos == len(p.tokens) {
+		return hookToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// accept consumes the next token if it is the operator or keyword text.
+func (p *hookParser) accept(text string) bool {
+	if t, ok := p.peek(); ok && !t.quoted && strings.EqualFold(t.text, text) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *hookParser) expect(text string) error {
+	if p.accept(text) {
+		return nil
+	}
+	if t, ok := p.peek(); ok {
+		return fmt.Errorf("expected %s, got %q", text, t.text)
+	}
+	return fmt.Errorf("expected %s at the end", text)
+}
+
+func (p *hookParser) hook() (*Hook, error) {
+	if err := p.expect("if"); err != nil {
+		return nil, err
+	}
+	cond, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("then"); err != nil {
+		return nil, err
+	}
+	t, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("expected an action at the end")
+	}
+	action, ok := hookActions[strings.ToLower(t.text)]
+	if !ok || t.quoted {
+		return nil, fmt.Errorf("unknown action %q (want pass, refuse, drop, nxdomain, servfail or nodata)", t.text)
+	}
+	if p.pos++; p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q after the action", p.tokens[p.pos].text)
+	}
+	return &Hook{Action: action, cond: cond}, nil
+}
+
+func (p *hookParser) or() (func(*hookEnv) bool, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("or") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		a, b := left, right
+		left = func(env *hookEnv) bool { return a(env) || b(env) }
+	}
+	return left, nil
+}
+
+func (p *hookParser) and() (func(*hookEnv) bool, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("and") {
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		a, b := left, right
+		left = func(env *hookEnv) bool { return a(env) && b(env) }
+	}
+	return left, nil
+}
+
+func (p *hookParser) unary() (func(*hookEnv) bool, error) {
+	if p.accept("not") {
+		cond, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(env *hookEnv) bool { return !cond(env) }, nil
+	}
+	if p.accept("(") {
+		cond, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return cond, p.expect(")")
+	}
+	return p.compare()
+}
+
+// operand is a variable or a literal, with the literal and the variable name
+// set for the checks done while compiling.
+type hookOperand struct {
+	value    func(env *hookEnv) string
+	literal  string
+	variable string
+}
+
+func (p *hookParser) operand() (hookOperand, error) {
+	t, ok := p.peek()
+	if !ok {
+		return hookOperand{}, fmt.Errorf("expected a value at the end")
+	}
+	if !t.quoted && strings.IndexByte("()<>,=!", t.text[0]) >= 0 {
+		return hookOperand{}, fmt.Errorf("expected a value, got %q", t.text)
+	}
+	p.pos++
+	if variable, ok := hookVariables[strings.ToLower(t.text)]; ok && !t.quoted {
+		return hookOperand{value: variable, variable: strings.ToLower(t.text)}, nil
+	}
+	literal := t.text
+	return hookOperand{value: func(*hookEnv) string { return literal }, literal: literal}, nil
+}
+
+func (p *hookParser) compare() (func(*hookEnv) bool, error) {
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	t, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("expected a comparison after %q", left.literal+left.variable)
+	}
+	switch op := strings.ToLower(t.text); {
+	case t.quoted:
+	case op == "==" || op == "!=":
+		p.pos++
+		right, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		equal := op == "=="
+		return func(env *hookEnv) bool { return strings.EqualFold(left.value(env), right.value(env)) == equal }, nil
+	case op == "<" || op == "<=" || op == ">" || op == ">=":
+		p.pos++
+		right, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		for _, operand := range []hookOperand{left, right} {
+			if _, err := strconv.Atoi(operand.literal); operand.variable == "" && err != nil {
+				return nil, fmt.Errorf("%s compares numbers, not %q", op, operand.literal)
+			}
+		}
+		return func(env *hookEnv) bool {
+			a, errA := strconv.Atoi(left.value(env))
+			b, errB := strconv.Atoi(right.value(env))
+			if errA != nil || errB != nil {
+				return false
+			}
+			switch op {
+			case "<":
+				return a < b
+			case "<=":
+				return a <= b
+			case ">":
+				return a > b
+			}
+			return a >= b
+		}, nil
+	case op == "in":
+		p.pos++
+		return p.in(left)
+	case op == "matches":
+		p.pos++
+		pattern, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		if pattern.variable != "" {
+			return nil, fmt.Errorf("matches takes a regular expression, not the variable %s", pattern.variable)
+		}
+		re, err := regexp.Compile(pattern.literal)
+		if err != nil {
+			return nil, err
+		}
+		return func(env *hookEnv) bool { return re.MatchString(left.value(env)) }, nil
+	}
+	return nil, fmt.Errorf("expected ==, !=, <, <=, >, >=, in or matches, got %q", t.text)
+}
+
+// in compiles the membership test of left in a literal or a list of them.
+func (p *hookParser) in(left hookOperand) (func(*hookEnv) bool, error) {
+	var items []string
+	list := p.accept("(")
+	for {
+		item, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		if item.variable != "" {
+			return nil, fmt.Errorf("in takes literals, not the variable %s", item.variable)
+		}
+		items = append(items, item.literal)
+		if !list || !p.accept(",") {
+			break
+		}
+	}
+	if list {
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+	switch left.variable {
+	case "client":
+		networks, err := parseCIDRList(strings.Join(items, ","))
+		if err != nil {
+			return nil, err
+		}
+		return func(env *hookEnv) bool {
+			for _, network := range networks {
+				if network.Contains(env.ip) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "qname":
+		zones := make([]string, len(items))
+		for i, item := range items {
+			zones[i] = canonicalName(item)
+		}
+		return func(env *hookEnv) bool {
+			for _, zone := range zones {
+				if inZone(env.name(), zone) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+	return func(env *hookEnv) bool {
+		value := left.value(env)
+		for _, item := range items {
+			if strings.EqualFold(value, item) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// hookFlag collects repeated -hook flags, compiled when they are set.
+type hookFlag struct {
+	hooks *Hooks
+}
+
+func (f *hookFlag) String() string {
+	if f.hooks == nil {
+		return ""
+	}
+	var sources []string
+	for _, hook := range *f.hooks {
+		sources = append(sources, hook.Source)
+	}
+	return strings.Join(sources, "; ")
+}
+
+func (f *hookFlag) Set(value string) error {
+	hook, err := parseHook(value)
+	if err != nil {
+		return err
+	}
+	*f.hooks = append(*f.hooks, hook)
+	return nil
+}
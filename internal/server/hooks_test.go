@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHookConditions(t *testing.T) {
+	// a Tuesday afternoon
+	now := time.Date(2026, 3, 3, 14, 30, 0, 0, time.Local)
+	env := func(name string, qtype uint16, client, group string) *hookEnv {
+		return &hookEnv{question: DNSQuestion{Name: labelSequence(name), Type: qtype, Class: ClassIN}, ip: net.ParseIP(client), group: group, proto: "udp", now: now}
+	}
+	for _, tt := range []struct {
+		hook string
+		env  *hookEnv
+		want bool
+	}{
+		{"if qtype == TXT and client in 10.0.0.0/8 then refuse", env("a.example", TypeTXT, "10.1.2.3", "default"), true},
+		{"if qtype == TXT and client in 10.0.0.0/8 then refuse", env("a.example", TypeTXT, "192.0.2.1", "default"), false},
+		{"if qtype == txt then refuse", env("a.example", TypeTXT, "192.0.2.1", "default"), true},
+		{"if qname in corp.example and not group in (staff, admins) then nxdomain", env("wiki.corp.example", TypeA, "192.0.2.1", "kids"), true},
+		{"if qname in corp.example and not group in (staff, admins) then nxdomain", env("wiki.corp.example", TypeA, "192.0.2.1", "staff"), false},
+		{"if qname in corp.example then nxdomain", env("notcorp.example", TypeA, "192.0.2.1", "kids"), false},
+		{`if length > 20 or qname matches "^[a-z0-9]{30,}\." then drop`, env("abcdefghijklmnopqrstuvwxyz0123.t.example", TypeA, "192.0.2.1", ""), true},
+		{"if labels >= 3 then drop", env("a.example", TypeA, "192.0.2.1", ""), false},
+		{"if weekday == tue and hour >= 9 and hour < 17 then refuse", env("a.example", TypeA, "192.0.2.1", ""), true},
+		{"if (proto == tcp or qclass == CH) then pass", env("a.example", TypeA, "192.0.2.1", ""), false},
+		{`if qname == "qname" then drop`, env("qname", TypeA, "192.0.2.1", ""), true},
+	} {
+		hook, err := parseHook(tt.hook)
+		if err != nil {
+			t.Errorf("%s: %v", tt.hook, err)
+			continue
+		}
+		if got := hook.cond(tt.env); got != tt.want {
+			t.Errorf("%s for %s: %v, want %v", tt.hook, domainName(tt.env.question.Name), got, tt.want)
+		}
+	}
+}
+
+func TestParseHookErrors(t *testing.T) {
+	for _, bad := range []string{
+		"qtype == TXT then refuse",
+		"if qtype == TXT",
+		"if qtype == TXT then explode",
+		"if (qtype == TXT then refuse",
+		"if qname matches \"[\" then drop",
+		"if client in 10.0.0.0/33 then drop",
+		"if length > many then drop",
+	} {
+		if _, err := parseHook(bad); err == nil {
+			t.Errorf("parseHook(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestHooksStageFirstMatchDecides(t *testing.T) {
+	srv := newTestServer(t, "-record", "a.lan A 10.0.0.1", "-record", "b.lan A 10.0.0.2",
+		"-hook", "if qname == a.lan then pass", "-hook", "if qname in lan then nxdomain")
+	for name, want := range map[string]Rcode{"a.lan": RcodeSuccess, "b.lan": RcodeNXDomain} {
+		var query Msg
+		query.SetQuestion(name, TypeA)
+		if r := srv.exchangeTest(t, &query); r.Header.Rcode() != want {
+			t.Errorf("%s answered %v, want %v", name, r.Header.Rcode(), want)
+		}
+	}
+}
@@ -0,0 +1,771 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const importUsage = `usage: %s import [flags] pihole|adguard path...
+
+Converts the configuration of a Pi-hole or AdGuard Home server into a config
+file for this one, printed or written to -o, so an existing setup moves over
+in one command. Review it before use: what has no equivalent here is listed
+in comments at the top instead of being dropped silently.
+
+For Pi-hole a path is the /etc/pihole directory, a Teleporter backup (.tar.gz
+of v5, .zip of v6) or one of the files in them: gravity.db for the adlists and
+the allow and deny lists, custom.list for local records, setupVars.conf (v5)
+or pihole.toml (v6) for the upstream and the records, and
+05-pihole-custom-cname.conf for CNAMEs. Stop pihole-FTL or copy gravity.db
+with sqlite3 .backup first; changes still in its write-ahead log are missed.
+
+For AdGuard Home the path is AdGuardHome.yaml: the upstreams, rewrites, filter
+lists, user rules and safe search are converted.
+
+Exact domains become domain rules, which cover their subdomains too, and
+CNAMEs become rewrites.
+
+Flags:
+`
+
+// runImport is the import subcommand. It returns the exit status.
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	output := fs.String("o", "", "file the config is written to (default: standard output)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), importUsage, os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return 2
+	}
+
+	m := &migration{seen: map[string]bool{}}
+	var importFile func(*migration, string) error
+	switch fs.Arg(0) {
+	case "pihole", "pi-hole":
+		m.source, importFile = "Pi-hole", importPihole
+	case "adguard", "adguardhome":
+		m.source, importFile = "AdGuard Home", importAdGuard
+	default:
+		fmt.Fprintf(os.Stderr, "unknown source %q (want pihole or adguard)\n", fs.Arg(0))
+		return 2
+	}
+	for _, p := range fs.Args()[1:] {
+		m.paths = append(m.paths, p)
+		if err := importFile(m, p); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", p, err)
+			return 1
+		}
+	}
+
+	var out bytes.Buffer
+	m.writeTOML(&out)
+	if *output == "" {
+		os.Stdout.Write(out.Bytes())
+	} else if err := os.WriteFile(*output, out.Bytes(), 0o644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "imported %d records, %d rewrites, %d blocklists, %d block and %d allow rules; %d notes\n",
+		len(m.records), len(m.rewrites), len(m.blocklists), len(m.block), len(m.allow), len(m.notes))
+	return 0
+}
+
+// migration collects the settings imported from another server, each checked
+// the way this server will parse it, and notes on what couldn't be.
+type migration struct {
+	source     string
+	paths      []string
+	resolver   string
+	records    []string
+	rewrites   []string
+	blocklists []string
+	block      []string
+	allow      []string
+	safeSearch bool
+	notes      []string
+	seen       map[string]bool
+}
+
+func (m *migration) note(format string, args ...any) {
+	m.notes = append(m.notes, fmt.Sprintf(format, args...))
+}
+
+// add appends value to list unless it is there already.
+func (m *migration) add(list *[]string, kind, value string) {
+	if key := kind + " " + value; !m.seen[key] {
+		m.seen[key] = true
+		*list = append(*list, value)
+	}
+}
+
+// upstream takes the first plain DNS upstream as the resolver. Encrypted
+// upstreams have no equivalent here.
+func (m *migration) upstream(s string) {
+	s = strings.TrimSpace(s)
+	address := s
+	for _, scheme := range []string{"udp://", "tcp://"} {
+		address = strings.TrimPrefix(address, scheme)
+	}
+	if strings.Contains(address, "://") || strings.HasPrefix(address, "sdns:") {
+		m.note("upstream %s: only plain DNS upstreams are supported", s)
+		return
+	}
+	// Pi-hole writes a port after #
+	address = strings.Replace(address, "#", ":", 1)
+	if ip := net.ParseIP(strings.Trim(address, "[]")); ip != nil {
+		address = net.JoinHostPort(ip.String(), "53")
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		m.note("upstream %s: %v", s, err)
+		return
+	}
+	switch {
+	case m.resolver == "":
+		m.resolver = address
+	case m.resolver != address:
+		m.note("upstream %s: only one resolver is used, %s", s, m.resolver)
+	}
+}
+
+// rule adds a block or allow rule, "domain" or "/regexp/".
+func (m *migration) rule(action FilterAction, source, origin string) {
+	if _, err := parseFilterRule(action, source); err != nil {
+		m.note("%s rule %s from %s: %v", action, source, origin, err)
+		return
+	}
+	if action == FilterAllow {
+		m.add(&m.allow, "allow", source)
+	} else {
+		m.add(&m.block, "block", source)
+	}
+}
+
+// regexRule adds a rule for a regular expression of Pi-hole or AdGuard Home.
+func (m *migration) regexRule(action FilterAction, re, origin string) {
+	if strings.Contains(re, ";") {
+		m.note("%s regex %s from %s: options after ; are not supported", action, re, origin)
+		return
+	}
+	m.rule(action, "/"+re+"/", origin)
+}
+
+// record adds a local A or AAAA record for name.
+func (m *migration) record(name, address, origin string) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		m.note("record %s %s from %s: not an address", name, address, origin)
+		return
+	}
+	qtype := "AAAA"
+	if ip.To4() != nil {
+		qtype = "A"
+	}
+	spec := fmt.Sprintf("%s %s %s", canonicalName(name), qtype, ip)
+	if _, err := parseLocalRecord(spec); err != nil {
+		m.note("record %s from %s: %v", spec, origin, err)
+		return
+	}
+	m.add(&m.records, "record", spec)
+}
+
+// cname adds a rewrite of name to target, standing in for a CNAME.
+func (m *migration) cname(name, target, origin string) {
+	name, target = canonicalName(name), canonicalName(target)
+	for _, zone := range []string{name, target} {
+		if _, err := encodeDomainName(zone); err != nil || zone == "" {
+			m.note("CNAME %s to %s from %s: invalid name", name, target, origin)
+			return
+		}
+	}
+	m.add(&m.rewrites, "rewrite", name+"="+target)
+}
+
+func (m *migration) blocklist(url, origin string) {
+	if url == "" {
+		return
+	}
+	m.add(&m.blocklists, "blocklist", url)
+}
+
+// writeTOML writes the config file of the migration, with the notes as
+// comments at the top.
+func (m *migration) writeTOML(w io.Writer) {
+	fmt.Fprintf(w, "# Imported from %s (%s).\n", m.source, strings.Join(m.paths, ", "))
+	if len(m.notes) > 0 {
+		fmt.Fprintln(w, "#\n# Not imported:")
+		for _, note := range m.notes {
+			fmt.Fprintf(w, "#   - %s\n", strings.ReplaceAll(note, "\n", " "))
+		}
+	}
+	if m.resolver != "" {
+		fmt.Fprintf(w, "\n[upstream]\nresolver = %s\n", tomlString(m.resolver))
+	}
+	if len(m.records) > 0 {
+		fmt.Fprintln(w, "\n[local]")
+		writeTOMLArray(w, "records", m.records)
+	}
+	if len(m.blocklists)+len(m.block)+len(m.allow)+len(m.rewrites) > 0 || m.safeSearch {
+		fmt.Fprintln(w, "\n[filtering]")
+		writeTOMLArray(w, "blocklists", m.blocklists)
+		writeTOMLArray(w, "block", m.block)
+		writeTOMLArray(w, "allow", m.allow)
+		writeTOMLArray(w, "rewrites", m.rewrites)
+		if m.safeSearch {
+			fmt.Fprintln(w, "safe_search = true")
+		}
+	}
+}
+
+func writeTOMLArray(w io.Writer, key string, values []string) {
+	if len(values) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%s = [\n", key)
+	for _, value := range values {
+		fmt.Fprintf(w, "  %s,\n", tomlString(value))
+	}
+	fmt.Fprintln(w, "]")
+}
+
+// tomlString quotes s for a config file: as a literal string when it can be,
+// which keeps the backslashes of regexps readable.
+func tomlString(s string) string {
+	if strings.IndexFunc(s, func(r rune) bool { return r == '\'' || r < 0x20 || r == 0x7f }) < 0 {
+		return "'" + s + "'"
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\u%04x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// piholeFiles are the files of /etc/pihole the import reads, with the CNAME
+// file of dnsmasq.d next to it.
+var piholeFiles = []string{"gravity.db", "pihole.toml", "setupVars.conf", "custom.list", "adlists.list", "whitelist.txt", "blacklist.txt", "regex.list", "../dnsmasq.d/05-pihole-custom-cname.conf"}
+
+// importPihole imports a Pi-hole directory, Teleporter backup or file.
+func importPihole(m *migration, p string) error {
+	info, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		found := false
+		for _, name := range piholeFiles {
+			data, err := os.ReadFile(filepath.Join(p, filepath.FromSlash(name)))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			found = true
+			if _, err := piholeFile(m, path.Base(name), data); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		if !found {
+			return fmt.Errorf("no Pi-hole files in the directory")
+		}
+		return nil
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	var files []archiveFile
+	switch {
+	case strings.HasSuffix(p, ".zip"):
+		files, err = zipFiles(data)
+	case strings.HasSuffix(p, ".tar.gz") || strings.HasSuffix(p, ".tgz"):
+		files, err = tarFiles(data)
+	default:
+		handled, err := piholeFile(m, filepath.Base(p), data)
+		if err == nil && !handled {
+			err = fmt.Errorf("not a Pi-hole file the import knows")
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	return importArchive(m, files)
+}
+
+// archiveFile is a file of a Teleporter backup.
+type archiveFile struct {
+	name string
+	data []byte
+}
+
+// importArchive imports the Pi-hole files of a Teleporter backup.
+func importArchive(m *migration, files []archiveFile) error {
+	found := false
+	for _, file := range files {
+		handled, err := piholeFile(m, path.Base(file.name), file.data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file.name, err)
+		}
+		found = found || handled
+	}
+	if !found {
+		return fmt.Errorf("no Pi-hole files in the backup")
+	}
+	return nil
+}
+
+func zipFiles(data []byte) ([]archiveFile, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	var files []archiveFile
+	for _, f := range archive.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, archiveFile{name: f.Name, data: content})
+	}
+	return files, nil
+}
+
+func tarFiles(data []byte) ([]archiveFile, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	archive := tar.NewReader(gz)
+	var files []archiveFile
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := io.ReadAll(archive)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, archiveFile{name: header.Name, data: content})
+	}
+}
+
+// piholeFile imports one Pi-hole file by its name and reports whether it is
+// one the import knows.
+func piholeFile(m *migration, name string, data []byte) (bool, error) {
+	switch name {
+	case "gravity.db":
+		return true, piholeGravity(m, data)
+	case "pihole.toml":
+		return true, piholeTOML(m, data)
+	case "setupVars.conf":
+		eachLine(data, func(line string) {
+			key, value, _ := strings.Cut(line, "=")
+			if strings.HasPrefix(key, "PIHOLE_DNS_") && value != "" {
+				m.upstream(value)
+			}
+		})
+	case "custom.list":
+		eachLine(data, func(line string) {
+			fields := strings.Fields(line)
+			for _, host := range fields[1:] {
+				m.record(host, fields[0], name)
+			}
+			if len(fields) == 1 {
+				m.note("line %q of %s: no host name", line, name)
+			}
+		})
+	case "05-pihole-custom-cname.conf":
+		eachLine(data, func(line string) {
+			if strings.HasPrefix(line, "cname=") {
+				piholeCNAME(m, strings.TrimPrefix(line, "cname="), name)
+			}
+		})
+	case "adlists.list":
+		eachLine(data, func(line string) { m.blocklist(line, name) })
+	case "whitelist.txt":
+		eachLine(data, func(line string) { m.rule(FilterAllow, line, name) })
+	case "blacklist.txt":
+		eachLine(data, func(line string) { m.rule(FilterBlock, line, name) })
+	case "regex.list":
+		eachLine(data, func(line string) { m.regexRule(FilterBlock, line, name) })
+	case "adlist.json":
+		var lists []struct {
+			Address string `json:"address"`
+			Enabled any    `json:"enabled"`
+		}
+		if err := json.Unmarshal(data, &lists); err != nil {
+			return true, err
+		}
+		for _, list := range lists {
+			if truthy(list.Enabled) {
+				m.blocklist(list.Address, name)
+			}
+		}
+	case "whitelist.exact.json", "blacklist.exact.json", "whitelist.regex.json", "blacklist.regex.json":
+		var entries []struct {
+			Domain  string `json:"domain"`
+			Enabled any    `json:"enabled"`
+		}
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return true, err
+		}
+		action := FilterBlock
+		if strings.HasPrefix(name, "whitelist") {
+			action = FilterAllow
+		}
+		for _, entry := range entries {
+			switch {
+			case !truthy(entry.Enabled):
+			case strings.Contains(name, "regex"):
+				m.regexRule(action, entry.Domain, name)
+			default:
+				m.rule(action, entry.Domain, name)
+			}
+		}
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// piholeCNAME imports "name[,name...],target[,ttl]" of a cname= line or a
+// cnameRecords entry.
+func piholeCNAME(m *migration, value, origin string) {
+	fields := strings.Split(value, ",")
+	if _, err := strconv.Atoi(fields[len(fields)-1]); err == nil && len(fields) > 2 {
+		fields = fields[:len(fields)-1]
+	}
+	if len(fields) < 2 {
+		m.note("CNAME %q from %s: want name,target", value, origin)
+		return
+	}
+	target := fields[len(fields)-1]
+	for _, name := range fields[:len(fields)-1] {
+		m.cname(name, target, origin)
+	}
+}
+
+// piholeGravity imports the adlists and the domain lists of gravity.db; the
+// gravity table, the downloaded domains, is left for the blocklists to fetch
+// again.
+func piholeGravity(m *migration, data []byte) error {
+	db, err := openSQLite(data)
+	if err != nil {
+		return err
+	}
+	columns, rows, err := db.Table("adlist")
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		address, _ := sqliteValue(columns, row, "address").(string)
+		switch {
+		case !truthy(sqliteValue(columns, row, "enabled")):
+		case truthy(sqliteValue(columns, row, "type")):
+			m.note("allowlist %s from gravity.db: lists of allowed domains are not supported", address)
+		default:
+			m.blocklist(address, "gravity.db")
+		}
+	}
+	columns, rows, err = db.Table("domainlist")
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		domain, _ := sqliteValue(columns, row, "domain").(string)
+		if !truthy(sqliteValue(columns, row, "enabled")) {
+			continue
+		}
+		// 0 exact allow, 1 exact deny, 2 regex allow, 3 regex deny
+		kind, _ := sqliteValue(columns, row, "type").(int64)
+		action := FilterAllow
+		if kind%2 == 1 {
+			action = FilterBlock
+		}
+		if kind >= 2 {
+			m.regexRule(action, domain, "gravity.db")
+		} else {
+			m.rule(action, domain, "gravity.db")
+		}
+	}
+	if _, rows, err := db.Table("client"); err == nil && len(rows) > 0 {
+		m.note("%d clients and their groups from gravity.db: define groups with [[group]]", len(rows))
+	}
+	return nil
+}
+
+func sqliteValue(columns []string, row []any, name string) any {
+	for i, column := range columns {
+		if column == name && i < len(row) {
+			return row[i]
+		}
+	}
+	return nil
+}
+
+// piholeTOML imports the upstreams, hosts and CNAMEs of the [dns] table of
+// pihole.toml, Pi-hole 6's configuration.
+func piholeTOML(m *migration, data []byte) error {
+	tables, err := parseTOML(string(data))
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		if table.Name != "dns" {
+			continue
+		}
+		for _, item := range tomlStrings(table.Values["upstreams"]) {
+			m.upstream(item)
+		}
+		for _, item := range tomlStrings(table.Values["hosts"]) {
+			fields := strings.Fields(item)
+			for _, host := range fields[1:] {
+				m.record(host, fields[0], "pihole.toml")
+			}
+		}
+		for _, item := range tomlStrings(table.Values["cnameRecords"]) {
+			piholeCNAME(m, item, "pihole.toml")
+		}
+	}
+	return nil
+}
+
+func tomlStrings(value any) []string {
+	items, _ := value.([]any)
+	var values []string
+	for _, item := range items {
+		if s, ok := item.(string); ok && strings.TrimSpace(s) != "" {
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
+// importAdGuard imports AdGuardHome.yaml.
+func importAdGuard(m *migration, p string) error {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	doc, err := parseYAML(string(data))
+	if err != nil {
+		return err
+	}
+	root, ok := doc.(map[string]any)
+	if !ok {
+		return fmt.Errorf("not an AdGuard Home configuration")
+	}
+	dns := yamlMap(root["dns"])
+	filtering := yamlMap(root["filtering"])
+
+	for _, upstream := range yamlStrings(dns["upstream_dns"]) {
+		if strings.HasPrefix(upstream, "#") {
+			continue
+		}
+		if strings.HasPrefix(upstream, "[/") {
+			m.note("upstream %s: upstreams per domain are not supported", upstream)
+			continue
+		}
+		m.upstream(upstream)
+	}
+	if file, _ := dns["upstream_dns_file"].(string); file != "" {
+		m.note("upstream_dns_file %s: list its upstreams in the config instead", file)
+	}
+
+	// rewrites moved from dns to filtering in newer versions
+	rewrites, _ := filtering["rewrites"].([]any)
+	if rewrites == nil {
+		rewrites, _ = dns["rewrites"].([]any)
+	}
+	for _, item := range rewrites {
+		rewrite := yamlMap(item)
+		domain, _ := rewrite["domain"].(string)
+		answer, _ := rewrite["answer"].(string)
+		if enabled, ok := rewrite["enabled"]; ok && !truthy(enabled) {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(domain, "*."):
+			m.note("rewrite of %s: wildcard rewrites are not supported", domain)
+		case answer == "A" || answer == "AAAA":
+			m.note("rewrite of %s to %s: keeping the upstream's records of a type is not supported", domain, answer)
+		case net.ParseIP(answer) != nil:
+			m.record(domain, answer, "rewrites")
+		default:
+			m.cname(domain, answer, "rewrites")
+		}
+	}
+
+	for _, item := range yamlSlice(root["filters"]) {
+		filter := yamlMap(item)
+		if url, _ := filter["url"].(string); truthy(filter["enabled"]) {
+			m.blocklist(url, "filters")
+		}
+	}
+	for _, item := range yamlSlice(root["whitelist_filters"]) {
+		filter := yamlMap(item)
+		if url, _ := filter["url"].(string); truthy(filter["enabled"]) {
+			m.note("allowlist %s: lists of allowed domains are not supported", url)
+		}
+	}
+	for _, rule := range yamlStrings(root["user_rules"]) {
+		adguardRule(m, rule)
+	}
+
+	if truthy(yamlMap(filtering["safe_search"])["enabled"]) || truthy(dns["safesearch_enabled"]) {
+		m.safeSearch = true
+	}
+	if services := yamlSlice(yamlMap(filtering["blocked_services"])["ids"]); len(services) > 0 {
+		m.note("%d blocked services: block their domains instead", len(services))
+	} else if services := yamlSlice(dns["blocked_services"]); len(services) > 0 {
+		m.note("%d blocked services: block their domains instead", len(services))
+	}
+	if clients := yamlSlice(yamlMap(root["clients"])["persistent"]); len(clients) > 0 {
+		m.note("%d persistent clients: define groups with [[group]]", len(clients))
+	}
+	for _, section := range []map[string]any{dns, filtering} {
+		if enabled, ok := section["filtering_enabled"]; ok && !truthy(enabled) {
+			m.note("filtering_enabled is off in AdGuard Home but the imported rules block here")
+		}
+	}
+	return nil
+}
+
+// adguardDomainRule matches the "||domain^" and "@@||domain^" rules of
+// adblock syntax, without modifiers.
+var adguardDomainRule = regexp.MustCompile(`^(@@)?\|\|([a-zA-Z0-9*._-]+)\^(\|)?$`)
+
+// adguardRule imports a user rule of AdGuard Home.
+func adguardRule(m *migration, rule string) {
+	rule = strings.TrimSpace(rule)
+	if rule == "" || strings.HasPrefix(rule, "!") || strings.HasPrefix(rule, "#") {
+		return
+	}
+	if match := adguardDomainRule.FindStringSubmatch(rule); match != nil && !strings.Contains(match[2], "*") {
+		action := FilterBlock
+		if match[1] != "" {
+			action = FilterAllow
+		}
+		m.rule(action, match[2], "user_rules")
+		return
+	}
+	action, pattern := FilterBlock, rule
+	if strings.HasPrefix(rule, "@@") {
+		action, pattern = FilterAllow, rule[2:]
+	}
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		m.regexRule(action, pattern[1:len(pattern)-1], "user_rules")
+		return
+	}
+	fields := strings.Fields(pattern)
+	switch {
+	case len(fields) == 2 && net.ParseIP(fields[0]) != nil:
+		// hosts syntax
+		if ip := net.ParseIP(fields[0]); ip.IsUnspecified() || ip.IsLoopback() {
+			m.rule(FilterBlock, fields[1], "user_rules")
+		} else {
+			m.record(fields[1], fields[0], "user_rules")
+		}
+	case len(fields) == 1 && !strings.ContainsAny(pattern, "|^$*/"):
+		m.rule(action, pattern, "user_rules")
+	default:
+		m.note("user rule %s: only ||domain^, @@||domain^, /regexp/ and hosts rules are supported", rule)
+	}
+}
+
+func yamlMap(value any) map[string]any {
+	m, _ := value.(map[string]any)
+	return m
+}
+
+func yamlSlice(value any) []any {
+	s, _ := value.([]any)
+	return s
+}
+
+func yamlStrings(value any) []string {
+	var values []string
+	for _, item := range yamlSlice(value) {
+		if s, ok := item.(string); ok && strings.TrimSpace(s) != "" {
+			values = append(values, strings.TrimSpace(s))
+		}
+	}
+	return values
+}
+
+// truthy reports whether a value of a JSON, YAML or SQLite file means true.
+func truthy(value any) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case int64:
+		return v != 0
+	case float64:
+		return v != 0
+	case string:
+		b, err := strconv.ParseBool(v)
+		return err == nil && b
+	}
+	return false
+}
+
+// eachLine calls f with the lines of data that aren't empty or # comments,
+// trimmed.
+func eachLine(data []byte, f func(line string)) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			f(line)
+		}
+	}
+}
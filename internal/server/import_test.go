@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestImportGolden converts the configurations in testdata/import and
+// compares the config files with the .toml next to them; -update rewrites
+// those after a deliberate change. The configs must load too.
+func TestImportGolden(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		run    func(*migration, string) error
+		paths  []string
+		golden string
+	}{
+		{"pihole directory", "Pi-hole", importPihole, []string{"testdata/import/etc/pihole"}, "pihole.toml"},
+		{"adguard", "AdGuard Home", importAdGuard, []string{"testdata/import/AdGuardHome.yaml"}, "adguard.toml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &migration{source: tt.source, seen: map[string]bool{}}
+			for _, p := range tt.paths {
+				m.paths = append(m.paths, p)
+				if err := tt.run(m, p); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var got bytes.Buffer
+			m.writeTOML(&got)
+
+			golden := filepath.Join("testdata", "import", tt.golden)
+			want, err := os.ReadFile(golden)
+			switch {
+			case err == nil && bytes.Equal(got.Bytes(), want):
+			case *updateGolden:
+				if err := os.WriteFile(golden, got.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			case err != nil:
+				t.Fatal(err)
+			default:
+				t.Errorf("config differs from %s\n--- want\n%s--- got\n%s", golden, want, got.Bytes())
+			}
+
+			if _, err := parseOptions([]string{"-config", golden}, flag.ContinueOnError, nil); err != nil {
+				t.Errorf("imported config doesn't load: %v", err)
+			}
+		})
+	}
+}
+
+func TestImportPiholeFiles(t *testing.T) {
+	// a file on its own gives what it has, the Pi-hole 6 export its JSON
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"adlists.list", "https://a.example/hosts\n# off\nhttps://b.example/hosts\nhttps://a.example/hosts\n", "blocklists = [\n  'https://a.example/hosts',\n  'https://b.example/hosts',\n]"},
+		{"regex.list", `(^|\.)ads\.example$` + "\n", `block = [` + "\n" + `  '/(^|\.)ads\.example$/',` + "\n]"},
+		{"whitelist.exact.json", `[{"domain":"ok.example","enabled":true},{"domain":"off.example","enabled":false}]`, "allow = [\n  'ok.example',\n]"},
+		{"adlist.json", `[{"address":"https://a.example/hosts","enabled":1},{"address":"https://b.example/hosts","enabled":0}]`, "blocklists = [\n  'https://a.example/hosts',\n]"},
+		{"pihole.toml", "[dns]\nupstreams = [\"1.1.1.1\"]\nhosts = [\"10.0.0.1 a.lan\"]\ncnameRecords = [\"b.lan,a.lan\"]\n", "resolver = '1.1.1.1:53'\n\n[local]\nrecords = [\n  'a.lan A 10.0.0.1',\n]\n\n[filtering]\nrewrites = [\n  'b.lan=a.lan',\n]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &migration{source: "Pi-hole", seen: map[string]bool{}}
+			handled, err := piholeFile(m, tt.name, []byte(tt.data))
+			if !handled || err != nil {
+				t.Fatalf("handled %v, %v", handled, err)
+			}
+			var out bytes.Buffer
+			m.writeTOML(&out)
+			if !strings.Contains(out.String(), tt.want) {
+				t.Errorf("config\n%s\nwithout\n%s", out.String(), tt.want)
+			}
+		})
+	}
+
+	m := &migration{seen: map[string]bool{}}
+	if handled, _ := piholeFile(m, "dhcp.leases", nil); handled {
+		t.Error("dhcp.leases handled")
+	}
+	if _, err := piholeFile(m, "adlist.json", []byte("{")); err == nil {
+		t.Error("invalid adlist.json accepted")
+	}
+}
+
+func TestTOMLString(t *testing.T) {
+	for s, want := range map[string]string{
+		`plain.example`:      `'plain.example'`,
+		`/ads\.example$/`:    `'/ads\.example$/'`,
+		`it's`:               `"it's"`,
+		"tab\there":          `"tab\there"`,
+		`quote " and \ in '`: `"quote \" and \\ in '"`,
+		"bell\a":             `"bell\u0007"`,
+	} {
+		got := tomlString(s)
+		if got != want {
+			t.Errorf("tomlString(%q) = %s, want %s", s, got, want)
+		}
+		// and it reads back
+		tables, err := parseTOML("key = " + got)
+		if err != nil || tables[0].Values["key"] != s {
+			t.Errorf("%s reads back as %#v, %v", got, tables[0].Values["key"], err)
+		}
+	}
+}
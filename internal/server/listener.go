@@ -0,0 +1,508 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/internal/slog"
+)
+
+// tcpIdleTimeout closes TCP connections that stay quiet between queries, as
+// recommended by RFC 7766.
+const tcpIdleTimeout = 10 * time.Second
+
+// listenEndpoint is one address the server listens on. Host may name a
+// network interface instead of an address, which stands for every address of
+// the interface.
+type listenEndpoint struct {
+	Network string // udp, udp4, udp6, tcp, tcp4 or tcp6
+	Host    string
+	Port    string
+	Group   string // -group of every query arriving on the endpoint, empty to match the clients
+}
+
+func (e listenEndpoint) String() string {
+	addr := e.address()
+	if e.Group != "" {
+		addr += "@" + e.Group
+	}
+	return addr
+}
+
+// address returns the endpoint as written in -listen without its group, the
+// key of its -listen-allow and -listen-deny networks.
+func (e listenEndpoint) address() string {
+	addr := net.JoinHostPort(e.Host, e.Port)
+	if e.Network != "udp" {
+		addr = e.Network + "://" + addr
+	}
+	return addr
+}
+
+// parseListenEndpoints parses a comma separated list of endpoints written as
+// host:port for UDP or network://host:port, optionally bound to a group with
+// @name, e.g. "127.0.0.1:53,tcp://127.0.0.1:53,udp://[::1]:53,tcp://eth0:53,
+// 10.8.0.1:53@vpn".
+func parseListenEndpoints(s string) ([]listenEndpoint, error) {
+	var endpoints []listenEndpoint
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		var group string
+		if i := strings.LastIndexByte(item, '@'); i >= 0 {
+			if group = item[i+1:]; group == "" {
+				return nil, fmt.Errorf("no group after @ in %q", item)
+			}
+			item = item[:i]
+		}
+		network, addr, ok := strings.Cut(item, "://")
+		if !ok {
+			network, addr = "udp", item
+		}
+		switch network {
+		case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+		default:
+			return nil, fmt.Errorf("unknown network %q in %q (want udp or tcp)", network, item)
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen address %q: %w", item, err)
+		}
+		endpoints = append(endpoints, listenEndpoint{Network: network, Host: host, Port: port, Group: group})
+	}
+	if len(endpoints) == 0 {
+		return nil, errors.New("no listen address given")
+	}
+	return endpoints, nil
+}
+
+// listenFlag is a flag holding a comma separated list of endpoints, checked
+// when the flag is set.
+type listenFlag struct {
+	endpoints *[]listenEndpoint
+}
+
+func (f *listenFlag) String() string {
+	if f.endpoints == nil {
+		return ""
+	}
+	var list []string
+	for _, endpoint := range *f.endpoints {
+		list = append(list, endpoint.String())
+	}
+	return strings.Join(list, ",")
+}
+
+func (f *listenFlag) Set(value string) error {
+	endpoints, err := parseListenEndpoints(value)
+	if err != nil {
+		return err
+	}
+	*f.endpoints = endpoints
+	return nil
+}
+
+// listenACLFlag collects repeated "endpoint=cidr,cidr" flag values into the
+// ACLs of -listen endpoints, filling either the allow or the deny side.
+type listenACLFlag struct {
+	acls map[string]*ACL
+	deny bool
+}
+
+func (f *listenACLFlag) String() string { return "" }
+
+func (f *listenACLFlag) Set(value string) error {
+	i := strings.LastIndexByte(value, '=')
+	if i < 0 {
+		return fmt.Errorf("expected endpoint=cidr[,cidr...], got %q", value)
+	}
+	endpoints, err := parseListenEndpoints(value[:i])
+	if err != nil {
+		return err
+	}
+	if len(endpoints) != 1 || endpoints[0].Group != "" {
+		return fmt.Errorf("expected a single endpoint without @group, got %q", value[:i])
+	}
+	networks, err := parseCIDRList(value[i+1:])
+	if err != nil {
+		return err
+	}
+	key := endpoints[0].address()
+	acl := f.acls[key]
+	if acl == nil {
+		acl = &ACL{}
+		f.acls[key] = acl
+	}
+	if f.deny {
+		acl.Deny = append(acl.Deny, networks...)
+	} else {
+		acl.Allow = append(acl.Allow, networks...)
+	}
+	return nil
+}
+
+// addresses returns the host:port pairs to bind for the endpoint, one per
+// address of the interface when Host names one.
+func (e listenEndpoint) addresses() ([]string, error) {
+	if e.Host == "" || net.ParseIP(strings.Split(e.Host, "%")[0]) != nil {
+		return []string{net.JoinHostPort(e.Host, e.Port)}, nil
+	}
+	iface, err := net.InterfaceByName(e.Host)
+	if err != nil {
+		// not an interface, leave the host name to the resolver
+		return []string{net.JoinHostPort(e.Host, e.Port)}, nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %w", iface.Name, err)
+	}
+	var hosts []string
+	for _, addr := range addrs {
+		network, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := network.IP
+		if strings.HasSuffix(e.Network, "4") && ip.To4() == nil || strings.HasSuffix(e.Network, "6") && ip.To4() != nil {
+			continue
+		}
+		host := ip.String()
+		if ip.IsLinkLocalUnicast() && ip.To4() == nil {
+			host += "%" + iface.Name
+		}
+		hosts = append(hosts, net.JoinHostPort(host, e.Port))
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("interface %s has no usable addresses", iface.Name)
+	}
+	return hosts, nil
+}
+
+// bind opens the sockets of the endpoint, udpSockets of them per address for
+// UDP.
+func (e listenEndpoint) bind(udpSockets int) ([]net.PacketConn, []net.Listener, error) {
+	addrs, err := e.addresses()
+	if err != nil {
+		return nil, nil, err
+	}
+	var packetConns []net.PacketConn
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		if strings.HasPrefix(e.Network, "udp") {
+			conns, err := listenUDP(e.Network, addr, udpSockets)
+			if err != nil {
+				return nil, nil, err
+			}
+			packetConns = append(packetConns, conns...)
+		} else {
+			listener, err := net.Listen(e.Network, addr)
+			if err != nil {
+				return nil, nil, err
+			}
+			listeners = append(listeners, listener)
+		}
+	}
+	return packetConns, listeners, nil
+}
+
+// listenerEndpoints are the endpoints of the sockets, by listenerKey, as
+// written in -listen, so port 0 stays 0. A query takes the group and the ACL
+// of the endpoint it arrived on.
+type listenerEndpoints map[string]listenEndpoint
+
+// listenerKey identifies a socket by its network, udp or tcp, and address.
+func listenerKey(network string, addr net.Addr) string {
+	return network + " " + addr.String()
+}
+
+// bindListenEndpoints opens the sockets of every endpoint, udpSockets of
+// them per UDP address, 0 meaning one per CPU, and returns the endpoints of
+// the sockets. Endpoints on port 0 of the same
+// host share the port picked for the first of them, so UDP and TCP on an
+// ephemeral port still answer on one port.
+func bindListenEndpoints(endpoints []listenEndpoint, udpSockets int) ([]net.PacketConn, []net.Listener, listenerEndpoints, error) {
+	if udpSockets == 0 {
+		udpSockets = runtime.NumCPU()
+	}
+	if udpSockets < 0 {
+		return nil, nil, nil, fmt.Errorf("invalid -udp-sockets %d, want 0 or more", udpSockets)
+	}
+	if udpSockets > 1 && !reusePortSupported {
+		return nil, nil, nil, fmt.Errorf("-udp-sockets above 1 needs SO_REUSEPORT load balancing, which only Linux has")
+	}
+	var packetConns []net.PacketConn
+	var listeners []net.Listener
+	closeAll := func() {
+		for _, conn := range packetConns {
+			conn.Close()
+		}
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+	bound := listenerEndpoints{}
+	picked := make(map[string]string) // ephemeral port by host
+	for _, endpoint := range endpoints {
+		spec := endpoint
+		ephemeral := endpoint.Port == "0"
+		if port, ok := picked[endpoint.Host]; ok && ephemeral {
+			endpoint.Port = port
+		}
+		conns, endpointListeners, err := endpoint.bind(udpSockets)
+		if err != nil {
+			closeAll()
+			return nil, nil, nil, fmt.Errorf("%s: %w", endpoint, err)
+		}
+		packetConns = append(packetConns, conns...)
+		listeners = append(listeners, endpointListeners...)
+		for _, conn := range conns {
+			bound[listenerKey("udp", conn.LocalAddr())] = spec
+		}
+		for _, listener := range endpointListeners {
+			bound[listenerKey("tcp", listener.Addr())] = spec
+		}
+		if _, ok := picked[endpoint.Host]; ephemeral && !ok {
+			var bound net.Addr
+			if len(conns) > 0 {
+				bound = conns[0].LocalAddr()
+			} else {
+				bound = endpointListeners[0].Addr()
+			}
+			if _, port, err := net.SplitHostPort(bound.String()); err == nil {
+				picked[endpoint.Host] = port
+			}
+		}
+	}
+	return packetConns, listeners, bound, nil
+}
+
+// listenUDP opens count sockets on addr sharing it with SO_REUSEPORT, so the
+// kernel spreads the queries across their read loops, or a plain socket for
+// a count of 1. With port 0 the other sockets join the port the first got.
+func listenUDP(network, addr string, count int) ([]net.PacketConn, error) {
+	if count <= 1 {
+		conn, err := net.ListenPacket(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.PacketConn{conn}, nil
+	}
+	config := net.ListenConfig{Control: setReusePort}
+	var conns []net.PacketConn
+	for i := 0; i < count; i++ {
+		conn, err := config.ListenPacket(context.Background(), network, addr)
+		if err != nil {
+			for _, opened := range conns {
+				opened.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn)
+		addr = conn.LocalAddr().String()
+	}
+	return conns, nil
+}
+
+// writeListenAddrs writes one bound address per line in the -listen syntax,
+// so the file can be handed back to -listen. Sockets sharing a port with
+// SO_REUSEPORT are written once.
+func writeListenAddrs(path string, packetConns []net.PacketConn, listeners []net.Listener) error {
+	var b strings.Builder
+	written := make(map[string]bool)
+	for _, conn := range packetConns {
+		addr := conn.LocalAddr().String()
+		if !written[addr] {
+			written[addr] = true
+			fmt.Fprintln(&b, addr)
+		}
+	}
+	for _, listener := range listeners {
+		fmt.Fprintf(&b, "tcp://%s\n", listener.Addr().String())
+	}
+	return os.WriteFile(path, []byte(b.String()), 0o644)
+}
+
+// serveUDP answers the queries arriving on conn until the server stops.
+func (s *server) serveUDP(conn net.PacketConn) {
+	defer s.serving.Done()
+	endpoint := s.listenerEndpoints[listenerKey("udp", conn.LocalAddr())]
+	for {
+		// each query keeps its buffer until it is answered
+		buf := getSizedBuffer(s.reload.current.Load().opts.maxUDPSize)
+		size, source, truncated, err := readUDP(conn, *buf)
+		if err != nil {
+			putBuffer(buf)
+			if !s.stopping.Load() {
+				slog.Error("error receiving data", "addr", conn.LocalAddr().String(), "err", err)
+			}
+			return
+		}
+		msg := (*buf)[:size]
+		reply := func(response []byte) error {
+			_, err := conn.WriteTo(response, source)
+			return err
+		}
+		if truncated {
+			s.answerTruncated(msg, source, reply)
+			putBuffer(buf)
+			continue
+		}
+		if !s.admit(msg, source, reply) {
+			putBuffer(buf)
+			continue
+		}
+		s.inflight.Add(1)
+		go func() {
+			defer s.inflight.Done()
+			defer s.release()
+			defer putBuffer(buf)
+			s.handle(context.Background(), msg, source, endpoint, reply)
+		}()
+	}
+}
+
+// readUDP reads a datagram into buf and reports whether the end of it was
+// cut off because it didn't fit.
+func readUDP(conn net.PacketConn, buf []byte) (int, net.Addr, bool, error) {
+	udp, ok := conn.(*net.UDPConn)
+	if !ok {
+		size, source, err := conn.ReadFrom(buf)
+		return size, source, false, err
+	}
+	size, _, flags, source, err := udp.ReadMsgUDP(buf, nil)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	return size, source, flags&syscall.MSG_TRUNC != 0, nil
+}
+
+// serveTCP accepts connections on listener until the server stops.
+func (s *server) serveTCP(listener net.Listener) {
+	defer s.serving.Done()
+	endpoint := s.listenerEndpoints[listenerKey("tcp", listener.Addr())]
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !s.stopping.Load() {
+				slog.Error("error accepting connection", "addr", listener.Addr().String(), "err", err)
+			}
+			return
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return
+		}
+		s.serving.Add(1)
+		go s.serveTCPConn(conn, endpoint)
+	}
+}
+
+// serveTCPConn reads the length prefixed queries of a connection, accepted
+// on a listener of endpoint, until the client goes quiet or
+// the server stops. The queries are answered
+// concurrently, in the order their answers are ready (RFC 7766 section 6.2.1.1).
+func (s *server) serveTCPConn(conn net.Conn, endpoint listenEndpoint) {
+	defer s.serving.Done()
+
+	// the queries of a client that closed the connection are given up, their
+	// answers would have nowhere to go
+	ctx, cancel := context.WithCancel(context.Background())
+	var pending sync.WaitGroup // queries read but not answered yet, tarpits included
+	ctx = context.WithValue(ctx, laterRepliesKey{}, &pending)
+	defer func() {
+		// close the connection once the last answer is written
+		s.inflight.Add(1)
+		go func() {
+			defer s.inflight.Done()
+			pending.Wait()
+			cancel()
+			s.untrack(conn)
+			conn.Close()
+		}()
+	}()
+
+	var length [2]byte
+	var writeMu sync.Mutex // answers are written from the query goroutines and tarpit timers
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		// shutdown may have expired the deadline before it was extended
+		if s.stopping.Load() {
+			return
+		}
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			keepPending(err, cancel)
+			return
+		}
+		msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			keepPending(err, cancel)
+			return
+		}
+		reply := func(response []byte) error {
+			framed := make([]byte, 2+len(response))
+			binary.BigEndian.PutUint16(framed, uint16(len(response)))
+			copy(framed[2:], response)
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			_, err := conn.Write(framed)
+			return err
+		}
+		if !s.admit(msg, conn.RemoteAddr(), reply) {
+			continue
+		}
+		pending.Add(1)
+		s.inflight.Add(1)
+		go func() {
+			defer s.inflight.Done()
+			defer pending.Done()
+			defer s.release()
+			s.handle(ctx, msg, conn.RemoteAddr(), endpoint, reply)
+		}()
+	}
+}
+
+// laterRepliesKey holds the WaitGroup of the connection a query came in on,
+// which answers sent after handle returns must count in so the connection
+// stays open for them.
+type laterRepliesKey struct{}
+
+// laterReplies returns the WaitGroup of laterRepliesKey, nil for queries
+// whose transport needs no waiting for, e.g. datagrams.
+func laterReplies(ctx context.Context) *sync.WaitGroup {
+	wg, _ := ctx.Value(laterRepliesKey{}).(*sync.WaitGroup)
+	return wg
+}
+
+// keepPending keeps the queries of a connection going when reading from it
+// stopped with err because the client went quiet or the server is stopping.
+// A connection the client closed or reset cancels them right away.
+func keepPending(err error, cancel context.CancelFunc) {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return
+	}
+	cancel()
+}
+
+// addrIP returns the IP address of a UDP or TCP peer.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// rotatingFile is an append-only log file that is rotated once it grows past
+// MaxSize or gets older than MaxAge, keeping Backups old files named path.1
+// (newest) to path.N, gzipped to path.N.gz when Compress is set.
+type rotatingFile struct {
+	Path     string
+	MaxSize  int64
+	MaxAge   time.Duration
+	Backups  int
+	Compress bool
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	f := &rotatingFile{Path: path, MaxSize: maxSize, Backups: backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tooBig := f.MaxSize > 0 && f.size+int64(len(p)) > f.MaxSize
+	tooOld := f.MaxAge > 0 && time.Since(f.opened) > f.MaxAge
+	if (tooBig || tooOld) && f.size > 0 {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) backup(i int) string {
+	name := fmt.Sprintf("%s.%d", f.Path, i)
+	if f.Compress {
+		name += ".gz"
+	}
+	return name
+}
+
+// rotate shifts the backups up by one and starts a new file. Compression
+// happens inline, which stalls writers for the duration but keeps the backup
+// numbering race free.
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if f.Backups == 0 {
+		os.Remove(f.Path)
+		return f.open()
+	}
+	os.Remove(f.backup(f.Backups))
+	for i := f.Backups - 1; i >= 1; i-- {
+		os.Rename(f.backup(i), f.backup(i+1))
+	}
+	if !f.Compress {
+		os.Rename(f.Path, f.backup(1))
+	} else if err := gzipFile(f.Path, f.backup(1)); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// gzipFile compresses src into dst and removes src.
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readSegment returns the content of a log file, gunzipped when its name
+// ends in .gz.
+func readSegment(t *testing.T, path string) string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		r = zr
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return string(data)
+}
+
+func TestRotatingFileSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+	f, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// each write fills a file of 10 bytes, so every one after the first
+	// rotates
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]string{
+		"query.log":   "fourth\n",
+		"query.log.1": "third\n",
+		"query.log.2": "second\n", // first is past the two backups
+	} {
+		if got := readSegment(t, filepath.Join(filepath.Dir(path), name)); got != want {
+			t.Errorf("%s holds %q, want %q", name, got, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("a third backup kept: %v", err)
+	}
+
+	// writes that fit stay in the file, one over the size starts the next,
+	// and a write alone over the size still goes to an empty file
+	f.Write([]byte("5\n"))
+	if got := readSegment(t, path); got != "fourth\n5\n" {
+		t.Errorf("file holds %q, want both writes", got)
+	}
+	f.Write([]byte("a line over the size\n"))
+	if got := readSegment(t, path); got != "a line over the size\n" {
+		t.Errorf("file holds %q after rotating", got)
+	}
+	if got := readSegment(t, path+".1"); got != "fourth\n5\n" {
+		t.Errorf("backup holds %q", got)
+	}
+}
+
+func TestRotatingFileAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+	f, err := openRotatingFile(path, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.MaxAge = time.Hour
+	f.Write([]byte("old\n"))
+	f.Write([]byte("still young\n"))
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Fatalf("rotated before MaxAge: %v", err)
+	}
+	f.opened = time.Now().Add(-2 * time.Hour)
+	f.Write([]byte("new\n"))
+	if got := readSegment(t, path+".1"); got != "old\nstill young\n" {
+		t.Errorf("backup holds %q", got)
+	}
+	if got := readSegment(t, path); got != "new\n" {
+		t.Errorf("file holds %q", got)
+	}
+
+	// reopening an existing file appends, counting what it holds already
+	f.Close()
+	if f, err = openRotatingFile(path, 8, 1); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write([]byte("more\n"))
+	if got := readSegment(t, path+".1"); got != "new\n" {
+		t.Errorf("backup holds %q after reopening, want the file reopened", got)
+	}
+}
+
+func TestRotatingFileWithoutBackups(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "query.log")
+	f, err := openRotatingFile(path, 4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write([]byte("one\n"))
+	f.Write([]byte("two\n"))
+	if got := readSegment(t, path); got != "two\n" {
+		t.Errorf("file holds %q, want it started over", got)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d files, want the log alone", len(entries))
+	}
+}
+
+func TestQueryLogCompressedSegments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+	file, err := openRotatingFile(path, 300, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	file.Compress = true
+	log := NewQueryLog(file, 1)
+	const queries = 20
+	for i := 0; i < queries; i++ {
+		log.Record(QueryLogEntry{Client: "192.0.2.1", Name: "q" + strings.Repeat("x", i%3) + ".example", Type: "A", Answers: i})
+	}
+
+	// every segment kept reads back, the newest entries in the file and the
+	// older ones in the gzipped backups, in order and without gaps
+	var answers []int
+	for _, segment := range []string{path + ".2.gz", path + ".1.gz", path} {
+		scanner := bufio.NewScanner(strings.NewReader(readSegment(t, segment)))
+		for scanner.Scan() {
+			var entry QueryLogEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				t.Fatalf("%s: %q: %v", segment, scanner.Text(), err)
+			}
+			answers = append(answers, entry.Answers)
+		}
+	}
+	if len(answers) == 0 || len(answers) == queries {
+		t.Fatalf("%d entries kept of %d, want the oldest rotated away", len(answers), queries)
+	}
+	for i, n := range answers {
+		if want := queries - len(answers) + i; n != want {
+			t.Fatalf("entries %v, want the last %d in order", answers, len(answers))
+		}
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Errorf("an uncompressed backup left: %v", err)
+	}
+	if _, err := os.Stat(path + ".3.gz"); !os.IsNotExist(err) {
+		t.Errorf("a third backup kept: %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/internal/slog"
+)
+
+// clientDebugLog writes the records of clients in debug mode whatever the
+// level of the default logger is. setupLogging points it at the same output.
+var clientDebugLog = slog.Default()
+
+// setupLogging installs the default logger, writing text or JSON records to
+// output. The returned LevelVar changes the level of the running logger.
+func setupLogging(level, format string, output io.Writer) (*slog.LevelVar, error) {
+	levelVar := &slog.LevelVar{}
+	if err := levelVar.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q (want debug, info, warn or error)", level)
+	}
+	handler, err := newLogHandler(output, format, levelVar)
+	if err != nil {
+		return nil, err
+	}
+	debugHandler, _ := newLogHandler(output, format, slog.LevelDebug)
+	slog.SetDefault(slog.New(handler))
+	clientDebugLog = slog.New(debugHandler)
+	return levelVar, nil
+}
+
+func newLogHandler(output io.Writer, format string, level slog.Leveler) (slog.Handler, error) {
+	options := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(format) {
+	case "text":
+		return slog.NewTextHandler(output, options), nil
+	case "json":
+		return slog.NewJSONHandler(output, options), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q (want text or json)", format)
+}
+
+// logLevels are the levels SIGUSR1 and SIGUSR2 step through, most verbose
+// first.
+var logLevels = []slog.Level{slog.LevelDebug, slog.LevelInfo, slog.LevelWarn, slog.LevelError}
+
+// stepLogLevel makes the logger more verbose for a negative step and quieter
+// for a positive one, stopping at debug and error.
+func stepLogLevel(levelVar *slog.LevelVar, step int) slog.Level {
+	current := 0
+	for i, level := range logLevels {
+		if levelVar.Level() >= level {
+			current = i
+		}
+	}
+	next := current + step
+	if next < 0 {
+		next = 0
+	}
+	if next >= len(logLevels) {
+		next = len(logLevels) - 1
+	}
+	levelVar.Set(logLevels[next])
+	return logLevels[next]
+}
+
+// debugClients are the client addresses whose queries and responses are
+// logged in full, each until its deadline.
+type debugClients struct {
+	mu      sync.Mutex
+	clients map[string]time.Time
+}
+
+// Enabled reports whether ip is in debug mode.
+func (d *debugClients) Enabled(ip net.IP) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.clients) == 0 {
+		return false
+	}
+	key := ip.String()
+	until, ok := d.clients[key]
+	if ok && time.Now().After(until) {
+		delete(d.clients, key)
+		slog.Info("client debug mode ended", "client", key)
+		return false
+	}
+	return ok
+}
+
+// Set puts ip in debug mode for duration, or takes it out for zero.
+func (d *debugClients) Set(ip net.IP, duration time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.clients == nil {
+		d.clients = make(map[string]time.Time)
+	}
+	if duration <= 0 {
+		delete(d.clients, ip.String())
+		return
+	}
+	d.clients[ip.String()] = time.Now().Add(duration)
+}
+
+// List returns the clients in debug mode with their deadlines.
+func (d *debugClients) List() map[string]time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := make(map[string]time.Time)
+	now := time.Now()
+	for client, until := range d.clients {
+		if now.Before(until) {
+			list[client] = until
+		}
+	}
+	return list
+}
+
+// fatal logs an error and exits, the structured counterpart of log.Fatal.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
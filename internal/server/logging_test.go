@@ -0,0 +1,151 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/internal/slog"
+)
+
+func TestStepLogLevel(t *testing.T) {
+	for _, tt := range []struct {
+		from slog.Level
+		step int
+		want slog.Level
+	}{
+		{slog.LevelInfo, -1, slog.LevelDebug},  // SIGUSR1
+		{slog.LevelInfo, 1, slog.LevelWarn},    // SIGUSR2
+		{slog.LevelDebug, -1, slog.LevelDebug}, // as verbose as it gets
+		{slog.LevelError, 1, slog.LevelError},  // as quiet as it gets
+		{slog.LevelWarn, -1, slog.LevelInfo},
+		{slog.LevelError, -3, slog.LevelDebug},
+		{slog.LevelDebug, 5, slog.LevelError},
+		// levels between the named ones step from the one below
+		{slog.LevelInfo + 2, -1, slog.LevelDebug},
+		{slog.LevelInfo + 2, 1, slog.LevelWarn},
+		{slog.LevelDebug - 4, 1, slog.LevelInfo},
+		{slog.LevelError + 4, -1, slog.LevelWarn},
+	} {
+		var levelVar slog.LevelVar
+		levelVar.Set(tt.from)
+		got := stepLogLevel(&levelVar, tt.step)
+		if got != tt.want || levelVar.Level() != tt.want {
+			t.Errorf("%s stepped by %d: %s, level now %s, want %s", tt.from, tt.step, got, levelVar.Level(), tt.want)
+		}
+	}
+}
+
+func TestDebugClients(t *testing.T) {
+	var d debugClients
+	ip := net.ParseIP("192.0.2.1")
+	if d.Enabled(ip) {
+		t.Error("client in debug mode before it was set")
+	}
+	d.Set(ip, time.Minute)
+	if !d.Enabled(ip) || d.Enabled(net.ParseIP("192.0.2.2")) {
+		t.Error("debug mode not set for the client only")
+	}
+	d.Set(ip, 0)
+	if d.Enabled(ip) || len(d.List()) != 0 {
+		t.Error("debug mode not taken out")
+	}
+	d.Set(ip, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if d.Enabled(ip) || len(d.List()) != 0 || len(d.clients) != 0 {
+		t.Errorf("debug mode kept past its deadline: %v", d.clients)
+	}
+}
+
+func TestLogLevelAPI(t *testing.T) {
+	var levelVar slog.LevelVar
+	mux := http.NewServeMux()
+	(&controlAPI{logLevel: &levelVar}).register(mux)
+	for _, tt := range []struct {
+		method, query string
+		status        int
+		want          slog.Level
+	}{
+		{http.MethodGet, "", http.StatusOK, slog.LevelInfo},
+		{http.MethodPost, "?level=debug", http.StatusOK, slog.LevelDebug},
+		{http.MethodGet, "?level=error", http.StatusOK, slog.LevelDebug}, // reading doesn't set
+		{http.MethodPost, "?level=WARN", http.StatusOK, slog.LevelWarn},
+		{http.MethodPost, "?level=info%2B2", http.StatusOK, slog.LevelInfo + 2},
+		{http.MethodPost, "?level=verbose", http.StatusBadRequest, slog.LevelInfo + 2},
+		{http.MethodPost, "", http.StatusBadRequest, slog.LevelInfo + 2},
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(tt.method, "/log-level"+tt.query, nil))
+		if w.Code != tt.status {
+			t.Errorf("%s /log-level%s: status %d, want %d", tt.method, tt.query, w.Code, tt.status)
+		}
+		if levelVar.Level() != tt.want {
+			t.Errorf("%s /log-level%s: level %s, want %s", tt.method, tt.query, levelVar.Level(), tt.want)
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var report map[string]string
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || report["level"] != tt.want.String() {
+			t.Errorf("%s /log-level%s: %s, want level %s", tt.method, tt.query, w.Body, tt.want)
+		}
+	}
+}
+
+func TestDebugClientsAPI(t *testing.T) {
+	debug := &debugClients{}
+	mux := http.NewServeMux()
+	(&controlAPI{debug: debug}).register(mux)
+	list := func() map[string]time.Time {
+		t.Helper()
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug-clients", nil))
+		var clients map[string]time.Time
+		if err := json.Unmarshal(w.Body.Bytes(), &clients); err != nil {
+			t.Fatalf("%v in %s", err, w.Body)
+		}
+		return clients
+	}
+	post := func(query string) int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/debug-clients"+query, nil))
+		return w.Code
+	}
+
+	start := time.Now()
+	if status := post("?client=192.0.2.1"); status != http.StatusOK {
+		t.Fatalf("status %d adding a client", status)
+	}
+	if status := post("?client=2001:db8::1&for=1h"); status != http.StatusOK {
+		t.Fatalf("status %d adding a client for an hour", status)
+	}
+	clients := list()
+	if until, ok := clients["192.0.2.1"]; !ok || until.Sub(start) < 10*time.Minute || until.Sub(start) > 11*time.Minute {
+		t.Errorf("clients %v, want 192.0.2.1 for the default 10m", clients)
+	}
+	if until, ok := clients["2001:db8::1"]; !ok || until.Sub(start) < time.Hour {
+		t.Errorf("clients %v, want 2001:db8::1 for an hour", clients)
+	}
+	if !debug.Enabled(net.ParseIP("192.0.2.1")) {
+		t.Error("added client not in debug mode")
+	}
+
+	if status := post("?client=192.0.2.1&for=0"); status != http.StatusOK {
+		t.Fatalf("status %d taking a client out", status)
+	}
+	if clients := list(); len(clients) != 1 || debug.Enabled(net.ParseIP("192.0.2.1")) {
+		t.Errorf("clients %v after taking 192.0.2.1 out", clients)
+	}
+
+	for _, query := range []string{"", "?client=host.lan", "?client=192.0.2.1&for=soon"} {
+		if status := post(query); status != http.StatusBadRequest {
+			t.Errorf("POST /debug-clients%s: status %d, want 400", query, status)
+		}
+	}
+	if clients := list(); len(clients) != 1 {
+		t.Errorf("clients %v after rejected requests", clients)
+	}
+}
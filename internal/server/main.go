@@ -0,0 +1,1291 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/internal/slog"
+)
+
+const (
+	// Common DNS question types
+	TypeA     = 1   // IPv4 address
+	TypeNS    = 2   // Name server
+	TypeCNAME = 5   // Canonical name
+	TypeMX    = 15  // Mail exchange
+	TypeAAAA  = 28  // IPv6 address
+	TypeSRV   = 33  // Service location
+	TypeDNAME = 39  // Delegation name
+	TypeTXT   = 16  // Text strings
+	TypeNULL  = 10  // Null record, arbitrary data
+	TypePTR   = 12  // Pointer record
+	TypeSOA   = 6   // Start of authority
+	TypeOPT   = 41  // EDNS pseudo-record
+	TypeIXFR  = 251 // Incremental zone transfer
+	TypeAXFR  = 252 // Full zone transfer
+	TypeANY   = 255 // Wildcard match any type
+)
+
+const (
+	// Classes
+	ClassIN   = 1   // Internet
+	ClassCH   = 3   // Chaos
+	ClassHS   = 4   // Hesiod
+	ClassNONE = 254 // Only in updates, RFC 2136
+	ClassANY  = 255 // Wildcard match any class
+)
+
+// Rcode is the response code in the low four bits of the flags.
+type Rcode uint16
+
+const (
+	RcodeSuccess  Rcode = 0  // No error
+	RcodeFormErr  Rcode = 1  // Format error, the query could not be parsed
+	RcodeServFail Rcode = 2  // Server failure
+	RcodeNXDomain Rcode = 3  // Domain name does not exist
+	RcodeNotImp   Rcode = 4  // Kind of query not implemented
+	RcodeRefused  Rcode = 5  // Query refused by policy
+	RcodeYXDomain Rcode = 6  // Name exists when it should not, e.g. too long after a rewrite
+	RcodeBadVers  Rcode = 16 // EDNS version not supported, extended rcode sent in the OPT
+)
+
+// rcodeNames maps the response codes the server sends to their mnemonics.
+var rcodeNames = map[Rcode]string{
+	RcodeSuccess:  "NOERROR",
+	RcodeFormErr:  "FORMERR",
+	RcodeServFail: "SERVFAIL",
+	RcodeNXDomain: "NXDOMAIN",
+	RcodeNotImp:   "NOTIMP",
+	RcodeRefused:  "REFUSED",
+	RcodeYXDomain: "YXDOMAIN",
+	RcodeBadVers:  "BADVERS",
+}
+
+func (r Rcode) String() string {
+	if name, ok := rcodeNames[r]; ok {
+		return name
+	}
+	return "RCODE" + strconv.Itoa(int(r))
+}
+
+// Opcode is the kind of query, in bits 11 to 14 of the flags. Only standard
+// queries are answered, the others get NOTIMP.
+type Opcode uint16
+
+const (
+	OpcodeQuery  Opcode = 0 // Standard query
+	OpcodeIQuery Opcode = 1 // Inverse query, obsolete
+	OpcodeStatus Opcode = 2 // Server status request
+	OpcodeNotify Opcode = 4 // Zone change notification
+	OpcodeUpdate Opcode = 5 // Dynamic update
+)
+
+// Header flag bits, see the layout below.
+const (
+	flagQR     = 1 << 15 // response
+	opcodeMask = 0xF << 11
+	rcodeMask  = 0xF
+	flagAA     = 1 << 10 // authoritative answer
+	flagTC     = 1 << 9  // truncated
+	flagRD     = 1 << 8  // recursion desired
+	flagRA     = 1 << 7  // recursion available
+	flagAD     = 1 << 5  // authentic data, RFC 4035
+	flagCD     = 1 << 4  // checking disabled, RFC 4035
+)
+
+/*
+	                              1  1  1  1  1  1
+	0  1  2  3  4  5  6  7  8  9  0  1  2  3  4  5
+
++--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+|                      ID                       |
++--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+|QR|   Opcode  |AA|TC|RD|RA|   Z    |   RCODE   |
++--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+|                    QDCOUNT                    |
++--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+|                    ANCOUNT                    |
++--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+|                    NSCOUNT                    |
++--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+|                    ARCOUNT                    |
++--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+*/
+type DNSHeader struct {
+	ID      uint16
+	Flags   uint16 // embedded struct for multiple flags
+	QDCount uint16
+	ANCount uint16
+	NSCount uint16
+	ARCount uint16
+}
+
+// Opcode returns the kind of query of the message.
+func (h DNSHeader) Opcode() Opcode {
+	return Opcode(h.Flags & opcodeMask >> 11)
+}
+
+// Rcode returns the response code of the message.
+func (h DNSHeader) Rcode() Rcode {
+	return Rcode(h.Flags & rcodeMask)
+}
+
+// SetRcode replaces the response code of the message.
+func (h *DNSHeader) SetRcode(rcode Rcode) {
+	h.Flags = h.Flags&^rcodeMask | uint16(rcode)
+}
+
+type DNSQuestion struct {
+	Name  []byte
+	Type  uint16
+	Class uint16
+}
+
+type DNSResourceRecord struct {
+	Name     []byte
+	Type     uint16
+	Class    uint16
+	TTL      uint32
+	RDLength uint16
+	RData    []byte
+}
+
+type DNSResponse struct {
+	Header DNSHeader
+	// Add other fields as needed for your response
+	Question   []DNSQuestion
+	Answers    []DNSResourceRecord
+	Authority  []DNSResourceRecord
+	Additional []DNSResourceRecord
+}
+
+// subcommands are run by the first argument of the binary with the
+// arguments after it, and return the exit status.
+var subcommands = map[string]func(args []string) int{
+	"ctl":    runCtl,
+	"query":  runQuery,
+	"replay": runReplay,
+	"bench":  runBench,
+	"import": runImport,
+}
+
+// Main runs the binary: the subcommand named by the first argument, or else
+// the server configured by the command line. It doesn't return.
+func Main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(run(os.Args[2:]))
+		}
+	}
+
+	opts, err := parseOptions(os.Args[1:], flag.ExitOnError, os.Getenv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if opts.signal != "" {
+		if err := signalServer(opts.pidFile, opts.signal, opts.shutdownTimeout+5*time.Second); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if opts.daemon && !inDaemon() {
+		os.Exit(startDaemon(opts.logFile))
+	}
+
+	var logOutput io.Writer = os.Stderr
+	if opts.logFile != "" {
+		file, err := openLogFile(opts.logFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		logOutput = file
+	}
+	logLevel, err := setupLogging(opts.logLevel, opts.logFormat, logOutput)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// the PID file goes first, so a second server gives up before touching
+	// the sockets or log files of the running one
+	if opts.pidFile != "" {
+		pid, err := createPIDFile(opts.pidFile)
+		if err != nil {
+			fatal("failed to create PID file", "err", err)
+		}
+		defer pid.Remove()
+	}
+
+	initial, err := newPolicy(opts, nil)
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+	applyMemoryLimit(initial.budget, memoryBudget{})
+	initial.start(nil)
+	health := &HealthChecker{Upstreams: initial.upstreams, Lists: initial.lists}
+	reload := &reloader{args: os.Args[1:], health: health, logLevel: logLevel}
+	reload.current.Store(initial)
+
+	adminMux := http.NewServeMux()
+	adminMux.HandleFunc("/blocklists", func(w http.ResponseWriter, r *http.Request) {
+		lists := reload.current.Load().lists
+		if lists == nil {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, lists.Status())
+	})
+	var auditFile *rotatingFile
+	if opts.auditPath != "" {
+		if auditFile, err = openRotatingFile(opts.auditPath, 10<<20, 3); err != nil {
+			fatal("failed to open audit log", "err", err)
+		}
+		defer auditFile.Close()
+	}
+	auditSize := capped(opts.auditSize, initial.budget.audit, auditEntryMemory)
+	if auditSize != opts.auditSize {
+		slog.Warn("audit-size lowered to fit the memory budget", "audit_size", auditSize)
+	}
+	audit := NewAuditLog(auditSize, auditFile)
+	adminMux.Handle("/audit", audit)
+
+	var queryLog *QueryLog
+	if opts.queryLogPath != "" {
+		if opts.queryLogSample < 0 || opts.queryLogSample > 1 {
+			fatal("invalid -query-log-sample, want a fraction between 0 and 1", "sample", opts.queryLogSample)
+		}
+		file, err := openRotatingFile(opts.queryLogPath, int64(opts.queryLogSize)<<20, opts.queryLogBackups)
+		if err != nil {
+			fatal("failed to open query log", "err", err)
+		}
+		defer file.Close()
+		file.MaxAge, file.Compress = opts.queryLogAge, opts.queryLogCompress
+		queryLog = NewQueryLog(file, opts.queryLogSample)
+	}
+
+	var quarantine *Quarantine
+	if opts.quarantineDir != "" {
+		if opts.quarantineMax < 1 {
+			fatal("invalid -quarantine-max, want at least 1", "max", opts.quarantineMax)
+		}
+		quarantine = NewQuarantine(opts.quarantineDir, opts.quarantineMax)
+		defer quarantine.Close()
+	}
+
+	recent := NewRecentQueries(opts.recentQueries)
+	adminMux.Handle("/queries", recent)
+	var history *History
+	if opts.historyDir != "" {
+		if opts.historyRetention < 0 {
+			fatal("invalid -history-retention, want 0 or more", "retention", opts.historyRetention)
+		}
+		history = NewHistory(opts.historyDir, opts.historyRetention)
+		defer history.Close()
+	}
+	adminMux.Handle("/history", history)
+	rules, err := LoadAdminRules(opts.adminRulesFile)
+	if err != nil {
+		fatal("failed to read admin rules", "err", err)
+	}
+	adminMux.Handle("/rules", rules)
+	adminMux.Handle("/", dashboard())
+
+	adminMux.HandleFunc("/healthz", health.Healthz)
+	adminMux.HandleFunc("/readyz", health.Readyz)
+
+	stats := NewStats()
+	analytics := NewAnalytics()
+	traffic := NewTraffic()
+	initial.budget.limitTracking(analytics, traffic)
+	blocking := &blockingSwitch{}
+	debug := &debugClients{}
+	control := &controlAPI{reload: reload, blocking: blocking, stats: stats, analytics: analytics, traffic: traffic, logLevel: logLevel, debug: debug, mux: DefaultServeMux}
+	control.register(adminMux)
+
+	srv := &server{reload: reload, audit: audit, queryLog: queryLog, quarantine: quarantine, mux: DefaultServeMux, health: health, stats: stats, analytics: analytics, traffic: traffic, recent: recent, history: history, rules: rules, blocking: blocking, debug: debug, udpBatch: opts.udpBatch}
+	adminMux.HandleFunc("/memory", srv.handleMemory)
+
+	var httpServers []*http.Server
+	if opts.adminAddr != "" {
+		var handler http.Handler = adminMux
+		// the endpoints reload, unblock and rewrite the rules, only the
+		// server's own user may reach them without a token
+		if opts.adminTokenFile != "" {
+			token, err := readToken(opts.adminTokenFile)
+			if err != nil {
+				fatal("failed to read admin token", "err", err)
+			}
+			handler = requireToken(token, adminMux)
+		} else if !isUnixAdminAddr(opts.adminAddr) {
+			fatal("-admin-token-file is required unless -admin is a unix socket", "addr", opts.adminAddr)
+		}
+		handler = rejectCrossSite(handler)
+		adminServer, err := serveAdmin("admin", opts.adminAddr, handler)
+		if err != nil {
+			fatal("failed to start admin endpoints", "addr", opts.adminAddr, "err", err)
+		}
+		httpServers = append(httpServers, adminServer)
+	}
+	if opts.pprofAddr != "" {
+		profilingServer, err := serveAdmin("profiling", opts.pprofAddr, profilingMux())
+		if err != nil {
+			fatal("failed to start profiling endpoints", "addr", opts.pprofAddr, "err", err)
+		}
+		httpServers = append(httpServers, profilingServer)
+	}
+
+	// sockets passed by systemd take the place of -listen, so the service can
+	// use port 53 without the privilege to bind it
+	packetConns, listeners, err := activatedSockets()
+	if err != nil {
+		fatal("failed to use sockets from systemd", "err", err)
+	}
+	if len(packetConns) > 0 || len(listeners) > 0 {
+		slog.Info("using sockets from systemd", "datagram", len(packetConns), "stream", len(listeners))
+	} else {
+		packetConns, listeners, srv.listenerEndpoints, err = bindListenEndpoints(opts.listen, opts.udpSockets)
+		if err != nil {
+			fatal("failed to bind to address", "err", err)
+		}
+	}
+	for _, conn := range packetConns {
+		defer conn.Close()
+		slog.Info("listening", "network", "udp", "addr", conn.LocalAddr().String())
+	}
+	for _, listener := range listeners {
+		defer listener.Close()
+		slog.Info("listening", "network", "tcp", "addr", listener.Addr().String())
+	}
+	if opts.listenAddrFile != "" {
+		if err := writeListenAddrs(opts.listenAddrFile, packetConns, listeners); err != nil {
+			fatal("failed to write listen address file", "err", err)
+		}
+	}
+
+	// on SIGTERM/SIGINT stop reading from the sockets, then drain whatever is
+	// still in flight below
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		slog.Info("shutting down", "signal", sig.String())
+		srv.shutdown()
+	}()
+
+	// SIGUSR1 makes the log more verbose, SIGUSR2 quieter
+	levelSignals := make(chan os.Signal, 1)
+	signal.Notify(levelSignals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range levelSignals {
+			step := 1
+			if sig == syscall.SIGUSR1 {
+				step = -1
+			}
+			slog.Warn("log level changed", "level", stepLogLevel(logLevel, step).String())
+		}
+	}()
+
+	// on SIGHUP load the configuration again, keeping the running one if the
+	// new one is invalid
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			slog.Info("reloading configuration")
+			if err := reload.Reload(); err != nil {
+				slog.Error("configuration reload rejected", "err", err)
+			}
+		}
+	}()
+
+	// everything privileged is done, the sockets, log files and admin
+	// endpoints stay usable after switching users
+	if opts.runAsUser != "" || opts.chroot != "" {
+		if err := dropPrivileges(opts.runAsUser, opts.chroot); err != nil {
+			fatal("failed to drop privileges", "err", err)
+		}
+	}
+
+	srv.serve(packetConns, listeners)
+	notifyDaemonReady()
+	srv.serving.Wait()
+
+	drained := make(chan struct{})
+	go func() {
+		srv.inflight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(opts.shutdownTimeout):
+		slog.Warn("shutdown timeout expired with queries still in flight", "timeout", opts.shutdownTimeout)
+	}
+	for _, httpServer := range httpServers {
+		ctx, cancel := context.WithTimeout(context.Background(), opts.shutdownTimeout)
+		httpServer.Shutdown(ctx)
+		cancel()
+	}
+	slog.Info("stopped")
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// stringsFlag collects the values of a repeatable string flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// query tracks a received query until it is answered or dropped, so the
+// outcome can be logged with the per-query fields.
+type query struct {
+	ctx       context.Context // done at the deadline of the query or when the client is gone
+	reply     func([]byte) error
+	client    net.Addr
+	ip        net.IP
+	start     time.Time
+	group     *ClientGroup
+	questions []DNSQuestion
+	queryLog  *QueryLog
+	stats     *Stats
+	analytics *Analytics
+	traffic   *Traffic
+	recent    *RecentQueries
+	history   *History
+	slow      time.Duration  // threshold above which the query is logged as slow
+	maxSize   int            // largest response the client takes, see responseLimit
+	edns      int            // payload size advertised in the OPT of the response, 0 for clients without EDNS
+	extRcode  Rcode          // rcode that needs the OPT, replacing the one of the header
+	debug     bool           // log the query and response in full
+	recursion bool           // the client's group forwards to an upstream
+	policy    *policy        // policy the query is answered with
+	listener  listenEndpoint // endpoint the query arrived on, zero when it didn't come from -listen
+	msg       []byte         // the query as received, valid until handle returns
+	request   *Msg           // the query parsed, valid until handle returns
+	stripped  map[int]bool   // questions -qtype-rule answers with no data, not forwarded
+	rewrites  []*RewriteRule // -rewrite rules applied to the questions, undone in the response
+	asked     []DNSQuestion  // the questions as the client asked them, when -rewrite moved some
+	blocked   bool           // blocked by the filter
+	upstream  string         // upstream the query was forwarded to, if any
+	finished  bool           // answered or dropped
+	pending   bool           // answered later, e.g. by the tarpit
+
+	ednsValues map[uint16]any    // EDNS options of the query, as their handlers parsed them
+	ednsSet    map[uint16][]byte // EDNS options set for the response with SetEDNSOption
+
+	stages []queryStage
+	mark   time.Time // end of the last stage
+}
+
+// queryStage is a step of the handling of a query and the time it took.
+type queryStage struct {
+	name string
+	took time.Duration
+}
+
+// stage records the time since the previous stage, or since the query was
+// received, as spent in the named stage.
+func (q *query) stage(name string) {
+	now := time.Now()
+	last := q.mark
+	if last.IsZero() {
+		last = q.start
+	}
+	q.stages = append(q.stages, queryStage{name: name, took: now.Sub(last)})
+	q.mark = now
+}
+
+// respond packs the response, sends it to the client and logs the query.
+func (q *query) respond(response DNSResponse) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	q.respondPacked(appendDNSResponse((*buf)[:0], response))
+}
+
+// respondPacked sends a packed response to the client and logs the query. A
+// response larger than the client takes is truncated.
+func (q *query) respondPacked(data []byte) {
+	q.finished = true
+	if len(q.rewrites) > 0 {
+		data = q.restoreRewrites(data)
+	}
+	limit := q.maxSize
+	var options []EDNSOption
+	if q.edns > 0 {
+		options = q.responseOptions()
+		limit -= optRecordSize + ednsOptionsSize(options)
+	}
+	if q.maxSize > 0 && len(data) > limit {
+		data = truncateResponse(data)
+	}
+	rcode := Rcode(0)
+	if len(data) >= 12 {
+		rcode = Rcode(data[3]) & rcodeMask
+	}
+	if q.edns > 0 && len(data) >= 12 {
+		// a client that sent an OPT gets one back, RFC 6891 7
+		if q.extRcode != 0 {
+			rcode = q.extRcode
+		}
+		data = addOPT(data, q.edns, rcode, options...)
+	}
+	if len(data) >= 12 {
+		// recursion is available to the clients of groups with an upstream
+		data[3] &^= flagRA
+		if q.recursion {
+			data[3] |= flagRA
+		}
+	}
+	if err := q.reply(data); err != nil {
+		slog.Error("failed to send response", "client", q.client.String(), "err", err)
+	}
+	q.stage("respond")
+	header, _ := parseDNSHeader(data)
+	if q.debug {
+		response, _, _ := parseDNSResponse(nil, data)
+		clientDebugLog.Info("client debug response", "client", q.client.String(), "id", header.ID, "flags", fmt.Sprintf("%04x", header.Flags),
+			"rcode", rcode.String(), "answers", answerSummary(response.Answers), "data", fmt.Sprintf("%x", data))
+	}
+	q.count(int(rcode))
+	q.log(QueryLogEntry{Rcode: int(rcode), Answers: int(header.ANCount)})
+}
+
+// drop logs a query that is not answered.
+func (q *query) drop(reason string) {
+	q.finished = true
+	if q.debug {
+		clientDebugLog.Info("client debug drop", "client", q.client.String(), "reason", reason)
+	}
+	q.count(-1)
+	q.log(QueryLogEntry{Dropped: reason})
+}
+
+// answered reports whether the query was answered or dropped, or will be.
+// Once pending, the query belongs to whatever answers it later, so finished
+// isn't read.
+func (q *query) answered() bool {
+	return q.pending || q.finished
+}
+
+// RemoteAddr is the client's address, a query being the ResponseWriter of
+// the handlers and middleware it goes through.
+func (q *query) RemoteAddr() net.Addr { return q.client }
+
+// Context is the context of the query, done when -query-timeout passes or the
+// client closes its TCP connection.
+func (q *query) Context() context.Context { return q.ctx }
+
+// Transport is the transport the query came in on.
+func (q *query) Transport() string { return transportName(q.client) }
+
+// MaxSize is the room for the response, the OPT record the server adds
+// taken off. Options added to it make the room smaller still.
+func (q *query) MaxSize() int {
+	if q.edns > 0 {
+		return q.maxSize - optRecordSize
+	}
+	return q.maxSize
+}
+
+// WriteMsg sends m unless the query was answered or dropped already, or m
+// doesn't answer it. Like Pack, it sets the counts of the header from the
+// sections, whatever the handler left in them.
+func (q *query) WriteMsg(m *Msg) error {
+	if q.answered() {
+		return errResponseWritten
+	}
+	if err := q.checkReply(m); err != nil {
+		return err
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	q.respondPacked(m.AppendPack((*buf)[:0]))
+	return nil
+}
+
+// Write sends the packed response data like WriteMsg.
+func (q *query) Write(data []byte) error {
+	if q.answered() {
+		return errResponseWritten
+	}
+	m, _, err := parseDNSResponse(nil, data)
+	if err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	if err := q.checkReply(&m); err != nil {
+		return err
+	}
+	q.respondPacked(data)
+	return nil
+}
+
+// checkReply reports whether m may be sent as the response to the query.
+func (q *query) checkReply(m *Msg) error {
+	if err := checkResponse(q.request, m); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	if _, ok := findOPT(m.Additional); ok {
+		return errors.New("invalid response: OPT record included, the server adds one when the query has it")
+	}
+	return nil
+}
+
+// count adds the query to the stats, the analytics and the traffic under
+// its first question.
+func (q *query) count(rcode int) {
+	var name, qtype string
+	if len(q.questions) > 0 {
+		name, qtype = domainName(q.questions[0].Name), typeName(q.questions[0].Type)
+	}
+	q.stats.record(name, qtype, rcode)
+	q.analytics.record(q.ip.String(), name, rcode, q.start)
+	q.traffic.record(q.ip.String(), name, q.blocked, q.start)
+}
+
+// log completes the entry with the query's fields and sends it to the logger
+// and the query log.
+func (q *query) log(entry QueryLogEntry) {
+	duration := time.Since(q.start)
+	slow := q.slow > 0 && duration >= q.slow
+	if slow {
+		q.stats.slow.Add(1)
+	}
+	if q.group.Quiet {
+		return
+	}
+	entry.Time = q.start
+	entry.Client = q.ip.String()
+	entry.Group = q.group.Name
+	entry.Duration = float64(duration) / float64(time.Millisecond)
+	entry.Blocked = q.blocked
+	entry.Upstream = q.upstream
+	if len(q.questions) > 0 {
+		entry.Name = domainName(q.questions[0].Name)
+		if unicode := idnaToUnicode(entry.Name); unicode != entry.Name {
+			entry.Unicode = unicode
+		}
+		entry.Type = typeName(q.questions[0].Type)
+	}
+	q.queryLog.Record(entry)
+	q.recent.Record(entry)
+	q.history.Record(entry)
+
+	args := []any{"client", entry.Client, "group", entry.Group, "qname", entry.Name, "qtype", entry.Type}
+	if entry.Dropped != "" {
+		args = append(args, "dropped", entry.Dropped)
+	} else {
+		args = append(args, "rcode", entry.Rcode, "answers", entry.Answers)
+	}
+	args = append(args, "duration", duration)
+	slog.Info("query", args...)
+	if slow {
+		slog.Warn("slow query", append(args, "stages", q.stageSummary())...)
+	}
+}
+
+// stageSummary lists the stages with their durations, e.g.
+// "parse=8µs policy=3µs upstream=1.2s respond=40µs".
+func (q *query) stageSummary() string {
+	parts := make([]string, len(q.stages))
+	for i, stage := range q.stages {
+		parts[i] = stage.name + "=" + stage.took.String()
+	}
+	return strings.Join(parts, " ")
+}
+
+// questionSummary describes questions for the debug log, e.g.
+// "example.com IN A".
+func questionSummary(questions []DNSQuestion) string {
+	parts := make([]string, len(questions))
+	for i, question := range questions {
+		parts[i] = fmt.Sprintf("%s %s %s", domainName(question.Name), className(question.Class), typeName(question.Type))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// answerSummary describes records for the debug log with their raw data, e.g.
+// "example.com 300 IN A 5db8d822".
+func answerSummary(answers []DNSResourceRecord) string {
+	parts := make([]string, len(answers))
+	for i, answer := range answers {
+		parts[i] = fmt.Sprintf("%s %d %s %s %x", domainName(answer.Name), answer.TTL, className(answer.Class), typeName(answer.Type), answer.RData)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func className(class uint16) string {
+	switch class {
+	case ClassIN:
+		return "IN"
+	case ClassCH:
+		return "CH"
+	case ClassHS:
+		return "HS"
+	case ClassNONE:
+		return "NONE"
+	case ClassANY:
+		return "ANY"
+	}
+	return fmt.Sprintf("CLASS%d", class)
+}
+
+// classRcode returns the rcode for a query with a question in a class the
+// server doesn't serve, or reports false when every question is IN or CH.
+// Hesiod and QCLASS ANY are refused, the server has no data in the one and
+// won't merge the classes for the other; classes it knows nothing of aren't
+// implemented.
+func classRcode(questions []DNSQuestion) (Rcode, bool) {
+	for _, question := range questions {
+		switch question.Class {
+		case ClassIN, ClassCH:
+		case ClassHS, ClassANY:
+			return RcodeRefused, true
+		default:
+			return RcodeNotImp, true
+		}
+	}
+	return RcodeSuccess, false
+}
+
+// permitted checks the client against the listener ACL and the ACL of the zone
+// of every question.
+func permitted(listenerACL *ACL, zoneACLs ZoneACLs, ip net.IP, questions []DNSQuestion) bool {
+	if !listenerACL.Permits(ip) {
+		return false
+	}
+	for _, question := range questions {
+		if !zoneACLs.Lookup(NameFromWire(question.Name)).Permits(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// responseFlags builds the flags of a response to a query with the flags
+// query: QR, the OPCODE and RD of the query and rcode. Every other bit is
+// cleared; callers add AA for authoritative data, and RA and TC are set when
+// the response is sent.
+func responseFlags(query uint16, rcode Rcode) uint16 {
+	return flagQR | query&(opcodeMask|flagRD) | uint16(rcode)
+}
+
+// errorResponse builds an answerless response to the query carrying rcode.
+func errorResponse(header DNSHeader, questions []DNSQuestion, rcode Rcode) DNSResponse {
+	var response DNSResponse
+	response.SetReply(&DNSResponse{Header: header, Question: questions}).SetRcode(rcode)
+	return response
+}
+
+// Limits of names and labels, RFC 1035 2.3.4. The name limit counts the
+// length bytes and the root.
+const (
+	maxLabelLength = 63
+	maxNameLength  = 255
+)
+
+// maxCompressionPointers bounds the pointers followed in one name, which is
+// more than any valid message needs and stops pointer loops.
+const maxCompressionPointers = 64
+
+var (
+	errShortMessage = errors.New("message truncated")
+	errPointerLoop  = errors.New("too many compression pointers")
+	errNameTooLong  = errors.New("name longer than 255 bytes")
+	errCountTooHigh = errors.New("section counts exceed the message")
+)
+
+// The smallest question and record, with the root as name.
+const (
+	minQuestionSize = 1 + 4
+	minRecordSize   = 1 + 10
+)
+
+// The parse functions below work on the message bytes directly, without
+// reflection. Names and record data are appended to a dst buffer that the
+// caller provides, usually a pooled one, so parsing a message allocates
+// nothing once dst is large enough. The parsed values alias dst and are only
+// valid as long as it is.
+
+// parseDNSHeader decodes the 12 byte header at the start of msg.
+func parseDNSHeader(msg []byte) (DNSHeader, error) {
+	if len(msg) < 12 {
+		return DNSHeader{}, errShortMessage
+	}
+	return DNSHeader{
+		ID:      binary.BigEndian.Uint16(msg[0:2]),
+		Flags:   binary.BigEndian.Uint16(msg[2:4]),
+		QDCount: binary.BigEndian.Uint16(msg[4:6]),
+		ANCount: binary.BigEndian.Uint16(msg[6:8]),
+		NSCount: binary.BigEndian.Uint16(msg[8:10]),
+		ARCount: binary.BigEndian.Uint16(msg[10:12]),
+	}, nil
+}
+
+// parseDNSResponse decodes msg section by section, as many questions and
+// records as the header counts, which must be all the message holds. At most
+// one OPT record is allowed, in the additional section (RFC 6891 6.1.1).
+// Queries are parsed with it as well.
+func parseDNSResponse(dst, msg []byte) (DNSResponse, []byte, error) {
+	var response DNSResponse
+	var err error
+	if response.Header, err = parseDNSHeader(msg); err != nil {
+		return response, dst, err
+	}
+	// checked before anything is allocated for them
+	if !countsFit(response.Header, len(msg)) {
+		return response, dst, errCountTooHigh
+	}
+	offset := 12
+	response.Question = make([]DNSQuestion, 0, response.Header.QDCount)
+	for i := 0; i < int(response.Header.QDCount); i++ {
+		var question DNSQuestion
+		if question, dst, offset, err = parseDNSQuestion(dst, msg, offset); err != nil {
+			return response, dst, err
+		}
+		response.Question = append(response.Question, question)
+	}
+	if response.Answers, dst, offset, err = parseDNSRecords(dst, msg, offset, response.Header.ANCount); err != nil {
+		return response, dst, err
+	}
+	if response.Authority, dst, offset, err = parseDNSRecords(dst, msg, offset, response.Header.NSCount); err != nil {
+		return response, dst, err
+	}
+	if response.Additional, dst, offset, err = parseDNSRecords(dst, msg, offset, response.Header.ARCount); err != nil {
+		return response, dst, err
+	}
+	if offset != len(msg) {
+		return response, dst, fmt.Errorf("%d bytes after the last record", len(msg)-offset)
+	}
+	opts := 0
+	for i, section := range [][]DNSResourceRecord{response.Answers, response.Authority, response.Additional} {
+		for _, record := range section {
+			if record.Type != TypeOPT {
+				continue
+			}
+			if opts++; i != 2 || opts > 1 || len(record.Name) != 1 {
+				return response, dst, errors.New("OPT record not alone in the additional section or not owned by the root")
+			}
+		}
+	}
+	return response, dst, nil
+}
+
+// parseDNSRecords decodes the count resource records of a section starting at
+// offset in msg.
+func parseDNSRecords(dst, msg []byte, offset int, count uint16) ([]DNSResourceRecord, []byte, int, error) {
+	records := make([]DNSResourceRecord, 0, count)
+	for i := 0; i < int(count); i++ {
+		var record DNSResourceRecord
+		var err error
+		if record, dst, offset, err = parseDNSAnswer(dst, msg, offset); err != nil {
+			return records, dst, 0, err
+		}
+		records = append(records, record)
+	}
+	return records, dst, offset, nil
+}
+
+// parseDNSName appends the name at offset in msg to dst as an uncompressed
+// label sequence, following compression pointers. It returns the grown dst
+// and the offset after the name.
+func parseDNSName(dst, msg []byte, offset int) ([]byte, int, error) {
+	start := len(dst)
+	next := -1 // where parsing continues, known after the first pointer
+	for pointers := 0; ; {
+		if offset >= len(msg) {
+			return dst, 0, errShortMessage
+		}
+		length := int(msg[offset])
+		switch length & 0xC0 {
+		case 0x00:
+			end := offset + 1 + length
+			if end > len(msg) {
+				return dst, 0, errShortMessage
+			}
+			// labels can't exceed 63 bytes, longer lengths have the
+			// top bits of the other label types set
+			dst = append(dst, msg[offset:end]...)
+			if len(dst)-start > maxNameLength {
+				return dst, 0, errNameTooLong
+			}
+			if length == 0 {
+				if next < 0 {
+					next = end
+				}
+				return dst, next, nil
+			}
+			offset = end
+		case 0xC0:
+			if offset+2 > len(msg) {
+				return dst, 0, errShortMessage
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			if pointers++; pointers > maxCompressionPointers {
+				return dst, 0, errPointerLoop
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3FFF)
+		default:
+			return dst, 0, fmt.Errorf("unsupported label type %#x", length&0xC0)
+		}
+	}
+}
+
+// parseDNSQuestion decodes the question at offset in msg, its name appended
+// to dst.
+func parseDNSQuestion(dst, msg []byte, offset int) (DNSQuestion, []byte, int, error) {
+	start := len(dst)
+	dst, offset, err := parseDNSName(dst, msg, offset)
+	if err != nil {
+		return DNSQuestion{}, dst, 0, err
+	}
+	if offset+4 > len(msg) {
+		return DNSQuestion{}, dst, 0, errShortMessage
+	}
+	return DNSQuestion{
+		Name:  dst[start:len(dst):len(dst)],
+		Type:  binary.BigEndian.Uint16(msg[offset:]),
+		Class: binary.BigEndian.Uint16(msg[offset+2:]),
+	}, dst, offset + 4, nil
+}
+
+// parseDNSAnswer decodes the resource record at offset in msg, its name and
+// data appended to dst. The names in the data of the types that may compress
+// them (RFC 3597 4) are decompressed, so the record can be packed anywhere,
+// and the data of those types and of addresses must fill RDLENGTH exactly.
+func parseDNSAnswer(dst, msg []byte, offset int) (DNSResourceRecord, []byte, int, error) {
+	start := len(dst)
+	dst, offset, err := parseDNSName(dst, msg, offset)
+	if err != nil {
+		return DNSResourceRecord{}, dst, 0, err
+	}
+	nameEnd := len(dst)
+	if offset+10 > len(msg) {
+		return DNSResourceRecord{}, dst, 0, errShortMessage
+	}
+	record := DNSResourceRecord{
+		Type:     binary.BigEndian.Uint16(msg[offset:]),
+		Class:    binary.BigEndian.Uint16(msg[offset+2:]),
+		TTL:      binary.BigEndian.Uint32(msg[offset+4:]),
+		RDLength: binary.BigEndian.Uint16(msg[offset+8:]),
+	}
+	offset += 10
+	end := offset + int(record.RDLength)
+	if end > len(msg) {
+		return DNSResourceRecord{}, dst, 0, errShortMessage
+	}
+	if dst, err = parseRData(dst, msg[:end], offset, record.Type); err != nil {
+		return DNSResourceRecord{}, dst, 0, fmt.Errorf("%s record: %w", typeName(record.Type), err)
+	}
+	record.Name = dst[start:nameEnd:nameEnd]
+	record.RData = dst[nameEnd:len(dst):len(dst)]
+	record.RDLength = uint16(len(record.RData))
+	return record, dst, end, nil
+}
+
+// parseRData appends the data of a record of type qtype, from offset to the
+// end of msg, to dst. Names are appended uncompressed, the rest as it is.
+func parseRData(dst, msg []byte, offset int, qtype uint16) ([]byte, error) {
+	var fixed, after int // bytes before the names and after them
+	names := 1
+	switch qtype {
+	case TypeA:
+		if len(msg)-offset != 4 {
+			return dst, fmt.Errorf("%d bytes of address", len(msg)-offset)
+		}
+		return append(dst, msg[offset:]...), nil
+	case TypeAAAA:
+		if len(msg)-offset != 16 {
+			return dst, fmt.Errorf("%d bytes of address", len(msg)-offset)
+		}
+		return append(dst, msg[offset:]...), nil
+	case TypeNS, TypeCNAME, TypePTR, TypeDNAME:
+	case TypeMX:
+		fixed = 2
+	case TypeSRV:
+		fixed = 6
+	case TypeSOA:
+		names, after = 2, 20
+	default:
+		return append(dst, msg[offset:]...), nil
+	}
+	if offset+fixed > len(msg) {
+		return dst, errShortMessage
+	}
+	dst = append(dst, msg[offset:offset+fixed]...)
+	offset += fixed
+	for i := 0; i < names; i++ {
+		var err error
+		if dst, offset, err = parseDNSName(dst, msg, offset); err != nil {
+			return dst, err
+		}
+	}
+	switch {
+	case offset+after > len(msg):
+		return dst, errShortMessage
+	case offset+after < len(msg):
+		return dst, fmt.Errorf("%d bytes of data left over", len(msg)-offset-after)
+	}
+	return append(dst, msg[offset:]...), nil
+}
+
+func packDNSResponse(response DNSResponse) ([]byte, error) {
+	return appendDNSResponse(nil, response), nil
+}
+
+// appendDNSResponse packs response at the end of dst, which only grows when
+// its capacity is too small, so pooled buffers can be packed into.
+func appendDNSResponse(dst []byte, response DNSResponse) []byte {
+	// Create a buffer to hold the binary representation
+	size := 12
+	for _, question := range response.Question {
+		size += len(question.Name) + 4
+	}
+
+	// Calculate the length needed for the answer, authority and additional sections
+	sections := [3][]DNSResourceRecord{response.Answers, response.Authority, response.Additional}
+	for _, section := range sections {
+		for _, answer := range section {
+			size += len(answer.Name) + 10 + len(answer.RData) // Name + Type + Class + TTL + RDLength + RData
+		}
+	}
+
+	start := len(dst)
+	if cap(dst)-start < size {
+		grown := make([]byte, start, start+size)
+		copy(grown, dst)
+		dst = grown
+	}
+	dst = dst[:start+size]
+	buffer := dst[start:]
+	for i := range buffer {
+		buffer[i] = 0 // a recycled buffer holds the previous message
+	}
+
+	// Pack the DNS header
+	binary.BigEndian.PutUint16(buffer[0:2], response.Header.ID)
+	binary.BigEndian.PutUint16(buffer[2:4], response.Header.Flags)
+	binary.BigEndian.PutUint16(buffer[4:6], response.Header.QDCount)
+	binary.BigEndian.PutUint16(buffer[6:8], response.Header.ANCount)
+	binary.BigEndian.PutUint16(buffer[8:10], response.Header.NSCount)
+	binary.BigEndian.PutUint16(buffer[10:12], response.Header.ARCount)
+
+	// Pack the DNS Questions
+	offset := 12
+	for _, question := range response.Question {
+		qNameLength := len(question.Name)
+		copy(buffer[offset:offset+qNameLength], question.Name)
+		offset += qNameLength
+		binary.BigEndian.PutUint16(buffer[offset:offset+2], question.Type)
+		binary.BigEndian.PutUint16(buffer[offset+2:offset+4], question.Class)
+		offset += 4
+	}
+
+	// Pack the DNS records
+	for _, section := range sections {
+		for _, answer := range section {
+			nameLength := len(answer.Name)
+			copy(buffer[offset:offset+nameLength], answer.Name)
+			offset += nameLength
+			binary.BigEndian.PutUint16(buffer[offset:offset+2], answer.Type)
+			binary.BigEndian.PutUint16(buffer[offset+2:offset+4], answer.Class)
+			binary.BigEndian.PutUint32(buffer[offset+4:offset+8], answer.TTL)
+			// the length of the data packed, whatever RDLength says
+			binary.BigEndian.PutUint16(buffer[offset+8:offset+10], uint16(len(answer.RData)))
+			copy(buffer[offset+10:offset+10+len(answer.RData)], answer.RData)
+			offset += 10 + len(answer.RData)
+		}
+	}
+
+	return dst
+}
+
+// labelSequence encodes a domain name known to be valid, such as a constant
+// or one decoded by domainName. encodeDomainName checks the name.
+func labelSequence(domain string) []byte {
+	sequence, _ := encodeDomainName(domain)
+	return sequence
+}
+
+// encodeDomainName converts a dotted domain name in presentation format, where
+// \. is a dot within a label and \DDD a byte in decimal, to a label
+// sequence. Unicode labels are encoded in their xn-- form. It fails on empty
+// labels and on labels or names over the limits of RFC 1035, returning as
+// much of the sequence as it could encode.
+func encodeDomainName(domain string) ([]byte, error) {
+	if hasNonASCII(domain) {
+		ascii, err := idnaToASCII(domain)
+		if err != nil {
+			return []byte{0}, err
+		}
+		domain = ascii
+	}
+	sequence := make([]byte, 1, len(domain)+2)
+	start := 0 // length byte of the current label
+	for i := 0; i < len(domain); i++ {
+		c := domain[i]
+		switch {
+		case c == '.':
+			if len(sequence) == start+1 {
+				if domain == "." {
+					return sequence, nil // the root
+				}
+				return append(sequence[:start], 0), fmt.Errorf("empty label in %q", domain)
+			}
+			// a trailing dot leaves the root as the last label
+			sequence[start] = byte(len(sequence) - start - 1)
+			start = len(sequence)
+			sequence = append(sequence, 0)
+			continue
+		case c == '\\' && i+3 < len(domain) && isDigits(domain[i+1:i+4]):
+			value := (int(domain[i+1]-'0')*10+int(domain[i+2]-'0'))*10 + int(domain[i+3]-'0')
+			if value > 255 {
+				return append(sequence[:start], 0), fmt.Errorf("invalid escape in %q", domain)
+			}
+			c = byte(value)
+			i += 3
+		case c == '\\' && i+1 < len(domain):
+			c = domain[i+1]
+			i++
+		case c == '\\':
+			return append(sequence[:start], 0), fmt.Errorf("invalid escape in %q", domain)
+		}
+		if len(sequence)-start-1 == maxLabelLength {
+			return append(sequence[:start], 0), fmt.Errorf("label longer than %d bytes in %q", maxLabelLength, domain)
+		}
+		sequence = append(sequence, c)
+	}
+	if len(sequence) > start+1 {
+		sequence[start] = byte(len(sequence) - start - 1)
+		sequence = append(sequence, 0)
+	}
+	if len(sequence) > maxNameLength {
+		return sequence, fmt.Errorf("name longer than %d bytes: %q", maxNameLength, domain)
+	}
+	return sequence, nil
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// domainName converts a label sequence back to its dotted form, escaping
+// dots and backslashes within labels, the characters special to master files
+// and bytes outside printable ASCII the way zone files do, so no two names
+// look the same and exported owners read back.
+func domainName(sequence []byte) string {
+	var name strings.Builder
+	name.Grow(len(sequence))
+	for i := 0; i < len(sequence) && sequence[i] != 0; i += int(sequence[i]) + 1 {
+		end := i + 1 + int(sequence[i])
+		if end > len(sequence) {
+			break
+		}
+		if i > 0 {
+			name.WriteByte('.')
+		}
+		for _, c := range sequence[i+1 : end] {
+			switch {
+			case strings.IndexByte(`.\"();@$`, c) >= 0:
+				name.WriteByte('\\')
+				name.WriteByte(c)
+			case c < '!' || c > '~':
+				fmt.Fprintf(&name, "\\%03d", c)
+			default:
+				name.WriteByte(c)
+			}
+		}
+	}
+	return name.String()
+}
+
+// dottedName is the name as domainName prints it, with the trailing dot so
+// the root shows.
+func dottedName(name []byte) string {
+	return domainName(name) + "."
+}
+
+// flagNames lists the header bits that are set, as dig does.
+func flagNames(flags uint16) string {
+	bits := []struct {
+		mask uint16
+		name string
+	}{{flagQR, "qr"}, {flagAA, "aa"}, {flagTC, "tc"}, {flagRD, "rd"}, {flagRA, "ra"}, {flagAD, "ad"}, {flagCD, "cd"}}
+	var set []string
+	for _, bit := range bits {
+		if flags&bit.mask != 0 {
+			set = append(set, bit.name)
+		}
+	}
+	if len(set) == 0 {
+		return "none"
+	}
+	return strings.Join(set, ",")
+}
+
+// equalNames compares two uncompressed label sequences the way DNS does,
+// ignoring the case of ASCII letters only (RFC 4343). Length bytes are below
+// 64 and so never taken for letters.
+func equalNames(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		x, y := a[i], b[i]
+		if 'A' <= x && x <= 'Z' {
+			x += 'a' - 'A'
+		}
+		if 'A' <= y && y <= 'Z' {
+			y += 'a' - 'A'
+		}
+		if x != y {
+			return false
+		}
+	}
+	return true
+}
+
+// cloneQuestions copies questions with their names, for use after the
+// buffer the names were parsed into is reused.
+func cloneQuestions(questions []DNSQuestion) []DNSQuestion {
+	clones := make([]DNSQuestion, len(questions))
+	for i, question := range questions {
+		clones[i] = question
+		clones[i].Name = append([]byte(nil), question.Name...)
+	}
+	return clones
+}
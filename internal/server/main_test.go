@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// the server logs every refused and malformed query
+	setupLogging("error", "text", io.Discard)
+	os.Exit(m.Run())
+}
+
+// testClient is the address the queries of the tests come from.
+var testClient = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 53), Port: 53000}
+
+// newTestServer returns a server configured by args, with a mux of its own,
+// the way NewServer does.
+func newTestServer(t testing.TB, args ...string) *server {
+	t.Helper()
+	s, err := NewServer(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.srv
+}
+
+// startTestServer serves the -listen endpoints of srv until the test ends and
+// returns the address of the first one.
+func startTestServer(t testing.TB, srv *server) string {
+	t.Helper()
+	s := &Server{srv: srv}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return s.Addr().String()
+}
+
+// handleTest answers data as a UDP query and returns the replies sent.
+func (s *server) handleTest(data []byte) [][]byte {
+	var replies [][]byte
+	s.handle(context.Background(), data, testClient, listenEndpoint{}, func(response []byte) error {
+		replies = append(replies, append([]byte(nil), response...))
+		return nil
+	})
+	return replies
+}
+
+// exchangeTest answers query and returns the parsed response, failing the
+// test unless there is exactly one.
+func (s *server) exchangeTest(t testing.TB, query *Msg) *Msg {
+	t.Helper()
+	replies := s.handleTest(query.Pack())
+	if len(replies) != 1 {
+		t.Fatalf("%d replies to the query, want 1", len(replies))
+	}
+	response, _, err := parseDNSResponse(nil, replies[0])
+	if err != nil {
+		t.Fatalf("reply %x doesn't parse: %v", replies[0], err)
+	}
+	return &response
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Rough cost of the items the memory budget is divided by, taken from heap
+// profiles on amd64 and rounded up.
+const (
+	queryMemory           = 16 << 10 // goroutine stack, pooled buffers and parsed message of a query in flight
+	auditEntryMemory      = 256
+	blocklistDomainMemory = 64  // map entry and slice element, on top of the name itself
+	bucketMemory          = 192 // with its entry among the limited clients
+	statsZoneMemory       = 512
+	analyticsMemory       = 2048 // with a few of its distinct names
+	trafficMemory         = 1024
+)
+
+// memoryBudget splits -memory-budget between the parts of the server that
+// grow with load or configuration. The rest is left to the stats, which
+// have a small cap of their own, to the runtime and to garbage waiting to be
+// collected. A zero budget limits nothing.
+type memoryBudget struct {
+	total      int64
+	inflight   int64
+	blocklists int64
+	audit      int64
+	limiter    int64
+	analytics  int64
+	traffic    int64
+}
+
+func newMemoryBudget(megabytes int) memoryBudget {
+	total := int64(megabytes) << 20
+	return memoryBudget{
+		total:      total,
+		inflight:   total / 4,
+		blocklists: total * 7 / 20,
+		audit:      total / 20,
+		limiter:    total / 20,
+		analytics:  total / 20,
+		traffic:    total / 20,
+	}
+}
+
+// limitTracking lowers the clients and names the analytics and the traffic
+// keep to fit their shares. Both live for as long as the server, so like
+// -audit-size they are sized at startup.
+func (b memoryBudget) limitTracking(analytics *Analytics, traffic *Traffic) {
+	analytics.limit(capped(maxAnalyticsClients+maxAnalyticsDomains, b.analytics, analyticsMemory))
+	traffic.limit(capped(maxTrafficClients+maxTrafficDomains, b.traffic, trafficMemory))
+}
+
+// halves splits n entries between two tables, at least one each.
+func halves(n int) (int, int) {
+	if n < 2 {
+		return 1, 1
+	}
+	return n / 2, n - n/2
+}
+
+// capped lowers limit to the number of items of size bytes that share has
+// room for, at least one. A limit of 0 means unlimited and a share of 0 no
+// budget.
+func capped(limit int, share, size int64) int {
+	if share <= 0 {
+		return limit
+	}
+	n := share / size
+	if n < 1 {
+		n = 1
+	}
+	if limit > 0 && int64(limit) <= n {
+		return limit
+	}
+	return int(n)
+}
+
+// applyMemoryLimit makes the garbage collector work harder as the heap nears
+// the budget. Without a budget the limit is left to GOMEMLIMIT, unless an
+// earlier budget replaced it.
+func applyMemoryLimit(budget, previous memoryBudget) {
+	switch {
+	case budget.total > 0:
+		debug.SetMemoryLimit(budget.total)
+	case previous.total > 0:
+		debug.SetMemoryLimit(math.MaxInt64)
+	}
+}
+
+// MemoryReport is the answer of the /memory endpoint.
+type MemoryReport struct {
+	Budget     int64                  `json:"budget"`
+	Runtime    MemoryRuntime          `json:"runtime"`
+	Components map[string]MemoryUsage `json:"components"`
+}
+
+// MemoryRuntime is what the Go runtime reports, in bytes.
+type MemoryRuntime struct {
+	HeapAlloc  uint64 `json:"heap_alloc"`
+	HeapInuse  uint64 `json:"heap_inuse"`
+	StackInuse uint64 `json:"stack_inuse"`
+	Sys        uint64 `json:"sys"`
+	Limit      int64  `json:"limit"`
+	GCCycles   uint32 `json:"gc_cycles"`
+	Goroutines int    `json:"goroutines"`
+	NextGC     uint64 `json:"next_gc"`
+}
+
+// MemoryUsage is the estimated size of one part of the server against its
+// limit and its share of the budget, where it has them.
+type MemoryUsage struct {
+	Items     int   `json:"items"`
+	Limit     int   `json:"limit,omitempty"`
+	Estimated int64 `json:"estimated_bytes"`
+	Budget    int64 `json:"budget_bytes,omitempty"`
+}
+
+// handleMemory answers GET /memory with the budget, the runtime's figures and
+// the estimated usage of the parts the budget accounts for.
+func (s *server) handleMemory(w http.ResponseWriter, r *http.Request) {
+	p := s.reload.current.Load()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	report := MemoryReport{
+		Budget: p.budget.total,
+		Runtime: MemoryRuntime{
+			HeapAlloc:  stats.HeapAlloc,
+			HeapInuse:  stats.HeapInuse,
+			StackInuse: stats.StackInuse,
+			Sys:        stats.Sys,
+			Limit:      debug.SetMemoryLimit(-1),
+			GCCycles:   stats.NumGC,
+			Goroutines: runtime.NumGoroutine(),
+			NextGC:     stats.NextGC,
+		},
+		Components: map[string]MemoryUsage{},
+	}
+
+	active := int(s.active.Load())
+	report.Components["inflight"] = MemoryUsage{
+		Items:     active,
+		Limit:     p.maxInflight,
+		Estimated: int64(active) * queryMemory,
+		Budget:    p.budget.inflight,
+	}
+	if s.audit != nil {
+		used, size := s.audit.Size()
+		report.Components["audit"] = MemoryUsage{
+			Items:     used,
+			Limit:     size,
+			Estimated: int64(used) * auditEntryMemory,
+			Budget:    p.budget.audit,
+		}
+	}
+	if p.lists != nil {
+		domains, size := p.lists.Memory()
+		report.Components["blocklists"] = MemoryUsage{
+			Items:     domains,
+			Estimated: size,
+			Budget:    p.budget.blocklists,
+		}
+	}
+	if p.limiter != nil {
+		clients := p.limiter.Clients()
+		report.Components["rate_limiter"] = MemoryUsage{
+			Items:     clients,
+			Limit:     p.limiter.MaxClients,
+			Estimated: int64(clients) * bucketMemory,
+			Budget:    p.budget.limiter,
+		}
+	}
+	zones := s.stats.Zones()
+	report.Components["stats"] = MemoryUsage{
+		Items:     zones,
+		Limit:     maxStatsZones,
+		Estimated: int64(zones) * statsZoneMemory,
+	}
+	tracked := s.analytics.Tracked()
+	report.Components["analytics"] = MemoryUsage{
+		Items:     tracked,
+		Limit:     s.analytics.Limit(),
+		Estimated: int64(tracked) * analyticsMemory,
+		Budget:    p.budget.analytics,
+	}
+	if s.recent != nil {
+		used, size := s.recent.Size()
+		report.Components["recent_queries"] = MemoryUsage{
+			Items:     used,
+			Limit:     size,
+			Estimated: int64(used) * auditEntryMemory,
+		}
+	}
+	tracked = s.traffic.Tracked()
+	report.Components["traffic"] = MemoryUsage{
+		Items:     tracked,
+		Limit:     s.traffic.Limit(),
+		Estimated: int64(tracked) * trafficMemory,
+		Budget:    p.budget.traffic,
+	}
+	writeJSON(w, report)
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMemoryBudgetShares(t *testing.T) {
+	budget := newMemoryBudget(64)
+	shares := budget.inflight + budget.blocklists + budget.audit + budget.limiter + budget.analytics + budget.traffic
+	if shares > budget.total*4/5 {
+		t.Errorf("shares take %d of %d bytes, want a fifth left to the runtime", shares, budget.total)
+	}
+
+	srv := newTestServer(t, "-memory-budget", "64")
+	if got, want := srv.analytics.Limit(), int(budget.analytics/analyticsMemory); got != want {
+		t.Errorf("analytics limit %d, want %d", got, want)
+	}
+	if got, want := srv.traffic.Limit(), int(budget.traffic/trafficMemory); got != want {
+		t.Errorf("traffic limit %d, want %d", got, want)
+	}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < srv.traffic.Limit()*2; i++ {
+		srv.traffic.record(testClient.IP.String(), fmt.Sprintf("n%d.example", i), false, now)
+	}
+	if got := srv.traffic.Tracked(); got > srv.traffic.Limit() {
+		t.Errorf("%d clients and names counted, over the limit of %d", got, srv.traffic.Limit())
+	}
+
+	// without a budget they keep their own caps
+	srv = newTestServer(t)
+	if srv.analytics.Limit() != maxAnalyticsClients+maxAnalyticsDomains || srv.traffic.Limit() != maxTrafficClients+maxTrafficDomains {
+		t.Errorf("limits %d and %d without a budget", srv.analytics.Limit(), srv.traffic.Limit())
+	}
+}
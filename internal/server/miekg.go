@@ -0,0 +1,103 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// The converters below let the server be mixed with code written for
+// github.com/miekg/dns, during a migration or to reuse its tooling, without
+// the module depending on it: messages cross over in wire format through the
+// Pack and Unpack methods of *dns.Msg, and records through their text form,
+// which dns.NewRR reads.
+//
+//	var dm dns.Msg
+//	if err := ToMiekg(m, &dm); err != nil { ... }
+//	m, err := FromMiekg(&dm)
+//	rr, err := dns.NewRR(record.String())
+
+// miekgPacker is the Pack method of *dns.Msg.
+type miekgPacker interface {
+	Pack() ([]byte, error)
+}
+
+// miekgUnpacker is the Unpack method of *dns.Msg.
+type miekgUnpacker interface {
+	Unpack(msg []byte) error
+}
+
+// miekgMsg is a *dns.Msg as the converters see it.
+type miekgMsg interface {
+	miekgPacker
+	miekgUnpacker
+}
+
+// FromMiekg converts a *dns.Msg, or anything else packing a message, into
+// a Msg.
+func FromMiekg(m miekgPacker) (*Msg, error) {
+	data, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	converted, _, err := parseDNSResponse(nil, data)
+	if err != nil {
+		return nil, err
+	}
+	return &converted, nil
+}
+
+// ToMiekg converts m into dst, a *dns.Msg.
+func ToMiekg(m *Msg, dst miekgUnpacker) error {
+	return dst.Unpack(m.Pack())
+}
+
+// MiekgHandler adapts a handler written against *dns.Msg, returning the
+// response rather than writing it, to a Handler of this package; newMsg
+// returns an empty message, new(dns.Msg):
+//
+//	DefaultServeMux.Handle("lab.example", MiekgHandler(func() *dns.Msg { return new(dns.Msg) },
+//		func(r *dns.Msg) *dns.Msg {
+//			m := new(dns.Msg)
+//			m.SetReply(r)
+//			...
+//			return m
+//		}))
+//
+// A nil response, or one that doesn't convert, is answered SERVFAIL. The
+// OPT record of the response is left to the server, which adds its own.
+func MiekgHandler[M miekgMsg](newMsg func() M, serve func(r M) M) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Msg) {
+		request := newMsg()
+		if err := ToMiekg(r, request); err != nil {
+			var m Msg
+			w.WriteMsg(m.SetReply(r).SetRcode(RcodeFormErr))
+			return
+		}
+		response := serve(request)
+		var m *Msg
+		if v := reflect.ValueOf(response); v.IsValid() && !(v.Kind() == reflect.Pointer && v.IsNil()) {
+			m, _ = FromMiekg(response)
+		}
+		if m == nil {
+			var failure Msg
+			w.WriteMsg(failure.SetReply(r).SetRcode(RcodeServFail))
+			return
+		}
+		additional := m.Additional[:0]
+		for _, record := range m.Additional {
+			if record.Type != TypeOPT {
+				additional = append(additional, record)
+			}
+		}
+		m.Additional = additional
+		m.Header.ARCount = uint16(len(additional))
+		w.WriteMsg(m)
+	})
+}
+
+// String returns the record in the text form of master files and dig, the
+// owner absolute, e.g. "www.example.com.\t300\tIN\tA\t192.0.2.1", which
+// dns.NewRR of github.com/miekg/dns parses.
+func (r DNSResourceRecord) String() string {
+	return fmt.Sprintf("%s\t%d\t%s\t%s\t%s", dottedName(r.Name), r.TTL, className(r.Class), typeName(r.Type), rdataText(r))
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// stubMiekgMsg stands in for a *dns.Msg of github.com/miekg/dns, which the
+// module doesn't depend on: it keeps the message in wire format, the way the
+// converters hand it over.
+type stubMiekgMsg struct {
+	data []byte
+	err  error // returned by Pack and Unpack
+}
+
+func (m *stubMiekgMsg) Pack() ([]byte, error) {
+	return append([]byte(nil), m.data...), m.err
+}
+
+func (m *stubMiekgMsg) Unpack(msg []byte) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.data = append(m.data[:0], msg...)
+	return nil
+}
+
+func TestMiekgRoundTrip(t *testing.T) {
+	tests := []struct {
+		res  Resource
+		text string // as dns.NewRR reads it
+	}{
+		{&AResource{IP: net.IPv4(192, 0, 2, 1).To4()}, "192.0.2.1"},
+		{&AAAAResource{IP: net.ParseIP("2001:db8::1")}, "2001:db8::1"},
+		{&NSResource{Host: "ns.example.com."}, "ns.example.com."},
+		{&CNAMEResource{Target: "www.example.net."}, "www.example.net."},
+		{&DNAMEResource{Target: "example.net."}, "example.net."},
+		{&PTRResource{Target: "host.example.com."}, "host.example.com."},
+		{&MXResource{Preference: 10, Exchange: "mail.example.com."}, "10 mail.example.com."},
+		{&SRVResource{Priority: 1, Weight: 2, Port: 5060, Target: "sip.example.com."}, "1 2 5060 sip.example.com."},
+		{&SOAResource{MName: "ns.example.com.", RName: "hostmaster.example.com.", Serial: 2024010101, Refresh: 7200, Retry: 3600, Expire: 1209600, Minimum: 300}, "ns.example.com. hostmaster.example.com. 2024010101 7200 3600 1209600 300"},
+		{&TXTResource{Text: []string{"v=spf1 -all", `say "hi"`}}, `"v=spf1 -all" "say \"hi\""`},
+		{&UnknownResource{RRType: 65280, Data: []byte{0xde, 0xad}}, `\# 2 dead`},
+	}
+	for _, tt := range tests {
+		name := typeName(tt.res.Type())
+		t.Run(name, func(t *testing.T) {
+			record, err := NewRecord("example.com", 300, tt.res)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "example.com.\t300\tIN\t" + name + "\t" + tt.text; record.String() != want {
+				t.Errorf("text %q, want %q", record.String(), want)
+			}
+
+			var query, m Msg
+			query.SetQuestion("example.com", tt.res.Type())
+			m.SetReply(&query).AddAnswer(record)
+			var dm stubMiekgMsg
+			if err := ToMiekg(&m, &dm); err != nil {
+				t.Fatal(err)
+			}
+			back, err := FromMiekg(&dm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(back.Pack(), m.Pack()) {
+				t.Errorf("round trip gave %+v, want %+v", back, m)
+			}
+			if len(back.Answers) != 1 {
+				t.Fatalf("%d answers, want 1", len(back.Answers))
+			}
+			res, err := back.Answers[0].Resource()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(res, tt.res) {
+				t.Errorf("resource %#v, want %#v", res, tt.res)
+			}
+		})
+	}
+}
+
+func TestFromMiekgCompressed(t *testing.T) {
+	// dns.Msg compresses names when it packs; the MX record points back at
+	// the question for its owner and the end of its exchange
+	data := []byte{
+		0x12, 0x34, 0x81, 0x80, 0, 1, 0, 1, 0, 0, 0, 0,
+		7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 15, 0, 1,
+		0xc0, 12, 0, 15, 0, 1, 0, 0, 1, 44, 0, 9, 0, 10, 4, 'm', 'a', 'i', 'l', 0xc0, 12,
+	}
+	m, err := FromMiekg(&stubMiekgMsg{data: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Answers) != 1 {
+		t.Fatalf("%d answers, want 1", len(m.Answers))
+	}
+	if got, want := m.Answers[0].String(), "example.com.\t300\tIN\tMX\t10 mail.example.com."; got != want {
+		t.Errorf("answer %q, want %q", got, want)
+	}
+}
+
+func TestMiekgConversionErrors(t *testing.T) {
+	failure := errors.New("stub failure")
+	if _, err := FromMiekg(&stubMiekgMsg{err: failure}); err != failure {
+		t.Errorf("FromMiekg error %v, want the Pack error", err)
+	}
+	if _, err := FromMiekg(&stubMiekgMsg{data: []byte{0x12, 0x34}}); err == nil {
+		t.Error("FromMiekg took a truncated message")
+	}
+	var m Msg
+	m.SetQuestion("example.com", TypeA)
+	if err := ToMiekg(&m, &stubMiekgMsg{err: failure}); err != failure {
+		t.Errorf("ToMiekg error %v, want the Unpack error", err)
+	}
+}
+
+func TestMiekgHandler(t *testing.T) {
+	srv := newTestServer(t)
+	answer, _ := NewRecord("ok.miekg.test", 60, &AResource{IP: net.IPv4(10, 0, 0, 1)})
+	srv.mux.Handle("miekg.test", MiekgHandler(func() *stubMiekgMsg { return new(stubMiekgMsg) },
+		func(r *stubMiekgMsg) *stubMiekgMsg {
+			request, err := FromMiekg(r)
+			if err != nil || len(request.Question) != 1 {
+				t.Errorf("handler got %v, %v", request, err)
+				return nil
+			}
+			switch domainName(request.Question[0].Name) {
+			case "nil.miekg.test":
+				return nil
+			case "bad.miekg.test":
+				return &stubMiekgMsg{data: []byte{1}}
+			}
+			var m Msg
+			m.SetReply(request).AddAnswer(answer)
+			// the handler's own OPT is dropped for the server's
+			m.AddAdditional(DNSResourceRecord{Name: []byte{0}, Type: TypeOPT, Class: 4096})
+			response := new(stubMiekgMsg)
+			if err := ToMiekg(&m, response); err != nil {
+				t.Error(err)
+			}
+			return response
+		}))
+
+	tests := []struct {
+		name  string
+		rcode Rcode
+	}{
+		{"ok.miekg.test", RcodeSuccess},
+		{"nil.miekg.test", RcodeServFail},
+		{"bad.miekg.test", RcodeServFail},
+	}
+	for _, tt := range tests {
+		var query Msg
+		query.SetQuestion(tt.name, TypeA)
+		replies := srv.handleTest(addOPT(query.Pack(), 1232, RcodeSuccess))
+		if len(replies) != 1 {
+			t.Fatalf("%s: %d replies, want 1", tt.name, len(replies))
+		}
+		r, _, err := parseDNSResponse(nil, replies[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Header.Rcode() != tt.rcode {
+			t.Errorf("%s: rcode %v, want %v", tt.name, r.Header.Rcode(), tt.rcode)
+		}
+		if tt.rcode == RcodeSuccess && (len(r.Answers) != 1 || r.Answers[0].String() != answer.String()) {
+			t.Errorf("%s: answers %v, want %v", tt.name, r.Answers, answer)
+		}
+		if opt, ok := findOPT(r.Additional); !ok || len(r.Additional) != 1 || opt.Class != 1232 {
+			t.Errorf("%s: additional %v, want the server's OPT only", tt.name, r.Additional)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// jsonMessage is a message in the JSON format of RFC 8427. Flags are 0 or 1
+// as in its examples; names are in presentation format without the
+// trailing dot, the root being ".".
+type jsonMessage struct {
+	ID      uint16 `json:"ID"`
+	QR      flagBit
+	Opcode  int
+	AA      flagBit
+	TC      flagBit
+	RD      flagBit
+	RA      flagBit
+	AD      flagBit
+	CD      flagBit
+	RCODE   int
+	QDCOUNT uint16
+	ANCOUNT uint16
+	NSCOUNT uint16
+	ARCOUNT uint16
+
+	QNAME      string `json:",omitempty"`
+	QTYPE      uint16 `json:",omitempty"`
+	QTYPEname  string `json:",omitempty"`
+	QCLASS     uint16 `json:",omitempty"`
+	QCLASSname string `json:",omitempty"`
+
+	AnswerRRs     []jsonRecord `json:"answerRRs,omitempty"`
+	AuthorityRRs  []jsonRecord `json:"authorityRRs,omitempty"`
+	AdditionalRRs []jsonRecord `json:"additionalRRs,omitempty"`
+}
+
+// jsonRecord is a resource record in the JSON format of RFC 8427, with its
+// data both in hex and, under "rdata" and the type, e.g. "rdataMX", in
+// presentation format.
+type jsonRecord struct {
+	NAME      string
+	TYPE      uint16
+	TYPEname  string `json:",omitempty"`
+	CLASS     uint16
+	CLASSname string `json:",omitempty"`
+	TTL       uint32
+	RDLENGTH  uint16
+	RDATAHEX  string
+	rdata     string // presentation format, see MarshalJSON
+}
+
+// flagBit is a header flag, written 0 or 1 and read as a number or a boolean.
+type flagBit bool
+
+func (b flagBit) MarshalJSON() ([]byte, error) {
+	if b {
+		return []byte("1"), nil
+	}
+	return []byte("0"), nil
+}
+
+func (b *flagBit) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case "0", "false":
+		*b = false
+	case "1", "true":
+		*b = true
+	default:
+		return fmt.Errorf("invalid flag %s, want 0 or 1", data)
+	}
+	return nil
+}
+
+// MarshalJSON encodes the message in the JSON format of RFC 8427, for logs,
+// test diffs and JSON APIs. The format has one question; only the first is
+// kept.
+func (m DNSResponse) MarshalJSON() ([]byte, error) {
+	flags := m.Header.Flags
+	j := jsonMessage{
+		ID:      m.Header.ID,
+		QR:      flags&flagQR != 0,
+		Opcode:  int(m.Header.Opcode()),
+		AA:      flags&flagAA != 0,
+		TC:      flags&flagTC != 0,
+		RD:      flags&flagRD != 0,
+		RA:      flags&flagRA != 0,
+		AD:      flags&flagAD != 0,
+		CD:      flags&flagCD != 0,
+		RCODE:   int(m.Header.Rcode()),
+		QDCOUNT: uint16(len(m.Question)),
+		ANCOUNT: uint16(len(m.Answers)),
+		NSCOUNT: uint16(len(m.Authority)),
+		ARCOUNT: uint16(len(m.Additional)),
+	}
+	if len(m.Question) > 0 {
+		question := m.Question[0]
+		j.QNAME = jsonName(question.Name)
+		j.QTYPE, j.QTYPEname = question.Type, typeName(question.Type)
+		j.QCLASS, j.QCLASSname = question.Class, className(question.Class)
+	}
+	j.AnswerRRs = jsonRecords(m.Answers)
+	j.AuthorityRRs = jsonRecords(m.Authority)
+	j.AdditionalRRs = jsonRecords(m.Additional)
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON decodes a message in the JSON format of RFC 8427. Record
+// data is taken from RDATAHEX, which the presentation format members can't
+// replace.
+func (m *DNSResponse) UnmarshalJSON(data []byte) error {
+	var j jsonMessage
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	if j.Opcode < 0 || j.Opcode > 15 || j.RCODE < 0 || j.RCODE > 15 {
+		return fmt.Errorf("opcode %d or rcode %d out of the header", j.Opcode, j.RCODE)
+	}
+	var decoded DNSResponse
+	decoded.Header.ID = j.ID
+	decoded.Header.Flags = uint16(j.Opcode)<<11 | uint16(j.RCODE)
+	for _, bit := range []struct {
+		set  flagBit
+		mask uint16
+	}{{j.QR, flagQR}, {j.AA, flagAA}, {j.TC, flagTC}, {j.RD, flagRD}, {j.RA, flagRA}, {j.AD, flagAD}, {j.CD, flagCD}} {
+		if bit.set {
+			decoded.Header.Flags |= bit.mask
+		}
+	}
+	if j.QNAME != "" {
+		name, err := encodeDomainName(j.QNAME)
+		if err != nil {
+			return fmt.Errorf("QNAME: %w", err)
+		}
+		decoded.Question = []DNSQuestion{{Name: name, Type: j.QTYPE, Class: j.QCLASS}}
+	}
+	sections := []struct {
+		records []jsonRecord
+		into    *[]DNSResourceRecord
+	}{{j.AnswerRRs, &decoded.Answers}, {j.AuthorityRRs, &decoded.Authority}, {j.AdditionalRRs, &decoded.Additional}}
+	for _, section := range sections {
+		for _, jr := range section.records {
+			record, err := jr.record()
+			if err != nil {
+				return err
+			}
+			*section.into = append(*section.into, record)
+		}
+	}
+	decoded.Header.QDCount = uint16(len(decoded.Question))
+	decoded.Header.ANCount = uint16(len(decoded.Answers))
+	decoded.Header.NSCount = uint16(len(decoded.Authority))
+	decoded.Header.ARCount = uint16(len(decoded.Additional))
+	*m = decoded
+	return nil
+}
+
+func jsonRecords(records []DNSResourceRecord) []jsonRecord {
+	var converted []jsonRecord
+	for _, record := range records {
+		jr := jsonRecord{
+			NAME:     jsonName(record.Name),
+			TYPE:     record.Type,
+			TYPEname: typeName(record.Type),
+			CLASS:    record.Class,
+			TTL:      record.TTL,
+			RDLENGTH: uint16(len(record.RData)),
+			RDATAHEX: hex.EncodeToString(record.RData),
+		}
+		if record.Type != TypeOPT {
+			// the class of an OPT record is the payload size
+			jr.CLASSname = className(record.Class)
+			if res, err := record.Resource(); err == nil {
+				if _, unknown := res.(*UnknownResource); !unknown {
+					jr.rdata = res.String()
+				}
+			}
+		}
+		converted = append(converted, jr)
+	}
+	return converted
+}
+
+// MarshalJSON adds the member of the data in presentation format, whose name
+// depends on the type.
+func (jr jsonRecord) MarshalJSON() ([]byte, error) {
+	type plain jsonRecord // without this method
+	data, err := json.Marshal(plain(jr))
+	if err != nil || jr.rdata == "" {
+		return data, err
+	}
+	value, err := json.Marshal(jr.rdata)
+	if err != nil {
+		return nil, err
+	}
+	member, _ := json.Marshal("rdata" + jr.TYPEname)
+	data = append(data[:len(data)-1], ',')
+	data = append(append(append(data, member...), ':'), value...)
+	return append(data, '}'), nil
+}
+
+var errNoRDATAHEX = errors.New("record without RDATAHEX")
+
+// record converts jr back, from its RDATAHEX.
+func (jr jsonRecord) record() (DNSResourceRecord, error) {
+	name, err := encodeDomainName(jr.NAME)
+	if err != nil {
+		return DNSResourceRecord{}, fmt.Errorf("NAME: %w", err)
+	}
+	if jr.RDATAHEX == "" && jr.RDLENGTH > 0 {
+		return DNSResourceRecord{}, fmt.Errorf("%s %s: %w", jr.NAME, typeName(jr.TYPE), errNoRDATAHEX)
+	}
+	rdata, err := hex.DecodeString(jr.RDATAHEX)
+	if err != nil || len(rdata) > 0xFFFF {
+		return DNSResourceRecord{}, fmt.Errorf("%s %s: invalid RDATAHEX", jr.NAME, typeName(jr.TYPE))
+	}
+	return DNSResourceRecord{Name: name, Type: jr.TYPE, Class: jr.CLASS, TTL: jr.TTL, RDLength: uint16(len(rdata)), RData: rdata}, nil
+}
+
+// jsonName is a name as RFC 8427 writes it, without the trailing dot.
+func jsonName(sequence []byte) string {
+	if name := domainName(sequence); name != "" {
+		return name
+	}
+	return "."
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+)
+
+// The examples of RFC 8427, section 5.
+const (
+	rfc8427Query = `{ "ID": 19678, "QR": 0, "Opcode": 0, "AA": 0,
+  "TC": 0, "RD": 0, "RA": 0, "AD": 0, "CD": 0, "RCODE": 0,
+  "QDCOUNT": 1, "ANCOUNT": 0, "NSCOUNT": 0, "ARCOUNT": 0,
+  "QNAME": "example.com", "QTYPE": 1, "QCLASS": 1
+}`
+	rfc8427Response = `{ "ID": 32784, "QR": 1, "AA": 1, "RCODE": 0,
+  "QDCOUNT": 1, "ANCOUNT": 2, "NSCOUNT": 1,
+  "ARCOUNT": 0,
+  "answerRRs": [ { "NAME": "example.com.",
+                   "TYPE": 1, "CLASS": 1,
+                   "TTL": 3600,
+                   "RDATAHEX": "C0000201" },
+                 { "NAME": "example.com.",
+                   "TYPE": 1, "CLASS": 1,
+                   "TTL": 3600,
+                   "RDATAHEX": "C000AA01" } ],
+  "authorityRRs": [ { "NAME": "ns.example.com.",
+                      "TYPE": 1, "CLASS": 1,
+                      "TTL": 28800,
+                      "RDATAHEX": "CB007181" } ]
+}`
+)
+
+func TestMessageJSONQueryExample(t *testing.T) {
+	var m Msg
+	if err := json.Unmarshal([]byte(rfc8427Query), &m); err != nil {
+		t.Fatal(err)
+	}
+	var want Msg
+	want.SetQuestion("example.com", TypeA)
+	want.Header.ID = 19678
+	want.Header.Flags = 0 // SetQuestion asks for recursion, the example doesn't
+	if !bytes.Equal(m.Pack(), want.Pack()) {
+		t.Errorf("decoded %+v, want %+v", m, want)
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const encoded = `{"ID":19678,"QR":0,"Opcode":0,"AA":0,"TC":0,"RD":0,"RA":0,"AD":0,"CD":0,"RCODE":0,` +
+		`"QDCOUNT":1,"ANCOUNT":0,"NSCOUNT":0,"ARCOUNT":0,` +
+		`"QNAME":"example.com","QTYPE":1,"QTYPEname":"A","QCLASS":1,"QCLASSname":"IN"}`
+	if string(data) != encoded {
+		t.Errorf("encoded\n%s\nwant\n%s", data, encoded)
+	}
+}
+
+func TestMessageJSONResponseExample(t *testing.T) {
+	var m Msg
+	if err := json.Unmarshal([]byte(rfc8427Response), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Header.ID != 32784 || m.Header.Flags != flagQR|flagAA {
+		t.Errorf("header %+v, want ID 32784 with QR and AA", m.Header)
+	}
+	// the example counts a question it leaves out; the counts follow the
+	// records the message has
+	if m.Header.QDCount != 0 || m.Header.ANCount != 2 || m.Header.NSCount != 1 || m.Header.ARCount != 0 {
+		t.Errorf("counts %+v, want 0, 2, 1 and 0", m.Header)
+	}
+	var got []string
+	for _, record := range append(m.Answers, m.Authority...) {
+		got = append(got, record.String())
+	}
+	want := []string{
+		"example.com.\t3600\tIN\tA\t192.0.2.1",
+		"example.com.\t3600\tIN\tA\t192.0.170.1",
+		"ns.example.com.\t28800\tIN\tA\t203.0.113.129",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("records\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const encoded = `{"ID":32784,"QR":1,"Opcode":0,"AA":1,"TC":0,"RD":0,"RA":0,"AD":0,"CD":0,"RCODE":0,` +
+		`"QDCOUNT":0,"ANCOUNT":2,"NSCOUNT":1,"ARCOUNT":0,` +
+		`"answerRRs":[` +
+		`{"NAME":"example.com","TYPE":1,"TYPEname":"A","CLASS":1,"CLASSname":"IN","TTL":3600,"RDLENGTH":4,"RDATAHEX":"c0000201","rdataA":"192.0.2.1"},` +
+		`{"NAME":"example.com","TYPE":1,"TYPEname":"A","CLASS":1,"CLASSname":"IN","TTL":3600,"RDLENGTH":4,"RDATAHEX":"c000aa01","rdataA":"192.0.170.1"}],` +
+		`"authorityRRs":[` +
+		`{"NAME":"ns.example.com","TYPE":1,"TYPEname":"A","CLASS":1,"CLASSname":"IN","TTL":28800,"RDLENGTH":4,"RDATAHEX":"cb007181","rdataA":"203.0.113.129"}]}`
+	if string(data) != encoded {
+		t.Errorf("encoded\n%s\nwant\n%s", data, encoded)
+	}
+}
+
+func TestMessageJSONRoundTrip(t *testing.T) {
+	record := func(name string, ttl uint32, res Resource) DNSResourceRecord {
+		t.Helper()
+		rr, err := NewRecord(name, ttl, res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	var query, m Msg
+	query.SetQuestion("example.com", TypeMX)
+	m.SetReply(&query).SetRcode(RcodeNXDomain)
+	m.Header.Flags |= flagAD | flagCD | flagTC
+	m.AddAnswer(record("example.com", 300, &MXResource{Preference: 10, Exchange: "mail.example.com"}))
+	m.AddAnswer(record("example.com", 300, &TXTResource{Text: []string{"v=spf1 -all", `a "quoted" string`}}))
+	m.AddAuthority(record("example.com", 60, &SOAResource{MName: "ns.example.com", RName: "hostmaster.example.com", Serial: 1, Refresh: 2, Retry: 3, Expire: 4, Minimum: 5}))
+	m.AddAdditional(record("mail.example.com", 300, &AAAAResource{IP: net.ParseIP("2001:db8::1")}))
+	m.AddAdditional(DNSResourceRecord{Name: []byte{0}, Type: TypeOPT, Class: 1232, TTL: 0x8000, RData: []byte{0, 10, 0, 2, 0xab, 0xcd}})
+	m.AddAdditional(DNSResourceRecord{Name: []byte{0}, Type: 65280, Class: ClassIN, RData: []byte{1, 2, 3}})
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Msg
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("%v decoding %s", err, data)
+	}
+	if !bytes.Equal(decoded.Pack(), m.Pack()) {
+		t.Errorf("round trip of\n%s\ngave %+v, want %+v", data, decoded, m)
+	}
+
+	// the presentation format goes along for the types the server knows,
+	// not for OPT, whose class is no class, or for unknown types
+	for _, member := range []string{
+		`"rdataMX":"10 mail.example.com."`,
+		`"rdataTXT":"\"v=spf1 -all\" \"a \\\"quoted\\\" string\""`,
+		`"rdataAAAA":"2001:db8::1"`,
+		`"TYPEname":"OPT","CLASS":1232,"TTL":32768,"RDLENGTH":6,"RDATAHEX":"000a0002abcd"}`,
+		`"NAME":".","TYPE":65280,"TYPEname":"TYPE65280","CLASS":1,"CLASSname":"IN","TTL":0,"RDLENGTH":3,"RDATAHEX":"010203"}`,
+	} {
+		if !strings.Contains(string(data), member) {
+			t.Errorf("encoded %s\nwithout %s", data, member)
+		}
+	}
+}
+
+func TestMessageJSONFlags(t *testing.T) {
+	// flags may be booleans as well as numbers
+	var m Msg
+	if err := json.Unmarshal([]byte(`{"ID":1,"QR":true,"RD":1,"RA":false,"Opcode":4,"RCODE":5}`), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Header.Flags != flagQR|flagRD|4<<11|5 {
+		t.Errorf("flags %#04x, want QR, RD, opcode 4 and rcode 5", m.Header.Flags)
+	}
+}
+
+func TestMessageJSONErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		err  string
+	}{
+		{"flag out of range", `{"QR":2}`, "invalid flag 2, want 0 or 1"},
+		{"opcode out of range", `{"Opcode":16}`, "opcode 16 or rcode 0 out of the header"},
+		{"negative rcode", `{"RCODE":-1}`, "opcode 0 or rcode -1 out of the header"},
+		{"invalid QNAME", `{"QNAME":"a..b"}`, `QNAME: empty label in "a..b"`},
+		{"invalid NAME", `{"answerRRs":[{"NAME":"a..b","RDATAHEX":""}]}`, `NAME: empty label in "a..b"`},
+		{"data only in presentation format", `{"answerRRs":[{"NAME":"a","TYPE":1,"RDLENGTH":4,"rdataA":"192.0.2.1"}]}`, "a A: record without RDATAHEX"},
+		{"invalid RDATAHEX", `{"answerRRs":[{"NAME":"a","TYPE":1,"RDATAHEX":"zz"}]}`, "a A: invalid RDATAHEX"},
+		{"odd RDATAHEX", `{"answerRRs":[{"NAME":"a","TYPE":16,"RDATAHEX":"abc"}]}`, "a TXT: invalid RDATAHEX"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m Msg
+			err := json.Unmarshal([]byte(tt.json), &m)
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,423 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Name is a domain name in canonical form: its uncompressed label sequence
+// with ASCII letters lowercased, RFC 4034 6.2. Being a string, Names compare
+// with == regardless of the case they were written in and serve as map keys.
+// Unlike the dotted names canonicalName returns, a dot within a label can't
+// be taken for a label boundary.
+//
+// The zero Name isn't valid; RootName is the root.
+type Name string
+
+// RootName is the name of the root, ".".
+const RootName Name = "\x00"
+
+// ParseName parses a name in presentation format, with or without the
+// trailing dot; "" and "." are the root.
+func ParseName(s string) (Name, error) {
+	if s == "" {
+		return RootName, nil
+	}
+	sequence, err := encodeDomainName(s)
+	if err != nil {
+		return "", err
+	}
+	return NameFromWire(sequence), nil
+}
+
+// mustParseName is ParseName for names known to be valid, such as constants.
+func mustParseName(s string) Name {
+	name, err := ParseName(s)
+	if err != nil {
+		panic(err)
+	}
+	return name
+}
+
+// NameFromWire returns the Name of an uncompressed label sequence, as parsing
+// leaves them in questions and records.
+func NameFromWire(sequence []byte) Name {
+	lower := make([]byte, len(sequence))
+	for i, c := range sequence {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		lower[i] = c
+	}
+	return Name(lower)
+}
+
+// Equal reports whether n and other are the same name. Canonical Names are
+// equal when ==, Equal is there for readability.
+func (n Name) Equal(other Name) bool { return n == other }
+
+// EqualWire reports whether n is the name of a label sequence in any case.
+func (n Name) EqualWire(sequence []byte) bool { return equalNames([]byte(n), sequence) }
+
+// IsSubdomainOf reports whether n equals parent or is below it. Every name
+// is a subdomain of the root.
+func (n Name) IsSubdomainOf(parent Name) bool {
+	if len(parent) > len(n) {
+		return false
+	}
+	for offset := 0; offset < len(n); offset += int(n[offset]) + 1 {
+		if len(n)-offset == len(parent) {
+			return n[offset:] == parent
+		}
+		if n[offset] == 0 {
+			break
+		}
+	}
+	return false
+}
+
+// Labels returns the labels of n from the leftmost, raw, without escapes.
+// The root has none.
+func (n Name) Labels() []string {
+	var labels []string
+	for offset := 0; offset < len(n) && n[offset] != 0; offset += int(n[offset]) + 1 {
+		end := offset + 1 + int(n[offset])
+		if end > len(n) {
+			break
+		}
+		labels = append(labels, string(n[offset+1:end]))
+	}
+	return labels
+}
+
+// CountLabels returns the number of labels of n, 0 for the root.
+func (n Name) CountLabels() int {
+	count := 0
+	for offset := 0; offset < len(n) && n[offset] != 0; offset += int(n[offset]) + 1 {
+		count++
+	}
+	return count
+}
+
+// Parent returns the name one label up, the root for the root.
+func (n Name) Parent() Name {
+	if len(n) == 0 || n[0] == 0 || int(n[0])+1 >= len(n) {
+		return RootName
+	}
+	return n[int(n[0])+1:]
+}
+
+// Wire returns the label sequence of n.
+func (n Name) Wire() []byte { return []byte(n) }
+
+// ASCII returns n in presentation format with the trailing dot, labels
+// escaped as domainName does.
+func (n Name) ASCII() string { return dottedName([]byte(n)) }
+
+// String returns n in presentation format with the trailing dot, as ASCII
+// does, except that internationalized labels, xn-- and Punycode, are shown
+// in Unicode.
+func (n Name) String() string {
+	ascii := n.ASCII()
+	if !strings.Contains(ascii, "xn--") {
+		return ascii
+	}
+	labels := n.Labels()
+	shown := make([]string, len(labels))
+	for i, label := range labels {
+		shown[i] = domainName(append([]byte{byte(len(label))}, label...))
+		if unicode, ok := unicodeLabel(label); ok {
+			shown[i] = unicode
+		}
+	}
+	return strings.Join(shown, ".") + "."
+}
+
+// Compare orders names canonically, RFC 4034 6.1: label by label from the
+// rightmost, so a zone sorts before the names below it. It returns -1, 0 or
+// +1.
+func (n Name) Compare(other Name) int {
+	a, b := n.Labels(), other.Labels()
+	for i, j := len(a)-1, len(b)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(a[i], b[j]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return 0
+}
+
+// longestZone returns the most specific zone of zones containing name,
+// looking name up and then its parents, one lookup per label.
+func longestZone[V any](name Name, zones map[Name]V) (Name, bool) {
+	for ; ; name = name.Parent() {
+		if _, ok := zones[name]; ok {
+			return name, true
+		}
+		if name == RootName {
+			return "", false
+		}
+	}
+}
+
+// closestZone returns the value of the zone longestZone finds for name.
+func closestZone[V any](name Name, zones map[Name]V) (V, bool) {
+	zone, ok := longestZone(name, zones)
+	return zones[zone], ok
+}
+
+var errPunycode = errors.New("invalid punycode")
+
+// idnaDots are the full stops IDNA takes for dots between labels, UTS 46 4.
+var idnaDots = strings.NewReplacer("\u3002", ".", "\uff0e", ".", "\uff61", ".")
+
+// idnaToASCII converts a domain name in presentation format whose labels may
+// be in Unicode to its ASCII form, each Unicode label lowercased and written
+// as xn-- and its Punycode, RFC 5891 4.4. Labels are expected in NFC, as
+// typed names are. ASCII names are returned unchanged.
+func idnaToASCII(domain string) (string, error) {
+	if !hasNonASCII(domain) {
+		return domain, nil
+	}
+	if !utf8.ValidString(domain) {
+		return "", fmt.Errorf("invalid UTF-8 in %q", domain)
+	}
+	labels := splitLabels(idnaDots.Replace(domain))
+	for i, label := range labels {
+		if !hasNonASCII(label) {
+			continue
+		}
+		if strings.ContainsAny(label, "\\ ") {
+			return "", fmt.Errorf("invalid internationalized label %q", label)
+		}
+		labels[i] = "xn--" + encodePunycode(strings.ToLower(label))
+		if len(labels[i]) > maxLabelLength {
+			return "", fmt.Errorf("label longer than %d bytes in %q", maxLabelLength, domain)
+		}
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// idnaToUnicode returns a domain name in presentation format, such as one
+// domainName returns, with its xn-- labels in Unicode for display.
+func idnaToUnicode(domain string) string {
+	if !strings.Contains(domain, "xn--") {
+		return domain
+	}
+	labels := splitLabels(domain)
+	for i, label := range labels {
+		if unicode, ok := unicodeLabel(label); ok {
+			labels[i] = unicode
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// unicodeLabel decodes an xn-- label. It fails on labels that aren't valid
+// Punycode or that would decode to a dot, a backslash or a control
+// character, which couldn't be told apart from the name's structure. Like
+// RFC 5891 5.4 it also wants the label back when the result is encoded
+// again, which turns away mixed-case Punycode and labels with nothing to
+// decode.
+func unicodeLabel(label string) (string, bool) {
+	if len(label) < 5 || !strings.EqualFold(label[:4], "xn--") {
+		return "", false
+	}
+	unicode, err := decodePunycode(label[4:])
+	if err != nil || strings.ContainsAny(unicode, ".\\") || strings.IndexFunc(unicode, func(r rune) bool { return r < ' ' || r >= 0x7f && r < 0xa0 }) >= 0 {
+		return "", false
+	}
+	if !hasNonASCII(unicode) || encodePunycode(strings.ToLower(unicode)) != label[4:] {
+		return "", false
+	}
+	return unicode, true
+}
+
+// splitLabels splits a name in presentation format at the dots that aren't
+// escaped, keeping an empty last label for a trailing dot.
+func splitLabels(domain string) []string {
+	var labels []string
+	start := 0
+	for i := 0; i < len(domain); i++ {
+		switch domain[i] {
+		case '\\':
+			i++
+		case '.':
+			labels = append(labels, domain[start:i])
+			start = i + 1
+		}
+	}
+	return append(labels, domain[start:])
+}
+
+func hasNonASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return true
+		}
+	}
+	return false
+}
+
+// Punycode parameters, RFC 3492 5.
+const (
+	punycodeBase        = 36
+	punycodeTMin        = 1
+	punycodeTMax        = 26
+	punycodeSkew        = 38
+	punycodeDamp        = 700
+	punycodeInitialBias = 72
+	punycodeInitialN    = 128
+)
+
+// punycodeAdapt is the bias adaptation function, RFC 3492 6.1.
+func punycodeAdapt(delta, points int, first bool) int {
+	if first {
+		delta /= punycodeDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+	k := 0
+	for delta > (punycodeBase-punycodeTMin)*punycodeTMax/2 {
+		delta /= punycodeBase - punycodeTMin
+		k += punycodeBase
+	}
+	return k + (punycodeBase-punycodeTMin+1)*delta/(delta+punycodeSkew)
+}
+
+// punycodeThreshold returns the threshold t of digit position k.
+func punycodeThreshold(k, bias int) int {
+	switch t := k - bias; {
+	case t < punycodeTMin:
+		return punycodeTMin
+	case t > punycodeTMax:
+		return punycodeTMax
+	default:
+		return t
+	}
+}
+
+func punycodeDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+// encodePunycode encodes a label, without the xn-- prefix, RFC 3492 6.3.
+// Labels are short, so the overflow the RFC guards against can't happen.
+func encodePunycode(s string) string {
+	input := []rune(s)
+	var output []byte
+	for _, r := range input {
+		if r < utf8.RuneSelf {
+			output = append(output, byte(r))
+		}
+	}
+	basic := len(output)
+	if basic > 0 {
+		output = append(output, '-')
+	}
+	n, delta, bias := punycodeInitialN, 0, punycodeInitialBias
+	for handled := basic; handled < len(input); {
+		// the smallest code point not handled yet
+		m := int(utf8.MaxRune) + 1
+		for _, r := range input {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		delta += (m - n) * (handled + 1)
+		n = m
+		for _, r := range input {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := punycodeBase; ; k += punycodeBase {
+				t := punycodeThreshold(k, bias)
+				if q < t {
+					break
+				}
+				output = append(output, punycodeDigit(t+(q-t)%(punycodeBase-t)))
+				q = (q - t) / (punycodeBase - t)
+			}
+			output = append(output, punycodeDigit(q))
+			bias = punycodeAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return string(output)
+}
+
+// decodePunycode decodes the part of a label after xn--, RFC 3492 6.2.
+func decodePunycode(s string) (string, error) {
+	var output []rune
+	if i := strings.LastIndexByte(s, '-'); i >= 0 {
+		for _, c := range s[:i] {
+			if c >= utf8.RuneSelf {
+				return "", errPunycode
+			}
+			output = append(output, c)
+		}
+		s = s[i+1:]
+	}
+	n, bias, i := punycodeInitialN, punycodeInitialBias, 0
+	for pos := 0; pos < len(s); {
+		oldI, w := i, 1
+		for k := punycodeBase; ; k += punycodeBase {
+			if pos == len(s) {
+				return "", errPunycode
+			}
+			var digit int
+			switch c := s[pos]; {
+			case 'a' <= c && c <= 'z':
+				digit = int(c - 'a')
+			case 'A' <= c && c <= 'Z':
+				digit = int(c - 'A')
+			case '0' <= c && c <= '9':
+				digit = int(c-'0') + 26
+			default:
+				return "", errPunycode
+			}
+			pos++
+			if digit > (1<<31-1-i)/w {
+				return "", errPunycode
+			}
+			i += digit * w
+			t := punycodeThreshold(k, bias)
+			if digit < t {
+				break
+			}
+			if w > (1<<31-1)/(punycodeBase-t) {
+				return "", errPunycode
+			}
+			w *= punycodeBase - t
+		}
+		bias = punycodeAdapt(i-oldI, len(output)+1, oldI == 0)
+		n += i / (len(output) + 1)
+		i %= len(output) + 1
+		if n > utf8.MaxRune || !utf8.ValidRune(rune(n)) {
+			return "", errPunycode
+		}
+		output = append(output, 0)
+		copy(output[i+1:], output[i:])
+		output[i] = rune(n)
+		i++
+	}
+	return string(output), nil
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+// punycodeTests are the samples of RFC 3492 7.1, with errata 3026, and a few
+// edge cases. The encoder keeps the case of basic code points, as the RFC's
+// mixed-case annotation does.
+var punycodeTests = []struct {
+	unicode, encoded string
+}{
+	{"", ""},
+	{"-", "--"},
+	{"a", "a-"},
+	{"bücher", "bcher-kva"},
+	{"ü", "tda"},
+	// (A) Arabic (Egyptian)
+	{"ليهمابتكلموشعربي؟", "egbpdaj6bu4bxfgehfvwxn"},
+	// (B) Chinese (simplified)
+	{"他们为什么不说中文", "ihqwcrb4cv8a8dqg056pqjye"},
+	// (C) Chinese (traditional)
+	{"他們爲什麽不說中文", "ihqwctvzc91f659drss3x8bo0yb"},
+	// (D) Czech
+	{"Pročprostěnemluvíčesky", "Proprostnemluvesky-uyb24dma41a"},
+	// (E) Hebrew
+	{"למההםפשוטלאמדבריםעברית", "4dbcagdahymbxekheh6e0a7fei0b"},
+	// (F) Hindi (Devanagari)
+	{"यहलोगहिन्दीक्योंनहींबोलसकतेहैं", "i1baa7eci9glrd9b2ae1bj0hfcgg6iyaf8o0a1dig0cd"},
+	// (G) Japanese (kanji and hiragana)
+	{"なぜみんな日本語を話してくれないのか", "n8jok5ay5dzabd5bym9f0cm5685rrjetr6pdxa"},
+	// (H) Korean (Hangul syllables)
+	{"세계의모든사람들이한국어를이해한다면얼마나좋을까", "989aomsvi5e83db1d2a355cv1e0vak1dwrv93d5xbh15a0dt30a5jpsd879ccm6fea98c"},
+	// (I) Russian (Cyrillic)
+	{"почемужеонинеговорятпорусски", "b1abfaaepdrnnbgefbadotcwatmq2g4l"},
+	// (J) Spanish
+	{"PorquénopuedensimplementehablarenEspañol", "PorqunopuedensimplementehablarenEspaol-fmd56a"},
+	// (K) Vietnamese
+	{"TạisaohọkhôngthểchỉnóitiếngViệt", "TisaohkhngthchnitingVit-kjcr8268qyxafd2f1b9g"},
+	// (L) 3<nen>B<gumi><kinpachi><sensei>
+	{"3年B組金八先生", "3B-ww4c5e180e575a65lsy2b"},
+	// (M) <amuro><namie>-with-SUPER-MONKEYS
+	{"安室奈美恵-with-SUPER-MONKEYS", "-with-SUPER-MONKEYS-pc58ag80a8qai00g7n9n"},
+	// (N) Hello-Another-Way-<sorezore><no><basho>
+	{"Hello-Another-Way-それぞれの場所", "Hello-Another-Way--fc4qua05auwb3674vfr0b"},
+	// (O) <hitotsu><yane><no><shita>2
+	{"ひとつ屋根の下2", "2-u9tlzr9756bt3uc0v"},
+	// (P) Maji<de>Koi<suru>5<byou><mae>
+	{"MajiでKoiする5秒前", "MajiKoi5-783gue6qz075azm5e"},
+	// (Q) <pafii>de<runba>
+	{"パフィーdeルンバ", "de-jg4avhby1noc0d"},
+	// (R) <sono><supiido><de>
+	{"そのスピードで", "d9juau41awczczp"},
+	// (S) -> $1.00 <-
+	{"-> $1.00 <-", "-> $1.00 <--"},
+}
+
+func TestPunycode(t *testing.T) {
+	for _, tt := range punycodeTests {
+		if got := encodePunycode(tt.unicode); got != tt.encoded {
+			t.Errorf("encodePunycode(%q) = %q, want %q", tt.unicode, got, tt.encoded)
+		}
+		got, err := decodePunycode(tt.encoded)
+		if err != nil || got != tt.unicode {
+			t.Errorf("decodePunycode(%q) = %q, %v, want %q", tt.encoded, got, err, tt.unicode)
+		}
+		// the digits may come in either case, RFC 3492 5
+		if got, err := decodePunycode(strings.ToUpper(tt.encoded)); err != nil || !strings.EqualFold(got, tt.unicode) {
+			t.Errorf("decodePunycode(%q) = %q, %v", strings.ToUpper(tt.encoded), got, err)
+		}
+	}
+}
+
+func TestDecodePunycodeInvalid(t *testing.T) {
+	for _, s := range []string{
+		"99999999999999999999a", // delta overflows
+		"99999z",                // beyond U+10FFFF
+		"ib9b",                  // a surrogate, U+D800
+		"bcher-kv!",             // not a digit
+		"bcher-kv_",             // not a digit
+		"bücher-kva",            // not basic before the delimiter
+		"bcher-kv9",             // ends inside a number
+		"b",                     // ends inside a number
+	} {
+		if got, err := decodePunycode(s); err == nil {
+			t.Errorf("decodePunycode(%q) = %q, want an error", s, got)
+		}
+	}
+}
+
+func TestIDNA(t *testing.T) {
+	for _, tt := range []struct {
+		unicode, ascii string
+	}{
+		{"example.com", "example.com"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"BÜCHER.example.", "xn--bcher-kva.example."},
+		{"münchen。de", "xn--mnchen-3ya.de"},
+		{"пример.испытание", "xn--e1afmkfd.xn--80akhbyknj4f"},
+		{"例え.テスト", "xn--r8jz45g.xn--zckzah"},
+	} {
+		ascii, err := idnaToASCII(tt.unicode)
+		if err != nil || ascii != tt.ascii {
+			t.Errorf("idnaToASCII(%q) = %q, %v, want %q", tt.unicode, ascii, err, tt.ascii)
+		}
+		// back to Unicode for display, lowercased and with plain dots
+		want := strings.ToLower(idnaDots.Replace(tt.unicode))
+		if got := idnaToUnicode(ascii); got != want {
+			t.Errorf("idnaToUnicode(%q) = %q, want %q", ascii, got, want)
+		}
+	}
+
+	for _, name := range []string{
+		"bad\xffname.example",
+		"sp aceü.example",
+		"esc\\.apeü.example",
+		strings.Repeat("ü", 60) + ".example", // longer than 63 bytes encoded
+	} {
+		if ascii, err := idnaToASCII(name); err == nil {
+			t.Errorf("idnaToASCII(%q) = %q, want an error", name, ascii)
+		}
+	}
+
+	// labels that aren't A-labels are shown as they are
+	for _, name := range []string{
+		"xn--Mnchen-3ya.de", // mixed case, decodes to an uppercase M
+		"xn--mnchen-3YA.de", // mixed-case digits
+		"xn--abc-.example",  // nothing to decode
+		"xn--bcher-kv9.example",
+		"xn--.example",
+		"xn--2a.example",   // decodes to a C1 control
+		"xn--ib9b.example", // decodes to a surrogate
+		`xn--a\.-.example`, // decodes to a dot
+	} {
+		if got := idnaToUnicode(name); got != name {
+			t.Errorf("idnaToUnicode(%q) = %q, want it unchanged", name, got)
+		}
+	}
+}
+
+func TestParseName(t *testing.T) {
+	label63 := strings.Repeat("a", 63)
+	longest := strings.Repeat(label63+".", 3) + strings.Repeat("b", 61) // 255 bytes on the wire
+	for _, tt := range []struct {
+		in, ascii string // no ascii: the name is rejected
+		labels    int
+	}{
+		{"", ".", 0},
+		{".", ".", 0},
+		{"example.com", "example.com.", 2},
+		{"WWW.Example.COM.", "www.example.com.", 3},
+		{`a\.b.example`, `a\.b.example.`, 2},
+		{`a\046b.example`, `a\.b.example.`, 2},
+		{`\065\066C.example`, "abc.example.", 2}, // escaped letters fold too
+		{`sp\ ace.example`, `sp\032ace.example.`, 2},
+		{`\000\255.example`, `\000\255.example.`, 2},
+		{`semi\;colon.example`, `semi\;colon.example.`, 2},
+		{`back\\slash.example`, `back\\slash.example.`, 2},
+		{"bücher.example", "xn--bcher-kva.example.", 2},
+		{label63 + ".example", label63 + ".example.", 2},
+		{longest, longest + ".", 4},
+		{longest + ".", longest + ".", 4},
+		{label63 + "a.example", "", 0},      // label over 63 bytes
+		{longest + "b", "", 0},              // name over 255 bytes
+		{strings.Repeat(`\097`, 64), "", 0}, // over 63 bytes once unescaped
+		{"a..example", "", 0},
+		{".example", "", 0},
+		{`\256.example`, "", 0},
+		{`trailing\`, "", 0},
+	} {
+		name, err := ParseName(tt.in)
+		if tt.ascii == "" {
+			if err == nil {
+				t.Errorf("ParseName(%q) = %s, want an error", tt.in, name.ASCII())
+			}
+			continue
+		}
+		if err != nil || name.ASCII() != tt.ascii || name.CountLabels() != tt.labels {
+			t.Errorf("ParseName(%q) = %s with %d labels, %v, want %s with %d", tt.in, name.ASCII(), name.CountLabels(), err, tt.ascii, tt.labels)
+		}
+	}
+}
+
+func TestNameFromWire(t *testing.T) {
+	wire := []byte("\x03WwW\x07ExAmPlE\x03\xc3\x9cX\x00")
+	name := NameFromWire(wire)
+	if name != Name("\x03www\x07example\x03\xc3\x9cx\x00") {
+		t.Errorf("NameFromWire(%q) = %q, want only the ASCII letters lowercased", wire, name)
+	}
+	if string(wire) != "\x03WwW\x07ExAmPlE\x03\xc3\x9cX\x00" {
+		t.Error("NameFromWire changed its argument")
+	}
+	if !name.EqualWire(wire) || name != mustParseName(`www.EXAMPLE.\195\156x`) {
+		t.Errorf("%s isn't the name it was made from", name)
+	}
+	// 0x5a is Z only outside length bytes; a 26-byte label keeps its length
+	long := append([]byte{26}, strings.Repeat("Z", 26)...)
+	if got := NameFromWire(append(long, 0)); got[0] != 26 {
+		t.Errorf("length byte folded to %d", got[0])
+	}
+}
+
+func TestNameCompare(t *testing.T) {
+	// in canonical order, RFC 4034 6.1
+	names := []string{
+		".",
+		"example.com", // com before example
+		"example",
+		"a.example",
+		"yljkjljk.a.example",
+		"Z.a.example",
+		"zABC.a.EXAMPLE",
+		"z.example",
+		`\001.z.example`,
+		"*.z.example",
+		`\200.z.example`,
+	}
+	for i, a := range names {
+		for j, b := range names {
+			want := 0
+			switch {
+			case i < j:
+				want = -1
+			case i > j:
+				want = 1
+			}
+			if got := mustParseName(a).Compare(mustParseName(b)); got != want {
+				t.Errorf("%s compared to %s = %d, want %d", a, b, got, want)
+			}
+		}
+	}
+	if c := mustParseName("EXAMPLE.com").Compare(mustParseName("example.COM.")); c != 0 {
+		t.Errorf("names differing in case compare %d", c)
+	}
+}
+
+func TestNameIsSubdomainOf(t *testing.T) {
+	for _, tt := range []struct {
+		name, parent string
+		want         bool
+	}{
+		{"www.example.com", "example.com", true},
+		{"WWW.EXAMPLE.COM", "example.com", true},
+		{"example.com", "example.com", true},
+		{"example.com", ".", true},
+		{".", ".", true},
+		{"a.b.c.example.com", "c.example.com", true},
+		{"example.com", "www.example.com", false},
+		{"notexample.com", "example.com", false}, // a suffix, not a label boundary
+		// a dot within a label is no label boundary
+		{`a\.example.com`, "example.com", false},
+		{`www.a\.example.com`, "example.com", false},
+		{`www.a\.example.com`, `a\.example.com`, true},
+		{"a.example.com", `a\.example.com`, false},
+		{".", "com", false},
+		{"example.org", "example.com", false},
+	} {
+		if got := mustParseName(tt.name).IsSubdomainOf(mustParseName(tt.parent)); got != tt.want {
+			t.Errorf("%s subdomain of %s = %v, want %v", tt.name, tt.parent, got, tt.want)
+		}
+	}
+}
+
+func TestLongestZone(t *testing.T) {
+	zones := map[Name]int{}
+	for i, zone := range []string{"example.com", "c.example.com", `a\.b.example.com`, "lan", "."} {
+		zones[mustParseName(zone)] = i
+	}
+	for _, tt := range []struct {
+		name, want string
+	}{
+		{"example.com", "example.com"},
+		{"WWW.Example.COM", "example.com"},
+		{"a.b.c.example.com", "c.example.com"},
+		{"notc.example.com", "example.com"}, // a suffix, not a label boundary
+		{`x.a\.b.example.com`, `a\.b.example.com`},
+		{"a.b.example.com", "example.com"}, // the dot is no label boundary
+		{"host.lan", "lan"},
+		{"example.org", "."},
+		{".", "."},
+	} {
+		zone, ok := longestZone(mustParseName(tt.name), zones)
+		if !ok || zone != mustParseName(tt.want) {
+			t.Errorf("longest zone of %s: %s, %v, want %s", tt.name, zone, ok, tt.want)
+		}
+		if v, _ := closestZone(mustParseName(tt.name), zones); v != zones[mustParseName(tt.want)] {
+			t.Errorf("closest zone of %s has %d, want %d", tt.name, v, zones[mustParseName(tt.want)])
+		}
+	}
+	delete(zones, RootName)
+	if zone, ok := longestZone(mustParseName("example.org"), zones); ok {
+		t.Errorf("example.org in zone %s", zone)
+	}
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// options holds everything that can be set by flags, the environment and the
+// config file.
+type options struct {
+	resolver        string
+	upstreamTimeout time.Duration
+	queryTimeout    time.Duration
+	records         LocalRecords
+	poolSpecs       poolFlag
+
+	listenerACL *ACL
+	listenACLs  map[string]*ACL
+	aclAction   string
+	zoneACLs    ZoneACLs
+
+	rateQPS     float64
+	rateBurst   int
+	rateAction  string
+	ratePrefix4 int
+	ratePrefix6 int
+	tarpitDelay time.Duration
+
+	tunnelDetect     bool
+	tunnelAction     string
+	tunnelMaxLabel   int
+	tunnelEntropy    float64
+	tunnelSubdomains int
+	tunnelTXTRate    int
+	tunnelHold       time.Duration
+	tunnelLimit      float64
+
+	qtypePolicy      QTypePolicy
+	hooks            Hooks
+	filter           *Filter
+	blocklistURLs    stringsFlag
+	blocklistRefresh time.Duration
+	groupSpecs       groupFlag
+	safeSearch       *SafeSearch
+	rewriter         Rewriter
+	chaos            *Chaos
+
+	auditSize        int
+	auditPath        string
+	recentQueries    int
+	historyDir       string
+	historyRetention time.Duration
+	queryLogPath     string
+	queryLogSize     int
+	queryLogBackups  int
+	queryLogAge      time.Duration
+	queryLogCompress bool
+	queryLogSample   float64
+	quarantineDir    string
+	quarantineMax    int
+	logLevel         string
+	logFormat        string
+	slowQuery        time.Duration
+
+	maxInflight     int
+	overloadAction  string
+	memoryBudget    int
+	maxUDPSize      int
+	pipeline        string
+	pluginSpecs     stringsFlag
+	shutdownTimeout time.Duration
+	adminAddr       string
+	adminTokenFile  string
+	adminRulesFile  string
+	pprofAddr       string
+	listen          []listenEndpoint
+	listenAddrFile  string
+	udpSockets      int
+	udpBatch        int
+	runAsUser       string
+	chroot          string
+	daemon          bool
+	pidFile         string
+	logFile         string
+	signal          string
+	configPath      string
+}
+
+// newFlagSet registers every flag of the server on a new flag set that fills
+// opts.
+func newFlagSet(opts *options, errorHandling flag.ErrorHandling) *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], errorHandling)
+
+	opts.listenerACL = &ACL{}
+	opts.listenACLs = map[string]*ACL{}
+	opts.zoneACLs = ZoneACLs{}
+	fs.StringVar(&opts.resolver, "resolver", "", "upstream host:port queries are forwarded to (none: names without local records get NXDOMAIN)")
+	fs.DurationVar(&opts.queryTimeout, "query-timeout", 5*time.Second, "how long answering a query may take in all, upstream queries included, before the client gets SERVFAIL")
+	fs.DurationVar(&opts.upstreamTimeout, "upstream-timeout", defaultExchangeTimeout, "how long an upstream query may take, including a retry over TCP when the UDP answer is truncated, before the client gets SERVFAIL")
+	fs.Var(&recordFlag{records: &opts.records}, "record", `local record answered authoritatively, "name [ttl] type data" for A, AAAA, PTR, MX or TXT, e.g. "router.lan A 192.168.1.1" (repeatable)`)
+	fs.Var(&opts.poolSpecs, "pool", `name answered with the addresses of healthy backends, e.g. "name=app.lan backends=10.0.0.1,10.0.0.2 policy=round-robin check=http:8080/healthz"; policy is round-robin, least-conn or priority, check tcp:port, http:port/path or none, with optional answers=1 ttl=30 interval=10s timeout=2s fall=3 rise=2 (repeatable)`)
+	fs.Var(&cidrListFlag{networks: &opts.listenerACL.Allow}, "allow", "comma separated client networks allowed to query (default: everyone)")
+	fs.Var(&cidrListFlag{networks: &opts.listenerACL.Deny}, "deny", "comma separated client networks that are refused service")
+	fs.Var(&listenACLFlag{acls: opts.listenACLs}, "listen-allow", "endpoint=cidr[,cidr...] allowed to query on a -listen endpoint, which then ignores -allow and -deny, e.g. tcp://0.0.0.0:53=198.51.100.0/24 (repeatable)")
+	fs.Var(&listenACLFlag{acls: opts.listenACLs, deny: true}, "listen-deny", "endpoint=cidr[,cidr...] refused on a -listen endpoint, which then ignores -allow and -deny (repeatable)")
+	fs.StringVar(&opts.aclAction, "acl-action", "refuse", "what to do with clients rejected by an ACL: refuse or drop")
+	fs.Var(&zoneACLFlag{acls: opts.zoneACLs}, "zone-allow", "zone=cidr[,cidr...] allowed to query names in zone (repeatable)")
+	fs.Var(&zoneACLFlag{acls: opts.zoneACLs, deny: true}, "zone-deny", "zone=cidr[,cidr...] refused for names in zone (repeatable)")
+
+	fs.Float64Var(&opts.rateQPS, "rate-limit", 0, "queries per second allowed per client IP (0 disables rate limiting)")
+	fs.IntVar(&opts.rateBurst, "rate-burst", 20, "number of queries a client may send in a burst above -rate-limit")
+	fs.IntVar(&opts.ratePrefix4, "rate-prefix-v4", 32, "length of the IPv4 prefix whose clients share a rate limit bucket")
+	fs.IntVar(&opts.ratePrefix6, "rate-prefix-v6", 56, "length of the IPv6 prefix whose clients share a rate limit bucket, as a client usually holds a whole /56 or /64")
+	fs.StringVar(&opts.rateAction, "rate-action", "drop", "what to do with rate limited queries: drop, refuse or tarpit")
+	fs.DurationVar(&opts.tarpitDelay, "rate-tarpit-delay", 2*time.Second, "how long tarpitted clients wait for their REFUSED answer")
+
+	fs.BoolVar(&opts.tunnelDetect, "tunnel-detect", false, "flag clients whose queries look like DNS tunneling, at the tunnel stage of -pipeline: long or high entropy labels, many distinct names below one domain, or many TXT and NULL queries, within a minute")
+	fs.StringVar(&opts.tunnelAction, "tunnel-action", "log", "what to do with the queries of flagged clients: log, refuse, drop or limit (to -tunnel-limit)")
+	fs.IntVar(&opts.tunnelMaxLabel, "tunnel-max-label", 50, "longest label that isn't suspicious")
+	fs.Float64Var(&opts.tunnelEntropy, "tunnel-entropy", 4, "entropy in bits per character above which the labels below the domain of a name, 24 characters or more, are suspicious")
+	fs.IntVar(&opts.tunnelSubdomains, "tunnel-subdomains", 100, "distinct names below one domain a client may ask for in a minute")
+	fs.IntVar(&opts.tunnelTXTRate, "tunnel-txt-rate", 100, "TXT and NULL queries a client may send in a minute")
+	fs.DurationVar(&opts.tunnelHold, "tunnel-hold", 10*time.Minute, "how long a client stays flagged after the last sign of tunneling")
+	fs.Float64Var(&opts.tunnelLimit, "tunnel-limit", 1, "queries per second allowed to flagged clients with -tunnel-action limit, in bursts of up to 5")
+
+	opts.filter = &Filter{}
+	fs.Var(&filterRuleFlag{filter: opts.filter, action: FilterBlock}, "block-domain", `domain or /regexp/ with optional @schedule to block, e.g. "facebook.com@sun-thu 21:00-07:00" (repeatable)`)
+	fs.Var(&filterRuleFlag{filter: opts.filter, action: FilterAllow}, "allow-domain", "domain or /regexp/ with optional @schedule exempt from blocking (repeatable)")
+	fs.Var(&opts.blocklistURLs, "blocklist", "URL or path of a hosts, domain or adblock style blocklist (repeatable)")
+	fs.DurationVar(&opts.blocklistRefresh, "blocklist-refresh", 24*time.Hour, "how often blocklists are checked for updates")
+	fs.Var(&opts.groupSpecs, "group", `client group with its own policy, e.g. "name=kids clients=10.0.1.0/24 block=tiktok.com safe-search=on" (repeatable, first match wins); a group a -listen endpoint is bound to may go without clients, and local=off forwards the names of local records and pools too`)
+
+	fs.IntVar(&opts.auditSize, "audit-size", 1000, "number of recent blocked queries kept for the admin API")
+	fs.StringVar(&opts.auditPath, "audit-log", "", "file blocked queries are appended to as JSON lines (rotated at 10MB)")
+	fs.IntVar(&opts.recentQueries, "recent-queries", 1000, "number of recent queries kept for the admin API and the dashboard, logged or not (0 disables)")
+	fs.StringVar(&opts.historyDir, "history-dir", "", "directory every query is kept in for /history, a file of JSON lines per day with an index of its blocks (disabled when empty)")
+	fs.DurationVar(&opts.historyRetention, "history-retention", 30*24*time.Hour, "how long the query history is kept, in whole days (0 keeps it all)")
+	fs.StringVar(&opts.queryLogPath, "query-log", "", "file every query is logged to as JSON lines (disabled when empty)")
+	fs.IntVar(&opts.queryLogSize, "query-log-max-size", 100, "size in MB at which the query log is rotated (0 disables)")
+	fs.DurationVar(&opts.queryLogAge, "query-log-max-age", 0, "age at which the query log is rotated, e.g. 24h (0 disables)")
+	fs.IntVar(&opts.queryLogBackups, "query-log-backups", 5, "number of rotated query logs to keep")
+	fs.BoolVar(&opts.queryLogCompress, "query-log-compress", false, "gzip rotated query logs")
+	fs.Float64Var(&opts.queryLogSample, "query-log-sample", 1, "fraction of queries written to the query log, between 0 and 1")
+	fs.StringVar(&opts.quarantineDir, "quarantine-dir", "", "directory the packets that fail to parse are kept in, raw with a JSON file of metadata each, inside -chroot if set (disabled when empty)")
+	fs.IntVar(&opts.quarantineMax, "quarantine-max", 1000, "number of packets kept in -quarantine-dir, the oldest are removed")
+	fs.StringVar(&opts.logLevel, "log-level", "info", "minimum level of log records: debug, info, warn or error")
+	fs.StringVar(&opts.logFormat, "log-format", "text", "log record format: text or json")
+	fs.DurationVar(&opts.slowQuery, "slow-query", 0, "log queries taking longer than this with the time spent in each stage, e.g. 500ms (0 disables)")
+
+	fs.IntVar(&opts.maxInflight, "max-inflight", 10000, "maximum number of queries answered at once (0 removes the limit)")
+	fs.StringVar(&opts.overloadAction, "overload-action", "drop", "what to do with queries beyond -max-inflight: drop, refuse or servfail")
+	fs.IntVar(&opts.maxUDPSize, "max-udp-size", defaultMaxUDPSize, "largest UDP message in bytes accepted from clients, and sent to clients advertising an EDNS buffer size at least as large; larger ones are truncated so the client retries over TCP. Also the size advertised to upstreams")
+	fs.StringVar(&opts.pipeline, "pipeline", defaultPipeline, "comma separated stages queries go through, in order, before they are forwarded: acl, ratelimit, tunnel, policy, hooks, plugins, rewrite, handlers, local and filter; stages left out are skipped")
+	fs.Var(&opts.pluginSpecs, "plugin", `zone plugin [args...] adding a registered plugin to the chain of zone at the plugins stage of -pipeline, e.g. "lab.example rcode REFUSED" (repeatable, chained in order)`)
+	fs.IntVar(&opts.memoryBudget, "memory-budget", 0, "memory in MB the server should stay within, lowering -max-inflight, capping the blocklists and the clients the rate limiter tracks and, at startup, -audit-size and the clients and names of the analytics and the traffic to fit and making the garbage collector keep the heap below it (0 disables)")
+	fs.DurationVar(&opts.shutdownTimeout, "shutdown-timeout", 5*time.Second, "how long in-flight queries may take to finish on SIGTERM/SIGINT")
+	fs.StringVar(&opts.adminAddr, "admin", "", "address of the admin HTTP endpoints, e.g. 127.0.0.1:8053 or unix:/run/dns-server/admin.sock (disabled when empty)")
+	fs.StringVar(&opts.adminTokenFile, "admin-token-file", "", "file holding the bearer token the admin endpoints require, except /healthz, /readyz and the pages of the dashboard, which asks for it; required unless -admin is a unix socket")
+	fs.StringVar(&opts.adminRulesFile, "admin-rules-file", "", "file the block and allow rules added from the admin API and the dashboard are saved to and read back from at startup (kept in memory only when empty)")
+	fs.StringVar(&opts.pprofAddr, "pprof", "", "address of the net/http/pprof profiling endpoints, e.g. 127.0.0.1:6060 (disabled when empty)")
+
+	opts.safeSearch = &SafeSearch{}
+	fs.BoolVar(&opts.safeSearch.Enabled, "safe-search", false, "force safe search on Google, Bing, DuckDuckGo and restricted mode on YouTube")
+	fs.Var(&cidrListFlag{networks: &opts.safeSearch.Clients}, "safe-search-clients", "comma separated client networks safe search applies to (default: everyone)")
+
+	opts.rewriter = Rewriter{}
+	fs.Var(&rewriteFlag{rewriter: opts.rewriter}, "rewrite", "from=to zone rewrite applied before resolution, e.g. example.com=internal.example.lan (repeatable)")
+	fs.Var(&hookFlag{hooks: &opts.hooks}, "hook", `per-query rule "if condition then action", e.g. "if qtype == TXT and client in 10.0.0.0/8 then refuse"; conditions compare qname, qtype, qclass, client, group, proto, labels, length, hour and weekday with ==, !=, <, <=, >, >=, in and matches, joined by and, or and not; actions are pass, refuse, drop, nxdomain, servfail and nodata (repeatable, first match wins, at the hooks stage of -pipeline)`)
+	fs.Var(&qtypeRuleFlag{policy: &opts.qtypePolicy}, "qtype-rule", `query type rule, e.g. "types=ANY,AXFR action=refuse except=10.0.0.0/8" (repeatable, first match wins)`)
+
+	opts.chaos = &Chaos{}
+	fs.StringVar(&opts.chaos.Version, "chaos-version", "dns-server", "answer to CH TXT version.bind and version.server (empty refuses them)")
+	fs.StringVar(&opts.chaos.ID, "chaos-id", defaultChaosID(), "answer to CH TXT hostname.bind and id.server (empty refuses them)")
+
+	opts.listen = []listenEndpoint{{Network: "udp", Host: "127.0.0.1", Port: "2053"}}
+	fs.Var(&listenFlag{endpoints: &opts.listen}, "listen", "comma separated addresses to serve DNS on, host:port for UDP or tcp://host:port, e.g. 0.0.0.0:53,tcp://[::]:53,udp://eth0:53; port 0 picks an ephemeral port, shared by the endpoints of one host; @name binds an endpoint to a -group, or to default, answering everyone there with its policy, e.g. 10.8.0.1:53@vpn (env DNS_SERVER_LISTEN)")
+	fs.StringVar(&opts.listenAddrFile, "listen-addr-file", "", "file the bound addresses are written to once listening, one per line, handy with an ephemeral port")
+	fs.IntVar(&opts.udpSockets, "udp-sockets", 1, "UDP sockets opened per listen address with SO_REUSEPORT, each with its own read loop (0 opens one per CPU; above 1 needs Linux)")
+	fs.IntVar(&opts.udpBatch, "udp-batch", 1, "UDP datagrams read or written per system call with recvmmsg/sendmmsg on Linux, e.g. 32 (1 handles them one at a time, as other platforms always do)")
+	fs.StringVar(&opts.runAsUser, "user", "", "user[:group] name or id to switch to once the sockets are bound, when started as root (group defaults to the user's primary group)")
+	fs.StringVar(&opts.chroot, "chroot", "", "directory to chroot into once the sockets are bound; config, blocklist and log paths are then looked up inside it")
+	fs.BoolVar(&opts.daemon, "daemon", false, "run in the background, detached from the terminal; the command returns once the server is serving")
+	fs.StringVar(&opts.pidFile, "pid-file", "", "file the process ID is written to and kept locked while running, refusing a second server with the same file")
+	fs.StringVar(&opts.logFile, "log-file", "", "file the log is appended to instead of stderr")
+	fs.StringVar(&opts.signal, "s", "", "send the server named by -pid-file a signal and exit: stop or reload")
+	fs.StringVar(&opts.configPath, "config", "", "TOML config file; flags given on the command line override its values")
+	return fs
+}
+
+// parseOptions reads the options from the environment, the command line
+// arguments and the config file named by -config, in increasing order of
+// precedence: flags override the environment, which overrides the file.
+// getenv looks up the environment; with a nil getenv it isn't consulted.
+func parseOptions(args []string, errorHandling flag.ErrorHandling, getenv func(string) string) (*options, error) {
+	opts := &options{}
+	fs := newFlagSet(opts, errorHandling)
+	if errorHandling == flag.ContinueOnError {
+		fs.SetOutput(io.Discard)
+	}
+
+	// the environment counts as set on the command line, so it wins over the
+	// config file but still loses against a flag
+	if getenv != nil {
+		if env := getenv("DNS_SERVER_LISTEN"); env != "" {
+			if err := fs.Set("listen", env); err != nil {
+				return nil, fmt.Errorf("invalid DNS_SERVER_LISTEN: %w", err)
+			}
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if opts.configPath != "" {
+		if err := loadConfig(opts.configPath, fs); err != nil {
+			return nil, fmt.Errorf("invalid config: %w", err)
+		}
+	}
+	return opts, nil
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/internal/slog"
+)
+
+// overloadReportInterval spaces the warnings about rejected queries, which
+// come in floods by nature.
+const overloadReportInterval = 10 * time.Second
+
+// OverloadAction decides what happens to a query that arrives while the
+// server already answers its maximum number of queries.
+type OverloadAction int
+
+const (
+	OverloadDrop     OverloadAction = iota // silently drop the query
+	OverloadRefuse                         // answer with RCODE REFUSED
+	OverloadServfail                       // answer with RCODE SERVFAIL
+)
+
+func parseOverloadAction(s string) (OverloadAction, error) {
+	switch strings.ToLower(s) {
+	case "drop":
+		return OverloadDrop, nil
+	case "refuse", "refused":
+		return OverloadRefuse, nil
+	case "servfail":
+		return OverloadServfail, nil
+	}
+	return OverloadDrop, fmt.Errorf("unknown overload action %q (want drop, refuse or servfail)", s)
+}
+
+// admit reserves one of the -max-inflight slots, as lowered by
+// -memory-budget, for msg before a goroutine
+// is started to answer it. When all are taken the query gets the overload
+// action right away, on the reading goroutine, and admit reports false.
+// Packets that fail checkHeader are dropped rather than answered.
+// Admitted queries give their slot back with release.
+func (s *server) admit(msg []byte, source net.Addr, reply func([]byte) error) bool {
+	p := s.reload.current.Load()
+	active := s.active.Add(1)
+	if p.maxInflight <= 0 || active <= int64(p.maxInflight) {
+		return true
+	}
+	s.active.Add(-1)
+	s.stats.overloaded.Add(1)
+	if last := s.overloadReported.Load(); time.Since(time.Unix(0, last)) >= overloadReportInterval &&
+		s.overloadReported.CompareAndSwap(last, time.Now().UnixNano()) {
+		slog.Warn("server overloaded, rejecting queries", "max_inflight", p.maxInflight, "rejected", s.stats.overloaded.Load())
+	}
+
+	// junk and responses get no answer here either, an overloaded server
+	// is the last thing that should reflect them
+	if reason, ok := checkHeader(msg); !ok {
+		s.stats.reject(reason)
+		return false
+	}
+	// no more than the header and questions are parsed, the point is to
+	// shed load
+	names := getBuffer()
+	defer putBuffer(names)
+	nameBuf := (*names)[:0]
+	header, err := parseDNSHeader(msg)
+	if err != nil {
+		s.stats.record("", "", -1)
+		return false
+	}
+	var questions []DNSQuestion
+	for i, offset := 0, 12; i < int(header.QDCount); i++ {
+		var question DNSQuestion
+		if question, nameBuf, offset, err = parseDNSQuestion(nameBuf, msg, offset); err != nil {
+			s.stats.record("", "", -1)
+			return false
+		}
+		questions = append(questions, question)
+	}
+	var name, qtype string
+	if len(questions) > 0 {
+		name, qtype = domainName(questions[0].Name), typeName(questions[0].Type)
+	}
+
+	var rcode Rcode
+	switch p.onOverload {
+	case OverloadDrop:
+		s.stats.record(name, qtype, -1)
+		return false
+	case OverloadRefuse:
+		rcode = RcodeRefused
+	case OverloadServfail:
+		rcode = RcodeServFail
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := reply(appendDNSResponse((*buf)[:0], errorResponse(header, questions, rcode))); err != nil {
+		slog.Error("failed to send response", "client", source.String(), "err", err)
+	}
+	s.stats.record(name, qtype, int(rcode))
+	return false
+}
+
+// release gives back the slot of an admitted query once it is answered.
+func (s *server) release() {
+	s.active.Add(-1)
+}
@@ -0,0 +1,81 @@
+package server
+
+import "testing"
+
+// overloadedServer returns a server answering queries over its limit with
+// REFUSED, with every slot taken.
+func overloadedServer(t *testing.T) *server {
+	t.Helper()
+	srv := newTestServer(t, "-max-inflight", "1", "-overload-action", "refuse")
+	srv.active.Store(1)
+	return srv
+}
+
+// admitTest offers data to srv and returns the replies sent.
+func (s *server) admitTest(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	var replies [][]byte
+	if s.admit(data, testClient, func(response []byte) error {
+		replies = append(replies, append([]byte(nil), response...))
+		return nil
+	}) {
+		t.Fatal("query admitted over the limit")
+	}
+	return replies
+}
+
+func TestOverloadRefusesQueries(t *testing.T) {
+	srv := overloadedServer(t)
+	var query Msg
+	query.SetQuestion("example.com", TypeA)
+	replies := srv.admitTest(t, query.Pack())
+	if len(replies) != 1 {
+		t.Fatalf("%d replies, want 1", len(replies))
+	}
+	response, _, err := parseDNSResponse(nil, replies[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Header.Rcode() != RcodeRefused {
+		t.Errorf("rcode %v, want REFUSED", response.Header.Rcode())
+	}
+}
+
+func TestOverloadDropsResponses(t *testing.T) {
+	srv := overloadedServer(t)
+	var response Msg
+	response.SetQuestion("example.com", TypeA)
+	response.Header.Flags |= flagQR
+	if replies := srv.admitTest(t, response.Pack()); len(replies) != 0 {
+		t.Errorf("answered a response with %x", replies)
+	}
+	if got := srv.stats.rejected[rejectResponse].Load(); got != 1 {
+		t.Errorf("%d responses rejected, want 1", got)
+	}
+}
+
+func TestOverloadDropsImpossiblePackets(t *testing.T) {
+	var query Msg
+	query.SetQuestion("example.com", TypeA)
+	counts := query.Pack()
+	counts[7] = 200 // ANCOUNT
+
+	for _, tt := range []struct {
+		name   string
+		data   []byte
+		reason rejectReason
+	}{
+		{"short", []byte{0, 1, 0, 0}, rejectShort},
+		{"counts", counts, rejectCounts},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := overloadedServer(t)
+			if replies := srv.admitTest(t, tt.data); len(replies) != 0 {
+				t.Errorf("answered %x with %x", tt.data, replies)
+			}
+			if got := srv.stats.rejected[tt.reason].Load(); got != 1 {
+				t.Errorf("%d packets rejected as %v, want 1", got, tt.reason)
+			}
+		})
+	}
+}
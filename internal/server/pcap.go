@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Link types of the capture formats readPcap understands, see
+// https://www.tcpdump.org/linktypes.html.
+const (
+	linkTypeNull     = 0 // BSD loopback, the address family in host order
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101 // IP with no link header
+	linkTypeLinuxSLL = 113 // tcpdump -i any
+	linkTypeLoop     = 108 // OpenBSD loopback, the family in network order
+	linkTypeSLL2     = 276
+)
+
+// maxPcapPacket bounds the captured length of a packet, larger ones mean a
+// corrupt file rather than a big packet.
+const maxPcapPacket = 256 << 10
+
+var errPcapNG = errors.New("pcapng captures aren't supported, convert with editcap -F pcap or save as pcap")
+
+// capturedMessage is a DNS message found in a capture, with the addresses of
+// the datagram or segment that carried it.
+type capturedMessage struct {
+	time     time.Time
+	src, dst net.Addr
+	msg      []byte
+}
+
+// readPcap returns the DNS messages of a capture in the classic libpcap
+// format: the payloads of the UDP datagrams, and the length framed messages
+// of the TCP segments, from or to port. Fragmented datagrams and messages
+// spread over several segments are skipped, readPcap doesn't reassemble, and
+// so are packets cut short by the snap length of the capture.
+func readPcap(r io.Reader, port int) ([]capturedMessage, error) {
+	br := bufio.NewReader(r)
+	var header [24]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, fmt.Errorf("reading pcap header: %w", err)
+	}
+	var order binary.ByteOrder
+	nano := false
+	switch magic := binary.LittleEndian.Uint32(header[:]); magic {
+	case 0xa1b2c3d4:
+		order = binary.LittleEndian
+	case 0xa1b23c4d:
+		order, nano = binary.LittleEndian, true
+	case 0xd4c3b2a1:
+		order = binary.BigEndian
+	case 0x4d3cb2a1:
+		order, nano = binary.BigEndian, true
+	case 0x0a0d0d0a:
+		return nil, errPcapNG
+	default:
+		return nil, fmt.Errorf("not a pcap file, magic %#08x", magic)
+	}
+	linkType := order.Uint32(header[20:]) & 0xFFFF
+
+	var messages []capturedMessage
+	var record [16]byte
+	for {
+		if _, err := io.ReadFull(br, record[:]); err != nil {
+			if err == io.EOF {
+				return messages, nil
+			}
+			return nil, fmt.Errorf("reading packet %d: %w", len(messages)+1, err)
+		}
+		sec, frac := order.Uint32(record[0:]), order.Uint32(record[4:])
+		size := order.Uint32(record[8:])
+		if size > maxPcapPacket {
+			return nil, fmt.Errorf("packet of %d bytes, the capture is corrupt", size)
+		}
+		packet := make([]byte, size)
+		if _, err := io.ReadFull(br, packet); err != nil {
+			return nil, fmt.Errorf("reading packet: %w", err)
+		}
+		if size < order.Uint32(record[12:]) {
+			continue // the messages in it would be cut too
+		}
+		if !nano {
+			frac *= 1000
+		}
+		at := time.Unix(int64(sec), int64(frac))
+		for _, found := range dnsPayloads(linkType, packet, port) {
+			found.time = at
+			messages = append(messages, found)
+		}
+	}
+}
+
+// dnsPayloads returns the DNS messages in a captured packet.
+func dnsPayloads(linkType uint32, packet []byte, port int) []capturedMessage {
+	ip, ok := linkPayload(linkType, packet)
+	if !ok || len(ip) == 0 {
+		return nil
+	}
+	var src, dst net.IP
+	var protocol byte
+	var transport []byte
+	switch ip[0] >> 4 {
+	case 4:
+		headerLen := int(ip[0]&0x0F) * 4
+		if len(ip) < 20 || headerLen < 20 || len(ip) < headerLen {
+			return nil
+		}
+		if binary.BigEndian.Uint16(ip[6:])&0x3FFF != 0 {
+			return nil // a fragment
+		}
+		end := int(binary.BigEndian.Uint16(ip[2:]))
+		if end < headerLen || end > len(ip) {
+			end = len(ip)
+		}
+		src, dst, protocol, transport = net.IP(ip[12:16]), net.IP(ip[16:20]), ip[9], ip[headerLen:end]
+	case 6:
+		// extension headers are left out, DNS traffic doesn't carry them
+		if len(ip) < 40 {
+			return nil
+		}
+		end := 40 + int(binary.BigEndian.Uint16(ip[4:]))
+		if end > len(ip) {
+			end = len(ip)
+		}
+		src, dst, protocol, transport = net.IP(ip[8:24]), net.IP(ip[24:40]), ip[6], ip[40:end]
+	default:
+		return nil
+	}
+
+	switch protocol {
+	case 17: // UDP
+		if len(transport) < 8 {
+			return nil
+		}
+		srcPort, dstPort := int(binary.BigEndian.Uint16(transport)), int(binary.BigEndian.Uint16(transport[2:]))
+		if srcPort != port && dstPort != port {
+			return nil
+		}
+		return []capturedMessage{{
+			src: &net.UDPAddr{IP: src, Port: srcPort},
+			dst: &net.UDPAddr{IP: dst, Port: dstPort},
+			msg: transport[8:],
+		}}
+	case 6: // TCP
+		if len(transport) < 20 {
+			return nil
+		}
+		srcPort, dstPort := int(binary.BigEndian.Uint16(transport)), int(binary.BigEndian.Uint16(transport[2:]))
+		offset := int(transport[12]>>4) * 4
+		if srcPort != port && dstPort != port || offset < 20 || offset > len(transport) {
+			return nil
+		}
+		var messages []capturedMessage
+		for data := transport[offset:]; len(data) >= 2; {
+			length := int(binary.BigEndian.Uint16(data))
+			if len(data) < 2+length {
+				break
+			}
+			messages = append(messages, capturedMessage{
+				src: &net.TCPAddr{IP: src, Port: srcPort},
+				dst: &net.TCPAddr{IP: dst, Port: dstPort},
+				msg: data[2 : 2+length],
+			})
+			data = data[2+length:]
+		}
+		return messages
+	}
+	return nil
+}
+
+// linkPayload strips the link layer header of a packet, returning the IP
+// packet it carries.
+func linkPayload(linkType uint32, packet []byte) ([]byte, bool) {
+	switch linkType {
+	case linkTypeRaw:
+		return packet, true
+	case linkTypeNull, linkTypeLoop:
+		if len(packet) < 4 {
+			return nil, false
+		}
+		return packet[4:], true
+	case linkTypeEthernet:
+		if len(packet) < 14 {
+			return nil, false
+		}
+		etherType, payload := binary.BigEndian.Uint16(packet[12:]), packet[14:]
+		for etherType == 0x8100 || etherType == 0x88A8 { // VLAN tags
+			if len(payload) < 4 {
+				return nil, false
+			}
+			etherType, payload = binary.BigEndian.Uint16(payload[2:]), payload[4:]
+		}
+		return payload, etherType == 0x0800 || etherType == 0x86DD
+	case linkTypeLinuxSLL:
+		if len(packet) < 16 {
+			return nil, false
+		}
+		protocol := binary.BigEndian.Uint16(packet[14:])
+		return packet[16:], protocol == 0x0800 || protocol == 0x86DD
+	case linkTypeSLL2:
+		if len(packet) < 20 {
+			return nil, false
+		}
+		protocol := binary.BigEndian.Uint16(packet)
+		return packet[20:], protocol == 0x0800 || protocol == 0x86DD
+	}
+	return nil, false
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// The captures in testdata/pcap:
+//
+// ethernet.pcap, little endian in microseconds: a UDP query for example.com
+// and its answer, a query tagged with VLAN 10, a TCP segment with two
+// queries, then packets to skip: a query to port 5353, a fragment, an ARP
+// packet and a query for example.com cut by the snap length.
+//
+// linux-sll.pcap, tcpdump -i any, big endian in nanoseconds: an AAAA query
+// over IPv6 and its answer, and an ARP packet.
+
+// describeCaptured summarises a captured message for comparison.
+func describeCaptured(m capturedMessage) string {
+	parsed, _, err := parseDNSResponse(nil, m.msg)
+	if err != nil {
+		return fmt.Sprintf("%s > %s: %v", m.src, m.dst, err)
+	}
+	return fmt.Sprintf("%s > %s %#04x %s", m.src, m.dst, parsed.Header.ID, replayQuestion(m.msg))
+}
+
+func TestReadPcap(t *testing.T) {
+	for _, tt := range []struct {
+		file  string
+		times []time.Time
+		want  []string
+	}{
+		{
+			"ethernet.pcap",
+			[]time.Time{time.Unix(1700000000, 123456000), time.Unix(1700000000, 223456000), time.Unix(1700000001, 0), time.Unix(1700000002, 0), time.Unix(1700000002, 0)},
+			[]string{
+				"192.0.2.1:40000 > 192.0.2.53:53 0x1111 example.com. A",
+				"192.0.2.53:53 > 192.0.2.1:40000 0x1111 example.com. A",
+				"192.0.2.2:40002 > 192.0.2.53:53 0x2222 vlan.example. A",
+				"192.0.2.1:40001 > 192.0.2.53:53 0x3333 tcp.example. A",
+				"192.0.2.1:40001 > 192.0.2.53:53 0x4444 tcp.example. AAAA",
+			},
+		},
+		{
+			"linux-sll.pcap",
+			[]time.Time{time.Unix(1700000000, 500), time.Unix(1700000000, 1000500)},
+			[]string{
+				"[2001:db8::1]:40000 > [2001:db8::53]:53 0x8888 v6.example. AAAA",
+				"[2001:db8::53]:53 > [2001:db8::1]:40000 0x8888 v6.example. AAAA",
+			},
+		},
+	} {
+		data, err := os.ReadFile("testdata/pcap/" + tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages, err := readPcap(bytes.NewReader(data), 53)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.file, err)
+		}
+		if len(messages) != len(tt.want) {
+			t.Errorf("%s: %d messages, want %d", tt.file, len(messages), len(tt.want))
+		}
+		for i := 0; i < len(messages) && i < len(tt.want); i++ {
+			if got := describeCaptured(messages[i]); got != tt.want[i] {
+				t.Errorf("%s: message %d is %q, want %q", tt.file, i, got, tt.want[i])
+			}
+			if !messages[i].time.Equal(tt.times[i]) {
+				t.Errorf("%s: message %d at %v, want %v", tt.file, i, messages[i].time, tt.times[i])
+			}
+		}
+
+		// a capture cut anywhere inside a record is an error, not a
+		// shorter capture
+		for _, cut := range []int{10, 24 + 8, 24 + 16 + 20} {
+			if _, err := readPcap(bytes.NewReader(data[:cut]), 53); err == nil {
+				t.Errorf("%s cut to %d bytes read", tt.file, cut)
+			}
+		}
+	}
+}
+
+func TestReadPcapInvalid(t *testing.T) {
+	pcapng := []byte{0x0a, 0x0d, 0x0d, 0x0a, 28, 0, 0, 0, 0x4d, 0x3c, 0x2b, 0x1a}
+	if _, err := readPcap(bytes.NewReader(append(pcapng, make([]byte, 12)...)), 53); !errors.Is(err, errPcapNG) {
+		t.Errorf("pcapng read with %v, want errPcapNG", err)
+	}
+	if _, err := readPcap(bytes.NewReader(make([]byte, 24)), 53); err == nil {
+		t.Error("a file without the pcap magic read")
+	}
+
+	// a record claiming more than maxPcapPacket bytes
+	data, err := os.ReadFile("testdata/pcap/ethernet.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := append([]byte(nil), data...)
+	corrupt[24+8], corrupt[24+9], corrupt[24+10] = 0xff, 0xff, 0xff
+	if _, err := readPcap(bytes.NewReader(corrupt), 53); err == nil {
+		t.Error("a packet of 16MB read")
+	}
+}
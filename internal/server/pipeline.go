@@ -0,0 +1,529 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/internal/slog"
+)
+
+// Middleware wraps a Handler, answering some queries itself and passing the
+// others on to next.
+type Middleware func(next Handler) Handler
+
+// Chain wraps h in middleware, the first one outermost, so it sees every
+// query first.
+func Chain(h Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// pipelineStages are the built-in stages a query goes through before it is
+// forwarded, by the names -pipeline orders them with.
+var pipelineStages = map[string]func(s *server, next Handler) Handler{
+	"acl":       (*server).aclStage,
+	"ratelimit": (*server).rateLimitStage,
+	"tunnel":    (*server).tunnelStage,
+	"policy":    (*server).policyStage,
+	"hooks":     (*server).hooksStage,
+	"plugins":   (*server).pluginsStage,
+	"rewrite":   (*server).rewriteStage,
+	"handlers":  (*server).handlersStage,
+	"local":     (*server).localStage,
+	"filter":    (*server).filterStage,
+}
+
+// defaultPipeline is the default of -pipeline.
+const defaultPipeline = "acl,ratelimit,tunnel,policy,hooks,plugins,rewrite,handlers,local,filter"
+
+// parsePipeline checks a comma separated list of stages.
+func parsePipeline(s string) ([]string, error) {
+	var stages []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, ok := pipelineStages[name]; !ok {
+			return nil, fmt.Errorf("unknown stage %q (want acl, ratelimit, tunnel, policy, hooks, plugins, rewrite, handlers, local or filter)", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("stage %q listed twice", name)
+		}
+		seen[name] = true
+		stages = append(stages, name)
+	}
+	return stages, nil
+}
+
+// pipeline returns the handler queries go through under p: the stages in the
+// order of -pipeline, then forwarding. It is built once per policy.
+func (s *server) pipeline(p *policy) Handler {
+	p.pipelineOnce.Do(func() {
+		middleware := make([]Middleware, 0, len(p.stages))
+		for _, name := range p.stages {
+			stage := pipelineStages[name]
+			middleware = append(middleware, func(next Handler) Handler { return stage(s, next) })
+		}
+		p.pipeline = Chain(HandlerFunc(s.forward), middleware...)
+	})
+	return p.pipeline
+}
+
+// queryOf returns the query answered through w, unwrapping the writers of
+// middleware that implement Unwrap() ResponseWriter.
+func queryOf(w ResponseWriter) *query {
+	for {
+		switch v := w.(type) {
+		case *query:
+			return v
+		case interface{ Unwrap() ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			panic(fmt.Sprintf("ResponseWriter %T doesn't unwrap to the query", w))
+		}
+	}
+}
+
+// aclStage refuses or drops the queries of clients the ACL of the listener
+// the query arrived on or the ACL of a zone asked about doesn't permit.
+func (s *server) aclStage(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Msg) {
+		q := queryOf(w)
+		p := q.policy
+		if !permitted(p.acl(q.listener), p.zoneACLs, q.ip, r.Question) {
+			if p.onReject == ACLDrop {
+				q.drop("acl")
+				return
+			}
+			q.respond(errorResponse(r.Header, r.Question, RcodeRefused))
+			return
+		}
+		next.ServeDNS(w, r)
+	})
+}
+
+// rateLimitStage holds clients to -rate-limit.
+func (s *server) rateLimitStage(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Msg) {
+		q := queryOf(w)
+		p := q.policy
+		if p.limiter.AllowIP(q.ip) {
+			next.ServeDNS(w, r)
+			return
+		}
+		switch p.onLimit {
+		case RateDrop:
+			q.drop("rate limit")
+		case RateRefuse:
+			q.respond(errorResponse(r.Header, r.Question, RcodeRefused))
+		case RateTarpit:
+			// the answer outlives the pooled buffer of the names
+			q.questions = cloneQuestions(r.Question)
+			refused := errorResponse(r.Header, q.questions, RcodeRefused)
+			q.pending = true
+			s.inflight.Add(1)
+			// a TCP connection is closed once its last answer is written
+			conn := laterReplies(q.ctx)
+			if conn != nil {
+				conn.Add(1)
+			}
+			time.AfterFunc(p.tarpitDelay, func() {
+				defer s.inflight.Done()
+				if conn != nil {
+					defer conn.Done()
+				}
+				q.stage("tarpit")
+				q.respond(refused)
+			})
+		}
+	})
+}
+
+// tunnelStage feeds the tunnel detector and applies -tunnel-action to the
+// queries of the clients it flagged.
+func (s *server) tunnelStage(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Msg) {
+		q := queryOf(w)
+		p := q.policy
+		if p.tunnel == nil {
+			next.ServeDNS(w, r)
+			return
+		}
+		client := q.ip.String()
+		flagged := false
+		for _, question := range r.Question {
+			isFlagged, reason, fresh := p.tunnel.Check(client, question, time.Now())
+			if fresh {
+				slog.Warn("possible DNS tunneling", "client", client, "group", q.group.Name, "qname", domainName(question.Name), "reason", reason, "action", p.opts.tunnelAction, "for", p.tunnel.Hold)
+			}
+			flagged = flagged || isFlagged
+		}
+		if !flagged {
+			next.ServeDNS(w, r)
+			return
+		}
+		switch p.onTunnel {
+		case TunnelRefuse:
+			q.respond(errorResponse(r.Header, r.Question, RcodeRefused))
+		case TunnelDrop:
+			q.drop("tunneling")
+		case TunnelLimit:
+			if !p.tunnelLimit.Allow(client) {
+				q.drop("tunneling")
+				return
+			}
+			next.ServeDNS(w, r)
+		default:
+			next.ServeDNS(w, r)
+		}
+	})
+}
+
+// policyStage answers what the server doesn't serve: other opcodes than
+// QUERY, EDNS versions above 0, classes other than IN and CH, and the query
+// types -qtype-rule refuses or drops. Questions the rules answer with no data
+// are marked for forwarding to skip, a query of nothing else is answered here.
+func (s *server) policyStage(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Msg) {
+		q := queryOf(w)
+		// notifies, updates and the like are for authoritative servers
+		if r.Header.Opcode() != OpcodeQuery {
+			q.respond(errorResponse(r.Header, r.Question, RcodeNotImp))
+			return
+		}
+
+		// the server speaks EDNS version 0 only, RFC 6891 6.1.3
+		if opt, ok := findOPT(r.Additional); ok && ednsVersion(opt) > 0 {
+			q.extRcode = RcodeBadVers
+			q.respond(errorResponse(r.Header, r.Question, RcodeSuccess))
+			return
+		}
+
+		// only IN questions are forwarded and CH ones answered by the
+		// server, the question goes back with its class as asked
+		if rcode, ok := classRcode(r.Question); ok {
+			q.respond(errorResponse(r.Header, r.Question, rcode))
+			return
+		}
+
+		// apply the query type policy before anything is resolved
+		for i, question := range r.Question {
+			rule := q.policy.qtypePolicy.Match(q.ip, question)
+			if rule == nil {
+				continue
+			}
+			switch rule.Action {
+			case QTypeNoData:
+				if q.stripped == nil {
+					q.stripped = make(map[int]bool)
+				}
+				q.stripped[i] = true
+				continue
+			case QTypeRefuse:
+				q.respond(errorResponse(r.Header, r.Question, RcodeRefused))
+			default:
+				q.drop("qtype policy")
+			}
+			return
+		}
+		// with every question stripped nothing is left to resolve, and the
+		// local records, pools and handlers mustn't answer them either
+		if len(r.Question) > 0 && len(q.stripped) == len(r.Question) {
+			var response Msg
+			response.SetReply(r)
+			q.respond(response)
+			return
+		}
+		next.ServeDNS(w, r)
+	})
+}
+
+// hooksStage applies the first -hook matching a question, in the order of
+// the questions, to the whole query.
+func (s *server) hooksStage(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Msg) {
+		q := queryOf(w)
+		hooks := q.policy.hooks
+		if len(hooks) == 0 {
+			next.ServeDNS(w, r)
+			return
+		}
+		env := hookEnv{ip: q.ip, group: q.group.Name, proto: "udp", now: time.Now()}
+		if _, ok := q.client.(*net.TCPAddr); ok {
+			env.proto = "tcp"
+		}
+		for _, question := range r.Question {
+			env.question, env.qname = question, ""
+			hook := hooks.Match(&env)
+			if hook == nil {
+				continue
+			}
+			if !q.group.Quiet {
+				slog.Debug("hook matched", "client", q.client.String(), "qname", domainName(question.Name), "hook", hook.Source)
+			}
+			switch hook.Action {
+			case HookPass:
+				next.ServeDNS(w, r)
+			case HookDrop:
+				q.drop("hook")
+			case HookRefuse:
+				q.respond(errorResponse(r.Header, r.Question, RcodeRefused))
+			case HookNXDomain:
+				q.respond(errorResponse(r.Header, r.Question, RcodeNXDomain))
+			case HookServFail:
+				q.respond(errorResponse(r.Header, r.Question, RcodeServFail))
+			case HookNoData:
+				q.respond(errorResponse(r.Header, r.Question, RcodeSuccess))
+			}
+			return
+		}
+		next.ServeDNS(w, r)
+	})
+}
+
+// rewriteStage moves the questions in a -rewrite zone to its target zone, so
+// the handlers, the local records and the upstreams all resolve the target
+// names. The names of the response are moved back before it is sent, see
+// restoreRewrites.
+func (s *server) rewriteStage(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Msg) {
+		q := queryOf(w)
+		var questions []DNSQuestion
+		for i, question := range r.Question {
+			rewritten, rule := q.policy.rewriter.Rewrite(NameFromWire(question.Name))
+			if rule == nil {
+				continue
+			}
+			if len(rewritten) > maxNameLength {
+				// the name is too long once moved to the target zone, as a
+				// DNAME would make it (RFC 6672 2.2)
+				q.respond(errorResponse(r.Header, r.Question, RcodeYXDomain))
+				return
+			}
+			if questions == nil {
+				questions = append([]DNSQuestion(nil), r.Question...)
+			}
+			questions[i].Name = rewritten.Wire()
+			q.rewrites = append(q.rewrites, rule)
+		}
+		if questions == nil {
+			next.ServeDNS(w, r)
+			return
+		}
+		rewritten := *r
+		rewritten.Question = questions
+		// handlers answer the rewritten question
+		q.request, q.asked = &rewritten, r.Question
+		next.ServeDNS(w, &rewritten)
+	})
+}
+
+// handlersStage hands the queries of zones with a handler of their own, see
+// ServeMux, to it.
+func (s *server) handlersStage(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Msg) {
+		h, ok := s.mux.handler(r)
+		if !ok {
+			next.ServeDNS(w, r)
+			return
+		}
+		q := queryOf(w)
+		q.stage("policy")
+		h.ServeDNS(w, r)
+		if !q.answered() {
+			slog.Error("handler wrote no response", "client", q.client.String(), "qname", domainName(r.Question[0].Name))
+			q.respond(errorResponse(r.Header, r.Question, RcodeServFail))
+		}
+	})
+}
+
+// localStage answers from the local records, the pools and the CHAOS class,
+// never asking the upstreams. Groups with local=off skip the records and the
+// pools.
+func (s *server) localStage(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Msg) {
+		q := queryOf(w)
+		p := q.policy
+		local := !q.group.NoLocal
+		// answers packed when the policy was built only need the query's
+		// header and question stitched on
+		if local && len(r.Question) == 1 && len(p.static) > 0 {
+			out := getBuffer()
+			defer putBuffer(out)
+			end, _ := skipDNSName(q.msg, 12) // parsed before
+			if data, ok := p.static.appendResponse((*out)[:0], r.Header, r.Question[0], q.msg[12:end+4]); ok {
+				q.respondPacked(data)
+				return
+			}
+		}
+
+		if local && len(r.Question) == 1 && r.Question[0].Class == ClassIN {
+			if pool, ok := p.pools[NameFromWire(r.Question[0].Name)]; ok {
+				q.respond(pool.respond(r, r.Question[0]))
+				return
+			}
+		}
+
+		// CHAOS class questions are about this server, never about the
+		// upstreams
+		if chaosQuery(r.Question) {
+			var response Msg
+			response.SetReply(r).SetAuthoritative(true)
+			for _, question := range r.Question {
+				answer, ok := p.chaos.Answer(question)
+				if question.Class != ClassCH || !ok {
+					q.respond(errorResponse(r.Header, r.Question, RcodeRefused))
+					return
+				}
+				response.AddAnswer(answer)
+			}
+			q.respond(response)
+			return
+		}
+		next.ServeDNS(w, r)
+	})
+}
+
+// filterStage answers NXDOMAIN for the names the blocklists, the rules of the
+// client's group and the rules of the admin API block, and audits them. A
+// -rewrite doesn't get a name past the filters: both the name the client
+// asked for and its target are checked, whichever side of the rewrite stage
+// filter runs on.
+func (s *server) filterStage(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Msg) {
+		q := queryOf(w)
+		group := q.group
+		// the blocking switch of the control API turns filtering off for
+		// everyone
+		filter := group.Filter
+		if !s.blocking.Enabled(time.Now()) {
+			filter = nil
+		}
+		for i, question := range r.Question {
+			asked := question.Name
+			if q.asked != nil {
+				asked = q.asked[i].Name
+			}
+			name := domainName(asked)
+			isBlocked, rule := s.filtered(filter, name)
+			if !isBlocked {
+				if target, rewrite := q.policy.rewriter.Rewrite(NameFromWire(asked)); rewrite != nil {
+					name = domainName(target.Wire())
+					isBlocked, rule = s.filtered(filter, name)
+				}
+			}
+			if !isBlocked {
+				continue
+			}
+			if !group.Quiet {
+				slog.Info("blocked query", "client", q.client.String(), "group", group.Name, "qname", name, "rule", rule.Source, "list", rule.List)
+			}
+			s.audit.Record(AuditEntry{
+				Time:   time.Now(),
+				Client: q.ip.String(),
+				Group:  group.Name,
+				Name:   name,
+				Type:   typeName(question.Type),
+				Rule:   rule.Source,
+				List:   rule.List,
+			})
+			s.stats.blocked.Add(1)
+			q.blocked = true
+			q.respond(errorResponse(r.Header, r.Question, RcodeNXDomain))
+			return
+		}
+		next.ServeDNS(w, r)
+	})
+}
+
+// filtered checks name against the rules of the admin API and filter, which
+// is nil when the client isn't filtered.
+func (s *server) filtered(filter *Filter, name string) (bool, *FilterRule) {
+	if filter == nil {
+		return false, nil
+	}
+	// the rules of the admin API come first, for every group that filters
+	if isBlocked, rule := s.rules.Check(name, time.Now()); rule != nil {
+		return isBlocked, rule
+	}
+	return filter.Check(name, time.Now())
+}
+
+// forward resolves the questions with the upstream of the client's group,
+// one upstream query per question, and answers with what came back. Without
+// an upstream names are unknown.
+func (s *server) forward(w ResponseWriter, r *Msg) {
+	q := queryOf(w)
+	p, group := q.policy, q.group
+	dnsHeader, dnsQuestions := r.Header, r.Question
+	dnsAnswers := make([]DNSResourceRecord, 0)
+	var dnsAuthority []DNSResourceRecord
+
+	q.stage("policy")
+	rcode := RcodeSuccess
+	if group.Resolver == "" && len(q.stripped) < len(dnsQuestions) {
+		// without an upstream only the local records are known, and the
+		// names aren't among them
+		rcode = RcodeNXDomain
+	}
+	if group.Resolver != "" {
+		if !group.Quiet {
+			slog.Debug("forwarding query", "client", q.client.String(), "upstream", group.Resolver)
+		}
+		for i, question := range dnsQuestions {
+			if q.stripped[i] {
+				continue
+			}
+			// safe search answers with a CNAME to the enforcing host and that host's records
+			if group.safeSearch(p.safeSearch, q.ip) {
+				if target, ok := safeSearchTarget(domainName(question.Name)); ok {
+					dnsAnswers = append(dnsAnswers, safeSearchCNAME(question.Name, target))
+					question.Name = labelSequence(target)
+				}
+			}
+			// one question per upstream query, under an ID of its own
+			upstreamQuery := Msg{Header: DNSHeader{ID: newID(), Flags: flagRD}}
+			upstreamQuery.Question = []DNSQuestion{question}
+			q.upstream = group.Resolver
+			response, err := p.client.Exchange(q.ctx, &upstreamQuery, group.Resolver)
+			if err != nil {
+				if errors.Is(err, context.Canceled) {
+					q.drop("client gone")
+					return
+				}
+				slog.Error("upstream query failed", "upstream", group.Resolver, "err", err)
+				q.respond(errorResponse(dnsHeader, dnsQuestions, RcodeServFail))
+				return
+			}
+			// the first failing question decides the rcode, e.g. NXDOMAIN
+			if rcode == RcodeSuccess {
+				rcode = response.Header.Rcode()
+			}
+			// the upstream may change the case of the name, clients
+			// matching the answer to the question byte for byte, e.g. for
+			// 0x20 randomization, want it as they asked
+			for j := range response.Answers {
+				if equalNames(response.Answers[j].Name, dnsQuestions[i].Name) {
+					response.Answers[j].Name = dnsQuestions[i].Name
+				}
+			}
+			dnsAnswers = append(dnsAnswers, response.Answers...)
+			// the SOA of a negative answer tells the client how long to
+			// cache it, RFC 2308 5
+			dnsAuthority = append(dnsAuthority, response.Authority...)
+		}
+		q.stage("upstream")
+	}
+
+	var response Msg
+	response.SetReply(r).SetRcode(rcode).AddAnswer(dnsAnswers...).AddAuthority(dnsAuthority...)
+	q.respond(response)
+}
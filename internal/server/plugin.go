@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/codecrafters-io/dns-server-starter-go/internal/slog"
+)
+
+// PluginSetup instantiates a plugin with the arguments it is given in a
+// -plugin line. It runs every time the configuration is loaded.
+type PluginSetup func(args []string) (Middleware, error)
+
+var (
+	pluginsMu sync.RWMutex
+	plugins   = make(map[string]PluginSetup)
+)
+
+// RegisterPlugin makes a plugin available to -plugin under name, the way
+// CoreDNS plugins are compiled in: a file dropped next to app/main.go
+// registers it from an init function.
+//
+//	func init() {
+//		dns.RegisterPlugin("nodata", func(args []string) (dns.Middleware, error) {
+//			return func(next dns.Handler) dns.Handler {
+//				return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+//					var m dns.Msg
+//					w.WriteMsg(m.SetReply(r))
+//				})
+//			}, nil
+//		})
+//	}
+//
+// It panics if name is taken, as two plugins can't answer to one name.
+func RegisterPlugin(name string, setup PluginSetup) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+	name = strings.ToLower(name)
+	if _, ok := plugins[name]; ok {
+		panic("plugin " + name + " registered twice")
+	}
+	plugins[name] = setup
+}
+
+// Plugins returns the names of the registered plugins, sorted.
+func Plugins() []string {
+	pluginsMu.RLock()
+	defer pluginsMu.RUnlock()
+	names := make([]string, 0, len(plugins))
+	for name := range plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// pluginChains are the plugins of each zone, in the order of their -plugin
+// lines.
+type pluginChains map[Name][]Middleware
+
+// add instantiates the plugin of a -plugin line, written "zone plugin
+// [args...]", e.g. "lab.example rcode REFUSED", and appends it to the chain
+// of the zone.
+func (c pluginChains) add(spec string) error {
+	fields := strings.Fields(spec)
+	if len(fields) < 2 {
+		return fmt.Errorf("%q: want zone plugin [args...]", spec)
+	}
+	zone, err := ParseName(fields[0])
+	if err != nil {
+		return fmt.Errorf("%q: %w", spec, err)
+	}
+	name := strings.ToLower(fields[1])
+	pluginsMu.RLock()
+	setup, ok := plugins[name]
+	pluginsMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown plugin %q (registered: %s)", name, strings.Join(Plugins(), ", "))
+	}
+	middleware, err := setup(fields[2:])
+	if err != nil {
+		return fmt.Errorf("plugin %s of %s: %w", name, fields[0], err)
+	}
+	c[zone] = append(c[zone], middleware)
+	return nil
+}
+
+// pluginsStage runs the queries of zones with plugins through their chain,
+// the rest of the pipeline coming after the last plugin. A query goes
+// through the chain of the most specific zone containing the name of its
+// first question only.
+func (s *server) pluginsStage(next Handler) Handler {
+	// the pipeline, and the stage with it, is built for the policy of the
+	// queries going through it, see server.pipeline
+	var once sync.Once
+	var chains map[Name]Handler
+	return HandlerFunc(func(w ResponseWriter, r *Msg) {
+		once.Do(func() {
+			chains = make(map[Name]Handler)
+			for zone, middleware := range queryOf(w).policy.plugins {
+				chains[zone] = Chain(next, middleware...)
+			}
+		})
+		if len(chains) == 0 || len(r.Question) == 0 {
+			next.ServeDNS(w, r)
+			return
+		}
+		chain, ok := closestZone(NameFromWire(r.Question[0].Name), chains)
+		if !ok {
+			next.ServeDNS(w, r)
+			return
+		}
+		chain.ServeDNS(w, r)
+	})
+}
+
+func init() {
+	RegisterPlugin("rcode", setupRcode)
+	RegisterPlugin("log", setupLog)
+}
+
+// setupRcode is the rcode plugin, answering every query with the rcode it is
+// given by name or number, e.g. "rcode NXDOMAIN" to make a zone vanish.
+func setupRcode(args []string) (Middleware, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("want one rcode, e.g. REFUSED")
+	}
+	rcode, err := parseRcode(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Msg) {
+			var m Msg
+			w.WriteMsg(m.SetReply(r).SetRcode(rcode))
+		})
+	}, nil
+}
+
+// setupLog is the log plugin, logging the queries that reach it at the level
+// it is given, info by default, before passing them on.
+func setupLog(args []string) (Middleware, error) {
+	var level slog.Level
+	switch len(args) {
+	case 0:
+		level = slog.LevelInfo
+	case 1:
+		if err := level.UnmarshalText([]byte(args[0])); err != nil {
+			return nil, fmt.Errorf("invalid level %q", args[0])
+		}
+	default:
+		return nil, fmt.Errorf("want at most a level")
+	}
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Msg) {
+			slog.Log(context.Background(), level, "plugin query", "client", w.RemoteAddr().String(), "questions", questionSummary(r.Question))
+			next.ServeDNS(w, r)
+		})
+	}, nil
+}
+
+// parseRcode parses an rcode mnemonic such as NXDOMAIN, or its number.
+func parseRcode(s string) (Rcode, error) {
+	for rcode, name := range rcodeNames {
+		if strings.EqualFold(s, name) {
+			return rcode, nil
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > 15 {
+		return 0, fmt.Errorf("unknown rcode %q", s)
+	}
+	return Rcode(n), nil
+}
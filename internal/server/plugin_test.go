@@ -0,0 +1,95 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func init() {
+	RegisterPlugin("Tag", setupTag)
+}
+
+// setupTag is a plugin for the tests answering every query with a TXT
+// record holding its argument.
+func setupTag(args []string) (Middleware, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("want one tag")
+	}
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Msg) {
+			var m Msg
+			m.SetReply(r).AddAnswer(TXT(domainName(r.Question[0].Name), args[0], 60))
+			w.WriteMsg(&m)
+		})
+	}, nil
+}
+
+func TestRegisterPlugin(t *testing.T) {
+	names := Plugins()
+	for _, name := range []string{"log", "rcode", "tag"} {
+		if !containsString(names, name) {
+			t.Errorf("plugins %q, want %s among them", names, name)
+		}
+	}
+	for _, name := range []string{"tag", "TAG", "rcode"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("plugin %s registered twice", name)
+				}
+			}()
+			RegisterPlugin(name, setupTag)
+		}()
+	}
+}
+
+func TestPlugins(t *testing.T) {
+	srv := newTestServer(t,
+		"-record", "www.other.example A 10.0.0.1",
+		"-record", "www.lab.example A 10.0.0.2",
+		"-plugin", "lab.example log debug",
+		"-plugin", "lab.example tag outer",
+		"-plugin", "Inner.Lab.Example tag inner",
+		"-plugin", "gone.lab.example rcode NXDOMAIN")
+	for _, tt := range []struct {
+		name  string
+		rcode Rcode
+		want  string // the TXT answer, empty for none
+	}{
+		{"lab.example", RcodeSuccess, `"outer"`},
+		{"www.lab.example", RcodeSuccess, `"outer"`}, // ahead of the local records
+		{"inner.lab.example", RcodeSuccess, `"inner"`},
+		{"deep.INNER.lab.example", RcodeSuccess, `"inner"`}, // the longest zone wins
+		{"gone.lab.example", RcodeNXDomain, ""},
+		{"notlab.example", RcodeNXDomain, ""}, // a suffix, not in the zone
+		{"www.other.example", RcodeSuccess, ""},
+	} {
+		var query Msg
+		query.SetQuestion(tt.name, TypeTXT)
+		r := srv.exchangeTest(t, &query)
+		var got string
+		if len(r.Answers) == 1 && r.Answers[0].Type == TypeTXT {
+			res, err := r.Answers[0].Resource()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = res.String()
+		}
+		if r.Header.Rcode() != tt.rcode || got != tt.want {
+			t.Errorf("%s: %v with %v, want %v with %s", tt.name, r.Header.Rcode(), r.Answers, tt.rcode, tt.want)
+		}
+	}
+
+	for spec, want := range map[string]string{
+		"lab.example nosuch":      "unknown plugin",
+		"lab.example":             "want zone plugin",
+		"lab.example tag":         "want one tag",
+		"lab.example rcode NOPE":  "unknown rcode",
+		"bad..zone rcode REFUSED": "",
+	} {
+		if _, err := NewServer("-plugin", spec); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("-plugin %q: error %v, want it to say %q", spec, err, want)
+		}
+	}
+}
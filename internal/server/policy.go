@@ -0,0 +1,423 @@
+package server
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/internal/slog"
+)
+
+// policy is the part of the configuration that decides how queries are
+// answered. It is built in one go from the options and never modified
+// afterwards, so a reload can swap it atomically under running queries.
+type policy struct {
+	opts *options
+
+	listenerACL  *ACL
+	listenACLs   map[string]*ACL // of -listen endpoints by address, in place of listenerACL
+	onReject     ACLAction
+	zoneACLs     ZoneACLs
+	limiter      *RateLimiter
+	onLimit      RateAction
+	tunnel       *TunnelDetector // nil without -tunnel-detect
+	onTunnel     TunnelAction
+	tunnelLimit  *RateLimiter // of flagged clients, for TunnelLimit
+	onOverload   OverloadAction
+	budget       memoryBudget
+	maxInflight  int // -max-inflight lowered to fit the budget, 0 for no limit
+	tarpitDelay  time.Duration
+	qtypePolicy  QTypePolicy
+	hooks        Hooks
+	rewriter     Rewriter
+	safeSearch   *SafeSearch
+	chaos        *Chaos
+	static       staticAnswers
+	pools        Pools
+	defaultGroup *ClientGroup
+	groups       ClientGroups
+	lists        *Blocklists
+	upstreams    []string
+	client       *Client  // of the upstream queries
+	stages       []string // of -pipeline
+	plugins      pluginChains
+
+	pipelineOnce sync.Once
+	pipeline     Handler // see server.pipeline
+}
+
+// newPolicy builds the policy of opts. Blocklists, pools, the rate limiter and
+// the tunnel detector of previous are carried over when their settings are
+// unchanged, so a reload neither downloads the lists again nor forgets the
+// clients' buckets, the health of the backends or the flagged clients.
+func newPolicy(opts *options, previous *policy) (*policy, error) {
+	p := &policy{
+		opts:        opts,
+		listenerACL: opts.listenerACL,
+		listenACLs:  opts.listenACLs,
+		zoneACLs:    opts.zoneACLs,
+		tarpitDelay: opts.tarpitDelay,
+		qtypePolicy: opts.qtypePolicy,
+		hooks:       opts.hooks,
+		rewriter:    opts.rewriter,
+		safeSearch:  opts.safeSearch,
+		chaos:       opts.chaos,
+	}
+	p.static = staticAnswers{}
+	p.static.addChaos(p.chaos)
+	p.static.addRecords(opts.records)
+	p.pools = Pools{}
+	for _, spec := range opts.poolSpecs {
+		pool, err := parsePool(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -pool: %w", err)
+		}
+		if _, ok := p.pools[pool.Name]; ok {
+			return nil, fmt.Errorf("invalid -pool: %s pooled twice", pool.Name)
+		}
+		if _, ok := p.static[staticKey{pool.Name, 0, ClassIN}]; ok {
+			return nil, fmt.Errorf("invalid -pool: %s has local records", pool.Name)
+		}
+		// an unchanged pool keeps its checks running and what they found
+		if previous != nil && previous.pools[pool.Name] != nil && previous.pools[pool.Name].spec == spec {
+			pool = previous.pools[pool.Name]
+		}
+		p.pools[pool.Name] = pool
+	}
+	var err error
+	if p.onReject, err = parseACLAction(opts.aclAction); err != nil {
+		return nil, fmt.Errorf("invalid -acl-action: %w", err)
+	}
+	if p.onLimit, err = parseRateAction(opts.rateAction); err != nil {
+		return nil, fmt.Errorf("invalid -rate-action: %w", err)
+	}
+	if p.onOverload, err = parseOverloadAction(opts.overloadAction); err != nil {
+		return nil, fmt.Errorf("invalid -overload-action: %w", err)
+	}
+	if opts.maxInflight < 0 {
+		return nil, fmt.Errorf("invalid -max-inflight %d, want 0 or more", opts.maxInflight)
+	}
+	if opts.maxUDPSize < minUDPSize || opts.maxUDPSize > maxTCPSize {
+		return nil, fmt.Errorf("invalid -max-udp-size %d, want %d to %d", opts.maxUDPSize, minUDPSize, maxTCPSize)
+	}
+	if opts.memoryBudget < 0 {
+		return nil, fmt.Errorf("invalid -memory-budget %d, want 0 or more", opts.memoryBudget)
+	}
+	if p.stages, err = parsePipeline(opts.pipeline); err != nil {
+		return nil, fmt.Errorf("invalid -pipeline: %w", err)
+	}
+	p.plugins = pluginChains{}
+	for _, spec := range opts.pluginSpecs {
+		if err := p.plugins.add(spec); err != nil {
+			return nil, fmt.Errorf("invalid -plugin: %w", err)
+		}
+	}
+	if opts.queryTimeout <= 0 {
+		return nil, fmt.Errorf("invalid -query-timeout %s, want more than 0", opts.queryTimeout)
+	}
+	if opts.upstreamTimeout <= 0 {
+		return nil, fmt.Errorf("invalid -upstream-timeout %s, want more than 0", opts.upstreamTimeout)
+	}
+	// with an OPT record answers up to -max-udp-size come back without
+	// truncation
+	p.client = &Client{Timeout: opts.upstreamTimeout, UDPSize: opts.maxUDPSize}
+	p.budget = newMemoryBudget(opts.memoryBudget)
+	p.maxInflight = capped(opts.maxInflight, p.budget.inflight, queryMemory)
+
+	if len(opts.blocklistURLs) > 0 {
+		if previous != nil && previous.lists != nil && previous.lists.Interval == opts.blocklistRefresh &&
+			previous.lists.MaxBytes == p.budget.blocklists && equalStrings(previous.opts.blocklistURLs, opts.blocklistURLs) {
+			p.lists = previous.lists
+		} else {
+			p.lists = NewBlocklists(opts.blocklistURLs, opts.blocklistRefresh)
+			p.lists.MaxBytes = p.budget.blocklists
+		}
+	}
+	opts.filter.Lists = p.lists
+	if err := checkRegexBudget(opts.filter.Rules); err != nil {
+		return nil, fmt.Errorf("invalid -block-domain or -allow-domain: %w", err)
+	}
+
+	p.defaultGroup = &ClientGroup{Name: "default", Filter: opts.filter, Resolver: opts.resolver}
+	for _, spec := range opts.groupSpecs {
+		group, err := parseClientGroup(spec, opts.filter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -group: %w", err)
+		}
+		if group.Filter != nil {
+			if err := checkRegexBudget(group.Filter.Rules); err != nil {
+				return nil, fmt.Errorf("invalid -group %s: %w", group.Name, err)
+			}
+		}
+		if group.Resolver == "" {
+			group.Resolver = opts.resolver
+		}
+		p.groups = append(p.groups, group)
+	}
+	for _, endpoint := range opts.listen {
+		if endpoint.Group != "" && p.group(endpoint.Group) == nil {
+			return nil, fmt.Errorf("invalid -listen: %s is bound to unknown group %q", endpoint, endpoint.Group)
+		}
+	}
+	for address := range p.listenACLs {
+		if !listening(opts.listen, address) {
+			return nil, fmt.Errorf("invalid -listen-allow or -listen-deny: %s is not a -listen endpoint", address)
+		}
+	}
+	for _, group := range p.groups {
+		if len(group.Clients) == 0 && !boundGroup(opts.listen, group.Name) {
+			return nil, fmt.Errorf("invalid -group: group %s has no clients and no listener bound to it", group.Name)
+		}
+	}
+	for _, group := range append(ClientGroups{p.defaultGroup}, p.groups...) {
+		if group.Resolver != "" && !containsString(p.upstreams, group.Resolver) {
+			p.upstreams = append(p.upstreams, group.Resolver)
+		}
+	}
+
+	if opts.tunnelDetect {
+		if p.onTunnel, err = parseTunnelAction(opts.tunnelAction); err != nil {
+			return nil, fmt.Errorf("invalid -tunnel-action: %w", err)
+		}
+		if opts.tunnelMaxLabel < 1 || opts.tunnelEntropy <= 0 || opts.tunnelSubdomains < 1 || opts.tunnelTXTRate < 1 || opts.tunnelHold <= 0 {
+			return nil, fmt.Errorf("invalid -tunnel-* thresholds, want them above 0")
+		}
+		if opts.tunnelLimit <= 0 {
+			return nil, fmt.Errorf("invalid -tunnel-limit %g, want more than 0", opts.tunnelLimit)
+		}
+		p.tunnel = NewTunnelDetector(opts.tunnelMaxLabel, opts.tunnelEntropy, opts.tunnelSubdomains, opts.tunnelTXTRate, opts.tunnelHold)
+		if previous != nil && previous.tunnel != nil && previous.tunnel.same(p.tunnel) {
+			p.tunnel = previous.tunnel
+		}
+		p.tunnelLimit = NewRateLimiter(opts.tunnelLimit, 5)
+		if previous != nil && previous.tunnelLimit != nil && previous.tunnelLimit.QPS == opts.tunnelLimit {
+			p.tunnelLimit = previous.tunnelLimit
+		}
+	}
+
+	if opts.ratePrefix4 < 1 || opts.ratePrefix4 > 32 {
+		return nil, fmt.Errorf("invalid -rate-prefix-v4 %d, want 1 to 32", opts.ratePrefix4)
+	}
+	if opts.ratePrefix6 < 1 || opts.ratePrefix6 > 128 {
+		return nil, fmt.Errorf("invalid -rate-prefix-v6 %d, want 1 to 128", opts.ratePrefix6)
+	}
+	if opts.rateQPS > 0 {
+		maxClients := capped(defaultRateClients, p.budget.limiter, bucketMemory)
+		if previous != nil && previous.limiter != nil && previous.limiter.QPS == opts.rateQPS &&
+			previous.opts.rateBurst == opts.rateBurst && previous.opts.ratePrefix4 == opts.ratePrefix4 &&
+			previous.opts.ratePrefix6 == opts.ratePrefix6 && previous.limiter.MaxClients == maxClients {
+			p.limiter = previous.limiter
+		} else {
+			p.limiter = NewRateLimiter(opts.rateQPS, opts.rateBurst)
+			p.limiter.IPv4Prefix, p.limiter.IPv6Prefix = opts.ratePrefix4, opts.ratePrefix6
+			p.limiter.MaxClients = maxClients
+		}
+	}
+	return p, nil
+}
+
+// group returns the group called name, the default group for "default"
+// unless a -group takes the name, or nil.
+func (p *policy) group(name string) *ClientGroup {
+	if name == "" {
+		return nil
+	}
+	for _, group := range p.groups {
+		if group.Name == name {
+			return group
+		}
+	}
+	if name == p.defaultGroup.Name {
+		return p.defaultGroup
+	}
+	return nil
+}
+
+// acl returns the ACL of the clients of listener: its own -listen-allow and
+// -listen-deny networks if it has any, otherwise -allow and -deny.
+func (p *policy) acl(listener listenEndpoint) *ACL {
+	if acl, ok := p.listenACLs[listener.address()]; ok {
+		return acl
+	}
+	return p.listenerACL
+}
+
+// listening reports whether address is one of the endpoints.
+func listening(endpoints []listenEndpoint, address string) bool {
+	for _, endpoint := range endpoints {
+		if endpoint.address() == address {
+			return true
+		}
+	}
+	return false
+}
+
+// boundGroup reports whether an endpoint is bound to the group called name.
+func boundGroup(endpoints []listenEndpoint, name string) bool {
+	for _, endpoint := range endpoints {
+		if endpoint.Group == name {
+			return true
+		}
+	}
+	return false
+}
+
+// start launches the background work of the parts of p that previous does not
+// share with it. New blocklists are loaded before start returns, so a reload
+// doesn't let blocked names through while they download.
+func (p *policy) start(previous *policy) {
+	if p.lists != nil && (previous == nil || p.lists != previous.lists) {
+		if previous == nil {
+			go func() {
+				p.lists.Refresh()
+				p.lists.Run()
+			}()
+		} else {
+			p.lists.Refresh()
+			go p.lists.Run()
+		}
+	}
+	if p.maxInflight != p.opts.maxInflight && (previous == nil || p.maxInflight != previous.maxInflight) {
+		slog.Warn("max-inflight lowered to fit the memory budget", "max_inflight", p.maxInflight)
+	}
+	if p.limiter != nil && (previous == nil || p.limiter != previous.limiter) {
+		go p.limiter.reportLimited(time.Minute)
+	}
+	for name, pool := range p.pools {
+		if previous == nil || previous.pools[name] != pool {
+			go pool.Run()
+		}
+	}
+}
+
+// stop ends the background work of the parts of p that next doesn't reuse,
+// all of it when next is nil.
+func (p *policy) stop(next *policy) {
+	if next == nil {
+		next = &policy{}
+	}
+	if p.lists != nil && p.lists != next.lists {
+		p.lists.Stop()
+	}
+	if p.limiter != nil && p.limiter != next.limiter {
+		p.limiter.Stop()
+	}
+	for name, pool := range p.pools {
+		if next.pools[name] != pool {
+			pool.Stop()
+		}
+	}
+}
+
+// reloader re-reads the command line and the config file and swaps in the
+// resulting policy. A configuration that fails to load is rejected as a
+// whole and the running policy stays in place.
+type reloader struct {
+	args     []string
+	embedded bool // for a Server: no environment and no memory limit
+	current  atomic.Pointer[policy]
+	health   *HealthChecker
+	logLevel *slog.LevelVar // nil for a Server, whose log level is the program's
+
+	mu sync.Mutex // serialises reloads
+}
+
+// Reload loads the configuration again. Listener, admin and log file settings
+// only take effect on restart; a change to them is logged and ignored.
+func (r *reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	getenv := os.Getenv
+	if r.embedded {
+		getenv = nil
+	}
+	opts, err := parseOptions(r.args, flag.ContinueOnError, getenv)
+	if err != nil {
+		return err
+	}
+	var level slog.LevelVar
+	if err := level.UnmarshalText([]byte(opts.logLevel)); err != nil {
+		return fmt.Errorf("invalid log level %q (want debug, info, warn or error)", opts.logLevel)
+	}
+	previous := r.current.Load()
+	restart := restartOnly(previous.opts, opts)
+	// the sockets stay bound to the endpoints the server started with, and
+	// the listener ACLs and groups of the new policy have to name those
+	opts.listen = previous.opts.listen
+	p, err := newPolicy(opts, previous)
+	if err != nil {
+		return err
+	}
+
+	if !r.embedded {
+		applyMemoryLimit(p.budget, previous.budget)
+	}
+	p.start(previous)
+	r.current.Store(p)
+	previous.stop(p)
+	r.health.SetTargets(p.upstreams, p.lists)
+	if r.logLevel != nil {
+		r.logLevel.Set(level.Level())
+	}
+	for _, name := range restart {
+		slog.Warn("option change needs a restart to take effect", "option", name)
+	}
+	slog.Info("configuration reloaded", "groups", len(p.groups), "upstreams", len(p.upstreams))
+	return nil
+}
+
+// restartOnly names the options that differ between old and new but are
+// only read at startup.
+func restartOnly(old, new *options) []string {
+	var changed []string
+	check := func(name string, differs bool) {
+		if differs {
+			changed = append(changed, name)
+		}
+	}
+	check("listen", fmt.Sprint(old.listen) != fmt.Sprint(new.listen))
+	check("listen-addr-file", old.listenAddrFile != new.listenAddrFile)
+	check("udp-sockets", old.udpSockets != new.udpSockets)
+	check("udp-batch", old.udpBatch != new.udpBatch)
+	check("admin", old.adminAddr != new.adminAddr)
+	check("admin-token-file", old.adminTokenFile != new.adminTokenFile)
+	check("admin-rules-file", old.adminRulesFile != new.adminRulesFile)
+	check("pprof", old.pprofAddr != new.pprofAddr)
+	check("shutdown-timeout", old.shutdownTimeout != new.shutdownTimeout)
+	check("user", old.runAsUser != new.runAsUser)
+	check("chroot", old.chroot != new.chroot)
+	check("daemon", old.daemon != new.daemon)
+	check("pid-file", old.pidFile != new.pidFile)
+	check("log-format", old.logFormat != new.logFormat)
+	check("log-file", old.logFile != new.logFile)
+	check("audit-log", old.auditPath != new.auditPath)
+	check("audit-size", old.auditSize != new.auditSize)
+	check("recent-queries", old.recentQueries != new.recentQueries)
+	check("history-dir", old.historyDir != new.historyDir)
+	check("history-retention", old.historyRetention != new.historyRetention)
+	check("query-log", old.queryLogPath != new.queryLogPath)
+	check("query-log-max-size", old.queryLogSize != new.queryLogSize)
+	check("query-log-max-age", old.queryLogAge != new.queryLogAge)
+	check("query-log-backups", old.queryLogBackups != new.queryLogBackups)
+	check("query-log-compress", old.queryLogCompress != new.queryLogCompress)
+	check("query-log-sample", old.queryLogSample != new.queryLogSample)
+	check("quarantine-dir", old.quarantineDir != new.quarantineDir)
+	check("quarantine-max", old.quarantineMax != new.quarantineMax)
+	return changed
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,395 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/internal/slog"
+)
+
+// PoolPolicy decides which healthy backends of a pool a query is answered
+// with, and in which order.
+type PoolPolicy int
+
+const (
+	PoolRoundRobin PoolPolicy = iota // every backend in turn
+	PoolLeastConn                    // the fewest connections first, as the HTTP checks report them
+	PoolPriority                     // the first healthy backend in the listed order, the others fail over
+)
+
+func parsePoolPolicy(s string) (PoolPolicy, error) {
+	switch strings.ToLower(s) {
+	case "round-robin":
+		return PoolRoundRobin, nil
+	case "least-conn":
+		return PoolLeastConn, nil
+	case "priority":
+		return PoolPriority, nil
+	}
+	return 0, fmt.Errorf("unknown policy %q (want round-robin, least-conn or priority)", s)
+}
+
+func (p PoolPolicy) String() string {
+	switch p {
+	case PoolLeastConn:
+		return "least-conn"
+	case PoolPriority:
+		return "priority"
+	}
+	return "round-robin"
+}
+
+// connectionsHeader is the response header an HTTP health check reads the
+// number of connections a backend serves from, for the least-conn policy.
+const connectionsHeader = "X-Connections"
+
+// Pool answers a name with the addresses of its healthy backends, making the
+// server a small global load balancer: clients resolving the name spread over
+// the backends and stop being sent to those failing their health checks.
+// When every backend fails, all of them are answered rather than none.
+type Pool struct {
+	Name     Name
+	Backends []*Backend
+	Policy   PoolPolicy
+	Answers  int    // addresses per answer, 0 for all of them
+	TTL      uint32 // short, so clients come back when a backend fails
+	Check    string // "tcp:port" or "http:port/path", empty for no checks
+	Interval time.Duration
+	Timeout  time.Duration
+	Fall     int // failed checks in a row marking a backend down
+	Rise     int // passed checks in a row marking it up again
+
+	spec string // as given to -pool, see newPolicy
+	next atomic.Uint32
+	stop chan struct{}
+}
+
+// Backend is an address of a pool and what its health checks found out.
+// Backends start healthy, so a restart doesn't wait for the first checks.
+type Backend struct {
+	IP net.IP
+
+	mu          sync.Mutex
+	healthy     bool
+	streak      int // checks in a row contradicting healthy
+	connections int // reported by the last HTTP check, -1 when unknown
+	err         error
+	checked     time.Time
+}
+
+// Pools are the pools of the configuration by name.
+type Pools map[Name]*Pool
+
+// parsePool parses a pool written as space separated key=value pairs, e.g.
+// "name=app.lan backends=10.0.0.1,10.0.0.2 policy=round-robin
+// check=http:8080/healthz interval=10s". Only name and backends are
+// required.
+func parsePool(s string) (*Pool, error) {
+	pool := &Pool{Policy: PoolRoundRobin, Answers: 1, TTL: 30, Interval: 10 * time.Second, Timeout: 2 * time.Second, Fall: 3, Rise: 2, spec: s, stop: make(chan struct{})}
+	fields, err := splitFields(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range fields {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected key=value, got %q", field)
+		}
+		var err error
+		switch strings.ToLower(key) {
+		case "name":
+			pool.Name, err = ParseName(value)
+		case "backends":
+			for _, address := range strings.Split(value, ",") {
+				ip := net.ParseIP(strings.TrimSpace(address))
+				if ip == nil {
+					err = fmt.Errorf("invalid backend address %q", address)
+					break
+				}
+				if ip4 := ip.To4(); ip4 != nil {
+					ip = ip4
+				}
+				pool.Backends = append(pool.Backends, &Backend{IP: ip, healthy: true, connections: -1})
+			}
+		case "policy":
+			pool.Policy, err = parsePoolPolicy(value)
+		case "answers":
+			pool.Answers, err = strconv.Atoi(value)
+			if err == nil && pool.Answers < 0 {
+				err = fmt.Errorf("invalid answers %d, want 0 or more", pool.Answers)
+			}
+		case "ttl":
+			var ttl uint64
+			ttl, err = strconv.ParseUint(value, 10, 32)
+			pool.TTL = uint32(ttl)
+		case "check":
+			err = checkPoolCheck(value)
+			pool.Check = value
+		case "interval", "timeout":
+			var d time.Duration
+			if d, err = time.ParseDuration(value); err == nil && d <= 0 {
+				err = fmt.Errorf("invalid %s %s, want more than 0", key, value)
+			}
+			if strings.ToLower(key) == "interval" {
+				pool.Interval = d
+			} else {
+				pool.Timeout = d
+			}
+		case "fall", "rise":
+			var n int
+			if n, err = strconv.Atoi(value); err == nil && n < 1 {
+				err = fmt.Errorf("invalid %s %d, want 1 or more", key, n)
+			}
+			if strings.ToLower(key) == "fall" {
+				pool.Fall = n
+			} else {
+				pool.Rise = n
+			}
+		default:
+			return nil, fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("pool %q: %w", s, err)
+		}
+	}
+	if pool.Name == "" || len(pool.Backends) == 0 {
+		return nil, fmt.Errorf("pool %q needs a name and backends", s)
+	}
+	return pool, nil
+}
+
+// checkPoolCheck validates a check=: "none", "tcp:port" or
+// "http:port/path".
+func checkPoolCheck(check string) error {
+	if check == "" || check == "none" {
+		return nil
+	}
+	kind, target, _ := strings.Cut(check, ":")
+	port, _, hasPath := strings.Cut(target, "/")
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err == nil && n > 0 && (kind == "tcp" && !hasPath || kind == "http") {
+		return nil
+	}
+	return fmt.Errorf("invalid check %q, want tcp:port, http:port/path or none", check)
+}
+
+// poolFlag collects repeated -pool specs, checked when they are set.
+type poolFlag []string
+
+func (f *poolFlag) String() string { return strings.Join(*f, " ") }
+
+func (f *poolFlag) Set(value string) error {
+	if _, err := parsePool(value); err != nil {
+		return err
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+// answer returns the addresses of the pool for qtype, A or AAAA, in the
+// order of its policy.
+func (p *Pool) answer(qtype uint16) []net.IP {
+	var all, healthy []*Backend
+	for _, b := range p.Backends {
+		if (b.IP.To4() != nil) != (qtype == TypeA) {
+			continue
+		}
+		all = append(all, b)
+		if up, _ := b.state(); up {
+			healthy = append(healthy, b)
+		}
+	}
+	if len(healthy) == 0 {
+		// better a backend that may be down than no answer at all
+		healthy = all
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+	if p.Policy != PoolPriority {
+		// rotating first spreads the backends that tie on connections
+		start := int(p.next.Add(1)-1) % len(healthy)
+		healthy = append(healthy[start:len(healthy):len(healthy)], healthy[:start]...)
+	}
+	if p.Policy == PoolLeastConn {
+		sort.SliceStable(healthy, func(i, j int) bool {
+			_, a := healthy[i].state()
+			_, b := healthy[j].state()
+			return a >= 0 && (b < 0 || a < b) // unknown counts last
+		})
+	}
+	if p.Answers > 0 && len(healthy) > p.Answers {
+		healthy = healthy[:p.Answers]
+	}
+	ips := make([]net.IP, len(healthy))
+	for i, b := range healthy {
+		ips[i] = b.IP
+	}
+	return ips
+}
+
+// respond answers question, of the name of the pool, authoritatively: A and
+// AAAA questions with the addresses, the other types with no data.
+func (p *Pool) respond(r *Msg, question DNSQuestion) Msg {
+	var m Msg
+	m.SetReply(r).SetAuthoritative(true)
+	if question.Type != TypeA && question.Type != TypeAAAA {
+		return m
+	}
+	for _, ip := range p.answer(question.Type) {
+		m.AddAnswer(DNSResourceRecord{Name: question.Name, Type: question.Type, Class: ClassIN, TTL: p.TTL, RDLength: uint16(len(ip)), RData: ip})
+	}
+	return m
+}
+
+// Run checks the backends every interval until Stop, the first time right
+// away. Without a check it returns at once.
+func (p *Pool) Run() {
+	if p.Check == "" || p.Check == "none" {
+		return
+	}
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, b := range p.Backends {
+			wg.Add(1)
+			go func(b *Backend) {
+				defer wg.Done()
+				connections, err := p.probe(b.IP)
+				p.record(b, connections, err)
+			}(b)
+		}
+		wg.Wait()
+		select {
+		case <-ticker.C:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// Stop ends Run.
+func (p *Pool) Stop() {
+	close(p.stop)
+}
+
+// probe runs the check against ip, returning the connections an HTTP check
+// reported, -1 if none.
+func (p *Pool) probe(ip net.IP) (int, error) {
+	kind, target, _ := strings.Cut(p.Check, ":")
+	port, path, _ := strings.Cut(target, "/")
+	address := net.JoinHostPort(ip.String(), port)
+	if kind == "tcp" {
+		conn, err := net.DialTimeout("tcp", address, p.Timeout)
+		if err != nil {
+			return -1, err
+		}
+		conn.Close()
+		return -1, nil
+	}
+	client := http.Client{
+		Timeout: p.Timeout,
+		// a redirect elsewhere says nothing about this backend
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	resp, err := client.Get("http://" + address + "/" + path)
+	if err != nil {
+		return -1, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return -1, fmt.Errorf("status %s", resp.Status)
+	}
+	connections, err := strconv.Atoi(resp.Header.Get(connectionsHeader))
+	if err != nil || connections < 0 {
+		return -1, nil
+	}
+	return connections, nil
+}
+
+// record applies the result of a check to b, changing its health after Fall
+// failures or Rise successes in a row.
+func (p *Pool) record(b *Backend, connections int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.connections, b.err, b.checked = connections, err, time.Now()
+	if (err == nil) == b.healthy {
+		b.streak = 0
+		return
+	}
+	b.streak++
+	if b.healthy && b.streak >= p.Fall || !b.healthy && b.streak >= p.Rise {
+		b.healthy, b.streak = !b.healthy, 0
+		if b.healthy {
+			slog.Info("pool backend up", "pool", p.Name.String(), "backend", b.IP.String())
+		} else {
+			slog.Warn("pool backend down", "pool", p.Name.String(), "backend", b.IP.String(), "err", err)
+		}
+	}
+}
+
+type backendStatus struct {
+	Address     string     `json:"address"`
+	Healthy     bool       `json:"healthy"`
+	Connections *int       `json:"connections,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	Checked     *time.Time `json:"checked,omitempty"`
+}
+
+// state returns the health of b and the connections last reported, -1 if
+// unknown.
+func (b *Backend) state() (healthy bool, connections int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.healthy, b.connections
+}
+
+func (b *Backend) status() backendStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := backendStatus{Address: b.IP.String(), Healthy: b.healthy}
+	if !b.checked.IsZero() {
+		checked := b.checked
+		s.Checked = &checked
+	}
+	if b.connections >= 0 {
+		connections := b.connections
+		s.Connections = &connections
+	}
+	if b.err != nil {
+		s.Error = b.err.Error()
+	}
+	return s
+}
+
+// Status reports the pools and the health of their backends, for the admin
+// API.
+func (p Pools) Status() []map[string]any {
+	names := make([]Name, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i].Compare(names[j]) < 0 })
+	status := make([]map[string]any, 0, len(p))
+	for _, name := range names {
+		pool := p[name]
+		backends := make([]backendStatus, len(pool.Backends))
+		for i, b := range pool.Backends {
+			backends[i] = b.status()
+		}
+		check := pool.Check
+		if check == "" {
+			check = "none"
+		}
+		status = append(status, map[string]any{"name": name.String(), "policy": pool.Policy.String(), "check": check, "backends": backends})
+	}
+	return status
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testPool(t *testing.T, spec string) *Pool {
+	t.Helper()
+	pool, err := parsePool(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+// answerIPs returns the addresses of pool answers joined by commas.
+func answerIPs(pool *Pool, qtype uint16) string {
+	var ips []string
+	for _, ip := range pool.answer(qtype) {
+		ips = append(ips, ip.String())
+	}
+	return strings.Join(ips, ",")
+}
+
+var errCheckFailed = errors.New("check failed")
+
+func TestParsePool(t *testing.T) {
+	pool := testPool(t, "name=app.lan backends=10.0.0.1,2001:db8::1")
+	if pool.Policy != PoolRoundRobin || pool.Answers != 1 || pool.TTL != 30 || pool.Interval != 10*time.Second || pool.Timeout != 2*time.Second || pool.Fall != 3 || pool.Rise != 2 {
+		t.Errorf("defaults %+v", pool)
+	}
+	if len(pool.Backends) != 2 || len(pool.Backends[0].IP) != net.IPv4len {
+		t.Errorf("backends %v, want IPv4 addresses in 4 bytes", pool.Backends)
+	}
+
+	tests := []struct {
+		spec string
+		err  string
+	}{
+		{"backends=10.0.0.1", "needs a name and backends"},
+		{"name=app.lan", "needs a name and backends"},
+		{"name=app.lan backends=10.0.0.300", `invalid backend address "10.0.0.300"`},
+		{"name=app.lan backends=10.0.0.1 policy=random", `unknown policy "random"`},
+		{"name=app.lan backends=10.0.0.1 answers=-1", "invalid answers -1"},
+		{"name=app.lan backends=10.0.0.1 check=udp:53", `invalid check "udp:53"`},
+		{"name=app.lan backends=10.0.0.1 check=tcp:80/path", `invalid check "tcp:80/path"`},
+		{"name=app.lan backends=10.0.0.1 interval=0s", "invalid interval 0s"},
+		{"name=app.lan backends=10.0.0.1 fall=0", "invalid fall 0"},
+		{"name=app.lan backends=10.0.0.1 weight=2", `unknown key "weight"`},
+	}
+	for _, tt := range tests {
+		if _, err := parsePool(tt.spec); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: error %v, want %q", tt.spec, err, tt.err)
+		}
+	}
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	pool := testPool(t, "name=app.lan backends=10.0.0.1,10.0.0.2,10.0.0.3,2001:db8::1")
+	counts := map[string]int{}
+	for i := 0; i < 30; i++ {
+		counts[answerIPs(pool, TypeA)]++
+	}
+	// every IPv4 backend gets its share, the IPv6 one is for AAAA
+	if len(counts) != 3 || counts["10.0.0.1"] != 10 || counts["10.0.0.2"] != 10 || counts["10.0.0.3"] != 10 {
+		t.Errorf("answers %v, want 10 each", counts)
+	}
+	if got := answerIPs(pool, TypeAAAA); got != "2001:db8::1" {
+		t.Errorf("AAAA %s, want the IPv6 backend", got)
+	}
+
+	pool = testPool(t, "name=app.lan backends=10.0.0.1,10.0.0.2,10.0.0.3 answers=0")
+	for _, want := range []string{"10.0.0.1,10.0.0.2,10.0.0.3", "10.0.0.2,10.0.0.3,10.0.0.1", "10.0.0.3,10.0.0.1,10.0.0.2"} {
+		if got := answerIPs(pool, TypeA); got != want {
+			t.Errorf("answers=0 gave %s, want all rotated, %s", got, want)
+		}
+	}
+}
+
+func TestPoolLeastConnWeighsConnections(t *testing.T) {
+	pool := testPool(t, "name=app.lan backends=10.0.0.1,10.0.0.2,10.0.0.3,10.0.0.4 policy=least-conn answers=0")
+	for i, connections := range []int{30, 5, -1, 12} {
+		pool.record(pool.Backends[i], connections, nil)
+	}
+	// the fewest connections first whatever the rotation, unknown last
+	for i := 0; i < 4; i++ {
+		if got := answerIPs(pool, TypeA); got != "10.0.0.2,10.0.0.4,10.0.0.1,10.0.0.3" {
+			t.Fatalf("answer %d: %s, want ordered by connections", i, got)
+		}
+	}
+
+	// backends reporting the same load take turns first
+	pool = testPool(t, "name=app.lan backends=10.0.0.1,10.0.0.2,10.0.0.3 policy=least-conn")
+	for i, connections := range []int{3, 3, 9} {
+		pool.record(pool.Backends[i], connections, nil)
+	}
+	counts := map[string]int{}
+	for i := 0; i < 6; i++ {
+		counts[answerIPs(pool, TypeA)]++
+	}
+	if counts["10.0.0.1"] == 0 || counts["10.0.0.2"] == 0 || counts["10.0.0.3"] != 0 {
+		t.Errorf("answers %v, want the two least loaded in turn", counts)
+	}
+}
+
+func TestPoolFailover(t *testing.T) {
+	pool := testPool(t, "name=app.lan backends=10.0.0.1,10.0.0.2,10.0.0.3 policy=priority fall=2 rise=2")
+	primary, secondary := pool.Backends[0], pool.Backends[1]
+	steps := []struct {
+		backend *Backend
+		err     error
+		want    string
+	}{
+		{primary, errCheckFailed, "10.0.0.1"}, // one failure isn't enough
+		{primary, nil, "10.0.0.1"},            // and a success resets the count
+		{primary, errCheckFailed, "10.0.0.1"},
+		{primary, errCheckFailed, "10.0.0.2"}, // down, the next one takes over
+		{secondary, errCheckFailed, "10.0.0.2"},
+		{secondary, errCheckFailed, "10.0.0.3"},
+		{primary, nil, "10.0.0.3"}, // one success isn't enough to come back
+		{primary, nil, "10.0.0.1"},
+	}
+	for i, step := range steps {
+		pool.record(step.backend, -1, step.err)
+		if got := answerIPs(pool, TypeA); got != step.want {
+			t.Fatalf("step %d: answer %s, want %s", i, got, step.want)
+		}
+	}
+
+	// with every backend down, all of them are answered rather than none
+	pool = testPool(t, "name=app.lan backends=10.0.0.1,10.0.0.2 fall=1 answers=0")
+	for _, b := range pool.Backends {
+		pool.record(b, -1, errCheckFailed)
+	}
+	if got := answerIPs(pool, TypeA); got != "10.0.0.1,10.0.0.2" && got != "10.0.0.2,10.0.0.1" {
+		t.Errorf("all down: answer %s, want both backends", got)
+	}
+}
+
+func TestPoolProbe(t *testing.T) {
+	var status, connections atomic.Int32
+	status.Store(http.StatusOK)
+	connections.Store(7)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set(connectionsHeader, fmt.Sprint(connections.Load()))
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	loopback := net.IPv4(127, 0, 0, 1)
+
+	pool := testPool(t, "name=app.lan backends=127.0.0.1 check=http:"+port+"/healthz timeout=1s")
+	if n, err := pool.probe(loopback); n != 7 || err != nil {
+		t.Errorf("HTTP check: %d connections, %v, want 7", n, err)
+	}
+	connections.Store(-2)
+	if n, err := pool.probe(loopback); n != -1 || err != nil {
+		t.Errorf("HTTP check with invalid connections: %d, %v, want -1 and healthy", n, err)
+	}
+	status.Store(http.StatusServiceUnavailable)
+	if _, err := pool.probe(loopback); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("HTTP check of a 503: %v, want it failed", err)
+	}
+	pool.Check = "http:" + port + "/missing"
+	if _, err := pool.probe(loopback); err == nil {
+		t.Error("HTTP check of a 404 passed")
+	}
+
+	pool.Check = "tcp:" + port
+	if _, err := pool.probe(loopback); err != nil {
+		t.Errorf("TCP check of a listening port: %v", err)
+	}
+	backend.Close()
+	if _, err := pool.probe(loopback); err == nil {
+		t.Error("TCP check of a closed port passed")
+	}
+}
+
+func TestPoolHealthCheckFailover(t *testing.T) {
+	// the primary listens on 127.0.0.1 only, so the same check of
+	// 127.0.0.2 is refused
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	srv := newTestServer(t, "-pool", "name=app.lan backends=127.0.0.2,127.0.0.1 policy=priority check=tcp:"+port+" interval=10ms timeout=1s fall=1 rise=1")
+	pool := srv.reload.current.Load().pools[mustName(t, "app.lan")]
+	go pool.Run()
+	defer pool.Stop()
+
+	ask := func() string {
+		var query Msg
+		query.SetQuestion("app.lan", TypeA)
+		r := srv.exchangeTest(t, &query)
+		if len(r.Answers) != 1 {
+			t.Fatalf("%d answers, want 1", len(r.Answers))
+		}
+		res, _ := r.Answers[0].Resource()
+		return res.String()
+	}
+	waitFor(t, func() bool { return ask() == "127.0.0.1" }, "the failing 127.0.0.2 to be passed over")
+	if healthy, _ := pool.Backends[0].state(); healthy {
+		t.Error("127.0.0.2 still healthy")
+	}
+
+	listener.Close()
+	waitFor(t, func() bool { healthy, _ := pool.Backends[1].state(); return !healthy }, "127.0.0.1 to fail its checks")
+	// both down: the first one is answered again rather than nothing
+	if got := ask(); got != "127.0.0.2" {
+		t.Errorf("all down: answer %s, want the first backend", got)
+	}
+}
+
+func mustName(t *testing.T, s string) Name {
+	t.Helper()
+	name, err := ParseName(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// waitFor polls cond for up to 5 seconds.
+func waitFor(t *testing.T, cond func() bool, what string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
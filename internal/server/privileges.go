@@ -0,0 +1,94 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/codecrafters-io/dns-server-starter-go/internal/slog"
+)
+
+// dropPrivileges chroots into dir, when given, and switches to the user and
+// group of spec, written user[:group] with names or numeric ids. It must run
+// as root, before any goroutine depends on the old credentials.
+func dropPrivileges(spec, dir string) error {
+	if os.Geteuid() != 0 {
+		return errors.New("dropping privileges needs the server to start as root")
+	}
+
+	// look the user up while /etc/passwd is still reachable
+	var uid, gid int
+	if spec != "" {
+		var err error
+		if uid, gid, err = lookupUserGroup(spec); err != nil {
+			return err
+		}
+	}
+
+	if dir != "" {
+		if err := syscall.Chroot(dir); err != nil {
+			return fmt.Errorf("chroot %s: %w", dir, err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			return err
+		}
+	}
+	if spec != "" {
+		// the group goes first, root is needed to change it
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("setgroups: %w", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("setgid %d: %w", gid, err)
+		}
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("setuid %d: %w", uid, err)
+		}
+	}
+	slog.Info("dropped privileges", "uid", os.Getuid(), "gid", os.Getgid(), "chroot", dir)
+	return nil
+}
+
+// lookupUserGroup resolves user[:group] to numeric ids. The group defaults to
+// the user's primary group.
+func lookupUserGroup(spec string) (int, int, error) {
+	userName, groupName, hasGroup := strings.Cut(spec, ":")
+	u, err := user.Lookup(userName)
+	if err != nil {
+		if _, numeric := strconv.Atoi(userName); numeric != nil {
+			return 0, 0, err
+		}
+		if u, err = user.LookupId(userName); err != nil {
+			return 0, 0, err
+		}
+	}
+	gidString := u.Gid
+	if hasGroup {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if _, numeric := strconv.Atoi(groupName); numeric != nil {
+				return 0, 0, err
+			}
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return 0, 0, err
+			}
+		}
+		gidString = g.Gid
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("user %s has non-numeric id %q", userName, u.Uid)
+	}
+	gid, err := strconv.Atoi(gidString)
+	if err != nil {
+		return 0, 0, fmt.Errorf("group of %s has non-numeric id %q", spec, gidString)
+	}
+	if uid == 0 {
+		return 0, 0, fmt.Errorf("user %s is root, there is nothing to drop", userName)
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// typeNames maps the mnemonic of a record type to its code.
+var typeNames = map[string]uint16{
+	"A":     TypeA,
+	"NS":    TypeNS,
+	"CNAME": TypeCNAME,
+	"SOA":   TypeSOA,
+	"PTR":   TypePTR,
+	"MX":    TypeMX,
+	"NULL":  TypeNULL,
+	"TXT":   TypeTXT,
+	"AAAA":  TypeAAAA,
+	"SRV":   TypeSRV,
+	"DNAME": TypeDNAME,
+	"OPT":   TypeOPT,
+	"IXFR":  TypeIXFR,
+	"AXFR":  TypeAXFR,
+	"ANY":   TypeANY,
+}
+
+// typeName returns the mnemonic of a record type, or TYPEnnn for types
+// without one.
+func typeName(t uint16) string {
+	for name, code := range typeNames {
+		if code == t {
+			return name
+		}
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+// parseType accepts a type mnemonic or the RFC 3597 TYPEnnn form.
+func parseType(s string) (uint16, error) {
+	s = strings.ToUpper(s)
+	if t, ok := typeNames[s]; ok {
+		return t, nil
+	}
+	if code, err := strconv.ParseUint(strings.TrimPrefix(s, "TYPE"), 10, 16); err == nil {
+		return uint16(code), nil
+	}
+	return 0, fmt.Errorf("unknown record type %q", s)
+}
+
+// QTypeAction is what a query-type rule does to a matching question.
+type QTypeAction int
+
+const (
+	QTypeRefuse QTypeAction = iota // answer the whole query with REFUSED
+	QTypeDrop                      // silently drop the query
+	QTypeNoData                    // answer NOERROR without records, e.g. to strip AAAA
+)
+
+// QTypeRule matches questions by type, zone and client network. A rule with
+// no Clients applies to every client except those listed in Except.
+type QTypeRule struct {
+	Types   []uint16
+	Zone    string
+	Clients []*net.IPNet
+	Except  []*net.IPNet
+	Action  QTypeAction
+}
+
+func (r *QTypeRule) matches(ip net.IP, question DNSQuestion) bool {
+	typeMatch := false
+	for _, t := range r.Types {
+		if t == question.Type {
+			typeMatch = true
+			break
+		}
+	}
+	if !typeMatch || !inZone(canonicalName(domainName(question.Name)), r.Zone) {
+		return false
+	}
+	return (&ACL{Allow: r.Clients, Deny: r.Except}).Permits(ip)
+}
+
+// QTypePolicy is an ordered list of rules; the first matching rule wins.
+type QTypePolicy []*QTypeRule
+
+// Match returns the rule that applies to the question, or nil.
+func (p QTypePolicy) Match(ip net.IP, question DNSQuestion) *QTypeRule {
+	for _, rule := range p {
+		if rule.matches(ip, question) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// parseQTypeRule parses a rule written as space separated key=value pairs,
+// e.g. "types=ANY,AXFR action=refuse except=10.0.0.0/8" or
+// "types=AAAA action=nodata clients=192.168.10.0/24 zone=example.com".
+func parseQTypeRule(s string) (*QTypeRule, error) {
+	rule := &QTypeRule{}
+	fields, err := splitFields(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range fields {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected key=value, got %q", field)
+		}
+		var err error
+		switch strings.ToLower(key) {
+		case "types", "type":
+			for _, name := range strings.Split(value, ",") {
+				t, err := parseType(name)
+				if err != nil {
+					return nil, err
+				}
+				rule.Types = append(rule.Types, t)
+			}
+		case "action":
+			switch strings.ToLower(value) {
+			case "refuse", "refused":
+				rule.Action = QTypeRefuse
+			case "drop":
+				rule.Action = QTypeDrop
+			case "nodata", "strip":
+				rule.Action = QTypeNoData
+			default:
+				return nil, fmt.Errorf("unknown query type action %q (want refuse, drop or nodata)", value)
+			}
+		case "zone":
+			rule.Zone = canonicalName(value)
+		case "clients":
+			rule.Clients, err = parseCIDRList(value)
+		case "except":
+			rule.Except, err = parseCIDRList(value)
+		default:
+			return nil, fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(rule.Types) == 0 {
+		return nil, fmt.Errorf("rule %q lists no types", s)
+	}
+	return rule, nil
+}
+
+// qtypeRuleFlag collects repeated -qtype-rule flags into a policy.
+type qtypeRuleFlag struct {
+	policy *QTypePolicy
+}
+
+func (f *qtypeRuleFlag) String() string { return "" }
+
+func (f *qtypeRuleFlag) Set(value string) error {
+	rule, err := parseQTypeRule(value)
+	if err != nil {
+		return err
+	}
+	*f.policy = append(*f.policy, rule)
+	return nil
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseQTypeRule(t *testing.T) {
+	rule, err := parseQTypeRule("types=ANY,axfr,TYPE65280 action=nodata zone=Example.COM. clients=192.0.2.0/24,2001:db8::/32 except=192.0.2.1/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rule.Types) != 3 || rule.Types[0] != TypeANY || rule.Types[1] != TypeAXFR || rule.Types[2] != 65280 {
+		t.Errorf("types %v", rule.Types)
+	}
+	if rule.Action != QTypeNoData || rule.Zone != "example.com" || len(rule.Clients) != 2 || len(rule.Except) != 1 {
+		t.Errorf("rule %+v", rule)
+	}
+	for spec, action := range map[string]QTypeAction{
+		"types=ANY":                QTypeRefuse, // the default
+		"type=ANY action=REFUSED":  QTypeRefuse,
+		"types=ANY action=drop":    QTypeDrop,
+		"types=AAAA action=strip":  QTypeNoData,
+		`types=TXT "action=drop"`:  QTypeDrop,
+		"types=TXT    action=drop": QTypeDrop,
+	} {
+		if rule, err := parseQTypeRule(spec); err != nil || rule.Action != action {
+			t.Errorf("%q: %v, %v, want action %v", spec, rule, err, action)
+		}
+	}
+	for _, spec := range []string{
+		"",
+		"action=refuse",
+		"types=",
+		"types=BOGUS",
+		"types=ANY action=ignore",
+		"types=ANY clients=192.0.2.0/33",
+		"types=ANY except=nowhere",
+		"types=ANY colour=red",
+		"types=ANY refuse",
+	} {
+		if rule, err := parseQTypeRule(spec); err == nil {
+			t.Errorf("%q parsed as %+v", spec, rule)
+		}
+	}
+}
+
+func TestQTypePolicyMatch(t *testing.T) {
+	var policy QTypePolicy
+	for _, spec := range []string{
+		"types=AAAA action=nodata zone=ipv4only.example",
+		"types=ANY action=refuse except=10.0.0.0/8",
+		"types=TXT action=drop clients=192.0.2.0/24 except=192.0.2.128/25",
+		"types=TXT,ANY action=nodata", // behind the rules above
+	} {
+		flag := qtypeRuleFlag{policy: &policy}
+		if err := flag.Set(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range []struct {
+		client string
+		name   string
+		qtype  uint16
+		rule   int // index of the matching rule, -1 for none
+	}{
+		{"192.0.2.1", "ipv4only.example", TypeAAAA, 0},
+		{"192.0.2.1", "WWW.IPv4Only.Example", TypeAAAA, 0},
+		{"192.0.2.1", "notipv4only.example", TypeAAAA, -1}, // a suffix, not a subdomain
+		{"192.0.2.1", "ipv4only.example", TypeA, -1},
+		{"192.0.2.1", "example.com", TypeANY, 1},
+		{"10.1.2.3", "example.com", TypeANY, 3}, // excepted, the next rule applies
+		{"192.0.2.1", "example.com", TypeTXT, 2},
+		{"192.0.2.200", "example.com", TypeTXT, 3},
+		{"198.51.100.1", "example.com", TypeTXT, 3},
+		{"2001:db8::1", "example.com", TypeMX, -1},
+	} {
+		question := DNSQuestion{Name: labelSequence(tt.name), Type: tt.qtype, Class: ClassIN}
+		got := policy.Match(net.ParseIP(tt.client), question)
+		want := (*QTypeRule)(nil)
+		if tt.rule >= 0 {
+			want = policy[tt.rule]
+		}
+		if got != want {
+			t.Errorf("%s asking %s %s matched %+v, want rule %d", tt.client, tt.name, typeName(tt.qtype), got, tt.rule)
+		}
+	}
+}
+
+func TestQTypePolicyStage(t *testing.T) {
+	srv := newTestServer(t,
+		"-record", "host.lan A 10.0.0.1",
+		"-record", "host.lan AAAA fd00::1",
+		"-record", "host.lan TXT hello",
+		"-qtype-rule", "types=AAAA action=nodata zone=lan",
+		"-qtype-rule", "types=ANY action=refuse",
+		"-qtype-rule", "types=TXT action=drop clients="+testClient.IP.String()+"/32")
+	for _, tt := range []struct {
+		qtype   uint16
+		replies int
+		rcode   Rcode
+		answers int
+	}{
+		{TypeA, 1, RcodeSuccess, 1},
+		{TypeAAAA, 1, RcodeSuccess, 0}, // stripped though the record exists
+		{TypeANY, 1, RcodeRefused, 0},
+		{TypeTXT, 0, 0, 0},
+	} {
+		var query Msg
+		query.SetQuestion("host.lan", tt.qtype)
+		replies := srv.handleTest(query.Pack())
+		if len(replies) != tt.replies {
+			t.Errorf("%s: %d replies, want %d", typeName(tt.qtype), len(replies), tt.replies)
+			continue
+		}
+		if tt.replies == 0 {
+			continue
+		}
+		r, _, err := parseDNSResponse(nil, replies[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Header.Rcode() != tt.rcode || len(r.Answers) != tt.answers {
+			t.Errorf("%s: %v with answers %v, want %v with %d", typeName(tt.qtype), r.Header.Rcode(), r.Answers, tt.rcode, tt.answers)
+		}
+	}
+}
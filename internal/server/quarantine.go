@@ -0,0 +1,162 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/internal/slog"
+)
+
+// quarantineQueue is how many packets wait to be written before more are
+// skipped, so a flood of junk costs memory and disk writes only up to a
+// point.
+const quarantineQueue = 64
+
+// QuarantineEntry is the metadata written next to a quarantined packet.
+type QuarantineEntry struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Transport string    `json:"transport"`
+	Size      int       `json:"size"`
+	Error     string    `json:"error"`
+}
+
+// Quarantine keeps the last packets that failed to parse in a directory, each
+// as the raw message in a .bin file, which replay and a hex dump take as
+// they are, and a .json file saying where it came from and why it failed.
+// The oldest packets are removed beyond Max.
+type Quarantine struct {
+	Dir string
+	Max int
+
+	queue   chan quarantined
+	done    chan struct{}
+	mu      sync.Mutex // guards the fields below
+	files   []string   // base names of the quarantined packets, oldest first
+	skipped int
+	closed  bool // queries still answered after the shutdown timeout add nothing
+}
+
+type quarantined struct {
+	msg   []byte
+	entry QuarantineEntry
+}
+
+// NewQuarantine starts the writer. The directory is only looked at when the
+// first packet is written, after privileges are dropped, so it is created by
+// and inside the chroot of the server as it runs.
+func NewQuarantine(dir string, max int) *Quarantine {
+	q := &Quarantine{Dir: dir, Max: max, queue: make(chan quarantined, quarantineQueue), done: make(chan struct{})}
+	go q.write()
+	return q
+}
+
+// open creates the directory if needed and counts the packets already in
+// it against Max.
+func (q *Quarantine) open() error {
+	if err := os.MkdirAll(q.Dir, 0o750); err != nil {
+		return err
+	}
+	existing, err := filepath.Glob(filepath.Join(q.Dir, "*.bin"))
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, path := range existing {
+		q.files = append(q.files, strings.TrimSuffix(filepath.Base(path), ".bin"))
+	}
+	sort.Strings(q.files) // the names start with the time
+	return nil
+}
+
+// Add queues a copy of msg to be written. A nil Quarantine discards
+// everything, and packets are skipped while the writer is behind.
+func (q *Quarantine) Add(msg []byte, client net.Addr, err error) {
+	if q == nil {
+		return
+	}
+	packet := quarantined{
+		msg: append([]byte(nil), msg...),
+		entry: QuarantineEntry{
+			Time:      time.Now(),
+			Client:    client.String(),
+			Transport: transportName(client),
+			Size:      len(msg),
+			Error:     err.Error(),
+		},
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	select {
+	case q.queue <- packet:
+	default:
+		q.skipped++
+	}
+}
+
+// Close stops the writer after the queued packets are written.
+func (q *Quarantine) Close() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	q.closed = true
+	close(q.queue)
+	q.mu.Unlock()
+	<-q.done
+}
+
+func (q *Quarantine) write() {
+	defer close(q.done)
+	opened := false
+	for packet := range q.queue {
+		if !opened {
+			if err := q.open(); err != nil {
+				slog.Error("failed to quarantine malformed packet", "err", err)
+				continue
+			}
+			opened = true
+		}
+		sum := sha1.Sum(packet.msg)
+		name := fmt.Sprintf("%d-%x", packet.entry.Time.UnixNano(), sum[:4])
+		meta, _ := json.MarshalIndent(packet.entry, "", "  ")
+		if err := os.WriteFile(filepath.Join(q.Dir, name+".bin"), packet.msg, 0o640); err != nil {
+			slog.Error("failed to quarantine malformed packet", "err", err)
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(q.Dir, name+".json"), append(meta, '\n'), 0o640); err != nil {
+			slog.Error("failed to quarantine malformed packet", "err", err)
+		}
+
+		q.mu.Lock()
+		q.files = append(q.files, name)
+		var expired []string
+		if len(q.files) > q.Max {
+			expired = q.files[:len(q.files)-q.Max]
+			q.files = append([]string(nil), q.files[len(q.files)-q.Max:]...)
+		}
+		skipped := q.skipped
+		q.skipped = 0
+		q.mu.Unlock()
+
+		for _, old := range expired {
+			os.Remove(filepath.Join(q.Dir, old+".bin"))
+			os.Remove(filepath.Join(q.Dir, old+".json"))
+		}
+		if skipped > 0 {
+			slog.Warn("malformed packets not quarantined, writing fell behind", "skipped", skipped)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// quarantinedFiles returns the base names of the packets in dir, oldest
+// first, checking each has its metadata.
+func quarantinedFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	bins, err := filepath.Glob(filepath.Join(dir, "*.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsons, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(jsons) != len(bins) {
+		t.Errorf("%d packets with %d metadata files", len(bins), len(jsons))
+	}
+	var names []string
+	for _, path := range bins {
+		names = append(names, strings.TrimSuffix(filepath.Base(path), ".bin"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestQuarantine(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "quarantine") // created on the first packet
+	q := NewQuarantine(dir, 3)
+	client := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+	q.Add([]byte{0x12, 0x34, 0xff}, client, errShortMessage)
+	q.Close()
+
+	names := quarantinedFiles(t, dir)
+	if len(names) != 1 {
+		t.Fatalf("quarantined %v, want one packet", names)
+	}
+	msg, err := os.ReadFile(filepath.Join(dir, names[0]+".bin"))
+	if err != nil || !bytes.Equal(msg, []byte{0x12, 0x34, 0xff}) {
+		t.Errorf("packet %x, %v, want it as received", msg, err)
+	}
+	meta, err := os.ReadFile(filepath.Join(dir, names[0]+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry QuarantineEntry
+	if err := json.Unmarshal(meta, &entry); err != nil {
+		t.Fatalf("%v in %s", err, meta)
+	}
+	if entry.Client != "192.0.2.1:40000" || entry.Transport != "tcp" || entry.Size != 3 || entry.Error != errShortMessage.Error() || entry.Time.IsZero() {
+		t.Errorf("metadata %+v", entry)
+	}
+
+	// packets of a stopped server are dropped, not sent on a closed queue
+	q.Add([]byte{0x56}, client, errShortMessage)
+	if names := quarantinedFiles(t, dir); len(names) != 1 {
+		t.Errorf("quarantined %v after Close", names)
+	}
+	var none *Quarantine
+	none.Add([]byte{0x56}, client, errShortMessage)
+	none.Close()
+}
+
+func TestQuarantineMax(t *testing.T) {
+	dir := t.TempDir()
+	// a packet of an earlier run counts against the limit and goes first
+	for _, ext := range []string{".bin", ".json"} {
+		if err := os.WriteFile(filepath.Join(dir, "1000-00000000"+ext), []byte("old"), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q := NewQuarantine(dir, 3)
+	client := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+	for i := 0; i < 5; i++ {
+		q.Add([]byte(fmt.Sprintf("packet %d", i)), client, errors.New("bad"))
+	}
+	q.Close()
+
+	names := quarantinedFiles(t, dir)
+	if len(names) != 3 {
+		t.Fatalf("quarantined %v, want the last 3", names)
+	}
+	kept := map[string]bool{}
+	for _, name := range names {
+		msg, _ := os.ReadFile(filepath.Join(dir, name+".bin"))
+		kept[string(msg)] = true
+	}
+	for _, want := range []string{"packet 2", "packet 3", "packet 4"} {
+		if !kept[want] {
+			t.Errorf("kept %v, want %q among them", kept, want)
+		}
+	}
+}
+
+func TestQuarantineBehind(t *testing.T) {
+	dir := t.TempDir()
+	// the writer isn't started until the queue is full
+	q := &Quarantine{Dir: dir, Max: 1000, queue: make(chan quarantined, quarantineQueue), done: make(chan struct{})}
+	client := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+	for i := 0; i < quarantineQueue+5; i++ {
+		q.Add([]byte(fmt.Sprintf("packet %d", i)), client, errShortMessage)
+	}
+	q.mu.Lock()
+	skipped := q.skipped
+	q.mu.Unlock()
+	if skipped != 5 {
+		t.Errorf("%d packets skipped, want 5", skipped)
+	}
+	go q.write()
+	q.Close()
+	if names := quarantinedFiles(t, dir); len(names) != quarantineQueue {
+		t.Errorf("%d packets quarantined, want the %d queued", len(names), quarantineQueue)
+	}
+	if q.skipped != 0 {
+		t.Errorf("%d skipped still counted after they were reported", q.skipped)
+	}
+}
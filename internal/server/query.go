@@ -0,0 +1,351 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const queryUsage = `usage: %s query [@server] [-x address] name [type] [class] [+option...]
+
+Sends a query and prints the response the way dig does, to try the server
+out without dig installed. The server defaults to 127.0.0.1:2053, the
+default -listen, and port 53, or 853 with +tls, when only a host is given;
+the type defaults to A and the class to IN.
+
+Options:
+  +tcp           ask over TCP rather than UDP
+  +tls           ask over TLS, RFC 7858
+  +dnssec        set the DO bit, asking for DNSSEC records
+  +norec         clear RD, asking for no recursion
+  +noedns        send no OPT record
+  +noidnout      print internationalized names as xn-- rather than Unicode
+  +bufsize=N     UDP payload size advertised in the OPT record (1232)
+  +ednsopt=C[:H] add the EDNS option with code C and hex data H, repeatable
+  +timeout=D     how long to wait for the response, e.g. 5s (2s)
+  +short         print the record data of the answers only
+  +json          print the response as JSON, RFC 8427
+`
+
+// queryCommand is what the arguments of the query subcommand ask for.
+type queryCommand struct {
+	server  string
+	name    string
+	qtype   uint16
+	class   uint16
+	net     string
+	dnssec  bool
+	norec   bool
+	noedns  bool
+	noidn   bool
+	options []EDNSOption
+	bufsize int
+	timeout time.Duration
+	short   bool
+	json    bool
+}
+
+// runQuery is the query subcommand. It returns the exit status.
+func runQuery(args []string) int {
+	return queryTo(os.Stdout, os.Stderr, args)
+}
+
+// queryTo sends the query args ask for and prints the response to stdout
+// and what went wrong to stderr. It returns the exit status.
+func queryTo(stdout, stderr io.Writer, args []string) int {
+	cmd, err := parseQueryCommand(args)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		fmt.Fprintf(stderr, queryUsage, os.Args[0])
+		return 2
+	}
+
+	var m Msg
+	m.SetQuestion(cmd.name, cmd.qtype).Header.ID = newID()
+	m.Question[0].Class = cmd.class
+	if cmd.norec {
+		m.Header.Flags &^= flagRD
+	}
+	client := Client{Net: cmd.net, Timeout: cmd.timeout}
+	if !cmd.noedns {
+		client.UDPSize = cmd.bufsize
+		if cmd.dnssec || len(cmd.options) > 0 {
+			opt := DNSResourceRecord{Name: []byte{0}, Type: TypeOPT, Class: uint16(cmd.bufsize), RData: appendEDNSOptions(nil, cmd.options)}
+			if cmd.dnssec {
+				opt.TTL = ednsFlagDO
+			}
+			m.AddAdditional(opt)
+		}
+	}
+
+	start := time.Now()
+	r, err := client.Exchange(context.Background(), &m, cmd.server)
+	took := time.Since(start)
+	if err != nil {
+		fmt.Fprintf(stderr, ";; query to %s failed: %v\n", cmd.server, err)
+		return 1
+	}
+	if cmd.short {
+		for _, record := range r.Answers {
+			fmt.Fprintln(stdout, rdataText(record))
+		}
+		return 0
+	}
+	if cmd.json {
+		data, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		fmt.Fprintln(stdout, string(data))
+		return 0
+	}
+	printResponse(stdout, r, !cmd.noidn)
+	network := cmd.net
+	if network == "" {
+		network = "udp"
+	}
+	fmt.Fprintf(stdout, "\n;; Query time: %d msec\n", took.Milliseconds())
+	fmt.Fprintf(stdout, ";; SERVER: %s (%s)\n", cmd.server, network)
+	fmt.Fprintf(stdout, ";; WHEN: %s\n", start.Format(time.RFC1123Z))
+	return 0
+}
+
+// ednsFlagDO is the DNSSEC OK bit in the TTL of an OPT record, RFC 3225.
+const ednsFlagDO = 1 << 15
+
+func parseQueryCommand(args []string) (*queryCommand, error) {
+	cmd := &queryCommand{server: "127.0.0.1:2053", qtype: TypeA, class: ClassIN, bufsize: defaultMaxUDPSize, timeout: defaultExchangeTimeout}
+	server := ""
+	typed, classed := false, false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case strings.HasPrefix(arg, "@"):
+			server = arg[1:]
+		case arg == "-x":
+			if i+1 == len(args) {
+				return nil, fmt.Errorf("-x needs an address")
+			}
+			i++
+			name, err := reverseName(args[i])
+			if err != nil {
+				return nil, err
+			}
+			cmd.name, cmd.qtype, typed = name, TypePTR, true
+		case strings.HasPrefix(arg, "+"):
+			if err := cmd.setOption(arg[1:]); err != nil {
+				return nil, err
+			}
+		case cmd.name == "":
+			if _, err := encodeDomainName(arg); err != nil {
+				return nil, err
+			}
+			cmd.name = arg
+		case !typed:
+			qtype, err := parseType(arg)
+			if err != nil {
+				return nil, err
+			}
+			cmd.qtype, typed = qtype, true
+		case !classed:
+			class, err := parseClass(arg)
+			if err != nil {
+				return nil, err
+			}
+			cmd.class, classed = class, true
+		default:
+			return nil, fmt.Errorf("unexpected argument %q", arg)
+		}
+	}
+	if cmd.name == "" {
+		return nil, fmt.Errorf("no name to query")
+	}
+	if server != "" {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			port := "53"
+			if cmd.net == "tcp-tls" {
+				port = "853"
+			}
+			server = net.JoinHostPort(strings.Trim(server, "[]"), port)
+		}
+		cmd.server = server
+	}
+	return cmd, nil
+}
+
+// setOption applies a +option of the query subcommand, given without the +.
+func (cmd *queryCommand) setOption(option string) error {
+	name, value, _ := strings.Cut(option, "=")
+	switch name {
+	case "tcp":
+		cmd.net = "tcp"
+	case "tls":
+		cmd.net = "tcp-tls"
+	case "dnssec":
+		cmd.dnssec = true
+	case "norec", "norecurse":
+		cmd.norec = true
+	case "noedns":
+		cmd.noedns = true
+	case "idnout":
+		cmd.noidn = false
+	case "noidnout":
+		cmd.noidn = true
+	case "short":
+		cmd.short = true
+	case "json":
+		cmd.json = true
+	case "ednsopt":
+		code, data, _ := strings.Cut(value, ":")
+		n, err := strconv.ParseUint(code, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid +ednsopt code %q", code)
+		}
+		option := EDNSOption{Code: uint16(n)}
+		if option.Data, err = hex.DecodeString(data); err != nil {
+			return fmt.Errorf("invalid +ednsopt data %q, want hex", data)
+		}
+		cmd.options = append(cmd.options, option)
+	case "bufsize":
+		size, err := strconv.Atoi(value)
+		if err != nil || size < minUDPSize || size > maxTCPSize {
+			return fmt.Errorf("invalid +bufsize %q, want %d to %d", value, minUDPSize, maxTCPSize)
+		}
+		cmd.bufsize = size
+	case "timeout":
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			// dig takes seconds
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds <= 0 {
+				return fmt.Errorf("invalid +timeout %q", value)
+			}
+			timeout = time.Duration(seconds) * time.Second
+		}
+		cmd.timeout = timeout
+	default:
+		return fmt.Errorf("unknown option +%s", option)
+	}
+	return nil
+}
+
+// parseClass accepts a class mnemonic or the RFC 3597 CLASSnnn form.
+func parseClass(s string) (uint16, error) {
+	s = strings.ToUpper(s)
+	for _, class := range []uint16{ClassIN, ClassCH, ClassHS, ClassNONE, ClassANY} {
+		if className(class) == s {
+			return class, nil
+		}
+	}
+	if code, err := strconv.ParseUint(strings.TrimPrefix(s, "CLASS"), 10, 16); err == nil && strings.HasPrefix(s, "CLASS") {
+		return uint16(code), nil
+	}
+	return 0, fmt.Errorf("unknown class %q", s)
+}
+
+// reverseName returns the in-addr.arpa or ip6.arpa name of an address, the
+// name its PTR record is at.
+func reverseName(address string) (string, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return "", fmt.Errorf("invalid address %q", address)
+	}
+	var labels []string
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := len(ip4) - 1; i >= 0; i-- {
+			labels = append(labels, strconv.Itoa(int(ip4[i])))
+		}
+		return strings.Join(labels, ".") + ".in-addr.arpa", nil
+	}
+	const digits = "0123456789abcdef"
+	for i := len(ip) - 1; i >= 0; i-- {
+		labels = append(labels, string(digits[ip[i]&0xF]), string(digits[ip[i]>>4]))
+	}
+	return strings.Join(labels, ".") + ".ip6.arpa", nil
+}
+
+// printResponse prints r to w in the layout of dig, with the owner names of
+// internationalized domains in Unicode when unicode is set.
+func printResponse(w io.Writer, r *Msg, unicode bool) {
+	name := dottedName
+	if unicode {
+		name = func(sequence []byte) string { return idnaToUnicode(dottedName(sequence)) }
+	}
+	header := r.Header
+	fmt.Fprintf(w, ";; ->>HEADER<<- opcode: %s, status: %s, id: %d\n", opcodeName(header.Opcode()), header.Rcode(), header.ID)
+	fmt.Fprintf(w, ";; flags: %s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d\n",
+		strings.ReplaceAll(flagNames(header.Flags), ",", " "), len(r.Question), len(r.Answers), len(r.Authority), len(r.Additional))
+
+	additional := r.Additional
+	if opt, ok := findOPT(r.Additional); ok {
+		flags := ""
+		if opt.TTL&ednsFlagDO != 0 {
+			flags = " do"
+		}
+		rcode := Rcode(opt.TTL>>24)<<4 | header.Rcode()
+		fmt.Fprintf(w, "\n;; OPT PSEUDOSECTION:\n; EDNS: version: %d, flags:%s; udp: %d\n", ednsVersion(opt), flags, opt.Class)
+		if rcode != header.Rcode() {
+			fmt.Fprintf(w, "; EXTENDED RCODE: %s\n", rcode)
+		}
+		options, _ := ParseEDNSOptions(opt)
+		for _, option := range options {
+			fmt.Fprintf(w, "; OPT=%d: %x\n", option.Code, option.Data)
+		}
+		additional = nil
+		for _, record := range r.Additional {
+			if record.Type != TypeOPT {
+				additional = append(additional, record)
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "\n;; QUESTION SECTION:\n")
+	for _, question := range r.Question {
+		fmt.Fprintf(w, ";%s\t\t%s\t%s\n", name(question.Name), className(question.Class), typeName(question.Type))
+	}
+	sections := []struct {
+		name    string
+		records []DNSResourceRecord
+	}{{"ANSWER", r.Answers}, {"AUTHORITY", r.Authority}, {"ADDITIONAL", additional}}
+	for _, section := range sections {
+		if len(section.records) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n;; %s SECTION:\n", section.name)
+		for _, record := range section.records {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", name(record.Name), record.TTL, className(record.Class), typeName(record.Type), rdataText(record))
+		}
+	}
+}
+
+// opcodeName returns the mnemonic of an opcode as dig prints it.
+func opcodeName(opcode Opcode) string {
+	switch opcode {
+	case OpcodeQuery:
+		return "QUERY"
+	case 2:
+		return "STATUS"
+	case 4:
+		return "NOTIFY"
+	case 5:
+		return "UPDATE"
+	}
+	return "OPCODE" + strconv.Itoa(int(opcode))
+}
+
+// rdataText returns the data of a record in presentation format, or in the
+// generic form of RFC 3597 when it doesn't unpack.
+func rdataText(record DNSResourceRecord) string {
+	if res, err := record.Resource(); err == nil {
+		return res.String()
+	}
+	return (&UnknownResource{RRType: record.Type, Data: record.RData}).String()
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseQueryCommand(t *testing.T) {
+	for _, tt := range []struct {
+		args   []string
+		server string
+		name   string
+		qtype  uint16
+		class  uint16
+		net    string
+	}{
+		{[]string{"example.com"}, "127.0.0.1:2053", "example.com", TypeA, ClassIN, ""},
+		{[]string{"@192.0.2.1", "example.com", "mx"}, "192.0.2.1:53", "example.com", TypeMX, ClassIN, ""},
+		{[]string{"example.com", "@192.0.2.1:5353", "TYPE65280"}, "192.0.2.1:5353", "example.com", 65280, ClassIN, ""},
+		{[]string{"@::1", "+tcp", "version.bind", "txt", "ch"}, "[::1]:53", "version.bind", TypeTXT, ClassCH, "tcp"},
+		{[]string{"@[2001:db8::1]", "example.com", "+tls"}, "[2001:db8::1]:853", "example.com", TypeA, ClassIN, "tcp-tls"},
+		{[]string{"example.com", "ANY", "CLASS255"}, "127.0.0.1:2053", "example.com", TypeANY, ClassANY, ""},
+		{[]string{"-x", "192.0.2.1"}, "127.0.0.1:2053", "1.2.0.192.in-addr.arpa", TypePTR, ClassIN, ""},
+		{[]string{"-x", "2001:db8::1", "+json"}, "127.0.0.1:2053", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", TypePTR, ClassIN, ""},
+	} {
+		cmd, err := parseQueryCommand(tt.args)
+		if err != nil {
+			t.Errorf("%q: %v", tt.args, err)
+			continue
+		}
+		if cmd.server != tt.server || cmd.name != tt.name || cmd.qtype != tt.qtype || cmd.class != tt.class || cmd.net != tt.net {
+			t.Errorf("%q: %+v", tt.args, cmd)
+		}
+	}
+
+	cmd, err := parseQueryCommand([]string{"example.com", "+dnssec", "+norec", "+noidnout", "+bufsize=4096", "+ednsopt=10:0102", "+ednsopt=65001", "+timeout=3", "+short"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmd.dnssec || !cmd.norec || !cmd.noidn || cmd.bufsize != 4096 || len(cmd.options) != 2 || !bytes.Equal(cmd.options[0].Data, []byte{1, 2}) || cmd.timeout != 3*time.Second || !cmd.short {
+		t.Errorf("options %+v", cmd)
+	}
+
+	for _, args := range [][]string{
+		{},
+		{"+tcp"},
+		{"example.com", "BOGUS"},
+		{"example.com", "A", "XX"},
+		{"example.com", "A", "IN", "extra"},
+		{"example.com", "+bogus"},
+		{"example.com", "+bufsize=100"},
+		{"example.com", "+ednsopt=x"},
+		{"example.com", "+ednsopt=10:zz"},
+		{"example.com", "+timeout=soon"},
+		{"-x"},
+		{"-x", "host.lan"},
+		{"bad..name"},
+	} {
+		if cmd, err := parseQueryCommand(args); err == nil {
+			t.Errorf("%q parsed as %+v", args, cmd)
+		}
+	}
+}
+
+func TestQueryCommand(t *testing.T) {
+	srv := newTestServer(t, "-listen", "127.0.0.1:0,tcp://127.0.0.1:0",
+		"-record", "host.lan 300 A 10.0.0.1",
+		"-record", "host.lan TXT hello",
+		"-chaos-version", "dns-server 1.2")
+	server := "@" + startTestServer(t, srv)
+
+	for _, tt := range []struct {
+		args []string
+		want []string // lines of the output
+	}{
+		{[]string{server, "host.lan"}, []string{
+			";; ->>HEADER<<- opcode: QUERY, status: NOERROR, id: ",
+			";; flags: qr aa rd; QUERY: 1, ANSWER: 1, AUTHORITY: 0, ADDITIONAL: 1",
+			";host.lan.\t\tIN\tA",
+			"host.lan.\t300\tIN\tA\t10.0.0.1",
+			";; SERVER: " + server[1:] + " (udp)",
+		}},
+		{[]string{server, "+tcp", "+noedns", "host.lan"}, []string{
+			";; flags: qr aa rd; QUERY: 1, ANSWER: 1, AUTHORITY: 0, ADDITIONAL: 0",
+			";; SERVER: " + server[1:] + " (tcp)",
+		}},
+		{[]string{server, "host.lan", "txt", "+short"}, []string{`"hello"`}},
+		{[]string{server, "version.bind", "TXT", "CH", "+short"}, []string{`"dns-server 1.2"`}},
+		{[]string{server, "missing.lan"}, []string{";; ->>HEADER<<- opcode: QUERY, status: NXDOMAIN, id: "}},
+	} {
+		var stdout, stderr bytes.Buffer
+		if status := queryTo(&stdout, &stderr, tt.args); status != 0 {
+			t.Errorf("%q: status %d, %s", tt.args, status, stderr.String())
+			continue
+		}
+		lines := strings.Split(stdout.String(), "\n")
+		for _, want := range tt.want {
+			found := false
+			for _, line := range lines {
+				if strings.HasPrefix(line, want) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				t.Errorf("%q printed\n%s\nwant a line %q", tt.args, stdout.String(), want)
+			}
+		}
+		if len(tt.args) > 0 && tt.args[len(tt.args)-1] == "+short" && len(lines) != len(tt.want)+1 {
+			t.Errorf("%q printed %q, want the answers only", tt.args, stdout.String())
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	if status := queryTo(&stdout, &stderr, []string{server, "host.lan", "+json"}); status != 0 {
+		t.Fatalf("+json: status %d, %s", status, stderr.String())
+	}
+	var r Msg
+	if err := json.Unmarshal(stdout.Bytes(), &r); err != nil {
+		t.Fatalf("+json printed %s: %v", stdout.String(), err)
+	}
+	if len(r.Answers) != 1 || !net.IP(r.Answers[0].RData).Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("+json answers %v", r.Answers)
+	}
+
+	// a port nothing listens on
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := conn.LocalAddr().String()
+	conn.Close()
+	stdout.Reset()
+	stderr.Reset()
+	if status := queryTo(&stdout, &stderr, []string{"@" + down, "host.lan", "+timeout=1s"}); status != 1 || !strings.HasPrefix(stderr.String(), ";; query to "+down+" failed: ") || stdout.Len() != 0 {
+		t.Errorf("query to a closed port: status %d, %q, %q", status, stdout.String(), stderr.String())
+	}
+	stderr.Reset()
+	if status := queryTo(&stdout, &stderr, []string{"host.lan", "BOGUS"}); status != 2 || !strings.Contains(stderr.String(), "usage: ") {
+		t.Errorf("bad arguments: status %d, %q", status, stderr.String())
+	}
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/internal/slog"
+)
+
+// QueryLogEntry summarises one query and its response.
+type QueryLogEntry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Group    string    `json:"group"`
+	Name     string    `json:"qname,omitempty"`
+	Unicode  string    `json:"qname_unicode,omitempty"` // Name in Unicode, when internationalized
+	Type     string    `json:"qtype,omitempty"`
+	Rcode    int       `json:"rcode"`
+	Answers  int       `json:"answers"`
+	Dropped  string    `json:"dropped,omitempty"`
+	Blocked  bool      `json:"blocked,omitempty"`
+	Upstream string    `json:"upstream,omitempty"`
+	Duration float64   `json:"duration_ms"`
+}
+
+// QueryLog appends a JSON line per query to a rotating file. On busy servers
+// Sample can be lowered below 1 to log only that fraction of the queries.
+type QueryLog struct {
+	Sample float64
+	file   *rotatingFile
+}
+
+func NewQueryLog(file *rotatingFile, sample float64) *QueryLog {
+	return &QueryLog{Sample: sample, file: file}
+}
+
+// Record writes the entry unless it is sampled out. A nil QueryLog discards
+// everything.
+func (l *QueryLog) Record(entry QueryLogEntry) {
+	if l == nil || (l.Sample < 1 && rand.Float64() >= l.Sample) {
+		return
+	}
+	line, _ := json.Marshal(entry)
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		slog.Error("failed to write query log", "err", err)
+	}
+}
+
+// RecentQueries keeps the most recent queries in a ring buffer for the admin
+// API and the dashboard, whether or not a query log is written.
+type RecentQueries struct {
+	mu      sync.Mutex
+	entries []QueryLogEntry
+	next    int
+	full    bool
+}
+
+// NewRecentQueries returns a ring of size entries, or nil, which keeps
+// nothing, for a size below 1.
+func NewRecentQueries(size int) *RecentQueries {
+	if size < 1 {
+		return nil
+	}
+	return &RecentQueries{entries: make([]QueryLogEntry, size)}
+}
+
+// Record adds an entry. A nil RecentQueries discards it.
+func (r *RecentQueries) Record(entry QueryLogEntry) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[r.next] = entry
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Recent returns up to limit entries, newest first, whose client equals
+// client and whose name contains name; empty filters match everything.
+func (r *RecentQueries) Recent(client, name string, limit int) []QueryLogEntry {
+	result := make([]QueryLogEntry, 0)
+	if r == nil {
+		return result
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count := r.next
+	if r.full {
+		count = len(r.entries)
+	}
+	name = canonicalName(name)
+	for i := 1; i <= count && len(result) < limit; i++ {
+		entry := r.entries[(r.next-i+len(r.entries))%len(r.entries)]
+		if client != "" && entry.Client != client {
+			continue
+		}
+		if name != "" && !strings.Contains(canonicalName(entry.Name), name) {
+			continue
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+// Size returns the number of entries kept and the size of the ring.
+func (r *RecentQueries) Size() (int, int) {
+	if r == nil {
+		return 0, 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.full {
+		return len(r.entries), len(r.entries)
+	}
+	return r.next, len(r.entries)
+}
+
+// ServeHTTP answers GET /queries?client=&name=&limit= with matching entries.
+func (r *RecentQueries) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	limit := 100
+	if s := req.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	writeJSON(w, r.Recent(req.URL.Query().Get("client"), req.URL.Query().Get("name"), limit))
+}
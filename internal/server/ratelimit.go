@@ -0,0 +1,248 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/internal/slog"
+)
+
+// RateAction decides what happens to a query that exceeds its client's rate.
+type RateAction int
+
+const (
+	RateDrop   RateAction = iota // silently drop the query
+	RateRefuse                   // answer with RCODE REFUSED
+	RateTarpit                   // answer REFUSED, but only after a delay
+)
+
+func parseRateAction(s string) (RateAction, error) {
+	switch strings.ToLower(s) {
+	case "drop":
+		return RateDrop, nil
+	case "refuse", "refused":
+		return RateRefuse, nil
+	case "tarpit":
+		return RateTarpit, nil
+	}
+	return RateDrop, fmt.Errorf("unknown rate limit action %q (want drop, refuse or tarpit)", s)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+const (
+	// defaultRateClients caps the buckets of a limiter without a memory
+	// budget.
+	defaultRateClients = 100000
+	// defaultTopLimited is how many limited clients /rate-limit lists.
+	defaultTopLimited = 10
+)
+
+// RateLimiter is a token bucket per client address. Every client may send
+// QPS queries per second on average with bursts of up to Burst queries.
+type RateLimiter struct {
+	QPS   float64
+	Burst float64
+	// MaxClients caps the buckets and the clients counted as limited, so a
+	// flood from spoofed addresses can't grow them without bound. A new
+	// client beyond it takes the bucket of the least recently seen of a
+	// sample.
+	MaxClients int
+	// IPv4Prefix and IPv6Prefix group the addresses of AllowIP into networks
+	// sharing a bucket, 0 for a bucket per address. An IPv6 client usually
+	// holds a whole /56 or /64 and would get round a limit per address.
+	IPv4Prefix int
+	IPv6Prefix int
+
+	now     func() time.Time // time.Now, unless a test winds its own clock
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	limited map[string]uint64 // queries refused per client since the last report
+	last    []LimitedClient   // the clients limited in the last complete report interval
+	total   uint64            // queries refused since the limiter started
+	sweep   time.Time
+	stop    chan struct{}
+}
+
+func NewRateLimiter(qps float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		QPS:        qps,
+		Burst:      float64(burst),
+		MaxClients: defaultRateClients,
+		buckets:    make(map[string]*bucket),
+		limited:    make(map[string]uint64),
+		stop:       make(chan struct{}),
+		now:        time.Now,
+	}
+}
+
+// AllowIP is Allow for the network of ip, see IPv4Prefix and IPv6Prefix.
+func (r *RateLimiter) AllowIP(ip net.IP) bool {
+	if r == nil {
+		return true
+	}
+	return r.Allow(r.network(ip))
+}
+
+// network names the bucket of ip: the address, or the network of the prefix
+// length for its family.
+func (r *RateLimiter) network(ip net.IP) string {
+	bits, prefix := 128, r.IPv6Prefix
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits, prefix = ip4, 32, r.IPv4Prefix
+	}
+	if prefix <= 0 || prefix >= bits {
+		return ip.String()
+	}
+	network := net.IPNet{IP: ip.Mask(net.CIDRMask(prefix, bits)), Mask: net.CIDRMask(prefix, bits)}
+	return network.String()
+}
+
+// Allow takes a token from the client's bucket and reports whether there was
+// one. A nil limiter allows everything.
+func (r *RateLimiter) Allow(client string) bool {
+	if r == nil {
+		return true
+	}
+	now := r.now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.expire(now)
+	b, ok := r.buckets[client]
+	if !ok {
+		if len(r.buckets) >= r.MaxClients {
+			r.evict()
+		}
+		b = &bucket{tokens: r.Burst, last: now}
+		r.buckets[client] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * r.QPS
+	if b.tokens > r.Burst {
+		b.tokens = r.Burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		r.total++
+		if _, ok := r.limited[client]; ok || len(r.limited) < r.MaxClients {
+			r.limited[client]++
+		}
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// expire forgets buckets that have been refilled completely, so the map only
+// holds clients that are currently active.
+func (r *RateLimiter) expire(now time.Time) {
+	if now.Sub(r.sweep) < time.Minute {
+		return
+	}
+	r.sweep = now
+	full := time.Duration(r.Burst / r.QPS * float64(time.Second))
+	for client, b := range r.buckets {
+		if now.Sub(b.last) > full {
+			delete(r.buckets, client)
+		}
+	}
+}
+
+// evict makes room for a bucket by dropping the least recently seen of a
+// sample, as scanning all of them for every new address of a flood would be
+// too slow.
+func (r *RateLimiter) evict() {
+	var oldest string
+	sampled := 0
+	for client, b := range r.buckets {
+		if oldest == "" || b.last.Before(r.buckets[oldest].last) {
+			oldest = client
+		}
+		if sampled++; sampled == evictionSample {
+			break
+		}
+	}
+	delete(r.buckets, oldest)
+}
+
+// Clients returns the number of clients with a bucket.
+func (r *RateLimiter) Clients() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.buckets)
+}
+
+// LimitedClient is a client that had queries rejected by the rate limiter.
+type LimitedClient struct {
+	Client  string `json:"client"`
+	Limited uint64 `json:"limited"`
+}
+
+// TakeLimited returns the clients that were limited since the previous call,
+// busiest first, and resets the counters.
+func (r *RateLimiter) TakeLimited() []LimitedClient {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clients := make([]LimitedClient, 0, len(r.limited))
+	for client, count := range r.limited {
+		clients = append(clients, LimitedClient{Client: client, Limited: count})
+	}
+	r.limited = make(map[string]uint64)
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Limited > clients[j].Limited })
+	r.last = clients
+	return clients
+}
+
+// RateLimitReport is the answer of the /rate-limit endpoint.
+type RateLimitReport struct {
+	Limited uint64          `json:"limited"` // queries refused since the limiter started
+	Clients int             `json:"clients"` // clients with a bucket
+	Top     []LimitedClient `json:"top"`     // busiest of the last complete interval
+}
+
+// Report returns the number of queries refused and the top clients limited
+// in the last complete report interval.
+func (r *RateLimiter) Report(top int) RateLimitReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report := RateLimitReport{Limited: r.total, Clients: len(r.buckets), Top: r.last}
+	if len(report.Top) > top {
+		report.Top = report.Top[:top]
+	}
+	if report.Top == nil {
+		report.Top = []LimitedClient{}
+	}
+	return report
+}
+
+// reportLimited periodically prints the clients that were rate limited until
+// the limiter is stopped.
+func (r *RateLimiter) reportLimited(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.stop:
+			return
+		}
+		for _, client := range r.TakeLimited() {
+			slog.Warn("client rate limited", "client", client.Client, "limited", client.Limited, "interval", interval)
+		}
+	}
+}
+
+// Stop ends reportLimited, e.g. once a reload replaced the limiter.
+func (r *RateLimiter) Stop() {
+	close(r.stop)
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// testClock is a clock the tests move by hand.
+type testClock struct{ now time.Time }
+
+func (c *testClock) Now() time.Time          { return c.now }
+func (c *testClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestLimiter(qps float64, burst int) (*RateLimiter, *testClock) {
+	clock := &testClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	limiter := NewRateLimiter(qps, burst)
+	limiter.now = clock.Now
+	return limiter, clock
+}
+
+func TestRateLimiterBucket(t *testing.T) {
+	limiter, clock := newTestLimiter(2, 3)
+	steps := []struct {
+		advance time.Duration
+		client  string
+		allowed bool
+	}{
+		{0, "192.0.2.1", true},
+		{0, "192.0.2.1", true},
+		{0, "192.0.2.1", true},
+		{0, "192.0.2.1", false}, // the burst is spent
+		{0, "192.0.2.2", true},  // a bucket per client
+		{250 * time.Millisecond, "192.0.2.1", false},
+		{250 * time.Millisecond, "192.0.2.1", true}, // one token after half a second
+		{0, "192.0.2.1", false},
+		{time.Hour, "192.0.2.1", true}, // refilled up to the burst, no more
+		{0, "192.0.2.1", true},
+		{0, "192.0.2.1", true},
+		{0, "192.0.2.1", false},
+	}
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		if got := limiter.Allow(step.client); got != step.allowed {
+			t.Errorf("step %d: %s allowed %v, want %v", i, step.client, got, step.allowed)
+		}
+	}
+
+	limited := limiter.TakeLimited()
+	if len(limited) != 1 || limited[0] != (LimitedClient{Client: "192.0.2.1", Limited: 4}) {
+		t.Errorf("limited clients %v, want 192.0.2.1 limited 4 times", limited)
+	}
+	if limited := limiter.TakeLimited(); len(limited) != 0 {
+		t.Errorf("limited clients %v after taking them, want none", limited)
+	}
+}
+
+func TestRateLimiterPrefix(t *testing.T) {
+	tests := []struct {
+		prefix4, prefix6 int
+		a, b             string
+		shared           bool
+	}{
+		{32, 56, "192.0.2.1", "192.0.2.2", false},
+		{24, 56, "192.0.2.1", "192.0.2.200", true},
+		{24, 56, "192.0.2.1", "192.0.3.1", false},
+		{32, 56, "2001:db8:0:ff::1", "2001:db8:0:1::2", true},
+		{32, 56, "2001:db8:0:ff::1", "2001:db8:0:100::1", false},
+		{32, 128, "2001:db8::1", "2001:db8::2", false},
+		{32, 64, "2001:db8::1", "2001:db8::2", true},
+		{0, 0, "2001:db8::1", "2001:db8::2", false},
+		{16, 16, "192.0.2.1", "::ffff:192.0.3.1", true}, // IPv4-mapped counts as IPv4
+	}
+	for _, tt := range tests {
+		limiter, _ := newTestLimiter(1, 1)
+		limiter.IPv4Prefix, limiter.IPv6Prefix = tt.prefix4, tt.prefix6
+		if !limiter.AllowIP(net.ParseIP(tt.a)) {
+			t.Fatalf("first query of %s limited", tt.a)
+		}
+		if shared := !limiter.AllowIP(net.ParseIP(tt.b)); shared != tt.shared {
+			t.Errorf("/%d and /%d: %s and %s share a bucket %v, want %v", tt.prefix4, tt.prefix6, tt.a, tt.b, shared, tt.shared)
+		}
+	}
+
+	limiter, _ := newTestLimiter(1, 1)
+	limiter.IPv6Prefix = 56
+	limiter.AllowIP(net.ParseIP("2001:db8:0:ff::1"))
+	limiter.AllowIP(net.ParseIP("2001:db8:0:1::1"))
+	if limited := limiter.TakeLimited(); len(limited) != 1 || limited[0].Client != "2001:db8::/56" {
+		t.Errorf("limited clients %v, want the network 2001:db8::/56", limited)
+	}
+}
+
+func TestRateLimiterExpiry(t *testing.T) {
+	limiter, clock := newTestLimiter(1, 10)
+	limiter.Allow("192.0.2.1")
+	clock.Advance(30 * time.Second)
+	limiter.Allow("192.0.2.2")
+	if got := limiter.Clients(); got != 2 {
+		t.Fatalf("%d clients, want 2", got)
+	}
+
+	// the first bucket is full again after 10s, but buckets are swept once
+	// a minute
+	clock.Advance(15 * time.Second)
+	limiter.Allow("192.0.2.3")
+	if got := limiter.Clients(); got != 3 {
+		t.Errorf("%d clients before the sweep, want 3", got)
+	}
+	clock.Advance(20 * time.Second)
+	limiter.Allow("192.0.2.3")
+	if got := limiter.Clients(); got != 1 {
+		t.Errorf("%d clients after the sweep, want only the active one", got)
+	}
+
+	// an expired client starts again with a full burst
+	for i := 0; i < 10; i++ {
+		if !limiter.Allow("192.0.2.1") {
+			t.Fatalf("query %d of a returning client limited", i+1)
+		}
+	}
+}
+
+func TestRateLimitStage(t *testing.T) {
+	srv := newTestServer(t, "-rate-limit", "1", "-rate-burst", "2", "-rate-action", "refuse", "-rate-prefix-v4", "24")
+	var query Msg
+	query.SetQuestion("example.com", TypeA)
+	rcodes := make([]Rcode, 3)
+	for i := range rcodes {
+		rcodes[i] = srv.exchangeTest(t, &query).Header.Rcode()
+	}
+	if rcodes[0] == RcodeRefused || rcodes[1] == RcodeRefused || rcodes[2] != RcodeRefused {
+		t.Errorf("rcodes %v, want the third query refused", rcodes)
+	}
+
+	for _, value := range []string{"0", "33"} {
+		if _, err := NewServer("-rate-limit", "1", "-rate-prefix-v4", value); err == nil {
+			t.Errorf("-rate-prefix-v4 %s accepted", value)
+		}
+	}
+}
+
+func TestRateLimiterMaxClients(t *testing.T) {
+	limiter, clock := newTestLimiter(1, 1)
+	limiter.MaxClients = 3
+	for i := 0; i < 100; i++ {
+		client := net.IPv4(198, 51, 100, byte(i)).String()
+		limiter.Allow(client)
+		limiter.Allow(client)
+		clock.Advance(time.Millisecond)
+	}
+	if got := limiter.Clients(); got != 3 {
+		t.Errorf("%d clients, want the cap of 3", got)
+	}
+	// the clients seen last keep their buckets
+	if limiter.Allow("198.51.100.99") {
+		t.Error("the latest client lost its bucket")
+	}
+	limited := limiter.TakeLimited()
+	if len(limited) != 3 {
+		t.Errorf("%d limited clients kept, want the cap of 3", len(limited))
+	}
+	if report := limiter.Report(2); report.Limited != 101 || len(report.Top) != 2 || report.Clients != 3 {
+		t.Errorf("report %+v, want 101 limited queries, 3 clients and the top 2", report)
+	}
+}
+
+func TestRateLimitReport(t *testing.T) {
+	limiter, _ := newTestLimiter(1, 1)
+	if report := limiter.Report(10); report.Limited != 0 || report.Top == nil || len(report.Top) != 0 {
+		t.Errorf("report %+v of an idle limiter", report)
+	}
+	for i := 0; i < 4; i++ {
+		limiter.Allow("192.0.2.1")
+	}
+	limiter.Allow("192.0.2.2")
+	limiter.Allow("192.0.2.2")
+	// the top clients are those of the last complete interval
+	if report := limiter.Report(10); report.Limited != 4 || len(report.Top) != 0 {
+		t.Errorf("report %+v before the interval ends", report)
+	}
+	limiter.TakeLimited()
+	report := limiter.Report(10)
+	want := []LimitedClient{{"192.0.2.1", 3}, {"192.0.2.2", 1}}
+	if report.Limited != 4 || len(report.Top) != 2 || report.Top[0] != want[0] || report.Top[1] != want[1] {
+		t.Errorf("report %+v, want %v", report, want)
+	}
+}
+
+func TestRateLimitTarpitTCP(t *testing.T) {
+	srv := newTestServer(t, "-listen", "tcp://127.0.0.1:0", "-rate-limit", "1", "-rate-burst", "1", "-rate-action", "tarpit", "-rate-tarpit-delay", "200ms")
+	conn, err := net.Dial("tcp", startTestServer(t, srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var query Msg
+	query.SetQuestion("example.com", TypeA)
+	for _, id := range []uint16{1, 2} {
+		query.Header.ID = id
+		packed := query.Pack()
+		if _, err := conn.Write(append([]byte{byte(len(packed) >> 8), byte(len(packed))}, packed...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the client is done asking, the server still owes the tarpitted answer
+	conn.(*net.TCPConn).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	rcodes := map[uint16]Rcode{}
+	for len(rcodes) < 2 {
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			t.Fatalf("answers %v, then %v", rcodes, err)
+		}
+		data := make([]byte, int(length[0])<<8|int(length[1]))
+		if _, err := io.ReadFull(conn, data); err != nil {
+			t.Fatal(err)
+		}
+		response, _, err := parseDNSResponse(nil, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rcodes[response.Header.ID] = response.Header.Rcode()
+	}
+	// the queries are answered concurrently, either may be the one limited
+	if (rcodes[1] == RcodeRefused) == (rcodes[2] == RcodeRefused) {
+		t.Errorf("answers %v, want one of them REFUSED by the tarpit", rcodes)
+	}
+}
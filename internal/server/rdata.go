@@ -0,0 +1,415 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Resource is the data of a resource record as a typed value, for code that
+// builds or reads records rather than passing them through. RData keeps the
+// wire form, which is what forwarding, caching and packing need; Resource
+// and NewRecord convert between the two:
+//
+//	record, err := NewRecord("lab.example", 300, &MXResource{Preference: 10, Exchange: "mail.lab.example"})
+//	...
+//	res, err := record.Resource()
+//	if mx, ok := res.(*MXResource); ok {
+//		fmt.Println(mx.Exchange)
+//	}
+//
+// Names are in presentation format, and come out of Unpack with the
+// trailing dot.
+type Resource interface {
+	// Type returns the record type the data is for.
+	Type() uint16
+	// Pack appends the data in wire form, names uncompressed, to dst.
+	Pack(dst []byte) ([]byte, error)
+	// Unpack sets the resource from data in wire form with its names
+	// uncompressed, as parsing leaves RData.
+	Unpack(rdata []byte) error
+	// String returns the data in presentation format, as dig prints it.
+	String() string
+}
+
+var errTrailingData = errors.New("data left over after the record data")
+
+// AResource is the IPv4 address of an A record.
+type AResource struct {
+	IP net.IP
+}
+
+func (r *AResource) Type() uint16 { return TypeA }
+
+func (r *AResource) Pack(dst []byte) ([]byte, error) {
+	ip := r.IP.To4()
+	if ip == nil {
+		return dst, fmt.Errorf("%s is not an IPv4 address", r.IP)
+	}
+	return append(dst, ip...), nil
+}
+
+func (r *AResource) Unpack(rdata []byte) error {
+	if err := checkLength(rdata, net.IPv4len); err != nil {
+		return err
+	}
+	r.IP = append(net.IP(nil), rdata...)
+	return nil
+}
+
+func (r *AResource) String() string { return r.IP.String() }
+
+// AAAAResource is the IPv6 address of an AAAA record.
+type AAAAResource struct {
+	IP net.IP
+}
+
+func (r *AAAAResource) Type() uint16 { return TypeAAAA }
+
+func (r *AAAAResource) Pack(dst []byte) ([]byte, error) {
+	if r.IP.To16() == nil || r.IP.To4() != nil {
+		return dst, fmt.Errorf("%s is not an IPv6 address", r.IP)
+	}
+	return append(dst, r.IP.To16()...), nil
+}
+
+func (r *AAAAResource) Unpack(rdata []byte) error {
+	if err := checkLength(rdata, net.IPv6len); err != nil {
+		return err
+	}
+	r.IP = append(net.IP(nil), rdata...)
+	return nil
+}
+
+func (r *AAAAResource) String() string { return r.IP.String() }
+
+// NSResource is the name server of an NS record.
+type NSResource struct {
+	Host string
+}
+
+func (r *NSResource) Type() uint16                    { return TypeNS }
+func (r *NSResource) Pack(dst []byte) ([]byte, error) { return appendName(dst, r.Host) }
+func (r *NSResource) Unpack(rdata []byte) error       { return unpackName(rdata, &r.Host) }
+func (r *NSResource) String() string                  { return r.Host }
+
+// CNAMEResource is the target of a CNAME record, the name its owner is an
+// alias of.
+type CNAMEResource struct {
+	Target string
+}
+
+func (r *CNAMEResource) Type() uint16                    { return TypeCNAME }
+func (r *CNAMEResource) Pack(dst []byte) ([]byte, error) { return appendName(dst, r.Target) }
+func (r *CNAMEResource) Unpack(rdata []byte) error       { return unpackName(rdata, &r.Target) }
+func (r *CNAMEResource) String() string                  { return r.Target }
+
+// DNAMEResource is the target of a DNAME record, RFC 6672, the name the
+// names below its owner are redirected under.
+type DNAMEResource struct {
+	Target string
+}
+
+func (r *DNAMEResource) Type() uint16                    { return TypeDNAME }
+func (r *DNAMEResource) Pack(dst []byte) ([]byte, error) { return appendName(dst, r.Target) }
+func (r *DNAMEResource) Unpack(rdata []byte) error       { return unpackName(rdata, &r.Target) }
+func (r *DNAMEResource) String() string                  { return r.Target }
+
+// PTRResource is the target of a PTR record.
+type PTRResource struct {
+	Target string
+}
+
+func (r *PTRResource) Type() uint16                    { return TypePTR }
+func (r *PTRResource) Pack(dst []byte) ([]byte, error) { return appendName(dst, r.Target) }
+func (r *PTRResource) Unpack(rdata []byte) error       { return unpackName(rdata, &r.Target) }
+func (r *PTRResource) String() string                  { return r.Target }
+
+// MXResource is a mail exchanger, lower preferences being tried first.
+type MXResource struct {
+	Preference uint16
+	Exchange   string
+}
+
+func (r *MXResource) Type() uint16 { return TypeMX }
+
+func (r *MXResource) Pack(dst []byte) ([]byte, error) {
+	return appendName(binary.BigEndian.AppendUint16(dst, r.Preference), r.Exchange)
+}
+
+func (r *MXResource) Unpack(rdata []byte) error {
+	if len(rdata) < 2 {
+		return errShortMessage
+	}
+	r.Preference = binary.BigEndian.Uint16(rdata)
+	return unpackName(rdata[2:], &r.Exchange)
+}
+
+func (r *MXResource) String() string { return fmt.Sprintf("%d %s", r.Preference, r.Exchange) }
+
+// SRVResource is a server of a service, RFC 2782.
+type SRVResource struct {
+	Priority, Weight, Port uint16
+	Target                 string
+}
+
+func (r *SRVResource) Type() uint16 { return TypeSRV }
+
+func (r *SRVResource) Pack(dst []byte) ([]byte, error) {
+	dst = binary.BigEndian.AppendUint16(dst, r.Priority)
+	dst = binary.BigEndian.AppendUint16(dst, r.Weight)
+	dst = binary.BigEndian.AppendUint16(dst, r.Port)
+	return appendName(dst, r.Target)
+}
+
+func (r *SRVResource) Unpack(rdata []byte) error {
+	if len(rdata) < 6 {
+		return errShortMessage
+	}
+	r.Priority, r.Weight, r.Port = binary.BigEndian.Uint16(rdata), binary.BigEndian.Uint16(rdata[2:]), binary.BigEndian.Uint16(rdata[4:])
+	return unpackName(rdata[6:], &r.Target)
+}
+
+func (r *SRVResource) String() string {
+	return fmt.Sprintf("%d %d %d %s", r.Priority, r.Weight, r.Port, r.Target)
+}
+
+// SOAResource is the start of authority of a zone: its primary server, the
+// mailbox of its admin and the timers of its secondaries and negative
+// caching.
+type SOAResource struct {
+	MName, RName                            string
+	Serial, Refresh, Retry, Expire, Minimum uint32
+}
+
+func (r *SOAResource) Type() uint16 { return TypeSOA }
+
+func (r *SOAResource) Pack(dst []byte) ([]byte, error) {
+	dst, err := appendName(dst, r.MName)
+	if err != nil {
+		return dst, err
+	}
+	if dst, err = appendName(dst, r.RName); err != nil {
+		return dst, err
+	}
+	for _, value := range []uint32{r.Serial, r.Refresh, r.Retry, r.Expire, r.Minimum} {
+		dst = binary.BigEndian.AppendUint32(dst, value)
+	}
+	return dst, nil
+}
+
+func (r *SOAResource) Unpack(rdata []byte) error {
+	mname, next, err := parseDNSName(nil, rdata, 0)
+	if err != nil {
+		return err
+	}
+	rname, next, err := parseDNSName(nil, rdata, next)
+	if err != nil {
+		return err
+	}
+	if err := checkLength(rdata[next:], 20); err != nil {
+		return err
+	}
+	fields := rdata[next:]
+	r.MName, r.RName = dottedName(mname), dottedName(rname)
+	r.Serial, r.Refresh, r.Retry = binary.BigEndian.Uint32(fields), binary.BigEndian.Uint32(fields[4:]), binary.BigEndian.Uint32(fields[8:])
+	r.Expire, r.Minimum = binary.BigEndian.Uint32(fields[12:]), binary.BigEndian.Uint32(fields[16:])
+	return nil
+}
+
+func (r *SOAResource) String() string {
+	return fmt.Sprintf("%s %s %d %d %d %d %d", r.MName, r.RName, r.Serial, r.Refresh, r.Retry, r.Expire, r.Minimum)
+}
+
+// TXTResource is the character strings of a TXT record, each at most 255
+// bytes; txtStrings splits longer text.
+type TXTResource struct {
+	Text []string
+}
+
+func (r *TXTResource) Type() uint16 { return TypeTXT }
+
+func (r *TXTResource) Pack(dst []byte) ([]byte, error) {
+	if len(r.Text) == 0 {
+		return dst, errors.New("TXT record without strings")
+	}
+	for _, s := range r.Text {
+		if len(s) > 255 {
+			return dst, fmt.Errorf("TXT string of %d bytes, over 255", len(s))
+		}
+		dst = append(append(dst, byte(len(s))), s...)
+	}
+	return dst, nil
+}
+
+func (r *TXTResource) Unpack(rdata []byte) error {
+	r.Text = nil
+	for offset := 0; offset < len(rdata); {
+		end := offset + 1 + int(rdata[offset])
+		if end > len(rdata) {
+			return errShortMessage
+		}
+		r.Text = append(r.Text, string(rdata[offset+1:end]))
+		offset = end
+	}
+	return nil
+}
+
+func (r *TXTResource) String() string {
+	quoted := make([]string, len(r.Text))
+	for i, s := range r.Text {
+		quoted[i] = quoteCharacterString(s)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// quoteCharacterString quotes s the way master files do, RFC 1035 5.1:
+// quotes and backslashes escaped with a backslash, bytes outside printable
+// ASCII as \DDD in decimal.
+func quoteCharacterString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// txtStrings splits s into the character strings of a TXT record.
+func txtStrings(s string) []string {
+	var strs []string
+	for {
+		chunk := s
+		if len(chunk) > 255 {
+			chunk = chunk[:255]
+		}
+		strs = append(strs, chunk)
+		s = s[len(chunk):]
+		if s == "" {
+			return strs
+		}
+	}
+}
+
+// UnknownResource is the data of a record of a type without a Resource of
+// its own, kept as it is, RFC 3597.
+type UnknownResource struct {
+	RRType uint16
+	Data   []byte
+}
+
+func (r *UnknownResource) Type() uint16 { return r.RRType }
+
+func (r *UnknownResource) Pack(dst []byte) ([]byte, error) { return append(dst, r.Data...), nil }
+
+func (r *UnknownResource) Unpack(rdata []byte) error {
+	r.Data = append([]byte(nil), rdata...)
+	return nil
+}
+
+func (r *UnknownResource) String() string { return fmt.Sprintf("\\# %d %x", len(r.Data), r.Data) }
+
+// newResource returns an empty Resource for records of type rrtype.
+func newResource(rrtype uint16) Resource {
+	switch rrtype {
+	case TypeA:
+		return new(AResource)
+	case TypeAAAA:
+		return new(AAAAResource)
+	case TypeNS:
+		return new(NSResource)
+	case TypeCNAME:
+		return new(CNAMEResource)
+	case TypeDNAME:
+		return new(DNAMEResource)
+	case TypePTR:
+		return new(PTRResource)
+	case TypeMX:
+		return new(MXResource)
+	case TypeSRV:
+		return new(SRVResource)
+	case TypeSOA:
+		return new(SOAResource)
+	case TypeTXT:
+		return new(TXTResource)
+	}
+	return &UnknownResource{RRType: rrtype}
+}
+
+// Resource returns the data of the record as a typed value, an
+// UnknownResource for types without one.
+func (r DNSResourceRecord) Resource() (Resource, error) {
+	res := newResource(r.Type)
+	if err := res.Unpack(r.RData); err != nil {
+		return nil, fmt.Errorf("%s record: %w", typeName(r.Type), err)
+	}
+	return res, nil
+}
+
+// NewRecord returns a record of class IN of name holding res.
+func NewRecord(name string, ttl uint32, res Resource) (DNSResourceRecord, error) {
+	owner, err := encodeDomainName(name)
+	if err != nil {
+		return DNSResourceRecord{}, err
+	}
+	rdata, err := res.Pack(nil)
+	if err != nil {
+		return DNSResourceRecord{}, fmt.Errorf("%s record: %w", typeName(res.Type()), err)
+	}
+	if len(rdata) > 0xFFFF {
+		return DNSResourceRecord{}, fmt.Errorf("%s record of %d bytes", typeName(res.Type()), len(rdata))
+	}
+	return DNSResourceRecord{Name: owner, Type: res.Type(), Class: ClassIN, TTL: ttl, RDLength: uint16(len(rdata)), RData: rdata}, nil
+}
+
+// packResource returns the wire form of a resource known to be valid, such
+// as one of constants.
+func packResource(res Resource) []byte {
+	rdata, _ := res.Pack(nil)
+	return rdata
+}
+
+// appendName appends the label sequence of a name in presentation format.
+func appendName(dst []byte, name string) ([]byte, error) {
+	sequence, err := encodeDomainName(name)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, sequence...), nil
+}
+
+// checkLength checks that rdata holds exactly the n bytes of fixed-size
+// fields.
+func checkLength(rdata []byte, n int) error {
+	switch {
+	case len(rdata) < n:
+		return errShortMessage
+	case len(rdata) > n:
+		return errTrailingData
+	}
+	return nil
+}
+
+// unpackName sets name from data holding exactly one uncompressed name.
+func unpackName(rdata []byte, name *string) error {
+	sequence, next, err := parseDNSName(nil, rdata, 0)
+	if err != nil {
+		return err
+	}
+	if next != len(rdata) {
+		return errTrailingData
+	}
+	*name = dottedName(sequence)
+	return nil
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net"
+	"testing"
+)
+
+// resourceTests are a resource of each type with its wire form, in hex, and
+// its presentation format.
+var resourceTests = []struct {
+	res  Resource
+	wire string
+	text string
+}{
+	{&AResource{IP: net.IPv4(192, 0, 2, 1)}, "c0000201", "192.0.2.1"},
+	{&AAAAResource{IP: net.ParseIP("2001:db8::1")}, "20010db8000000000000000000000001", "2001:db8::1"},
+	{&NSResource{Host: "ns.example."}, "026e73076578616d706c6500", "ns.example."},
+	{&CNAMEResource{Target: "www.example."}, "03777777076578616d706c6500", "www.example."},
+	{&DNAMEResource{Target: "example.net."}, "076578616d706c65036e657400", "example.net."},
+	{&PTRResource{Target: `a\.b.example.`}, "03612e62076578616d706c6500", `a\.b.example.`},
+	{&MXResource{Preference: 10, Exchange: "mail.example."}, "000a046d61696c076578616d706c6500", "10 mail.example."},
+	{&SRVResource{Priority: 1, Weight: 2, Port: 5060, Target: "sip.example."}, "0001000213c403736970076578616d706c6500", "1 2 5060 sip.example."},
+	{
+		&SOAResource{MName: "ns.example.", RName: "host\\.master.example.", Serial: 1, Refresh: 7200, Retry: 3600, Expire: 1209600, Minimum: 300},
+		"026e73076578616d706c65000b686f73742e6d6173746572076578616d706c65000000000100001c2000000e10001275000000012c",
+		`ns.example. host\.master.example. 1 7200 3600 1209600 300`,
+	},
+	{&TXTResource{Text: []string{"v=spf1 -all", `"\`, "\x00\x7f", ""}}, "0b763d73706631202d616c6c02225c02007f00", `"v=spf1 -all" "\"\\" "\000\127" ""`},
+	{&UnknownResource{RRType: 65280, Data: []byte{0xde, 0xad}}, "dead", `\# 2 dead`},
+	{&UnknownResource{RRType: 65280}, "", `\# 0 `},
+}
+
+func TestResourceRoundTrip(t *testing.T) {
+	for _, tt := range resourceTests {
+		name := typeName(tt.res.Type())
+		wire, err := tt.res.Pack(nil)
+		if err != nil {
+			t.Errorf("%s: pack: %v", name, err)
+			continue
+		}
+		if hex.EncodeToString(wire) != tt.wire {
+			t.Errorf("%s: packed %x, want %s", name, wire, tt.wire)
+		}
+		res := newResource(tt.res.Type())
+		if err := res.Unpack(wire); err != nil {
+			t.Errorf("%s: unpack: %v", name, err)
+			continue
+		}
+		if res.String() != tt.text || tt.res.String() != tt.text {
+			t.Errorf("%s: text %q unpacked and %q packed, want %q", name, res.String(), tt.res.String(), tt.text)
+		}
+		if again, _ := res.Pack([]byte{0xff}); !bytes.Equal(again, append([]byte{0xff}, wire...)) {
+			t.Errorf("%s: repacked %x, want %x after dst", name, again, wire)
+		}
+	}
+}
+
+func TestResourceUnpackInvalid(t *testing.T) {
+	for _, tt := range resourceTests {
+		name := typeName(tt.res.Type())
+		wire, _ := hex.DecodeString(tt.wire)
+		switch tt.res.(type) {
+		case *TXTResource, *UnknownResource:
+			continue // any length, see below
+		}
+		for n := 0; n < len(wire); n++ {
+			if err := newResource(tt.res.Type()).Unpack(wire[:n]); err == nil {
+				t.Errorf("%s: %d of %d bytes unpacked", name, n, len(wire))
+			}
+		}
+		if err := newResource(tt.res.Type()).Unpack(append(wire, 0)); !errors.Is(err, errTrailingData) {
+			t.Errorf("%s: a byte over unpacked with %v, want errTrailingData", name, err)
+		}
+	}
+
+	var txt TXTResource
+	for _, rdata := range []string{"05616263", "0361626302"} {
+		wire, _ := hex.DecodeString(rdata)
+		if err := txt.Unpack(wire); !errors.Is(err, errShortMessage) {
+			t.Errorf("TXT %s unpacked with %v, want errShortMessage", rdata, err)
+		}
+	}
+	// a pointer has nothing to point into within the data
+	if err := new(NSResource).Unpack([]byte{0xc0, 0x00}); err == nil {
+		t.Error("NS of a compression pointer unpacked")
+	}
+	if err := new(NSResource).Unpack([]byte{0x40, 'a', 0}); err == nil {
+		t.Error("NS with a reserved label type unpacked")
+	}
+
+	for _, res := range []Resource{
+		&AResource{IP: net.ParseIP("2001:db8::1")},
+		&AAAAResource{IP: net.IPv4(192, 0, 2, 1)},
+		&NSResource{Host: "a..example."},
+		&TXTResource{},
+		&TXTResource{Text: []string{string(make([]byte, 256))}},
+	} {
+		if wire, err := res.Pack(nil); err == nil {
+			t.Errorf("%s %s packed as %x", typeName(res.Type()), res, wire)
+		}
+	}
+}
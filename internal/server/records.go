@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// defaultRecordTTL is the TTL of local records that don't set one.
+const defaultRecordTTL = 300
+
+// LocalRecords are the records the server answers itself, authoritatively,
+// instead of asking an upstream, e.g. the names of a home network.
+type LocalRecords []DNSResourceRecord
+
+// parseLocalRecord reads a record in zone file order without the class,
+// "name [ttl] type data", e.g. "router.lan A 192.168.1.1",
+// "router.lan 60 TXT living room" or "lan MX 10 mail.lan".
+func parseLocalRecord(spec string) (DNSResourceRecord, error) {
+	fields := strings.Fields(spec)
+	if len(fields) < 3 {
+		return DNSResourceRecord{}, fmt.Errorf("expected name [ttl] type data, got %q", spec)
+	}
+	name, err := encodeDomainName(canonicalName(fields[0]))
+	if err != nil {
+		return DNSResourceRecord{}, err
+	}
+	record := DNSResourceRecord{Name: name, Class: ClassIN, TTL: defaultRecordTTL}
+	fields = fields[1:]
+	if ttl, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+		record.TTL = uint32(ttl)
+		fields = fields[1:]
+		if len(fields) < 2 {
+			return DNSResourceRecord{}, fmt.Errorf("expected name [ttl] type data, got %q", spec)
+		}
+	}
+	qtype, err := parseType(fields[0])
+	if err != nil {
+		return DNSResourceRecord{}, err
+	}
+	record.Type = qtype
+	data := fields[1:]
+
+	var res Resource
+	switch record.Type {
+	case TypeA, TypeAAAA:
+		ip := net.ParseIP(data[0])
+		if len(data) != 1 || ip == nil {
+			return DNSResourceRecord{}, fmt.Errorf("invalid address %q", strings.Join(data, " "))
+		}
+		if ip4 := ip.To4(); record.Type == TypeA && ip4 != nil {
+			res = &AResource{IP: ip4}
+		} else if record.Type == TypeAAAA && ip4 == nil {
+			res = &AAAAResource{IP: ip}
+		} else {
+			return DNSResourceRecord{}, fmt.Errorf("%s is not an address for %s", data[0], typeName(record.Type))
+		}
+	case TypePTR:
+		if len(data) != 1 {
+			return DNSResourceRecord{}, fmt.Errorf("invalid PTR data %q", strings.Join(data, " "))
+		}
+		res = &PTRResource{Target: canonicalName(data[0])}
+	case TypeMX:
+		preference, err := strconv.ParseUint(data[0], 10, 16)
+		if len(data) != 2 || err != nil {
+			return DNSResourceRecord{}, fmt.Errorf("invalid MX data %q, want preference and host", strings.Join(data, " "))
+		}
+		res = &MXResource{Preference: uint16(preference), Exchange: canonicalName(data[1])}
+	case TypeTXT:
+		res = &TXTResource{Text: txtStrings(strings.Join(data, " "))}
+	default:
+		return DNSResourceRecord{}, fmt.Errorf("unsupported record type %s (want A, AAAA, PTR, MX or TXT)", typeName(record.Type))
+	}
+	if record.RData, err = res.Pack(nil); err != nil {
+		return DNSResourceRecord{}, err
+	}
+	record.RDLength = uint16(len(record.RData))
+	return record, nil
+}
+
+// recordFlag adds a local record per -record flag.
+type recordFlag struct {
+	records *LocalRecords
+}
+
+func (f *recordFlag) String() string { return "" }
+
+func (f *recordFlag) Set(value string) error {
+	record, err := parseLocalRecord(value)
+	if err != nil {
+		return err
+	}
+	*f.records = append(*f.records, record)
+	return nil
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeConfig replaces the config file at path with config.
+func writeConfig(t *testing.T, path, config string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// localAnswer asks srv for the A record of name and returns it in dig format,
+// or the rcode when there is no answer.
+func localAnswer(t *testing.T, srv *server, name string) string {
+	t.Helper()
+	var query Msg
+	query.SetQuestion(name, TypeA)
+	r := srv.exchangeTest(t, &query)
+	if len(r.Answers) != 1 {
+		return r.Header.Rcode().String()
+	}
+	return r.Answers[0].String()
+}
+
+func TestReloadSwapsPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	writeConfig(t, path, "[local]\nrecords = [\"host.lan 60 A 10.0.0.1\"]\n")
+	srv := newTestServer(t, "-config", path)
+	before := srv.reload.current.Load()
+
+	writeConfig(t, path, "[local]\nrecords = [\"host.lan 60 A 10.0.0.2\"]\n")
+	// queries answered during the reload see one policy or the other, never
+	// a mix or none
+	var query Msg
+	query.SetQuestion("host.lan", TypeA)
+	data := query.Pack()
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			replies := srv.handleTest(data)
+			if len(replies) != 1 {
+				t.Errorf("%d replies during the reload", len(replies))
+				return
+			}
+			r, _, err := parseDNSResponse(nil, replies[0])
+			if err != nil || len(r.Answers) != 1 || !strings.HasPrefix(r.Answers[0].String(), "host.lan.\t60\tIN\tA\t10.0.0.") {
+				t.Errorf("answer %x during the reload", replies[0])
+				return
+			}
+		}
+	}()
+	err := srv.reload.Reload()
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if srv.reload.current.Load() == before {
+		t.Error("policy not swapped")
+	}
+	if got, want := localAnswer(t, srv, "host.lan"), "host.lan.\t60\tIN\tA\t10.0.0.2"; got != want {
+		t.Errorf("answer %q after the reload, want %q", got, want)
+	}
+}
+
+func TestReloadKeepsPolicyOnInvalidConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	writeConfig(t, path, "[local]\nrecords = [\"host.lan 60 A 10.0.0.1\"]\n")
+	srv := newTestServer(t, "-config", path)
+	before := srv.reload.current.Load()
+
+	for _, config := range []string{
+		"[local]\nrecords = [\"host.lan 60 A 10.0.0.2\", \"bad\"]\n",
+		"[local\nrecords = []\n",
+		"[server]\nmax_inflight = -1\n",
+	} {
+		writeConfig(t, path, config)
+		if err := srv.reload.Reload(); err == nil {
+			t.Errorf("config %q reloaded", config)
+		}
+		if srv.reload.current.Load() != before {
+			t.Fatalf("policy replaced by config %q", config)
+		}
+	}
+	if got, want := localAnswer(t, srv, "host.lan"), "host.lan.\t60\tIN\tA\t10.0.0.1"; got != want {
+		t.Errorf("answer %q after the rejected reloads, want %q", got, want)
+	}
+}
+
+func TestReloadKeepsListenEndpoints(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	writeConfig(t, path, "[server]\nlisten = [\"127.0.0.1:0\"]\n[local]\nrecords = [\"host.lan 60 A 10.0.0.1\"]\n")
+	srv := newTestServer(t, "-config", path)
+	addr := startTestServer(t, srv)
+
+	var log bytes.Buffer
+	if _, err := setupLogging("warn", "text", &log); err != nil {
+		t.Fatal(err)
+	}
+	defer setupLogging("error", "text", io.Discard)
+
+	writeConfig(t, path, "[server]\nlisten = [\"127.0.0.1:1\"]\n[local]\nrecords = [\"host.lan 60 A 10.0.0.2\"]\n")
+	if err := srv.reload.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(log.String(), "option=listen") {
+		t.Errorf("no warning about the changed listen addresses in %q", log.String())
+	}
+	if got := srv.reload.current.Load().opts.listen; len(got) != 1 || got[0].String() != "127.0.0.1:0" {
+		t.Errorf("policy listens on %v, want the bound endpoints", got)
+	}
+
+	// the old socket answers with the new records
+	var query Msg
+	query.SetQuestion("host.lan", TypeA)
+	r, err := (&Client{Timeout: time.Second}).Exchange(context.Background(), &query, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answers) != 1 || r.Answers[0].String() != "host.lan.\t60\tIN\tA\t10.0.0.2" {
+		t.Errorf("answers %v from %s after the reload", r.Answers, addr)
+	}
+
+	// an ACL for an endpoint that isn't bound couldn't be applied
+	writeConfig(t, path, "[server]\nlisten = [\"127.0.0.1:1\"]\n[acl]\nlisten_allow = [\"127.0.0.1:1=10.0.0.0/8\"]\n")
+	if err := srv.reload.Reload(); err == nil {
+		t.Error("reloaded an ACL for an endpoint the server doesn't listen on")
+	}
+}
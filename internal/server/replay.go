@@ -0,0 +1,370 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const replayUsage = `usage: %s replay [flags] capture... [-- server options...]
+
+Replays the queries of captured traffic and compares the responses with the
+ones recorded, to check a change of the codec or the handler against real
+traffic. A capture is a pcap file, e.g. from tcpdump -w, holding UDP and TCP
+DNS traffic, or a directory of raw messages, queries and responses, one per
+file in name order. Queries are paired with the response that followed them
+from the same client with the same ID and question; queries without one are
+counted but not replayed.
+
+The queries are answered by the handler in process, configured by the server
+options after --, with the client addresses of the capture; or sent to a
+running server with -server. Records are compared regardless of their order
+and TTLs are ignored unless -ttl is set, so caching and rotation don't count
+as differences.
+
+Flags:
+`
+
+// runReplay is the replay subcommand. It returns the exit status.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	target := fs.String("server", "", "address of a running server to send the queries to (default: the handler in process)")
+	network := fs.String("net", "", "transport to -server, udp, tcp or tcp-tls (default: the one of the capture)")
+	timeout := fs.Duration("timeout", defaultExchangeTimeout, "how long to wait for a response of -server")
+	port := fs.Int("port", 53, "port of the DNS traffic in pcap captures")
+	ttl := fs.Bool("ttl", false, "compare TTLs too")
+	verbose := fs.Bool("v", false, "print the queries whose responses match too")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), replayUsage, os.Args[0])
+		fs.PrintDefaults()
+	}
+	var serverArgs []string
+	for i, arg := range args {
+		if arg == "--" {
+			args, serverArgs = args[:i], args[i+1:]
+			break
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	var messages []capturedMessage
+	for _, path := range fs.Args() {
+		read, err := readCapture(path, *port)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			return 1
+		}
+		messages = append(messages, read...)
+	}
+	pairs, unanswered := pairExchanges(messages)
+
+	var exchange func(query capturedMessage) ([]byte, error)
+	if *target != "" {
+		client := &Client{Net: *network, Timeout: *timeout}
+		exchange = func(query capturedMessage) ([]byte, error) {
+			return replayToServer(client, query, *target)
+		}
+	} else {
+		// the handler logs every query
+		setupLogging("error", "text", os.Stderr)
+		srv, err := newBareServer(append([]string{"-max-inflight", "0"}, serverArgs...)...)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		exchange = srv.replayToHandler
+	}
+
+	differ, failed := replayPairs(os.Stdout, pairs, exchange, *ttl, *verbose)
+	fmt.Printf("%d queries replayed, %d responses differ, %d failed, %d queries without a recorded response\n",
+		len(pairs), differ, failed, unanswered)
+	if differ > 0 || failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// replayPairs replays the query of every pair through exchange and writes
+// the ones whose response differs from the one recorded to w, with the lines
+// that differ, or that failed, and with verbose the ones that match too. It
+// returns the number of responses that differ and of queries that failed.
+func replayPairs(w io.Writer, pairs []replayPair, exchange func(query capturedMessage) ([]byte, error), ttl, verbose bool) (differ, failed int) {
+	for i, pair := range pairs {
+		client := "-"
+		if pair.query.src != nil {
+			client = pair.query.src.String()
+		}
+		label := fmt.Sprintf("#%d %s %s", i+1, client, replayQuestion(pair.query.msg))
+		replayed, err := exchange(pair.query)
+		if err != nil {
+			fmt.Fprintf(w, "ERROR %s: %v\n", label, err)
+			failed++
+			continue
+		}
+		recorded, now := replayDump(pair.response.msg, ttl), replayDump(replayed, ttl)
+		if recorded == now {
+			if verbose {
+				fmt.Fprintf(w, "ok    %s\n", label)
+			}
+			continue
+		}
+		differ++
+		fmt.Fprintf(w, "DIFF  %s\n--- recorded\n+++ replayed\n%s", label, lineDiff(recorded, now))
+	}
+	return differ, failed
+}
+
+// readCapture returns the messages of a pcap file, or of the files of a
+// directory of raw messages.
+func readCapture(path string, port int) ([]capturedMessage, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return readPcap(file, port)
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var messages []capturedMessage
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) == ".json" {
+			continue // the metadata of a quarantine
+		}
+		msg, err := os.ReadFile(filepath.Join(path, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, capturedMessage{msg: msg})
+	}
+	return messages, nil
+}
+
+// replayPair is a captured query and the response recorded for it.
+type replayPair struct {
+	query, response capturedMessage
+}
+
+// pairExchanges pairs every query with the first response after it with its
+// ID and question going back to its client, and counts the queries left
+// without one. A response without a question, as to a query that didn't
+// parse, goes to the oldest query waiting with its ID. Messages too short for
+// a header are ignored.
+func pairExchanges(messages []capturedMessage) (pairs []replayPair, unanswered int) {
+	type key struct {
+		client string
+		id     uint16
+	}
+	addrString := func(addr net.Addr) string {
+		if addr == nil {
+			return ""
+		}
+		return addr.String()
+	}
+	pending := make(map[key][]int) // indexes in pairs, oldest first
+	var answered []bool
+	for _, m := range messages {
+		if len(m.msg) < 12 {
+			continue
+		}
+		id := binary.BigEndian.Uint16(m.msg)
+		if m.msg[2]&(flagQR>>8) == 0 {
+			k := key{addrString(m.src), id}
+			pending[k] = append(pending[k], len(pairs))
+			pairs = append(pairs, replayPair{query: m})
+			answered = append(answered, false)
+			continue
+		}
+		k := key{addrString(m.dst), id}
+		question := replayQuestionKey(m.msg)
+		for j, i := range pending[k] {
+			if question != "" && replayQuestionKey(pairs[i].query.msg) != question {
+				continue
+			}
+			pairs[i].response = m
+			answered[i] = true
+			if pending[k] = append(pending[k][:j], pending[k][j+1:]...); len(pending[k]) == 0 {
+				delete(pending, k)
+			}
+			break
+		}
+	}
+	kept := pairs[:0]
+	for i, pair := range pairs {
+		if answered[i] {
+			kept = append(kept, pair)
+		} else {
+			unanswered++
+		}
+	}
+	return kept, unanswered
+}
+
+// replayQuestionKey returns the first question of msg as on the wire with
+// the name folded to lower case, which a response repeats from its query, or
+// an empty string when there is none.
+func replayQuestionKey(msg []byte) string {
+	if binary.BigEndian.Uint16(msg[4:]) == 0 {
+		return ""
+	}
+	end, err := skipDNSName(msg, 12)
+	if err != nil || end+4 > len(msg) {
+		return ""
+	}
+	question := []byte(string(msg[12 : end+4]))
+	for i, c := range question[:end-12] {
+		// label lengths are at most 63, below 'A'
+		if 'A' <= c && c <= 'Z' {
+			question[i] = c + 'a' - 'A'
+		}
+	}
+	return string(question)
+}
+
+// replayToHandler answers a captured query in process, as coming from its
+// client in the capture, or from a UDP client of the documentation range when
+// the capture has no addresses.
+func (s *server) replayToHandler(query capturedMessage) ([]byte, error) {
+	source := query.src
+	if source == nil {
+		source = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 53), Port: 53000}
+	}
+	var reply []byte
+	s.handle(context.Background(), query.msg, source, listenEndpoint{}, func(response []byte) error {
+		reply = append([]byte(nil), response...)
+		return nil
+	})
+	if reply == nil {
+		return nil, fmt.Errorf("no response")
+	}
+	return reply, nil
+}
+
+// replayToServer sends a captured query to the server at addr, over the
+// transport it was captured on unless the client has its own.
+func replayToServer(client *Client, query capturedMessage, addr string) ([]byte, error) {
+	m, _, err := parseDNSResponse(nil, query.msg)
+	if err != nil {
+		return nil, fmt.Errorf("query doesn't parse: %w", err)
+	}
+	c := *client
+	if _, ok := query.src.(*net.TCPAddr); ok && c.Net == "" {
+		c.Net = "tcp"
+	}
+	r, err := c.Exchange(context.Background(), &m, addr)
+	if err != nil {
+		return nil, err
+	}
+	return r.Pack(), nil
+}
+
+// replayQuestion describes the first question of a query for the report.
+func replayQuestion(msg []byte) string {
+	m, _, err := parseDNSResponse(nil, msg)
+	if err != nil || len(m.Question) == 0 {
+		return "(no question)"
+	}
+	question := m.Question[0]
+	return dottedName(question.Name) + " " + typeName(question.Type)
+}
+
+// replayDump describes a response for comparison, one line per item with
+// the records of each section sorted.
+func replayDump(msg []byte, ttl bool) string {
+	var dump strings.Builder
+	r, _, err := parseDNSResponse(nil, msg)
+	if err != nil {
+		fmt.Fprintf(&dump, "error: %v\n", err)
+		return dump.String()
+	}
+	fmt.Fprintf(&dump, "header: opcode=%d rcode=%s flags=%s\n", r.Header.Opcode(), r.Header.Rcode(), flagNames(r.Header.Flags))
+	for _, question := range r.Question {
+		fmt.Fprintf(&dump, "question: %s %s %s\n", dottedName(question.Name), className(question.Class), typeName(question.Type))
+	}
+	sections := []struct {
+		name    string
+		records []DNSResourceRecord
+	}{{"answer", r.Answers}, {"authority", r.Authority}, {"additional", r.Additional}}
+	for _, section := range sections {
+		var lines []string
+		for _, record := range section.records {
+			if record.Type == TypeOPT {
+				lines = append(lines, fmt.Sprintf("%s: OPT size=%d %s", section.name, record.Class, replayOptions(record)))
+				continue
+			}
+			line := fmt.Sprintf("%s: %s %s %s %s", section.name, dottedName(record.Name), className(record.Class), typeName(record.Type), rdataText(record))
+			if ttl {
+				line += fmt.Sprintf(" ttl=%d", record.TTL)
+			}
+			lines = append(lines, line)
+		}
+		sort.Strings(lines)
+		for _, line := range lines {
+			dump.WriteString(line + "\n")
+		}
+	}
+	return dump.String()
+}
+
+// replayOptions describes the EDNS flags of an OPT record and the codes of
+// its options, leaving out their data, which like cookies changes from one
+// response to the next.
+func replayOptions(opt DNSResourceRecord) string {
+	desc := fmt.Sprintf("version=%d do=%t", ednsVersion(opt), opt.TTL&ednsFlagDO != 0)
+	for data := opt.RData; len(data) >= 4; {
+		code, length := binary.BigEndian.Uint16(data), int(binary.BigEndian.Uint16(data[2:]))
+		desc += fmt.Sprintf(" option=%d", code)
+		if len(data) < 4+length {
+			break
+		}
+		data = data[4+length:]
+	}
+	return desc
+}
+
+// lineDiff lists the lines of a missing from b with -, then those of b
+// missing from a with +.
+func lineDiff(a, b string) string {
+	count := func(s string) map[string]int {
+		counts := make(map[string]int)
+		for _, line := range strings.SplitAfter(s, "\n") {
+			counts[line]++
+		}
+		return counts
+	}
+	inA, inB := count(a), count(b)
+	var diff strings.Builder
+	for _, line := range strings.SplitAfter(a, "\n") {
+		if line != "" && inB[line] == 0 {
+			diff.WriteString("-" + line)
+		}
+		inB[line]--
+	}
+	for _, line := range strings.SplitAfter(b, "\n") {
+		if line != "" && inA[line] == 0 {
+			diff.WriteString("+" + line)
+		}
+		inA[line]--
+	}
+	return diff.String()
+}
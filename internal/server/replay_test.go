@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// readFixtures returns the messages of the captures in testdata/pcap.
+func readFixtures(t *testing.T, files ...string) []capturedMessage {
+	t.Helper()
+	var messages []capturedMessage
+	for _, file := range files {
+		data, err := os.ReadFile("testdata/pcap/" + file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := readPcap(bytes.NewReader(data), 53)
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, read...)
+	}
+	return messages
+}
+
+func TestPairExchanges(t *testing.T) {
+	for _, tt := range []struct {
+		file       string
+		pairs      []string
+		unanswered int
+	}{
+		// the VLAN query and the two over TCP have no response
+		{"ethernet.pcap", []string{"192.0.2.1:40000 example.com. A"}, 3},
+		{"linux-sll.pcap", []string{"[2001:db8::1]:40000 v6.example. AAAA"}, 0},
+	} {
+		pairs, unanswered := pairExchanges(readFixtures(t, tt.file))
+		var got []string
+		for _, pair := range pairs {
+			got = append(got, pair.query.src.String()+" "+replayQuestion(pair.response.msg))
+		}
+		if strings.Join(got, "\n") != strings.Join(tt.pairs, "\n") || unanswered != tt.unanswered {
+			t.Errorf("%s: pairs %q and %d unanswered, want %q and %d", tt.file, got, unanswered, tt.pairs, tt.unanswered)
+		}
+	}
+
+	client := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+	other := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 40000}
+	server := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 53), Port: 53}
+	query := func(id uint16, name string, from net.Addr) capturedMessage {
+		var m Msg
+		m.SetQuestion(name, TypeA).Header.ID = id
+		return capturedMessage{msg: m.Pack(), src: from, dst: server}
+	}
+	response := func(id uint16, name string, to net.Addr) capturedMessage {
+		var q, m Msg
+		q.SetQuestion(name, TypeA).Header.ID = id
+		m.SetReply(&q)
+		if name == "" {
+			m.Question, m.Header.QDCount = nil, 0
+		}
+		return capturedMessage{msg: m.Pack(), src: server, dst: to}
+	}
+	pairs, unanswered := pairExchanges([]capturedMessage{
+		query(1, "a.example", client),
+		query(1, "b.example", client), // the ID again, for another name
+		response(1, "B.Example", client),
+		response(1, "a.example", client),
+		query(2, "c.example", other),
+		response(2, "c.example", client),    // to another client
+		response(2, "other.example", other), // for another name
+		response(9, "a.example", client),    // to no query
+		{msg: []byte{0, 3, 0, 0, 0}},        // no header
+		query(3, "d.example", client),
+		response(3, "", client), // no question, as for FORMERR
+	})
+	want := []string{"a.example. A > a.example. A", "b.example. A > B.Example. A", "d.example. A > (no question)"}
+	var got []string
+	for _, pair := range pairs {
+		got = append(got, replayQuestion(pair.query.msg)+" > "+replayQuestion(pair.response.msg))
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") || unanswered != 1 {
+		t.Errorf("pairs %q and %d unanswered, want %q and 1", got, unanswered, want)
+	}
+}
+
+func TestReplayDump(t *testing.T) {
+	var query Msg
+	query.SetQuestion("example.com", TypeA)
+	response := func(ttl uint32, addrs ...string) []byte {
+		var m Msg
+		m.SetReply(&query)
+		for _, addr := range addrs {
+			m.AddAnswer(A("example.com", net.ParseIP(addr), ttl))
+		}
+		return m.Pack()
+	}
+	first := response(300, "192.0.2.1", "192.0.2.2")
+	for _, tt := range []struct {
+		other []byte
+		ttl   bool
+		same  bool
+	}{
+		{response(300, "192.0.2.2", "192.0.2.1"), false, true}, // rotated
+		{response(60, "192.0.2.1", "192.0.2.2"), false, true},
+		{response(60, "192.0.2.1", "192.0.2.2"), true, false},
+		{response(300, "192.0.2.1", "192.0.2.2"), true, true},
+		{response(300, "192.0.2.1"), false, false},
+		{response(300, "192.0.2.1", "192.0.2.3"), false, false},
+	} {
+		if same := replayDump(first, tt.ttl) == replayDump(tt.other, tt.ttl); same != tt.same {
+			t.Errorf("dumps\n%s\n%s\nequal %v with ttl %v, want %v", replayDump(first, tt.ttl), replayDump(tt.other, tt.ttl), same, tt.ttl, tt.same)
+		}
+	}
+
+	// the option data of OPT records, like cookies, isn't compared
+	withOption := func(data byte) string {
+		var m Msg
+		m.SetReply(&query)
+		m.Additional = append(m.Additional, DNSResourceRecord{Name: labelSequence("."), Type: TypeOPT, Class: 1232, RDLength: 6, RData: []byte{0, 10, 0, 2, data, data}})
+		m.Header.ARCount = 1
+		return replayDump(m.Pack(), true)
+	}
+	if a, b := withOption(1), withOption(2); a != b || !strings.Contains(a, "additional: OPT size=1232 version=0 do=false option=10\n") {
+		t.Errorf("dumps\n%s\n%s\nwant the same OPT line", a, b)
+	}
+	if dump := replayDump([]byte{0, 1, 2}, false); !strings.HasPrefix(dump, "error: ") {
+		t.Errorf("dump of junk %q", dump)
+	}
+}
+
+func TestLineDiff(t *testing.T) {
+	for _, tt := range []struct {
+		a, b, want string
+	}{
+		{"x\ny\n", "x\ny\n", ""},
+		{"x\ny\n", "y\nx\n", ""},
+		{"x\ny\n", "x\nz\n", "-y\n+z\n"},
+		{"x\nx\n", "x\n", "-x\n"},
+		{"", "x\n", "+x\n"},
+		{"a\nb\n", "c\n", "-a\n-b\n+c\n"},
+	} {
+		if got := lineDiff(tt.a, tt.b); got != tt.want {
+			t.Errorf("lineDiff(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestReplayPairs(t *testing.T) {
+	var address atomic.Value // of the A records
+	upstream := udpResponder(t, func(query *Msg) []*Msg {
+		var m Msg
+		m.SetReply(query)
+		name := domainName(query.Question[0].Name)
+		if query.Question[0].Type == TypeAAAA {
+			m.AddAnswer(AAAA(name, net.ParseIP("2001:db8::10"), 60))
+		} else {
+			m.AddAnswer(A(name, address.Load().(net.IP), 60))
+		}
+		return []*Msg{&m}
+	})
+	srv := newTestServer(t, "-resolver", upstream)
+	pairs, _ := pairExchanges(readFixtures(t, "ethernet.pcap", "linux-sll.pcap"))
+
+	for _, tt := range []struct {
+		address string
+		ttl     bool
+		verbose bool
+		differ  int
+		want    string
+	}{
+		{"192.0.2.10", false, false, 0, ""},
+		{"192.0.2.10", false, true, 0, "ok    #1 192.0.2.1:40000 example.com. A\nok    #2 [2001:db8::1]:40000 v6.example. AAAA\n"},
+		{"192.0.2.11", false, true, 1, "DIFF  #1 192.0.2.1:40000 example.com. A\n--- recorded\n+++ replayed\n" +
+			"-answer: example.com. IN A 192.0.2.10\n+answer: example.com. IN A 192.0.2.11\n" +
+			"ok    #2 [2001:db8::1]:40000 v6.example. AAAA\n"},
+		// the capture has TTLs of 300
+		{"192.0.2.10", true, false, 2, "DIFF  #1 192.0.2.1:40000 example.com. A\n--- recorded\n+++ replayed\n" +
+			"-answer: example.com. IN A 192.0.2.10 ttl=300\n+answer: example.com. IN A 192.0.2.10 ttl=60\n" +
+			"DIFF  #2 [2001:db8::1]:40000 v6.example. AAAA\n--- recorded\n+++ replayed\n" +
+			"-answer: v6.example. IN AAAA 2001:db8::10 ttl=300\n+answer: v6.example. IN AAAA 2001:db8::10 ttl=60\n"},
+	} {
+		address.Store(net.ParseIP(tt.address))
+		var out bytes.Buffer
+		differ, failed := replayPairs(&out, pairs, srv.replayToHandler, tt.ttl, tt.verbose)
+		if differ != tt.differ || failed != 0 || out.String() != tt.want {
+			t.Errorf("%s, ttl %v: %d differ, %d failed:\n%s\nwant %d differ:\n%s", tt.address, tt.ttl, differ, failed, out.String(), tt.differ, tt.want)
+		}
+	}
+
+	var out bytes.Buffer
+	differ, failed := replayPairs(&out, pairs[:1], func(capturedMessage) ([]byte, error) {
+		return nil, errors.New("no response")
+	}, false, false)
+	if differ != 0 || failed != 1 || out.String() != "ERROR #1 192.0.2.1:40000 example.com. A: no response\n" {
+		t.Errorf("%d differ, %d failed: %q", differ, failed, out.String())
+	}
+}
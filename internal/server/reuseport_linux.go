@@ -0,0 +1,22 @@
+package server
+
+import "syscall"
+
+// soReusePort is SO_REUSEPORT, which package syscall leaves out on Linux.
+const soReusePort = 0xf
+
+// reusePortSupported reports whether the kernel spreads the datagrams of a
+// port across the sockets sharing it, which only Linux does.
+const reusePortSupported = true
+
+// setReusePort is a net.ListenConfig Control function turning SO_REUSEPORT on.
+func setReusePort(network, address string, conn syscall.RawConn) error {
+	var sockErr error
+	err := conn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"syscall"
+)
+
+const reusePortSupported = false
+
+func setReusePort(network, address string, conn syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT load balancing needs Linux")
+}
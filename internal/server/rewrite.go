@@ -0,0 +1,148 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RewriteRule maps a queried zone onto another one, e.g. example.com to
+// internal.example.lan, so www.example.com is resolved as
+// www.internal.example.lan and the answers are renamed back.
+type RewriteRule struct {
+	From Name
+	To   Name
+}
+
+// replaceSuffix swaps the zone suffix from of name for to. name must be in
+// the from zone. The result may be too long to be a name.
+func replaceSuffix(name, from, to Name) Name {
+	return name[:len(name)-len(from)] + to
+}
+
+// Restore maps a name from the rewritten zone back to the queried one. The
+// target zone is matched in any case and the labels in front of it keep
+// theirs. Names outside the target zone are returned unchanged.
+func (r *RewriteRule) Restore(name string) string {
+	sequence, err := encodeDomainName(name)
+	if err != nil || !NameFromWire(sequence).IsSubdomainOf(r.To) {
+		return name
+	}
+	// lowercasing keeps the length, so the suffix is as long as r.To
+	prefix := sequence[:len(sequence)-len(r.To)]
+	return domainName(append(prefix, r.From...))
+}
+
+// restoreRewrites moves the names of a packed response back from the zones
+// the rewrite stage moved the questions to: the question to the one asked,
+// and the owners and the names in the data of the records of every section,
+// so a CNAME chain or the SOA of a negative answer read as in the zone asked
+// about.
+func (q *query) restoreRewrites(data []byte) []byte {
+	response, _, err := parseDNSResponse(nil, data)
+	if err != nil {
+		return data
+	}
+	if len(response.Question) == len(q.questions) {
+		response.Question = q.questions
+	}
+	for _, records := range [][]DNSResourceRecord{response.Answers, response.Authority, response.Additional} {
+		for i := range records {
+			records[i] = q.restoreRecord(records[i])
+		}
+	}
+	return response.Pack()
+}
+
+// restoreRecord moves the owner of record and the names in its data back to
+// the zone asked about. Owners that are the name asked keep its case.
+func (q *query) restoreRecord(record DNSResourceRecord) DNSResourceRecord {
+	if name, err := encodeDomainName(q.restoreName(domainName(record.Name))); err == nil {
+		record.Name = name
+		for _, question := range q.questions {
+			if equalNames(name, question.Name) {
+				record.Name = question.Name
+				break
+			}
+		}
+	}
+	res, err := record.Resource()
+	if err != nil {
+		return record
+	}
+	switch res := res.(type) {
+	case *CNAMEResource:
+		res.Target = q.restoreName(res.Target)
+	case *DNAMEResource:
+		res.Target = q.restoreName(res.Target)
+	case *PTRResource:
+		res.Target = q.restoreName(res.Target)
+	case *NSResource:
+		res.Host = q.restoreName(res.Host)
+	case *MXResource:
+		res.Exchange = q.restoreName(res.Exchange)
+	case *SRVResource:
+		res.Target = q.restoreName(res.Target)
+	case *SOAResource:
+		res.MName, res.RName = q.restoreName(res.MName), q.restoreName(res.RName)
+	default:
+		return record
+	}
+	// a name too long once moved back stays in the target zone
+	if rdata, err := res.Pack(nil); err == nil && len(rdata) <= 0xFFFF {
+		record.RData, record.RDLength = rdata, uint16(len(rdata))
+	}
+	return record
+}
+
+// restoreName moves name back by the first rewrite applied to the query
+// whose target zone holds it.
+func (q *query) restoreName(name string) string {
+	n, err := ParseName(name)
+	if err != nil {
+		return name
+	}
+	for _, rule := range q.rewrites {
+		if n.IsSubdomainOf(rule.To) {
+			return rule.Restore(name)
+		}
+	}
+	return name
+}
+
+// Rewriter holds rewrite rules keyed by the zone they apply to; the most
+// specific zone wins.
+type Rewriter map[Name]*RewriteRule
+
+// Rewrite returns the name to resolve instead of name and the rule that was
+// applied, or nil when no rule matches.
+func (r Rewriter) Rewrite(name Name) (Name, *RewriteRule) {
+	rule, ok := closestZone(name, r)
+	if !ok {
+		return name, nil
+	}
+	return replaceSuffix(name, rule.From, rule.To), rule
+}
+
+// rewriteFlag collects repeated "from=to" flag values into a Rewriter.
+type rewriteFlag struct {
+	rewriter Rewriter
+}
+
+func (f *rewriteFlag) String() string { return "" }
+
+func (f *rewriteFlag) Set(value string) error {
+	from, to, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected from=to, got %q", value)
+	}
+	fromZone, err := ParseName(from)
+	if err != nil {
+		return err
+	}
+	toZone, err := ParseName(to)
+	if err != nil {
+		return err
+	}
+	f.rewriter[fromZone] = &RewriteRule{From: fromZone, To: toZone}
+	return nil
+}
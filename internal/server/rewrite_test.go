@@ -0,0 +1,192 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRewriteRestoresNamesInRecordData(t *testing.T) {
+	srv := newTestServer(t, "-rewrite", "example.com=internal.lan")
+	zone := srv.Zone("internal.lan")
+	zone.AddCNAME("www", "host", 60)
+	zone.AddA("host", net.IPv4(10, 0, 0, 1), 60)
+
+	var query Msg
+	query.SetQuestion("WWW.Example.com", TypeA)
+	r := srv.exchangeTest(t, &query)
+	want := []string{
+		"WWW.Example.com.\t60\tIN\tCNAME\thost.example.com.",
+		"host.example.com.\t60\tIN\tA\t10.0.0.1",
+	}
+	if len(r.Answers) != len(want) {
+		t.Fatalf("answers %v, want %q", r.Answers, want)
+	}
+	for i, record := range r.Answers {
+		if record.String() != want[i] {
+			t.Errorf("answer %d is %q, want %q", i, record.String(), want[i])
+		}
+	}
+	if got := domainName(r.Question[0].Name); got != "WWW.Example.com" {
+		t.Errorf("question %q, want it as asked", got)
+	}
+}
+
+func TestRewriteKeepsNegativeAnswerSOA(t *testing.T) {
+	upstream := udpResponder(t, func(query *Msg) []*Msg {
+		if got := domainName(query.Question[0].Name); got != "gone.internal.lan" {
+			t.Errorf("upstream asked for %q, want gone.internal.lan", got)
+		}
+		soa, err := NewRecord("internal.lan", 300, &SOAResource{MName: "ns.internal.lan", RName: "hostmaster.internal.lan", Serial: 1, Minimum: 60})
+		if err != nil {
+			t.Error(err)
+		}
+		var m Msg
+		m.SetReply(query).SetRcode(RcodeNXDomain).AddAuthority(soa)
+		return []*Msg{&m}
+	})
+	srv := newTestServer(t, "-rewrite", "example.com=internal.lan", "-resolver", upstream)
+
+	var query Msg
+	query.SetQuestion("gone.example.com", TypeA)
+	r := srv.exchangeTest(t, &query)
+	if r.Header.Rcode() != RcodeNXDomain {
+		t.Errorf("rcode %v, want NXDOMAIN", r.Header.Rcode())
+	}
+	want := "example.com.\t300\tIN\tSOA\tns.example.com. hostmaster.example.com. 1 0 0 0 60"
+	if len(r.Authority) != 1 || r.Authority[0].String() != want {
+		t.Errorf("authority %v, want %q", r.Authority, want)
+	}
+}
+
+func TestRewriteKeepsBlockedNamesBlocked(t *testing.T) {
+	upstream := udpResponder(t, func(query *Msg) []*Msg {
+		a, err := NewRecord(domainName(query.Question[0].Name), 60, &AResource{IP: net.IPv4(10, 0, 0, 1)})
+		if err != nil {
+			t.Error(err)
+		}
+		var m Msg
+		m.SetReply(query).AddAnswer(a)
+		return []*Msg{&m}
+	})
+	// filter runs after the rewrite by default, and before it here
+	for _, pipeline := range []string{defaultPipeline, "acl,ratelimit,tunnel,policy,hooks,plugins,filter,rewrite,handlers,local"} {
+		for _, blocked := range []string{"www.example.com", "www.internal.lan"} {
+			srv := newTestServer(t, "-rewrite", "example.com=internal.lan", "-block-domain", blocked, "-pipeline", pipeline, "-resolver", upstream)
+
+			var query Msg
+			query.SetQuestion("www.example.com", TypeA)
+			r := srv.exchangeTest(t, &query)
+			if r.Header.Rcode() != RcodeNXDomain || len(r.Answers) != 0 {
+				t.Errorf("pipeline %s with %s blocked: rcode %v and answers %v, want NXDOMAIN", pipeline, blocked, r.Header.Rcode(), r.Answers)
+			}
+			entries := srv.audit.Recent("", "", 10)
+			if len(entries) != 1 || entries[0].Name != blocked {
+				t.Errorf("pipeline %s with %s blocked: audited %v", pipeline, blocked, entries)
+			}
+		}
+	}
+}
+
+func TestRewriter(t *testing.T) {
+	rewriter := Rewriter{}
+	for _, value := range []string{"example.com=internal.lan", "Deep.Example.COM.=deep.lan", `a\.b.example.com=dotted.lan`, "lab=."} {
+		if err := (&rewriteFlag{rewriter: rewriter}).Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, value := range []string{"example.com", "bad..zone=internal.lan", "example.com=bad..zone"} {
+		if err := (&rewriteFlag{rewriter: Rewriter{}}).Set(value); err == nil {
+			t.Errorf("%q accepted", value)
+		}
+	}
+
+	for _, tt := range []struct {
+		name, want string // want is empty for no rule
+	}{
+		{"example.com", "internal.lan"},
+		{"WWW.Example.com", "www.internal.lan"},
+		{"x.deep.example.com", "x.deep.lan"}, // the longest zone wins
+		{`x.a\.b.example.com`, "x.dotted.lan"},
+		{"x.a.b.example.com", "x.a.b.internal.lan"}, // the dot is no label boundary
+		{"host.lab", "host"},
+		{"notexample.com", ""},
+	} {
+		got, rule := rewriter.Rewrite(mustParseName(tt.name))
+		if tt.want == "" {
+			if rule != nil || got != mustParseName(tt.name) {
+				t.Errorf("%s rewritten to %s", tt.name, got)
+			}
+			continue
+		}
+		if rule == nil || got != mustParseName(tt.want) {
+			t.Errorf("%s rewritten to %s, want %s", tt.name, got, tt.want)
+			continue
+		}
+		if restored := rule.Restore(domainName(got.Wire())); mustParseName(restored) != mustParseName(tt.name) {
+			t.Errorf("%s restored to %s, want %s", got, restored, tt.name)
+		}
+	}
+}
+
+func TestRewriteRuleRestore(t *testing.T) {
+	rule := &RewriteRule{From: mustParseName("example.com"), To: mustParseName("internal.lan")}
+	for _, tt := range []struct {
+		name, want string
+	}{
+		{"host.internal.lan", "host.example.com"},
+		{"WWW.Host.Internal.LAN", "WWW.Host.example.com"},
+		{"internal.lan", "example.com"},
+		{`A\.b.internal.lan`, `A\.b.example.com`},
+		{"CDN.Provider.NET", "CDN.Provider.NET"}, // out of zone, untouched
+		{"notinternal.lan", "notinternal.lan"},
+		{"bad..name", "bad..name"},
+	} {
+		if got := rule.Restore(tt.name); got != tt.want {
+			t.Errorf("%s restored to %s, want %s", tt.name, got, tt.want)
+		}
+	}
+	root := &RewriteRule{From: mustParseName("lab"), To: RootName}
+	if got := root.Restore("Host"); got != "Host.lab" {
+		t.Errorf("Host restored from the root to %s, want Host.lab", got)
+	}
+}
+
+func TestRewriteKeepsCaseOfRestoredNames(t *testing.T) {
+	upstream := udpResponder(t, func(query *Msg) []*Msg {
+		var m Msg
+		m.SetReply(query)
+		for _, record := range []struct {
+			name     string
+			resource Resource
+		}{
+			{"Www.Internal.LAN", &CNAMEResource{Target: "Edge.Internal.LAN"}},
+			{"Edge.Internal.LAN", &CNAMEResource{Target: "Edge.CDN.Example.NET"}},
+			{"Edge.CDN.Example.NET", &AResource{IP: net.IPv4(10, 0, 0, 1)}},
+		} {
+			rr, err := NewRecord(record.name, 60, record.resource)
+			if err != nil {
+				t.Error(err)
+			}
+			m.AddAnswer(rr)
+		}
+		return []*Msg{&m}
+	})
+	srv := newTestServer(t, "-rewrite", "example.com=internal.lan", "-resolver", upstream)
+
+	var query Msg
+	query.SetQuestion("www.example.com", TypeA)
+	r := srv.exchangeTest(t, &query)
+	want := []string{
+		"www.example.com.\t60\tIN\tCNAME\tEdge.example.com.",
+		"Edge.example.com.\t60\tIN\tCNAME\tEdge.CDN.Example.NET.",
+		"Edge.CDN.Example.NET.\t60\tIN\tA\t10.0.0.1",
+	}
+	if len(r.Answers) != len(want) {
+		t.Fatalf("answers %v, want %q", r.Answers, want)
+	}
+	for i, record := range r.Answers {
+		if record.String() != want[i] {
+			t.Errorf("answer %d is %q, want %q", i, record.String(), want[i])
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AdminRules are block and allow rules added at runtime from the admin API
+// or the dashboard. They apply to every group with filtering on, ahead of the
+// group's own rules and the blocklists, and survive reloads. With a file they
+// are saved to it on every change and read back at startup, one
+// "block rule" or "allow rule" per line.
+type AdminRules struct {
+	mu    sync.Mutex
+	path  string
+	rules []*FilterRule
+}
+
+// LoadAdminRules reads the rules of path, which need not exist yet. An empty
+// path keeps the rules in memory only.
+func LoadAdminRules(path string) (*AdminRules, error) {
+	rules := &AdminRules{path: path}
+	if path == "" {
+		return rules, nil
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return rules, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		action, source, _ := strings.Cut(text, " ")
+		rule, err := parseAdminRule(action, strings.TrimSpace(source))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		rules.rules = append(rules.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := checkRegexBudget(rules.rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return rules, nil
+}
+
+func parseAdminRule(action, source string) (*FilterRule, error) {
+	switch action {
+	case "block":
+		return parseFilterRule(FilterBlock, source)
+	case "allow":
+		return parseFilterRule(FilterAllow, source)
+	}
+	return nil, fmt.Errorf("unknown rule action %q (want block or allow)", action)
+}
+
+// Check reports whether name is blocked by the rules at now and the rule that
+// decided it, nil when none matches. An allow rule overrides block rules.
+func (a *AdminRules) Check(name string, now time.Time) (bool, *FilterRule) {
+	if a == nil {
+		return false, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.rules) == 0 {
+		return false, nil
+	}
+	return (&Filter{Rules: a.rules}).Check(name, now)
+}
+
+// Add adds a rule unless it is there already, and saves the rules.
+func (a *AdminRules) Add(action, source string) error {
+	rule, err := parseAdminRule(action, source)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, other := range a.rules {
+		if other.Action == rule.Action && other.Source == rule.Source {
+			return nil
+		}
+	}
+	if err := checkRegexBudget(append(a.rules[:len(a.rules):len(a.rules)], rule)); err != nil {
+		return err
+	}
+	a.rules = append(a.rules, rule)
+	if err := a.save(); err != nil {
+		a.rules = a.rules[:len(a.rules)-1]
+		return fmt.Errorf("failed to save the rules: %w", err)
+	}
+	return nil
+}
+
+// Remove removes a rule and saves the rules. It reports whether the rule was
+// there.
+func (a *AdminRules) Remove(action, source string) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, rule := range a.rules {
+		if rule.Action.String() == action && rule.Source == source {
+			rules := a.rules
+			a.rules = append(rules[:i:i], rules[i+1:]...)
+			if err := a.save(); err != nil {
+				a.rules = rules
+				return true, fmt.Errorf("failed to save the rules: %w", err)
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// save writes the rules to the file, replacing it in one step.
+func (a *AdminRules) save() error {
+	if a.path == "" {
+		return nil
+	}
+	var b strings.Builder
+	b.WriteString("# block and allow rules added from the admin API, rewritten on every change\n")
+	for _, rule := range a.rules {
+		fmt.Fprintf(&b, "%s %s\n", rule.Action, rule.Source)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(a.path), filepath.Base(a.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), a.path)
+}
+
+// List returns the sources of the block and the allow rules.
+func (a *AdminRules) List() map[string][]string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	list := map[string][]string{"block": {}, "allow": {}}
+	for _, rule := range a.rules {
+		list[rule.Action.String()] = append(list[rule.Action.String()], rule.Source)
+	}
+	return list
+}
+
+// ServeHTTP lists the rules on GET, adds ?action=block|allow&rule= on POST
+// and removes it on DELETE.
+func (a *AdminRules) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	action, source := r.FormValue("action"), strings.TrimSpace(r.FormValue("rule"))
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		if err := a.Add(action, source); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		found, err := a.Remove(action, source)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, fmt.Sprintf("no %s rule %q", action, source), http.StatusNotFound)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, a.List())
+}
@@ -0,0 +1,73 @@
+package server
+
+import "net"
+
+const safeSearchTTL = 300
+
+// googleDomains are the Google search front ends that honour the
+// forcesafesearch.google.com virtual IP.
+var googleDomains = []string{
+	"google.com", "google.ad", "google.ae", "google.at", "google.be", "google.bg",
+	"google.ca", "google.ch", "google.cl", "google.co.id", "google.co.il", "google.co.in",
+	"google.co.jp", "google.co.kr", "google.co.nz", "google.co.th", "google.co.uk",
+	"google.co.za", "google.com.ar", "google.com.au", "google.com.br", "google.com.co",
+	"google.com.eg", "google.com.hk", "google.com.mx", "google.com.my", "google.com.ng",
+	"google.com.pe", "google.com.ph", "google.com.pk", "google.com.sa", "google.com.sg",
+	"google.com.tr", "google.com.tw", "google.com.ua", "google.com.vn", "google.cz",
+	"google.de", "google.dk", "google.es", "google.fi", "google.fr", "google.gr",
+	"google.hu", "google.ie", "google.it", "google.lt", "google.lv", "google.nl",
+	"google.no", "google.pl", "google.pt", "google.ro", "google.rs", "google.ru",
+	"google.se", "google.sk",
+}
+
+// safeSearchTargets maps search and video front ends to the hostnames that
+// serve their restricted modes.
+var safeSearchTargets = func() map[string]string {
+	targets := map[string]string{
+		"www.youtube.com":          "restrict.youtube.com",
+		"m.youtube.com":            "restrict.youtube.com",
+		"youtubei.googleapis.com":  "restrict.youtube.com",
+		"youtube.googleapis.com":   "restrict.youtube.com",
+		"www.youtube-nocookie.com": "restrict.youtube.com",
+		"www.bing.com":             "strict.bing.com",
+		"duckduckgo.com":           "safe.duckduckgo.com",
+		"www.duckduckgo.com":       "safe.duckduckgo.com",
+	}
+	for _, domain := range googleDomains {
+		targets[domain] = "forcesafesearch.google.com"
+		targets["www."+domain] = "forcesafesearch.google.com"
+	}
+	return targets
+}()
+
+// SafeSearch forces the restricted modes of search engines and YouTube by
+// answering their names with a CNAME to the enforcing hostname, resolved
+// upstream so the client gets that hostname's addresses.
+type SafeSearch struct {
+	Enabled bool
+	Clients []*net.IPNet // nil applies to every client
+}
+
+// Applies reports whether safe search is enforced for the client.
+func (s *SafeSearch) Applies(ip net.IP) bool {
+	return s != nil && s.Enabled && (&ACL{Allow: s.Clients}).Permits(ip)
+}
+
+// safeSearchTarget returns the hostname to resolve instead of name.
+func safeSearchTarget(name string) (string, bool) {
+	target, ok := safeSearchTargets[canonicalName(name)]
+	return target, ok
+}
+
+// safeSearchCNAME is the answer that points the queried name at target.
+func safeSearchCNAME(name []byte, target string) DNSResourceRecord {
+	rdata := packResource(&CNAMEResource{Target: target})
+	return DNSResourceRecord{
+		Name:     name,
+		Type:     TypeCNAME,
+		Class:    ClassIN,
+		TTL:      safeSearchTTL,
+		RDLength: uint16(len(rdata)),
+		RData:    rdata,
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestSafeSearchTarget(t *testing.T) {
+	for name, want := range map[string]string{
+		"www.google.com":          "forcesafesearch.google.com",
+		"google.co.uk":            "forcesafesearch.google.com",
+		"WWW.Google.DE.":          "forcesafesearch.google.com",
+		"www.youtube.com":         "restrict.youtube.com",
+		"youtubei.googleapis.com": "restrict.youtube.com",
+		"www.bing.com":            "strict.bing.com",
+		"duckduckgo.com":          "safe.duckduckgo.com",
+		"maps.google.com":         "",
+		"bing.com":                "",
+		"www.google.com.evil":     "",
+		"example.com":             "",
+	} {
+		target, ok := safeSearchTarget(name)
+		if ok != (want != "") || target != want {
+			t.Errorf("safeSearchTarget(%q) = %q, %v, want %q", name, target, ok, want)
+		}
+	}
+
+	_, clients, _ := net.ParseCIDR("10.0.1.0/24")
+	for _, tt := range []struct {
+		s    *SafeSearch
+		ip   string
+		want bool
+	}{
+		{nil, "10.0.1.1", false},
+		{&SafeSearch{}, "10.0.1.1", false},
+		{&SafeSearch{Enabled: true}, "192.0.2.1", true},
+		{&SafeSearch{Enabled: true, Clients: []*net.IPNet{clients}}, "10.0.1.1", true},
+		{&SafeSearch{Enabled: true, Clients: []*net.IPNet{clients}}, "10.0.2.1", false},
+	} {
+		if got := tt.s.Applies(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("%+v applies to %s %v, want %v", tt.s, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestSafeSearchAnswers(t *testing.T) {
+	var mu sync.Mutex
+	var asked []string
+	upstream := udpResponder(t, func(query *Msg) []*Msg {
+		name := domainName(query.Question[0].Name)
+		mu.Lock()
+		asked = append(asked, name)
+		mu.Unlock()
+		var m Msg
+		m.SetReply(query).AddAnswer(A(name, net.IPv4(203, 0, 113, 7), 60))
+		return []*Msg{&m}
+	})
+	client := testClient.IP.String()
+	for _, tt := range []struct {
+		args   []string
+		name   string
+		forced bool
+	}{
+		{[]string{"-safe-search"}, "www.google.com", true},
+		{[]string{"-safe-search"}, "WWW.YouTube.com", true},
+		{[]string{"-safe-search"}, "maps.google.com", false},
+		{[]string{}, "www.google.com", false},
+		{[]string{"-safe-search", "-safe-search-clients", client + "/32"}, "www.bing.com", true},
+		{[]string{"-safe-search", "-safe-search-clients", "10.0.0.0/8"}, "www.bing.com", false},
+		// groups override the flag both ways
+		{[]string{"-group", "name=kids clients=" + client + " safe-search=on"}, "duckduckgo.com", true},
+		{[]string{"-safe-search", "-group", "name=adults clients=" + client + " safe-search=off"}, "duckduckgo.com", false},
+	} {
+		srv := newTestServer(t, append([]string{"-resolver", upstream}, tt.args...)...)
+		mu.Lock()
+		asked = nil
+		mu.Unlock()
+		var query Msg
+		query.SetQuestion(tt.name, TypeA)
+		r := srv.exchangeTest(t, &query)
+		mu.Lock()
+		upstreamAsked := append([]string(nil), asked...)
+		mu.Unlock()
+
+		target, _ := safeSearchTarget(tt.name)
+		if !tt.forced {
+			if len(r.Answers) != 1 || r.Answers[0].Type != TypeA || len(upstreamAsked) != 1 || upstreamAsked[0] != canonicalName(tt.name) {
+				t.Errorf("%v %s: answers %v, upstream asked %v, want it forwarded as is", tt.args, tt.name, r.Answers, upstreamAsked)
+			}
+			continue
+		}
+		// the CNAME keeps the name as asked and the upstream resolves
+		// the target in its place
+		if len(r.Answers) != 2 || r.Answers[0].Type != TypeCNAME || domainName(r.Answers[0].Name) != tt.name {
+			t.Errorf("%v %s: answers %v, want a CNAME then the target's address", tt.args, tt.name, r.Answers)
+			continue
+		}
+		cname, err := r.Answers[0].Resource()
+		if err != nil || cname.String() != target+"." || domainName(r.Answers[1].Name) != target {
+			t.Errorf("%v %s: answers %v, want them for %s", tt.args, tt.name, r.Answers, target)
+		}
+		if len(upstreamAsked) != 1 || upstreamAsked[0] != target {
+			t.Errorf("%v %s: upstream asked %v, want only %s", tt.args, tt.name, upstreamAsked, target)
+		}
+	}
+}
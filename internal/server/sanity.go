@@ -0,0 +1,44 @@
+package server
+
+// rejectReason is why a packet failed the header checks of checkHeader.
+type rejectReason int
+
+const (
+	rejectShort    rejectReason = iota // shorter than a header
+	rejectResponse                     // QR set, a response or a reflection of one
+	rejectCounts                       // more questions and records than the packet can hold
+)
+
+// rejectReasons are the names of the reasons in the stats, by reason.
+var rejectReasons = [...]string{
+	rejectShort:    "short",
+	rejectResponse: "response",
+	rejectCounts:   "counts",
+}
+
+func (r rejectReason) String() string { return rejectReasons[r] }
+
+// countsFit reports whether a message of size bytes can hold the questions
+// and records its header counts, each at its smallest.
+func countsFit(header DNSHeader, size int) bool {
+	records := int(header.ANCount) + int(header.NSCount) + int(header.ARCount)
+	return 12+int(header.QDCount)*minQuestionSize+records*minRecordSize <= size
+}
+
+// checkHeader looks at the header of a packet received on a query socket
+// before anything is parsed or allocated for it, and reports false with the
+// reason when the packet is not worth an answer: it can't be a query, and
+// answering junk or a response only makes the server a reflector or starts a
+// loop with another server.
+func checkHeader(msg []byte) (rejectReason, bool) {
+	header, err := parseDNSHeader(msg)
+	switch {
+	case err != nil:
+		return rejectShort, false
+	case header.Flags&flagQR != 0:
+		return rejectResponse, false
+	case !countsFit(header, len(msg)):
+		return rejectCounts, false
+	}
+	return 0, true
+}
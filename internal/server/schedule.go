@@ -0,0 +1,129 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// timeRange is a span of the day in minutes since midnight. A range whose end
+// is before its start runs past midnight into the next day.
+type timeRange struct {
+	start, end int
+}
+
+// Schedule says when a rule is in force: on the listed days, during any of
+// the time ranges. A range that crosses midnight belongs to the day it starts
+// on, so "sun-thu 21:00-07:00" covers Monday 02:00 but not Saturday 02:00.
+type Schedule struct {
+	Days   [7]bool
+	Ranges []timeRange
+}
+
+// Active reports whether the schedule is in force at t. A nil schedule is
+// always active.
+func (s *Schedule) Active(t time.Time) bool {
+	if s == nil {
+		return true
+	}
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	yesterday := (day + 6) % 7
+	if len(s.Ranges) == 0 {
+		return s.Days[day]
+	}
+	for _, r := range s.Ranges {
+		if r.start <= r.end {
+			if s.Days[day] && minute >= r.start && minute < r.end {
+				return true
+			}
+			continue
+		}
+		if s.Days[day] && minute >= r.start {
+			return true
+		}
+		if s.Days[yesterday] && minute < r.end {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSchedule parses "days [times]", where days is a comma separated list
+// of day names or ranges (mon,wed or sun-thu, or daily, weekdays, weekends)
+// and times a comma separated list of HH:MM-HH:MM ranges.
+func parseSchedule(s string) (*Schedule, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid schedule %q, want \"days [HH:MM-HH:MM]\"", s)
+	}
+	schedule := &Schedule{}
+	for _, item := range strings.Split(strings.ToLower(fields[0]), ",") {
+		switch item {
+		case "daily", "all":
+			item = "sun-sat"
+		case "weekdays":
+			item = "mon-fri"
+		case "weekends":
+			item = "sat,sun"
+		}
+		for _, part := range strings.Split(item, ",") {
+			first, last, isRange := strings.Cut(part, "-")
+			if !isRange {
+				last = first
+			}
+			from, ok := weekdays[first]
+			to, ok2 := weekdays[last]
+			if !ok || !ok2 {
+				return nil, fmt.Errorf("invalid day %q in schedule %q", part, s)
+			}
+			for day := from; ; day = (day + 1) % 7 {
+				schedule.Days[day] = true
+				if day == to {
+					break
+				}
+			}
+		}
+	}
+	if len(fields) == 2 {
+		for _, item := range strings.Split(fields[1], ",") {
+			first, last, ok := strings.Cut(item, "-")
+			if !ok {
+				return nil, fmt.Errorf("invalid time range %q in schedule %q", item, s)
+			}
+			start, err := parseClock(first)
+			if err != nil {
+				return nil, err
+			}
+			end, err := parseClock(last)
+			if err != nil {
+				return nil, err
+			}
+			schedule.Ranges = append(schedule.Ranges, timeRange{start: start, end: end})
+		}
+	}
+	return schedule, nil
+}
+
+// parseClock converts HH:MM to minutes since midnight; 24:00 is allowed as the
+// end of the day.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		if s == "24:00" {
+			return 24 * 60, nil
+		}
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduleActive(t *testing.T) {
+	// 2024-03-03 is a Sunday
+	tests := []struct {
+		schedule string
+		at       string
+		active   bool
+	}{
+		{"sun-thu 21:00-07:00", "2024-03-03T21:00:00Z", true},
+		{"sun-thu 21:00-07:00", "2024-03-03T20:59:00Z", false},
+		{"sun-thu 21:00-07:00", "2024-03-04T02:00:00Z", true},  // Sunday night
+		{"sun-thu 21:00-07:00", "2024-03-04T07:00:00Z", false}, // the end is excluded
+		{"sun-thu 21:00-07:00", "2024-03-08T02:00:00Z", true},  // Thursday night
+		{"sun-thu 21:00-07:00", "2024-03-08T21:00:00Z", false},
+		{"sun-thu 21:00-07:00", "2024-03-09T02:00:00Z", false}, // Friday night
+		{"sun-thu 21:00-07:00", "2024-03-03T02:00:00Z", false}, // Saturday night
+		{"mon 22:00-02:00", "2024-03-05T01:59:00Z", true},
+		{"mon 22:00-02:00", "2024-03-05T02:00:00Z", false},
+		{"mon 22:00-02:00", "2024-03-04T01:00:00Z", false},
+		{"weekdays 08:00-12:00,13:00-17:00", "2024-03-05T09:00:00Z", true},
+		{"weekdays 08:00-12:00,13:00-17:00", "2024-03-05T12:30:00Z", false},
+		{"weekdays 08:00-12:00,13:00-17:00", "2024-03-05T13:00:00Z", true},
+		{"weekdays 08:00-12:00,13:00-17:00", "2024-03-09T09:00:00Z", false},
+		{"weekends", "2024-03-09T23:59:00Z", true},
+		{"weekends", "2024-03-04T00:00:00Z", false},
+		{"fri-mon", "2024-03-03T12:00:00Z", true},
+		{"fri-mon", "2024-03-04T12:00:00Z", true},
+		{"fri-mon", "2024-03-06T12:00:00Z", false},
+		{"mon,wed", "2024-03-06T12:00:00Z", true},
+		{"mon,wed", "2024-03-05T12:00:00Z", false},
+		{"daily 00:00-24:00", "2024-03-07T23:59:00Z", true},
+		{"daily 00:00-24:00", "2024-03-07T00:00:00Z", true},
+
+		// the schedule is in the time zone of the time it is checked at,
+		// the server's local time for queries; each pair is one instant
+		{"mon-fri 09:00-17:00", "2024-03-04T08:30:00Z", false},
+		{"mon-fri 09:00-17:00", "2024-03-04T09:30:00+01:00", true},
+		{"mon-fri 09:00-17:00", "2024-03-04T17:30:00-05:00", false},
+		{"mon-fri 09:00-17:00", "2024-03-04T14:30:00-08:00", true},
+		{"sat 10:00-12:00", "2024-03-09T10:30:00Z", true},
+		{"sat 10:00-12:00", "2024-03-08T23:30:00-11:00", false}, // still Friday
+		{"sun-thu 21:00-07:00", "2024-03-08T23:30:00Z", false},
+		{"sun-thu 21:00-07:00", "2024-03-09T05:00:00+05:30", false},
+		{"sun-thu 21:00-07:00", "2024-03-08T18:30:00-05:00", false},
+		{"sun-thu 21:00-07:00", "2024-03-07T23:30:00Z", true},
+		{"sun-thu 21:00-07:00", "2024-03-08T05:00:00+05:30", true},
+	}
+	for _, tt := range tests {
+		schedule, err := parseSchedule(tt.schedule)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.schedule, err)
+		}
+		at, err := time.Parse(time.RFC3339, tt.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := schedule.Active(at); got != tt.active {
+			t.Errorf("%q at %s (%s): active %v, want %v", tt.schedule, tt.at, at.Weekday(), got, tt.active)
+		}
+	}
+
+	var always *Schedule
+	if !always.Active(time.Now()) {
+		t.Error("nil schedule inactive")
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	tests := []struct {
+		schedule string
+		err      string
+	}{
+		{"", "invalid schedule"},
+		{"mon 09:00-10:00 extra", "invalid schedule"},
+		{"moon", `invalid day "moon"`},
+		{"mon-fry", `invalid day "mon-fry"`},
+		{"mon 09:00", `invalid time range "09:00"`},
+		{"mon 9-17", `invalid time "9"`},
+		{"mon 09:00-25:00", `invalid time "25:00"`},
+	}
+	for _, tt := range tests {
+		_, err := parseSchedule(tt.schedule)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: error %v, want %q", tt.schedule, err, tt.err)
+		}
+	}
+}
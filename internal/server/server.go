@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/internal/slog"
+)
+
+// server answers the queries of every listener with the current policy.
+type server struct {
+	reload     *reloader
+	audit      *AuditLog
+	queryLog   *QueryLog
+	quarantine *Quarantine
+	mux        *ServeMux // handlers of zones answered by custom logic, may be nil
+	health     *HealthChecker
+	stats      *Stats
+	analytics  *Analytics
+	traffic    *Traffic
+	recent     *RecentQueries
+	history    *History
+	rules      *AdminRules
+	blocking   *blockingSwitch
+	debug      *debugClients
+	udpBatch   int // datagrams read or written per system call, see serveUDPBatch
+
+	listenerEndpoints listenerEndpoints // of the sockets, set before serve
+
+	stopping atomic.Bool
+	serving  sync.WaitGroup // listener loops and TCP connections
+	inflight sync.WaitGroup // queries being answered, including tarpits and closing TCP connections
+
+	active           atomic.Int64 // admitted queries not answered yet, see admit
+	overloadReported atomic.Int64 // when rejected queries were last logged, in Unix nanoseconds
+
+	mu          sync.Mutex // guards the sockets below
+	packetConns []net.PacketConn
+	listeners   []net.Listener
+	conns       map[net.Conn]bool
+}
+
+// serve starts answering queries on the sockets.
+func (s *server) serve(packetConns []net.PacketConn, listeners []net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.packetConns, s.listeners = packetConns, listeners
+	s.conns = make(map[net.Conn]bool)
+	for _, conn := range packetConns {
+		s.serving.Add(1)
+		if udpConn, ok := conn.(*net.UDPConn); ok && s.udpBatch > 1 && udpBatchSupported {
+			go s.serveUDPBatch(udpConn, s.udpBatch)
+		} else {
+			go s.serveUDP(conn)
+		}
+	}
+	for _, listener := range listeners {
+		s.serving.Add(1)
+		go s.serveTCP(listener)
+	}
+	s.health.SetListening(true)
+}
+
+// shutdown stops reading from every socket: datagram sockets and open TCP
+// connections by expiring their read deadline, listeners by closing them.
+// Queries already read are still answered.
+func (s *server) shutdown() {
+	s.stopping.Store(true)
+	s.health.SetListening(false)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.packetConns {
+		conn.SetReadDeadline(time.Now())
+	}
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
+// track registers an accepted TCP connection for shutdown. It reports false
+// once the server is stopping.
+func (s *server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopping.Load() {
+		return false
+	}
+	s.conns[conn] = true
+	return true
+}
+
+func (s *server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// handle answers the DNS message msg received from source on a socket of
+// listener, the zero endpoint for queries that didn't come from -listen. reply sends a packed
+// response back over the transport the message came in on. The query is
+// given up when ctx is done or -query-timeout passes, whichever comes first.
+func (s *server) handle(ctx context.Context, msg []byte, source net.Addr, listener listenEndpoint, reply func([]byte) error) {
+	p := s.reload.current.Load()
+	ctx, cancel := context.WithTimeout(ctx, p.opts.queryTimeout)
+	defer cancel()
+	ip := addrIP(source)
+	// the group of the listener wins over the groups of the clients
+	group := p.group(listener.Group)
+	if group == nil {
+		group = p.groups.Match(ip, p.defaultGroup)
+	}
+	q := &query{ctx: ctx, reply: reply, client: source, ip: ip, start: time.Now(), group: group, queryLog: s.queryLog, stats: s.stats, analytics: s.analytics, traffic: s.traffic, recent: s.recent, history: s.history, slow: p.opts.slowQuery,
+		recursion: group.Resolver != "", policy: p, listener: listener, msg: msg}
+	// formatting the message is the costly part, skip it unless it is logged
+	if !group.Quiet && slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		slog.Debug("received query", "client", source.String(), "size", len(msg), "data", fmt.Sprintf("%x", msg))
+	}
+	if reason, ok := checkHeader(msg); !ok {
+		if !group.Quiet {
+			slog.Debug("rejected packet", "client", source.String(), "size", len(msg), "reason", reason.String())
+		}
+		s.stats.reject(reason)
+		q.drop(reason.String())
+		return
+	}
+	// the names and record data live in a pooled buffer until the query is
+	// answered
+	names := getBuffer()
+	defer putBuffer(names)
+	dnsQuery, _, err := parseDNSResponse((*names)[:0], msg)
+	if err != nil {
+		if !group.Quiet {
+			slog.Debug("malformed query", "client", source.String(), "size", len(msg), "err", err)
+		}
+		s.stats.malformed.Add(1)
+		s.quarantine.Add(msg, source, err)
+		q.respond(errorResponse(dnsQuery.Header, nil, RcodeFormErr))
+		return
+	}
+	q.request, q.questions = &dnsQuery, dnsQuery.Question
+	q.maxSize = responseLimit(dnsQuery.Additional, source, p.opts.maxUDPSize)
+	if opt, edns := findOPT(dnsQuery.Additional); edns {
+		q.edns = p.opts.maxUDPSize
+		if err := q.parseEDNSOptions(opt); err != nil {
+			if !group.Quiet {
+				slog.Debug("malformed EDNS option", "client", source.String(), "err", err)
+			}
+			s.stats.malformed.Add(1)
+			q.respond(errorResponse(dnsQuery.Header, dnsQuery.Question, RcodeFormErr))
+			return
+		}
+	}
+	q.stage("parse")
+	if s.debug.Enabled(ip) {
+		q.debug = true
+		clientDebugLog.Info("client debug query", "client", source.String(), "id", dnsQuery.Header.ID, "flags", fmt.Sprintf("%04x", dnsQuery.Header.Flags),
+			"questions", questionSummary(dnsQuery.Question), "data", fmt.Sprintf("%x", msg))
+	}
+
+	// the stages of -pipeline, then forwarding
+	s.pipeline(p).ServeDNS(q, &dnsQuery)
+	if !q.answered() {
+		slog.Error("query left unanswered by the pipeline", "client", source.String(), "pipeline", p.opts.pipeline)
+		q.respond(errorResponse(dnsQuery.Header, dnsQuery.Question, RcodeServFail))
+	}
+}
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// sqliteMaxDepth bounds the b-tree depth walked, so a corrupt file with a
+// page loop can't recurse forever.
+const sqliteMaxDepth = 32
+
+var errSQLiteCorrupt = errors.New("corrupt sqlite database")
+
+// sqliteDB reads the rows of the tables of an SQLite 3 database file, just
+// enough to import the lists of Pi-hole's gravity.db without a driver. It
+// reads the main file only: changes still in a -wal file are not seen.
+type sqliteDB struct {
+	data     []byte
+	pageSize int
+	usable   int // page size less the reserved bytes at the end of each page
+}
+
+func openSQLite(data []byte) (*sqliteDB, error) {
+	if len(data) < 100 || !bytes.HasPrefix(data, []byte("SQLite format 3\x00")) {
+		return nil, errors.New("not an sqlite 3 database")
+	}
+	pageSize := int(binary.BigEndian.Uint16(data[16:]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	if pageSize < 512 || pageSize&(pageSize-1) != 0 {
+		return nil, errSQLiteCorrupt
+	}
+	if encoding := binary.BigEndian.Uint32(data[56:]); encoding > 1 {
+		return nil, errors.New("sqlite database is not UTF-8")
+	}
+	return &sqliteDB{data: data, pageSize: pageSize, usable: pageSize - int(data[20])}, nil
+}
+
+func (db *sqliteDB) page(n uint32) ([]byte, error) {
+	start := (int(n) - 1) * db.pageSize
+	if n == 0 || start+db.pageSize > len(db.data) {
+		return nil, errSQLiteCorrupt
+	}
+	return db.data[start : start+db.pageSize], nil
+}
+
+// Table returns the columns of the table called name and its rows, in rowid
+// order. A column that is the INTEGER PRIMARY KEY holds the rowid.
+func (db *sqliteDB) Table(name string) ([]string, [][]any, error) {
+	var root int64
+	var sql string
+	err := db.rows(1, 0, func(_ int64, values []any) error {
+		if len(values) >= 5 && values[0] == "table" && strings.EqualFold(fmt.Sprint(values[1]), name) {
+			root, _ = values[3].(int64)
+			sql, _ = values[4].(string)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if root == 0 {
+		return nil, nil, fmt.Errorf("no table %s", name)
+	}
+	columns, rowidColumn := sqliteColumns(sql)
+	var rows [][]any
+	err = db.rows(uint32(root), 0, func(rowid int64, values []any) error {
+		// columns added by ALTER TABLE are missing from older rows
+		for len(values) < len(columns) {
+			values = append(values, nil)
+		}
+		if rowidColumn >= 0 && rowidColumn < len(values) {
+			values[rowidColumn] = rowid
+		}
+		rows = append(rows, values)
+		return nil
+	})
+	return columns, rows, err
+}
+
+// sqliteColumns returns the column names of a CREATE TABLE statement and
+// the index of the INTEGER PRIMARY KEY column, -1 if there is none.
+func sqliteColumns(sql string) ([]string, int) {
+	start, end := strings.IndexByte(sql, '('), strings.LastIndexByte(sql, ')')
+	if start < 0 || end < start {
+		return nil, -1
+	}
+	var columns []string
+	rowid := -1
+	depth, from := 0, start+1
+	definitions := []string{}
+	for i := start + 1; i <= end; i++ {
+		switch {
+		case sql[i] == '(':
+			depth++
+		case sql[i] == ')' && i < end:
+			depth--
+		case sql[i] == ',' && depth == 0 || i == end:
+			definitions = append(definitions, strings.TrimSpace(sql[from:i]))
+			from = i + 1
+		}
+	}
+	for _, definition := range definitions {
+		fields := strings.Fields(definition)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "PRIMARY", "UNIQUE", "CHECK", "FOREIGN", "CONSTRAINT":
+			continue
+		}
+		upper := strings.ToUpper(definition)
+		if len(fields) > 1 && strings.ToUpper(fields[1]) == "INTEGER" && strings.Contains(upper, "PRIMARY KEY") {
+			rowid = len(columns)
+		}
+		columns = append(columns, strings.Trim(fields[0], "\"`[]"))
+	}
+	return columns, rowid
+}
+
+// rows calls f with the rowid and values of every row of the table b-tree
+// rooted at page n.
+func (db *sqliteDB) rows(n uint32, depth int, f func(rowid int64, values []any) error) error {
+	if depth > sqliteMaxDepth {
+		return errSQLiteCorrupt
+	}
+	page, err := db.page(n)
+	if err != nil {
+		return err
+	}
+	header := 0
+	if n == 1 {
+		header = 100
+	}
+	if len(page) < header+8 {
+		return errSQLiteCorrupt
+	}
+	kind := page[header]
+	cells := int(binary.BigEndian.Uint16(page[header+3:]))
+	pointers := header + 8
+	if kind == 0x05 {
+		pointers = header + 12
+	}
+	if pointers+2*cells > len(page) {
+		return errSQLiteCorrupt
+	}
+	for i := 0; i < cells; i++ {
+		offset := int(binary.BigEndian.Uint16(page[pointers+2*i:]))
+		if offset >= len(page) {
+			return errSQLiteCorrupt
+		}
+		cell := page[offset:]
+		switch kind {
+		case 0x05: // interior table page: left child, then the key
+			if len(cell) < 4 {
+				return errSQLiteCorrupt
+			}
+			if err := db.rows(binary.BigEndian.Uint32(cell), depth+1, f); err != nil {
+				return err
+			}
+		case 0x0d: // leaf table page: payload size, rowid, payload
+			size, read := sqliteVarint(cell)
+			cell = cell[read:]
+			rowid, read := sqliteVarint(cell)
+			if read == 0 || size < 0 {
+				return errSQLiteCorrupt
+			}
+			payload, err := db.payload(cell[read:], int(size))
+			if err != nil {
+				return err
+			}
+			values, err := sqliteRecord(payload)
+			if err != nil {
+				return err
+			}
+			if err := f(rowid, values); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: page %d is not a table page", errSQLiteCorrupt, n)
+		}
+	}
+	if kind == 0x05 {
+		return db.rows(binary.BigEndian.Uint32(page[header+8:]), depth+1, f)
+	}
+	return nil
+}
+
+// payload returns the size bytes of a cell's payload starting at cell,
+// following the overflow pages of the ones that don't fit the page.
+func (db *sqliteDB) payload(cell []byte, size int) ([]byte, error) {
+	if size > len(db.data) {
+		return nil, errSQLiteCorrupt
+	}
+	maxLocal := db.usable - 35
+	local := size
+	if size > maxLocal {
+		minLocal := (db.usable-12)*32/255 - 23
+		local = minLocal + (size-minLocal)%(db.usable-4)
+		if local > maxLocal {
+			local = minLocal
+		}
+	}
+	if local > len(cell) {
+		return nil, errSQLiteCorrupt
+	}
+	payload := append([]byte(nil), cell[:local]...)
+	if local == size {
+		return payload, nil
+	}
+	if len(cell) < local+4 {
+		return nil, errSQLiteCorrupt
+	}
+	next := binary.BigEndian.Uint32(cell[local:])
+	for pages := 0; len(payload) < size; pages++ {
+		if pages > len(db.data)/db.pageSize {
+			return nil, errSQLiteCorrupt
+		}
+		page, err := db.page(next)
+		if err != nil {
+			return nil, err
+		}
+		chunk := page[4:db.usable]
+		if rest := size - len(payload); len(chunk) > rest {
+			chunk = chunk[:rest]
+		}
+		payload = append(payload, chunk...)
+		next = binary.BigEndian.Uint32(page)
+	}
+	return payload, nil
+}
+
+// sqliteRecord decodes the values of a record: nil, int64, float64, string
+// or []byte.
+func sqliteRecord(payload []byte) ([]any, error) {
+	headerSize, read := sqliteVarint(payload)
+	if read == 0 || headerSize < int64(read) || headerSize > int64(len(payload)) {
+		return nil, errSQLiteCorrupt
+	}
+	header, body := payload[read:headerSize], payload[headerSize:]
+	var values []any
+	for len(header) > 0 {
+		serial, read := sqliteVarint(header)
+		if read == 0 {
+			return nil, errSQLiteCorrupt
+		}
+		header = header[read:]
+		var size int
+		switch {
+		case serial >= 12:
+			size = int((serial - 12) / 2)
+		case serial >= 1 && serial <= 4:
+			size = int(serial)
+		case serial == 5:
+			size = 6
+		case serial == 6 || serial == 7:
+			size = 8
+		}
+		if size > len(body) || size < 0 {
+			return nil, errSQLiteCorrupt
+		}
+		data := body[:size]
+		body = body[size:]
+		switch {
+		case serial == 0:
+			values = append(values, nil)
+		case serial <= 6:
+			var n int64
+			for _, b := range data {
+				n = n<<8 | int64(b)
+			}
+			// sign extend from the stored width
+			shift := 64 - 8*uint(size)
+			values = append(values, n<<shift>>shift)
+		case serial == 7:
+			values = append(values, math.Float64frombits(binary.BigEndian.Uint64(data)))
+		case serial == 8 || serial == 9:
+			values = append(values, serial-8)
+		case serial >= 12 && serial%2 == 0:
+			values = append(values, append([]byte(nil), data...))
+		case serial >= 13:
+			values = append(values, string(data))
+		default:
+			return nil, errSQLiteCorrupt
+		}
+	}
+	return values, nil
+}
+
+// sqliteVarint decodes a big endian varint of up to 9 bytes and returns it
+// with the bytes read, 0 if b is too short.
+func sqliteVarint(b []byte) (int64, int) {
+	var n uint64
+	for i := 0; i < 9 && i < len(b); i++ {
+		if i == 8 {
+			return int64(n<<8 | uint64(b[i])), 9
+		}
+		n = n<<7 | uint64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return int64(n), i + 1
+		}
+	}
+	return 0, 0
+}
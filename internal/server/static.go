@@ -0,0 +1,99 @@
+package server
+
+import "encoding/binary"
+
+// staticAnswers holds answers that stay the same for as long as a policy is
+// in use, packed once when the policy is built. A response is stitched
+// together from the header and question of the query and the packed records,
+// whose owner names are compression pointers to the question, so answering
+// costs a copy instead of packing the records again.
+type staticAnswers map[staticKey]staticAnswer
+
+type staticKey struct {
+	name  Name
+	qtype uint16 // 0 marks a name that exists, answered with no records
+	class uint16
+}
+
+type staticAnswer struct {
+	records []byte
+	count   uint16
+}
+
+// add packs records as the answer to name, qtype and class. The owner names
+// of the records must be name.
+func (s staticAnswers) add(name Name, qtype, class uint16, records []DNSResourceRecord) {
+	var answer staticAnswer
+	for _, record := range records {
+		// the question starts right after the 12 byte header
+		answer.records = append(answer.records, 0xC0, 12)
+		answer.records = binary.BigEndian.AppendUint16(answer.records, record.Type)
+		answer.records = binary.BigEndian.AppendUint16(answer.records, record.Class)
+		answer.records = binary.BigEndian.AppendUint32(answer.records, record.TTL)
+		answer.records = binary.BigEndian.AppendUint16(answer.records, uint16(len(record.RData)))
+		answer.records = append(answer.records, record.RData...)
+		answer.count++
+	}
+	s[staticKey{name, qtype, class}] = answer
+}
+
+// addChaos adds the CHAOS TXT answers of c.
+func (s staticAnswers) addChaos(c *Chaos) {
+	for _, name := range []string{"version.bind", "version.server", "hostname.bind", "id.server"} {
+		for _, qtype := range []uint16{TypeTXT, TypeANY} {
+			record, ok := c.Answer(DNSQuestion{Name: labelSequence(name), Type: qtype, Class: ClassCH})
+			if ok {
+				s.add(mustParseName(name), qtype, ClassCH, []DNSResourceRecord{record})
+			}
+		}
+	}
+}
+
+// addRecords adds the local records, each name answering the types it has
+// records of and ANY with all of them, and every other type with no data.
+func (s staticAnswers) addRecords(records LocalRecords) {
+	byName := make(map[Name]LocalRecords)
+	var names []Name
+	for _, record := range records {
+		name := NameFromWire(record.Name)
+		if _, ok := byName[name]; !ok {
+			names = append(names, name)
+		}
+		byName[name] = append(byName[name], record)
+	}
+	for _, name := range names {
+		byType := make(map[uint16]LocalRecords)
+		for _, record := range byName[name] {
+			byType[record.Type] = append(byType[record.Type], record)
+		}
+		for qtype, typed := range byType {
+			s.add(name, qtype, ClassIN, typed)
+		}
+		s.add(name, TypeANY, ClassIN, byName[name])
+		s.add(name, 0, ClassIN, nil)
+	}
+}
+
+// appendResponse appends the authoritative answer to query to dst, or
+// reports false when there is none. A name with records of other types only
+// gets an empty answer. question is the only question of the
+// query and section its bytes, which are copied as they are so the case of
+// the name is kept.
+func (s staticAnswers) appendResponse(dst []byte, header DNSHeader, question DNSQuestion, section []byte) ([]byte, bool) {
+	key := staticKey{NameFromWire(question.Name), question.Type, question.Class}
+	answer, ok := s[key]
+	if !ok {
+		key.qtype = 0
+		if answer, ok = s[key]; !ok {
+			return dst, false
+		}
+	}
+	flags := responseFlags(header.Flags, RcodeSuccess) | flagAA
+	dst = binary.BigEndian.AppendUint16(dst, header.ID)
+	dst = binary.BigEndian.AppendUint16(dst, flags)
+	dst = append(dst, 0, 1)
+	dst = binary.BigEndian.AppendUint16(dst, answer.count)
+	dst = append(dst, 0, 0, 0, 0)
+	dst = append(dst, section...)
+	return append(dst, answer.records...), true
+}
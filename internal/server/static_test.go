@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestStaticAnswers(t *testing.T) {
+	// the upstream has answers of its own for every name, so a static one
+	// shows by not being forwarded
+	var mu sync.Mutex
+	var forwarded []string
+	upstream := udpResponder(t, func(query *Msg) []*Msg {
+		name := domainName(query.Question[0].Name)
+		mu.Lock()
+		forwarded = append(forwarded, name)
+		mu.Unlock()
+		var m Msg
+		m.SetReply(query)
+		if name == "missing.lan" {
+			return []*Msg{m.SetRcode(RcodeNXDomain)}
+		}
+		m.AddAnswer(A(name, net.IPv4(203, 0, 113, 1), 60))
+		return []*Msg{&m}
+	})
+	srv := newTestServer(t, "-resolver", upstream,
+		"-record", "router.lan A 192.168.1.1",
+		"-record", "router.lan 60 A 192.168.1.2",
+		"-record", "router.lan TXT living room",
+		"-record", "lan MX 10 router.lan",
+		"-record", `a\.b.lan TXT dotted`)
+
+	for _, tt := range []struct {
+		name    string
+		qtype   uint16
+		rcode   Rcode
+		answers int
+		static  bool
+	}{
+		{"router.lan", TypeA, RcodeSuccess, 2, true},
+		{"ROUTER.Lan", TypeTXT, RcodeSuccess, 1, true},
+		{"router.lan", TypeANY, RcodeSuccess, 3, true},
+		{"router.lan", TypeAAAA, RcodeSuccess, 0, true}, // NODATA, the name has other types
+		{"lan", TypeMX, RcodeSuccess, 1, true},
+		{"lan", TypeA, RcodeSuccess, 0, true},
+		{"missing.lan", TypeA, RcodeNXDomain, 0, false}, // not a local name, the upstream's to deny
+		{"other.lan", TypeA, RcodeSuccess, 1, false},
+		{`a\.b.lan`, TypeTXT, RcodeSuccess, 1, true},
+		{"a.b.lan", TypeTXT, RcodeSuccess, 1, false}, // the dot is no label boundary
+	} {
+		mu.Lock()
+		forwarded = nil
+		mu.Unlock()
+		var query Msg
+		query.SetQuestion(tt.name, tt.qtype)
+		query.Header.ID = 0x1234
+		r := srv.exchangeTest(t, &query)
+		mu.Lock()
+		wasForwarded := len(forwarded) > 0
+		mu.Unlock()
+
+		if r.Header.Rcode() != tt.rcode || len(r.Answers) != tt.answers {
+			t.Errorf("%s %s: %v with %d answers, want %v with %d", tt.name, typeName(tt.qtype), r.Header.Rcode(), len(r.Answers), tt.rcode, tt.answers)
+		}
+		if aa := r.Header.Flags&flagAA != 0; aa != tt.static || wasForwarded == tt.static {
+			t.Errorf("%s %s: AA %v, forwarded %v, want the answer static %v", tt.name, typeName(tt.qtype), aa, wasForwarded, tt.static)
+		}
+		if !tt.static {
+			continue
+		}
+		// stitched from the query: its ID, question and the case of its name
+		if r.Header.ID != 0x1234 || len(r.Question) != 1 || domainName(r.Question[0].Name) != tt.name {
+			t.Errorf("%s %s: ID %#x, question %v, want the query's", tt.name, typeName(tt.qtype), r.Header.ID, r.Question)
+		}
+		for _, answer := range r.Answers {
+			if domainName(answer.Name) != tt.name || (tt.qtype != TypeANY && answer.Type != tt.qtype) {
+				t.Errorf("%s %s: answer %s", tt.name, typeName(tt.qtype), answer)
+			}
+		}
+	}
+}
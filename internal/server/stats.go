@@ -0,0 +1,209 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxStatsZones caps the zones counted separately, so random names
+	// can't grow the table without bound; the rest is counted as otherZone.
+	maxStatsZones = 10000
+	otherZone     = "(other)"
+	// defaultTopZones is how many zones the stats report lists by default.
+	defaultTopZones = 50
+)
+
+// Stats counts the queries the server handled since it started, in total
+// and broken down by query type and by zone.
+type Stats struct {
+	start   time.Time
+	queries atomic.Uint64
+	dropped atomic.Uint64
+	blocked atomic.Uint64
+	slow    atomic.Uint64
+	// malformed counts the queries that failed to parse, answered with
+	// FORMERR
+	malformed atomic.Uint64
+	// overloaded counts the queries rejected by -max-inflight, which are
+	// also counted as dropped or under their rcode
+	overloaded atomic.Uint64
+	rcodes     [RcodeBadVers + 1]atomic.Uint64 // every rcode the server sends
+	// rejected counts the packets dropped by the header checks, which are
+	// also counted as dropped
+	rejected [len(rejectReasons)]atomic.Uint64
+
+	mu    sync.Mutex
+	types map[string]*statsCounters
+	zones map[string]*statsCounters
+}
+
+// statsCounters is the breakdown of the queries of one type or zone.
+type statsCounters struct {
+	Queries uint64            `json:"queries"`
+	Types   map[string]uint64 `json:"types,omitempty"`
+	Rcodes  map[string]uint64 `json:"rcodes"`
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		start: time.Now(),
+		types: make(map[string]*statsCounters),
+		zones: make(map[string]*statsCounters),
+	}
+}
+
+// StatsSnapshot is the state of the counters as shown by the admin API.
+type StatsSnapshot struct {
+	Uptime     string                   `json:"uptime"`
+	Queries    uint64                   `json:"queries"`
+	Dropped    uint64                   `json:"dropped"`
+	Blocked    uint64                   `json:"blocked"`
+	Slow       uint64                   `json:"slow"`
+	Malformed  uint64                   `json:"malformed"`
+	Overloaded uint64                   `json:"overloaded"`
+	Rejected   map[string]uint64        `json:"rejected"`
+	Rcodes     map[string]uint64        `json:"rcodes"`
+	Types      map[string]statsCounters `json:"types"`
+	Zones      map[string]statsCounters `json:"zones"`
+}
+
+// statsZone is the zone a name is counted under: its last two labels, e.g.
+// example.com for www.example.com.
+func statsZone(name string) string {
+	name = canonicalName(name)
+	if name == "" {
+		return "."
+	}
+	labels := strings.Split(name, ".")
+	if len(labels) > 2 {
+		labels = labels[len(labels)-2:]
+	}
+	return strings.Join(labels, ".")
+}
+
+// reject counts a packet dropped by the header checks, on top of counting
+// it with record.
+func (s *Stats) reject(reason rejectReason) {
+	s.rejected[reason].Add(1)
+}
+
+// record counts a query for name and qtype that was answered with rcode, or
+// dropped when rcode is negative.
+func (s *Stats) record(name, qtype string, rcode int) {
+	s.queries.Add(1)
+	outcome := "DROPPED"
+	if rcode < 0 {
+		s.dropped.Add(1)
+	} else {
+		if rcode >= len(s.rcodes) {
+			rcode &= 0xF
+		}
+		s.rcodes[rcode].Add(1)
+		outcome = Rcode(rcode).String()
+	}
+	if qtype == "" {
+		// nothing could be parsed, there is no type or zone to count
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	byType := s.counters(s.types, qtype, false)
+	byType.Queries++
+	byType.Rcodes[outcome]++
+
+	zone := statsZone(name)
+	if _, ok := s.zones[zone]; !ok && len(s.zones) >= maxStatsZones {
+		zone = otherZone
+	}
+	byZone := s.counters(s.zones, zone, true)
+	byZone.Queries++
+	byZone.Types[qtype]++
+	byZone.Rcodes[outcome]++
+}
+
+func (s *Stats) counters(table map[string]*statsCounters, key string, withTypes bool) *statsCounters {
+	counters, ok := table[key]
+	if !ok {
+		counters = &statsCounters{Rcodes: make(map[string]uint64)}
+		if withTypes {
+			counters.Types = make(map[string]uint64)
+		}
+		table[key] = counters
+	}
+	return counters
+}
+
+// Zones returns the number of zones counted separately.
+func (s *Stats) Zones() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.zones)
+}
+
+// Snapshot copies the counters, listing only the topZones zones with the
+// most queries.
+func (s *Stats) Snapshot(topZones int) StatsSnapshot {
+	snapshot := StatsSnapshot{
+		Uptime:     time.Since(s.start).Round(time.Second).String(),
+		Queries:    s.queries.Load(),
+		Dropped:    s.dropped.Load(),
+		Blocked:    s.blocked.Load(),
+		Slow:       s.slow.Load(),
+		Malformed:  s.malformed.Load(),
+		Overloaded: s.overloaded.Load(),
+		Rejected:   make(map[string]uint64),
+		Rcodes:     make(map[string]uint64),
+		Types:      make(map[string]statsCounters),
+		Zones:      make(map[string]statsCounters),
+	}
+	for reason, name := range rejectReasons {
+		snapshot.Rejected[name] = s.rejected[reason].Load()
+	}
+	for rcode := range s.rcodes {
+		if count := s.rcodes[rcode].Load(); count > 0 {
+			snapshot.Rcodes[Rcode(rcode).String()] = count
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for qtype, counters := range s.types {
+		snapshot.Types[qtype] = counters.copy()
+	}
+	zones := make([]string, 0, len(s.zones))
+	for zone := range s.zones {
+		zones = append(zones, zone)
+	}
+	sort.Slice(zones, func(i, j int) bool {
+		if s.zones[zones[i]].Queries != s.zones[zones[j]].Queries {
+			return s.zones[zones[i]].Queries > s.zones[zones[j]].Queries
+		}
+		return zones[i] < zones[j]
+	})
+	if len(zones) > topZones {
+		zones = zones[:topZones]
+	}
+	for _, zone := range zones {
+		snapshot.Zones[zone] = s.zones[zone].copy()
+	}
+	return snapshot
+}
+
+func (c *statsCounters) copy() statsCounters {
+	clone := statsCounters{Queries: c.Queries, Rcodes: make(map[string]uint64, len(c.Rcodes))}
+	for rcode, count := range c.Rcodes {
+		clone.Rcodes[rcode] = count
+	}
+	if c.Types != nil {
+		clone.Types = make(map[string]uint64, len(c.Types))
+		for qtype, count := range c.Types {
+			clone.Types[qtype] = count
+		}
+	}
+	return clone
+}
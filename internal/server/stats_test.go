@@ -0,0 +1,184 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatsZone(t *testing.T) {
+	for name, want := range map[string]string{
+		"www.example.com":     "example.com",
+		"A.B.Example.COM.":    "example.com",
+		"example.com":         "example.com",
+		"com":                 "com",
+		"":                    ".",
+		".":                   ".",
+		"host.lan":            "host.lan",
+		"deep.host.lab.local": "lab.local",
+	} {
+		if got := statsZone(name); got != want {
+			t.Errorf("statsZone(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestStatsRecord(t *testing.T) {
+	s := NewStats()
+	for _, tt := range []struct {
+		name, qtype string
+		rcode       int
+	}{
+		{"www.example.com", "A", int(RcodeSuccess)},
+		{"mail.Example.com.", "MX", int(RcodeSuccess)},
+		{"missing.example.com", "A", int(RcodeNXDomain)},
+		{"www.example.org", "AAAA", -1}, // dropped
+		{"www.example.org", "A", int(RcodeBadVers)},
+		{"www.example.org", "A", 0x23}, // over BADVERS, folded to its low 4 bits
+		{"", "", int(RcodeFormErr)},    // nothing parsed, no type or zone
+		{"www.example.net", "TXT", 17}, // folded to FORMERR
+	} {
+		s.record(tt.name, tt.qtype, tt.rcode)
+	}
+	snapshot := s.Snapshot(defaultTopZones)
+	if snapshot.Queries != 8 || snapshot.Dropped != 1 {
+		t.Errorf("%d queries, %d dropped, want 8 and 1", snapshot.Queries, snapshot.Dropped)
+	}
+	wantRcodes := map[string]uint64{"NOERROR": 2, "NXDOMAIN": 2, "FORMERR": 2, "BADVERS": 1}
+	if fmt.Sprint(snapshot.Rcodes) != fmt.Sprint(wantRcodes) {
+		t.Errorf("rcodes %v, want %v", snapshot.Rcodes, wantRcodes)
+	}
+
+	for _, tt := range []struct {
+		table   map[string]statsCounters
+		key     string
+		queries uint64
+		types   map[string]uint64
+		rcodes  map[string]uint64
+	}{
+		{snapshot.Types, "A", 4, nil, map[string]uint64{"NOERROR": 1, "NXDOMAIN": 2, "BADVERS": 1}},
+		{snapshot.Types, "AAAA", 1, nil, map[string]uint64{"DROPPED": 1}},
+		{snapshot.Types, "TXT", 1, nil, map[string]uint64{"FORMERR": 1}},
+		{snapshot.Zones, "example.com", 3, map[string]uint64{"A": 2, "MX": 1}, map[string]uint64{"NOERROR": 2, "NXDOMAIN": 1}},
+		{snapshot.Zones, "example.org", 3, map[string]uint64{"A": 2, "AAAA": 1}, map[string]uint64{"DROPPED": 1, "BADVERS": 1, "NXDOMAIN": 1}},
+		{snapshot.Zones, "example.net", 1, map[string]uint64{"TXT": 1}, map[string]uint64{"FORMERR": 1}},
+	} {
+		counters, ok := tt.table[tt.key]
+		if !ok {
+			t.Errorf("no counters for %s", tt.key)
+			continue
+		}
+		if counters.Queries != tt.queries || fmt.Sprint(counters.Types) != fmt.Sprint(tt.types) || fmt.Sprint(counters.Rcodes) != fmt.Sprint(tt.rcodes) {
+			t.Errorf("%s: %+v, want %d queries, types %v, rcodes %v", tt.key, counters, tt.queries, tt.types, tt.rcodes)
+		}
+	}
+	if len(snapshot.Types) != 4 || len(snapshot.Zones) != 3 {
+		t.Errorf("types %v, zones %v, want the parsed queries only", snapshot.Types, snapshot.Zones)
+	}
+}
+
+func TestStatsZoneOverflow(t *testing.T) {
+	s := NewStats()
+	for i := 0; i < maxStatsZones; i++ {
+		s.record(fmt.Sprintf("www.zone%d.example", i), "A", int(RcodeSuccess))
+	}
+	s.record("www.zone0.example", "A", int(RcodeSuccess)) // counted already
+	s.record("new.example", "A", int(RcodeNXDomain))
+	s.record("another.new", "AAAA", int(RcodeNXDomain))
+	if s.Zones() != maxStatsZones+1 {
+		t.Errorf("%d zones, want %d and %s", s.Zones(), maxStatsZones, otherZone)
+	}
+	snapshot := s.Snapshot(2)
+	other := snapshot.Zones[otherZone]
+	if other.Queries != 2 || other.Types["A"] != 1 || other.Types["AAAA"] != 1 {
+		t.Errorf("%s counted %+v, want the two zones over the cap", otherZone, other)
+	}
+	if zone0 := snapshot.Zones["zone0.example"]; zone0.Queries != 2 {
+		t.Errorf("zone0.example counted %+v, want its two queries after the cap", zone0)
+	}
+}
+
+func TestStatsSnapshotTopZones(t *testing.T) {
+	s := NewStats()
+	for zone, queries := range map[string]int{
+		"a.example": 1,
+		"b.example": 3,
+		"c.example": 2,
+		"d.example": 3,
+		"e.example": 2,
+	} {
+		for i := 0; i < queries; i++ {
+			s.record("www."+zone, "A", int(RcodeSuccess))
+		}
+	}
+	for _, tt := range []struct {
+		top  int
+		want []string
+	}{
+		{0, nil},
+		{1, []string{"b.example"}},
+		// ties go to the zone first in name order
+		{3, []string{"b.example", "c.example", "d.example"}},
+		{4, []string{"b.example", "c.example", "d.example", "e.example"}},
+		{10, []string{"a.example", "b.example", "c.example", "d.example", "e.example"}},
+	} {
+		snapshot := s.Snapshot(tt.top)
+		if len(snapshot.Zones) != len(tt.want) {
+			t.Errorf("top %d: zones %v, want %v", tt.top, snapshot.Zones, tt.want)
+			continue
+		}
+		for _, zone := range tt.want {
+			if _, ok := snapshot.Zones[zone]; !ok {
+				t.Errorf("top %d: zones %v, want %v", tt.top, snapshot.Zones, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestStatsAPI(t *testing.T) {
+	s := NewStats()
+	for i := 0; i < 3; i++ {
+		for j := 0; j <= i; j++ {
+			s.record(fmt.Sprintf("www.zone%d.example", i), "A", int(RcodeSuccess))
+		}
+	}
+	mux := http.NewServeMux()
+	(&controlAPI{stats: s}).register(mux)
+	for _, tt := range []struct {
+		query  string
+		status int
+		zones  []string
+	}{
+		{"", http.StatusOK, []string{"zone0.example", "zone1.example", "zone2.example"}},
+		{"?zones=2", http.StatusOK, []string{"zone1.example", "zone2.example"}},
+		{"?zones=0", http.StatusOK, nil},
+		{"?zones=-1", http.StatusBadRequest, nil},
+		{"?zones=all", http.StatusBadRequest, nil},
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats"+tt.query, nil))
+		if w.Code != tt.status {
+			t.Errorf("/stats%s: status %d, want %d", tt.query, w.Code, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var snapshot StatsSnapshot
+		if err := json.Unmarshal(w.Body.Bytes(), &snapshot); err != nil {
+			t.Fatalf("%v in %s", err, w.Body)
+		}
+		if snapshot.Queries != 6 || len(snapshot.Zones) != len(tt.zones) {
+			t.Errorf("/stats%s: %d queries, zones %v, want 6 and %v", tt.query, snapshot.Queries, snapshot.Zones, tt.zones)
+			continue
+		}
+		for _, zone := range tt.zones {
+			if _, ok := snapshot.Zones[zone]; !ok {
+				t.Errorf("/stats%s: zones %v, want %v", tt.query, snapshot.Zones, tt.zones)
+			}
+		}
+	}
+}
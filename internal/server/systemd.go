@@ -0,0 +1,86 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor systemd passes to an activated
+// service; the others follow it without gaps.
+const listenFDsStart = 3
+
+// activatedSockets returns the sockets systemd passed to the process with
+// socket activation (sd_listen_fds(3)), split into datagram sockets and
+// stream listeners. It returns nothing when the process wasn't activated.
+// The LISTEN_* variables are cleared so child processes don't pick the
+// sockets up again.
+func activatedSockets() ([]net.PacketConn, []net.Listener, error) {
+	names, ok, err := listenEnv(os.Getenv, os.Getpid())
+	if !ok || err != nil {
+		return nil, nil, err
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	files := make([]*os.File, len(names))
+	for i, name := range names {
+		files[i] = os.NewFile(uintptr(listenFDsStart+i), name)
+	}
+	return splitSockets(files)
+}
+
+// listenEnv reads the LISTEN_* variables through getenv and returns the names
+// of the sockets passed, one for each descriptor from listenFDsStart on. ok
+// is false when the variables are unset or meant for a process other than
+// pid.
+func listenEnv(getenv func(string) string, pid int) (names []string, ok bool, err error) {
+	listenPID, err := strconv.Atoi(getenv("LISTEN_PID"))
+	if err != nil || listenPID != pid {
+		return nil, false, nil
+	}
+	count, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return nil, false, fmt.Errorf("invalid LISTEN_FDS %q", getenv("LISTEN_FDS"))
+	}
+	given := strings.Split(getenv("LISTEN_FDNAMES"), ":")
+	names = make([]string, count)
+	for i := range names {
+		names[i] = "LISTEN_FD_" + strconv.Itoa(listenFDsStart+i)
+		if i < len(given) && given[i] != "" {
+			names[i] = given[i]
+		}
+	}
+	return names, true, nil
+}
+
+// splitSockets turns the files of passed sockets into datagram sockets and
+// stream listeners. The files are closed.
+func splitSockets(files []*os.File) ([]net.PacketConn, []net.Listener, error) {
+	var packetConns []net.PacketConn
+	var listeners []net.Listener
+	for i, file := range files {
+		// both calls duplicate the descriptor, so the file is closed either way
+		if conn, err := net.FilePacketConn(file); err == nil {
+			packetConns = append(packetConns, conn)
+		} else if listener, err := net.FileListener(file); err == nil {
+			listeners = append(listeners, listener)
+		} else {
+			for _, file := range files[i:] {
+				file.Close()
+			}
+			for _, conn := range packetConns {
+				conn.Close()
+			}
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return nil, nil, fmt.Errorf("socket %s is neither a datagram nor a stream socket: %w", file.Name(), err)
+		}
+		file.Close()
+	}
+	return packetConns, listeners, nil
+}
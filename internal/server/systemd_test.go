@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListenEnv(t *testing.T) {
+	for _, tt := range []struct {
+		env   map[string]string
+		names []string
+		ok    bool
+		err   bool
+	}{
+		{map[string]string{}, nil, false, false},
+		{map[string]string{"LISTEN_PID": "4242", "LISTEN_FDS": "2"}, nil, false, false}, // for another process
+		{map[string]string{"LISTEN_PID": "1000", "LISTEN_FDS": "2"}, []string{"LISTEN_FD_3", "LISTEN_FD_4"}, true, false},
+		{map[string]string{"LISTEN_PID": "1000", "LISTEN_FDS": "3", "LISTEN_FDNAMES": "dns-udp::dns-tcp"}, []string{"dns-udp", "LISTEN_FD_4", "dns-tcp"}, true, false},
+		{map[string]string{"LISTEN_PID": "1000", "LISTEN_FDS": "1", "LISTEN_FDNAMES": "a:b"}, []string{"a"}, true, false},
+		{map[string]string{"LISTEN_PID": "1000", "LISTEN_FDS": "0"}, []string{}, true, false},
+		{map[string]string{"LISTEN_PID": "1000"}, nil, false, true},
+		{map[string]string{"LISTEN_PID": "1000", "LISTEN_FDS": "-1"}, nil, false, true},
+	} {
+		names, ok, err := listenEnv(func(key string) string { return tt.env[key] }, 1000)
+		if strings.Join(names, ":") != strings.Join(tt.names, ":") || len(names) != len(tt.names) || ok != tt.ok || (err != nil) != tt.err {
+			t.Errorf("%v: names %q, ok %v, error %v", tt.env, names, ok, err)
+		}
+	}
+}
+
+func TestSplitSockets(t *testing.T) {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packetConn.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	files := func() []*os.File {
+		t.Helper()
+		// the descriptors systemd would pass, in the order of the unit
+		tcpFile, err := listener.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		udpFile, err := packetConn.(*net.UDPConn).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []*os.File{tcpFile, udpFile}
+	}
+
+	packetConns, listeners, err := splitSockets(files())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packetConns) != 1 || len(listeners) != 1 {
+		t.Fatalf("%d datagram sockets and %d listeners, want one each", len(packetConns), len(listeners))
+	}
+	if got, want := packetConns[0].LocalAddr().String(), packetConn.LocalAddr().String(); got != want {
+		t.Errorf("datagram socket on %s, want %s", got, want)
+	}
+	if got, want := listeners[0].Addr().String(), listener.Addr().String(); got != want {
+		t.Errorf("listener on %s, want %s", got, want)
+	}
+	packetConns[0].Close()
+	listeners[0].Close()
+
+	notSocket, err := os.Create(filepath.Join(t.TempDir(), "not-a-socket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := splitSockets(append(files(), notSocket)); err == nil || !strings.Contains(err.Error(), "not-a-socket") {
+		t.Errorf("a regular file passed: %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+-- gravity.db is built from this file, with the tables of Pi-hole 5:
+--
+--	rm -f gravity.db && sqlite3 gravity.db < gravity.sql
+--
+-- Pages of 512 bytes make the b-trees of the tables a few levels deep with
+-- little data, and the long comments spill onto overflow pages.
+PRAGMA page_size = 512;
+
+CREATE TABLE adlist (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	address TEXT UNIQUE NOT NULL,
+	enabled BOOLEAN NOT NULL DEFAULT 1,
+	date_added INTEGER NOT NULL DEFAULT (cast(strftime('%s', 'now') as int)),
+	comment TEXT
+);
+CREATE TABLE domainlist (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	type INTEGER NOT NULL DEFAULT 0,
+	domain TEXT NOT NULL,
+	enabled BOOLEAN NOT NULL DEFAULT 1,
+	date_added INTEGER NOT NULL DEFAULT 1700000000,
+	comment TEXT,
+	UNIQUE(domain, type)
+);
+CREATE TABLE client (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	ip TEXT NOT NULL UNIQUE,
+	comment TEXT
+);
+CREATE TABLE gravity (
+	domain TEXT NOT NULL,
+	adlist_id INTEGER NOT NULL REFERENCES adlist (id)
+);
+
+INSERT INTO adlist (address, enabled, date_added, comment) VALUES
+	('https://raw.githubusercontent.com/StevenBlack/hosts/master/hosts', 1, 1700000000, 'Migrated from /etc/pihole/adlists.list'),
+	('https://v.firebog.net/hosts/Easyprivacy.txt', '1', 1700000001, NULL),
+	('https://v.firebog.net/hosts/AdguardDNS.txt', 0, 1700000002, NULL);
+-- added by a later version: the rows above have no value for it
+ALTER TABLE adlist ADD COLUMN type INTEGER NOT NULL DEFAULT 0;
+INSERT INTO adlist (address, enabled, date_added, comment, type) VALUES
+	('https://example.com/allowlist.txt', 1, 1700000003, NULL, 1),
+	('https://example.com/' || replace(hex(zeroblob(300)), '00', 'ab') || '.txt', 1, 1700000004, 'an address too long for its page', 0);
+
+INSERT INTO domainlist (type, domain, enabled, comment) VALUES
+	(0, 'allowed.example.com', 1, NULL),
+	(1, 'denied.example.com', 1, 'blocked for everyone'),
+	(1, 'disabled.example.com', 0, NULL),
+	(2, '^allowed[0-9]+\.example\.net$', 1, NULL),
+	(3, '(\.|^)tracker\.example\.org$', '1', replace(hex(zeroblob(1000)), '00', 'comment '));
+-- Pi-hole's regexes may carry options, which have no equivalent here
+INSERT INTO domainlist (type, domain, enabled) VALUES (3, 'ads\.example;querytype=AAAA', 1);
+
+INSERT INTO client (ip, comment) VALUES ('192.168.1.10', 'kids'), ('192.168.1.0/24', NULL);
+
+WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 2000)
+INSERT INTO gravity (domain, adlist_id) SELECT 'ads' || i || '.example.com', 1 + i % 2 FROM n;
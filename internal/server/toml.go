@@ -0,0 +1,244 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// tomlTable is one [table] or [[array.of.tables]] entry of a TOML document.
+// The root table has an empty name.
+type tomlTable struct {
+	Name   string
+	Line   int
+	Keys   []string // in file order
+	Values map[string]any
+	Lines  map[string]int
+}
+
+// parseTOML decodes the subset of TOML the config file needs: tables, arrays
+// of tables, and keys holding strings, integers, floats, booleans or arrays of
+// those. Dotted keys, inline tables, multiline strings, nested arrays and
+// dates are not supported and rejected with an error saying so.
+func parseTOML(data string) ([]*tomlTable, error) {
+	p := &tomlParser{lines: strings.Split(data, "\n")}
+	root := &tomlTable{Values: map[string]any{}, Lines: map[string]int{}}
+	tables := []*tomlTable{root}
+	current := root
+	seen := map[string]bool{}
+
+	for p.line < len(p.lines) {
+		text := strings.TrimSpace(p.lines[p.line])
+		p.line++
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		if strings.HasPrefix(text, "[") {
+			array := strings.HasPrefix(text, "[[")
+			name, rest, ok := strings.Cut(strings.TrimLeft(text, "["), "]")
+			if array {
+				rest = strings.TrimPrefix(rest, "]")
+			}
+			if !ok || !isBareKey(strings.ReplaceAll(name, ".", "")) || !isComment(rest) {
+				return nil, p.errorf("invalid table header %q", text)
+			}
+			if !array && seen[name] {
+				return nil, p.errorf("table [%s] defined twice", name)
+			}
+			seen[name] = true
+			current = &tomlTable{Name: name, Line: p.line, Values: map[string]any{}, Lines: map[string]int{}}
+			tables = append(tables, current)
+			continue
+		}
+
+		key, rest, ok := strings.Cut(text, "=")
+		key = strings.TrimSpace(key)
+		if ok && strings.Contains(key, ".") && isBareKey(strings.ReplaceAll(key, ".", "")) {
+			return nil, p.errorf("dotted key %q is not supported, put it in a [table]", key)
+		}
+		if !ok || !isBareKey(key) {
+			return nil, p.errorf("expected key = value, got %q", text)
+		}
+		if _, dup := current.Values[key]; dup {
+			return nil, p.errorf("key %q defined twice", key)
+		}
+		line := p.line
+		value, rest, err := p.value(strings.TrimSpace(rest))
+		if err != nil {
+			return nil, err
+		}
+		if !isComment(rest) {
+			return nil, p.errorf("unexpected text after value: %q", rest)
+		}
+		current.Keys = append(current.Keys, key)
+		current.Values[key] = value
+		current.Lines[key] = line
+	}
+	return tables, nil
+}
+
+type tomlParser struct {
+	lines []string
+	line  int // 1-based number of the line being parsed, once incremented
+}
+
+// tomlError is a syntax error at a line of the document.
+type tomlError struct {
+	Line int
+	Msg  string
+}
+
+func (e *tomlError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+func (p *tomlParser) errorf(format string, args ...any) error {
+	return &tomlError{Line: p.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func isBareKey(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func isComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || s[0] == '#'
+}
+
+// value parses the value at the start of s and returns the remaining text.
+// Arrays may continue on the following lines.
+func (p *tomlParser) value(s string) (any, string, error) {
+	switch {
+	case s == "":
+		return nil, "", p.errorf("missing value")
+	case strings.HasPrefix(s, `"""`) || strings.HasPrefix(s, "'''"):
+		return nil, "", p.errorf("multiline strings are not supported, use an array of strings")
+	case s[0] == '{':
+		return nil, "", p.errorf("inline tables are not supported, use a [table]")
+	case s[0] == '"':
+		return p.basicString(s)
+	case s[0] == '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return nil, "", p.errorf("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	case s[0] == '[':
+		return p.array(s[1:])
+	}
+
+	end := strings.IndexAny(s, ",]# \t")
+	if end < 0 {
+		end = len(s)
+	}
+	word, rest := s[:end], s[end:]
+	switch word {
+	case "true":
+		return true, rest, nil
+	case "false":
+		return false, rest, nil
+	}
+	clean := strings.ReplaceAll(word, "_", "")
+	if n, err := strconv.ParseInt(clean, 0, 64); err == nil {
+		return n, rest, nil
+	}
+	if f, err := strconv.ParseFloat(clean, 64); err == nil {
+		return f, rest, nil
+	}
+	if isDateTime(word) {
+		return nil, "", p.errorf("dates and times are not supported, quote %q", word)
+	}
+	return nil, "", p.errorf("invalid value %q (strings must be quoted)", word)
+}
+
+// isDateTime reports whether word looks like a TOML date, 1979-05-27, or time
+// of day, 07:32:00.
+func isDateTime(word string) bool {
+	digits := func(s string) bool {
+		for _, c := range s {
+			if c < '0' || c > '9' {
+				return false
+			}
+		}
+		return s != ""
+	}
+	date := len(word) >= 10 && word[4] == '-' && word[7] == '-' && digits(word[:4]) && digits(word[5:7]) && digits(word[8:10])
+	clock := len(word) >= 8 && word[2] == ':' && word[5] == ':' && digits(word[:2]) && digits(word[3:5]) && digits(word[6:8])
+	return date || clock
+}
+
+func (p *tomlParser) basicString(s string) (any, string, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			return b.String(), s[i+1:], nil
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case '"', '\\':
+				b.WriteByte(s[i])
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'u':
+				if i+4 >= len(s) {
+					return nil, "", p.errorf("invalid unicode escape")
+				}
+				r, err := strconv.ParseUint(s[i+1:i+5], 16, 32)
+				if err != nil {
+					return nil, "", p.errorf("invalid unicode escape %q", s[i-1:i+5])
+				}
+				b.WriteRune(rune(r))
+				i += 4
+			default:
+				return nil, "", p.errorf("invalid escape \\%c", s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return nil, "", p.errorf("unterminated string")
+}
+
+func (p *tomlParser) array(s string) (any, string, error) {
+	var items []any
+	for {
+		s = strings.TrimSpace(s)
+		// arrays may span lines and carry comments between items
+		for isComment(s) {
+			if p.line >= len(p.lines) {
+				return nil, "", p.errorf("unterminated array")
+			}
+			s = strings.TrimSpace(p.lines[p.line])
+			p.line++
+		}
+		if s[0] == ']' {
+			return items, s[1:], nil
+		}
+		item, rest, err := p.value(s)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, nested := item.([]any); nested {
+			return nil, "", p.errorf("nested arrays are not supported")
+		}
+		items = append(items, item)
+		s = strings.TrimSpace(rest)
+		if strings.HasPrefix(s, ",") {
+			s = s[1:]
+		} else if !strings.HasPrefix(s, "]") && !isComment(s) {
+			return nil, "", p.errorf("expected , or ] in array, got %q", s)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// dumpTOML prints the tables of a document one key per line, as
+// "[table] key = value" with the Go syntax of the value.
+func dumpTOML(tables []*tomlTable) string {
+	var b strings.Builder
+	for _, table := range tables {
+		fmt.Fprintf(&b, "[%s]@%d\n", table.Name, table.Line)
+		for _, key := range table.Keys {
+			fmt.Fprintf(&b, "%s = %#v @%d\n", key, table.Values[key], table.Lines[key])
+		}
+	}
+	return b.String()
+}
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want string
+	}{
+		{"empty", "", "[]@0\n"},
+		{"comments", "# a comment\n\n  # indented\nkey = 1 # after the value\n", "[]@0\nkey = 1 @4\n"},
+		{
+			"basic strings",
+			`quote = "a \"b\" c"` + "\n" + `escapes = "back\\slash\ttab\nnewline \u00e9"` + "\n" + `hash = "# not a comment"`,
+			"[]@0\n" + `quote = "a \"b\" c" @1` + "\n" + `escapes = "back\\slash\ttab\nnewline é" @2` + "\n" + `hash = "# not a comment" @3` + "\n",
+		},
+		{"literal strings", `path = 'C:\dns\"raw"'`, "[]@0\n" + `path = "C:\\dns\\\"raw\"" @1` + "\n"},
+		{
+			"numbers and booleans",
+			"int = 53\nneg = -1\nsep = 1_000_000\nhex = 0x35\nfloat = 0.5\nexp = 1e3\non = true\noff = false",
+			"[]@0\nint = 53 @1\nneg = -1 @2\nsep = 1000000 @3\nhex = 53 @4\nfloat = 0.5 @5\nexp = 1000 @6\non = true @7\noff = false @8\n",
+		},
+		{
+			"arrays",
+			"one = [\"a\"]\nempty = []\nmixed = [1, \"b\", true]\nlines = [\n  \"x\", # first\n  # between\n  \"y\",\n]\nafter = 1",
+			"[]@0\n" + `one = []interface {}{"a"} @1` + "\n" + `empty = []interface {}(nil) @2` + "\n" + `mixed = []interface {}{1, "b", true} @3` + "\n" + `lines = []interface {}{"x", "y"} @4` + "\n" + "after = 1 @9\n",
+		},
+		{
+			"tables",
+			"root = 1\n[server]\nlisten = \"127.0.0.1:53\"\n\n[rate_limit] # limits\nqps = 5\n[a.b-c]\nkey = 2",
+			"[]@0\nroot = 1 @1\n[server]@2\n" + `listen = "127.0.0.1:53" @3` + "\n[rate_limit]@5\nqps = 5 @6\n[a.b-c]@7\nkey = 2 @8\n",
+		},
+		{
+			"arrays of tables",
+			"[[group]]\nname = \"kids\"\n[[group]]\nname = \"guests\"\n[server]\n[[group]]\nname = \"iot\"",
+			"[]@0\n[group]@1\n" + `name = "kids" @2` + "\n[group]@3\n" + `name = "guests" @4` + "\n[server]@5\n[group]@6\n" + `name = "iot" @7` + "\n",
+		},
+		{"same key in two tables", "[a]\nkey = 1\n[b]\nkey = 2", "[]@0\n[a]@1\nkey = 1 @2\n[b]@3\nkey = 2 @4\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tables, err := parseTOML(tt.doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := dumpTOML(tables); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		err  string
+	}{
+		{"dotted key", "[server]\nrate_limit.qps = 5", `line 2: dotted key "rate_limit.qps" is not supported, put it in a [table]`},
+		{"inline table", "limits = { qps = 5 }", "line 1: inline tables are not supported, use a [table]"},
+		{"multiline basic string", "records = \"\"\"\na\n\"\"\"", "line 1: multiline strings are not supported, use an array of strings"},
+		{"multiline literal string", "records = '''a'''", "line 1: multiline strings are not supported, use an array of strings"},
+		{"nested array", "pairs = [[1, 2], [3, 4]]", "line 1: nested arrays are not supported"},
+		{"date", "since = 1979-05-27", `line 1: dates and times are not supported, quote "1979-05-27"`},
+		{"date and time", "since = 1979-05-27T07:32:00Z", `line 1: dates and times are not supported, quote "1979-05-27T07:32:00Z"`},
+		{"time", "at = 07:32:00", `line 1: dates and times are not supported, quote "07:32:00"`},
+		{"unquoted string", "resolver = 1.1.1.1:53", `line 1: invalid value "1.1.1.1:53" (strings must be quoted)`},
+		{"missing value", "\nkey =", "line 2: missing value"},
+		{"no equals sign", "key", `line 1: expected key = value, got "key"`},
+		{"quoted key", `"key" = 1`, `line 1: expected key = value, got "\"key\" = 1"`},
+		{"key twice", "key = 1\nkey = 2", `line 2: key "key" defined twice`},
+		{"table twice", "[server]\n[acl]\n[server]", "line 3: table [server] defined twice"},
+		{"invalid table header", "[server", `line 1: invalid table header "[server"`},
+		{"text after table header", "[server] x", `line 1: invalid table header "[server] x"`},
+		{"text after value", `key = "a" "b"`, `line 1: unexpected text after value: " \"b\""`},
+		{"unterminated string", `key = "abc`, "line 1: unterminated string"},
+		{"unterminated literal string", "key = 'abc", "line 1: unterminated string"},
+		{"invalid escape", `key = "\x41"`, `line 1: invalid escape \x`},
+		{"invalid unicode escape", `key = "\u00zz"`, `line 1: invalid unicode escape "\\u00zz"`},
+		{"unterminated array", "list = [\n\"a\",\n", "line 3: unterminated array"},
+		{"missing comma", `list = ["a" "b"]`, `line 1: expected , or ] in array, got "\"b\"]"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTOML(tt.doc)
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// trafficBuckets is the longest window of the traffic report in minutes,
+	// one bucket of counters per minute.
+	trafficBuckets = 60
+	// maxTrafficClients and maxTrafficDomains cap the clients and names
+	// counted unless the memory budget lowers them; beyond them the least
+	// recently seen of a sample is forgotten.
+	maxTrafficClients = 10000
+	maxTrafficDomains = 10000
+	// defaultTopTraffic is how many clients and names the report lists by
+	// default.
+	defaultTopTraffic = 10
+)
+
+// trafficRates are the windows the report gives the query rate for, in
+// minutes by name.
+var trafficRates = map[string]int{"1m": 1, "5m": 5, "15m": 15, "1h": 60}
+
+// Traffic counts the queries of the last hour per minute, in total, per
+// client and per name, so the admin API can show the busiest clients and
+// names and the blocked ones over a sliding window without the query log.
+type Traffic struct {
+	mu         sync.Mutex
+	total      rollingCounts
+	clients    map[string]*rollingCounts
+	domains    map[string]*rollingCounts
+	maxClients int
+	maxDomains int
+}
+
+// rollingCounts is the queries of a client or name, or of all of them, in
+// the minutes of the last hour.
+type rollingCounts struct {
+	buckets [trafficBuckets]trafficBucket
+	seen    int64 // minute last seen
+}
+
+type trafficBucket struct {
+	minute  int64
+	queries uint32
+	blocked uint32
+}
+
+func NewTraffic() *Traffic {
+	return &Traffic{clients: make(map[string]*rollingCounts), domains: make(map[string]*rollingCounts), maxClients: maxTrafficClients, maxDomains: maxTrafficDomains}
+}
+
+// limit lowers the clients and names counted to entries between them. It is
+// called before the first query is recorded.
+func (t *Traffic) limit(entries int) {
+	t.maxClients, t.maxDomains = halves(entries)
+}
+
+// Limit returns the number of clients and names that may be counted.
+func (t *Traffic) Limit() int {
+	return t.maxClients + t.maxDomains
+}
+
+// record counts a query from client for name, blocked by the filter or not.
+func (t *Traffic) record(client, name string, blocked bool, now time.Time) {
+	if t == nil {
+		return
+	}
+	minute := now.Unix() / 60
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.total.add(minute, blocked)
+	rollingOf(t.clients, client, t.maxClients).add(minute, blocked)
+	if name != "" {
+		rollingOf(t.domains, name, t.maxDomains).add(minute, blocked)
+	}
+}
+
+// rollingOf returns the counts of key in table, making room for new ones by
+// forgetting the least recently seen of a sample.
+func rollingOf(table map[string]*rollingCounts, key string, limit int) *rollingCounts {
+	counts, ok := table[key]
+	if ok {
+		return counts
+	}
+	if len(table) >= limit {
+		var oldest string
+		sampled := 0
+		for k, other := range table {
+			if oldest == "" || other.seen < table[oldest].seen {
+				oldest = k
+			}
+			if sampled++; sampled == evictionSample {
+				break
+			}
+		}
+		delete(table, oldest)
+	}
+	counts = &rollingCounts{}
+	table[key] = counts
+	return counts
+}
+
+func (c *rollingCounts) add(minute int64, blocked bool) {
+	b := &c.buckets[minute%trafficBuckets]
+	if b.minute > minute {
+		// counted an hour late, the bucket is a later minute's now
+		return
+	}
+	if minute > c.seen {
+		c.seen = minute
+	}
+	if b.minute != minute {
+		*b = trafficBucket{minute: minute}
+	}
+	b.queries++
+	if blocked {
+		b.blocked++
+	}
+}
+
+// sum returns the queries and blocked queries of the window of minutes
+// ending at minute.
+func (c *rollingCounts) sum(minute int64, minutes int) (queries, blocked uint64) {
+	for _, b := range c.buckets {
+		if minute-b.minute < int64(minutes) {
+			queries += uint64(b.queries)
+			blocked += uint64(b.blocked)
+		}
+	}
+	return queries, blocked
+}
+
+// TrafficCount is the queries of a client or name in the window of a
+// report.
+type TrafficCount struct {
+	Name    string `json:"name"`
+	Queries uint64 `json:"queries"`
+	Blocked uint64 `json:"blocked"`
+}
+
+// TrafficMinute is the queries of one minute of the window of a report.
+type TrafficMinute struct {
+	Time    time.Time `json:"time"`
+	Queries uint64    `json:"queries"`
+	Blocked uint64    `json:"blocked"`
+}
+
+// TrafficReport is the traffic of a window as shown by the admin API. Rates
+// are in queries per second over each of the windows up to an hour.
+type TrafficReport struct {
+	Window     string             `json:"window"`
+	Queries    uint64             `json:"queries"`
+	Blocked    uint64             `json:"blocked"`
+	Rates      map[string]float64 `json:"rates"`
+	PerMinute  []TrafficMinute    `json:"per_minute"`
+	Clients    []TrafficCount     `json:"top_clients"`
+	Domains    []TrafficCount     `json:"top_domains"`
+	BlockedTop []TrafficCount     `json:"top_blocked"`
+}
+
+// parseTrafficWindow parses the window of a report, whole minutes up to an
+// hour.
+func parseTrafficWindow(s string) (time.Duration, error) {
+	window, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if window < time.Minute || window > trafficBuckets*time.Minute || window%time.Minute != 0 {
+		return 0, fmt.Errorf("window %s is not whole minutes from 1m to %s", window, trafficBuckets*time.Minute)
+	}
+	return window, nil
+}
+
+// Report lists the top clients, names and blocked names of the window ending
+// at now, its queries minute by minute and the query rates.
+func (t *Traffic) Report(window time.Duration, top int, now time.Time) TrafficReport {
+	report := TrafficReport{Window: window.String(), Rates: make(map[string]float64)}
+	if t == nil {
+		return report
+	}
+	minute, minutes := now.Unix()/60, int(window/time.Minute)
+	// the current minute is only partly over
+	elapsed := time.Duration(now.Unix()%60)*time.Second + time.Second
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	report.Queries, report.Blocked = t.total.sum(minute, minutes)
+	for m := minute - int64(minutes) + 1; m <= minute; m++ {
+		point := TrafficMinute{Time: time.Unix(m*60, 0).UTC()}
+		if b := t.total.buckets[m%trafficBuckets]; b.minute == m {
+			point.Queries, point.Blocked = uint64(b.queries), uint64(b.blocked)
+		}
+		report.PerMinute = append(report.PerMinute, point)
+	}
+	for name, n := range trafficRates {
+		queries, _ := t.total.sum(minute, n)
+		report.Rates[name] = float64(queries) / (time.Duration(n-1)*time.Minute + elapsed).Seconds()
+	}
+	report.Clients = topTraffic(t.clients, minute, minutes, top, false)
+	report.Domains = topTraffic(t.domains, minute, minutes, top, false)
+	report.BlockedTop = topTraffic(t.domains, minute, minutes, top, true)
+	return report
+}
+
+// topTraffic returns the top entries of table by queries, or by blocked
+// queries with byBlocked.
+func topTraffic(table map[string]*rollingCounts, minute int64, minutes, top int, byBlocked bool) []TrafficCount {
+	counts := make([]TrafficCount, 0)
+	for name, c := range table {
+		queries, blocked := c.sum(minute, minutes)
+		if queries == 0 || byBlocked && blocked == 0 {
+			continue
+		}
+		counts = append(counts, TrafficCount{Name: name, Queries: queries, Blocked: blocked})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		a, b := counts[i].Queries, counts[j].Queries
+		if byBlocked {
+			a, b = counts[i].Blocked, counts[j].Blocked
+		}
+		if a != b {
+			return a > b
+		}
+		return counts[i].Name < counts[j].Name
+	})
+	if len(counts) > top {
+		counts = counts[:top]
+	}
+	return counts
+}
+
+// Tracked returns the number of clients and names counted.
+func (t *Traffic) Tracked() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.clients) + len(t.domains)
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// trafficCounts prints counts as "name queries/blocked" joined by commas.
+func trafficCounts(counts []TrafficCount) string {
+	var s []string
+	for _, c := range counts {
+		s = append(s, fmt.Sprintf("%s %d/%d", c.Name, c.Queries, c.Blocked))
+	}
+	return strings.Join(s, ",")
+}
+
+func TestTrafficCounters(t *testing.T) {
+	tr := NewTraffic()
+	now := time.Date(2024, 1, 1, 12, 30, 29, 0, time.UTC)
+	at := func(minutesAgo int) time.Time { return now.Add(-time.Duration(minutesAgo) * time.Minute) }
+	for i := 0; i < 6; i++ {
+		tr.record("192.0.2.1", "www.example.com", false, at(0))
+	}
+	for i := 0; i < 3; i++ {
+		tr.record("192.0.2.2", "ads.example.net", true, at(2))
+	}
+	tr.record("192.0.2.2", "www.example.com", false, at(4))
+	tr.record("192.0.2.3", "tracker.example.org", true, at(10))
+	tr.record("192.0.2.3", "www.example.com", false, at(59))
+	tr.record("192.0.2.4", "", false, at(1))             // no question: the client counts, no name
+	tr.record("192.0.2.9", "old.example", false, at(60)) // an hour late, in the slot of the current minute
+
+	tests := []struct {
+		window         time.Duration
+		queries        uint64
+		blocked        uint64
+		clients        string
+		domains        string
+		blockedDomains string
+	}{
+		{time.Minute, 6, 0, "192.0.2.1 6/0", "www.example.com 6/0", ""},
+		{5 * time.Minute, 11, 3, "192.0.2.1 6/0,192.0.2.2 4/3,192.0.2.4 1/0", "www.example.com 7/0,ads.example.net 3/3", "ads.example.net 3/3"},
+		{time.Hour, 13, 4, "192.0.2.1 6/0,192.0.2.2 4/3,192.0.2.3 2/1,192.0.2.4 1/0", "www.example.com 8/0,ads.example.net 3/3,tracker.example.org 1/1", "ads.example.net 3/3,tracker.example.org 1/1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.window.String(), func(t *testing.T) {
+			report := tr.Report(tt.window, 10, now)
+			if report.Window != tt.window.String() || report.Queries != tt.queries || report.Blocked != tt.blocked {
+				t.Errorf("window %s with %d queries, %d blocked, want %d and %d", report.Window, report.Queries, report.Blocked, tt.queries, tt.blocked)
+			}
+			if got := trafficCounts(report.Clients); got != tt.clients {
+				t.Errorf("top clients %s, want %s", got, tt.clients)
+			}
+			if got := trafficCounts(report.Domains); got != tt.domains {
+				t.Errorf("top domains %s, want %s", got, tt.domains)
+			}
+			if got := trafficCounts(report.BlockedTop); got != tt.blockedDomains {
+				t.Errorf("top blocked %s, want %s", got, tt.blockedDomains)
+			}
+			if len(report.PerMinute) != int(tt.window/time.Minute) {
+				t.Fatalf("%d minutes, want one per minute of the window", len(report.PerMinute))
+			}
+			var sum uint64
+			for _, m := range report.PerMinute {
+				sum += m.Queries
+			}
+			if last := report.PerMinute[len(report.PerMinute)-1]; sum != tt.queries || !last.Time.Equal(time.Date(2024, 1, 1, 12, 30, 0, 0, time.UTC)) || last.Queries != 6 {
+				t.Errorf("per minute %+v, want the current minute last and %d queries in all", report.PerMinute, tt.queries)
+			}
+		})
+	}
+
+	// the top is cut, ties going by name
+	if got := trafficCounts(tr.Report(time.Hour, 2, now).Clients); got != "192.0.2.1 6/0,192.0.2.2 4/3" {
+		t.Errorf("top 2 clients %s", got)
+	}
+	tr.record("192.0.2.5", "a.example", false, at(0))
+	tr.record("192.0.2.5", "b.example", false, at(0))
+	if got := trafficCounts(tr.Report(time.Minute, 3, now).Domains); got != "www.example.com 6/0,a.example 1/0,b.example 1/0" {
+		t.Errorf("top 3 domains %s, want the ties by name", got)
+	}
+}
+
+func TestTrafficRates(t *testing.T) {
+	tr := NewTraffic()
+	// 29 seconds into the minute, so 30 seconds of it counted
+	now := time.Date(2024, 1, 1, 12, 30, 29, 0, time.UTC)
+	for i := 0; i < 60; i++ {
+		tr.record("192.0.2.1", "www.example.com", false, now)
+	}
+	for i := 0; i < 240; i++ {
+		tr.record("192.0.2.1", "www.example.com", false, now.Add(-3*time.Minute))
+	}
+	rates := tr.Report(5*time.Minute, 10, now).Rates
+	for window, want := range map[string]float64{"1m": 60.0 / 30, "5m": 300.0 / (4*60 + 30), "15m": 300.0 / (14*60 + 30), "1h": 300.0 / (59*60 + 30)} {
+		if got := rates[window]; got != want {
+			t.Errorf("rate over %s %g, want %g", window, got, want)
+		}
+	}
+}
+
+func TestTrafficBucketsRoll(t *testing.T) {
+	tr := NewTraffic()
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tr.record("192.0.2.1", "www.example.com", false, start)
+	// an hour later the bucket of the first query is reused
+	tr.record("192.0.2.1", "www.example.com", true, start.Add(time.Hour))
+	report := tr.Report(time.Hour, 10, start.Add(time.Hour))
+	if report.Queries != 1 || report.Blocked != 1 {
+		t.Errorf("%d queries, %d blocked, want only the later one", report.Queries, report.Blocked)
+	}
+	if got := trafficCounts(report.Clients); got != "192.0.2.1 1/1" {
+		t.Errorf("clients %s, want the later query alone", got)
+	}
+}
+
+func TestTrafficForgetsOldestClients(t *testing.T) {
+	tr := NewTraffic()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i <= maxTrafficClients; i++ {
+		tr.record(fmt.Sprintf("10.%d.%d.%d", i>>16, i>>8&0xff, i&0xff), "www.example.com", false, now.Add(time.Duration(i)*time.Millisecond))
+	}
+	if n := len(tr.clients); n != maxTrafficClients {
+		t.Errorf("%d clients counted, want the limit of %d", n, maxTrafficClients)
+	}
+	// the total still has every query
+	if q := tr.Report(time.Minute, 1, now).Queries; q != maxTrafficClients+1 {
+		t.Errorf("%d queries in total, want %d", q, maxTrafficClients+1)
+	}
+}
+
+func TestParseTrafficWindow(t *testing.T) {
+	for value, want := range map[string]time.Duration{"1m": time.Minute, "5m": 5 * time.Minute, "1h": time.Hour, "90s": 0, "30s": 0, "61m": 0, "-5m": 0, "soon": 0} {
+		got, err := parseTrafficWindow(value)
+		if got != want || (err == nil) != (want != 0) {
+			t.Errorf("parseTrafficWindow(%q) = %v, %v, want %v", value, got, err, want)
+		}
+	}
+}
+
+func TestTrafficCountsQueries(t *testing.T) {
+	// the zone answers all of test, before the filter, so the blocked name
+	// is elsewhere
+	srv := newTestServer(t, "-block-domain", "ads.example")
+	srv.Zone("test").AddA("www", []byte{10, 0, 0, 1}, 60)
+	for _, name := range []string{"www.test", "www.test", "ads.example"} {
+		var query Msg
+		query.SetQuestion(name, TypeA)
+		if replies := srv.handleTest(query.Pack()); len(replies) != 1 {
+			t.Fatalf("%s: %d replies, want 1", name, len(replies))
+		}
+	}
+
+	mux := http.NewServeMux()
+	(&controlAPI{traffic: srv.traffic}).register(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/traffic?window=1m&top=5", nil))
+	var report TrafficReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("%v in %s", err, w.Body)
+	}
+	if report.Queries != 3 || report.Blocked != 1 {
+		t.Errorf("%d queries, %d blocked, want 3 and 1", report.Queries, report.Blocked)
+	}
+	if got := trafficCounts(report.Clients); got != testClient.IP.String()+" 3/1" {
+		t.Errorf("clients %s, want the test client", got)
+	}
+	if got := trafficCounts(report.Domains); got != "www.test 2/0,ads.example 1/1" {
+		t.Errorf("domains %s", got)
+	}
+	if got := trafficCounts(report.BlockedTop); got != "ads.example 1/1" {
+		t.Errorf("blocked %s", got)
+	}
+
+	for _, query := range []string{"window=2h", "window=30s", "top=-1", "top=x"} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/traffic?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, w.Code)
+		}
+	}
+}
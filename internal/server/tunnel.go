@@ -0,0 +1,216 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tunnelWindow is the period the per-client counters of the tunnel
+	// detector cover.
+	tunnelWindow = time.Minute
+	// tunnelLabelHits is how many names with suspicious labels a client may
+	// ask for in a window, hashed CDN and tracking names being common, before
+	// it is flagged.
+	tunnelLabelHits = 5
+	// tunnelEntropyLength is the shortest subdomain part whose entropy is
+	// looked at; short strings never score high.
+	tunnelEntropyLength = 24
+	// tunnelMaxTracked bounds the distinct names remembered per client and
+	// window.
+	tunnelMaxTracked = 4096
+)
+
+// TunnelAction is what happens to the queries of a client flagged as
+// tunneling.
+type TunnelAction int
+
+const (
+	TunnelLog    TunnelAction = iota // only log the client when it is flagged
+	TunnelRefuse                     // answer REFUSED
+	TunnelDrop                       // silently drop the queries
+	TunnelLimit                      // hold the client to -tunnel-limit queries per second
+)
+
+func parseTunnelAction(s string) (TunnelAction, error) {
+	switch strings.ToLower(s) {
+	case "log":
+		return TunnelLog, nil
+	case "refuse", "refused":
+		return TunnelRefuse, nil
+	case "drop":
+		return TunnelDrop, nil
+	case "limit":
+		return TunnelLimit, nil
+	}
+	return TunnelLog, fmt.Errorf("unknown tunnel action %q (want log, refuse, drop or limit)", s)
+}
+
+// TunnelDetector flags the clients whose queries look like data tunneled
+// through DNS: names with long or high entropy labels, many distinct names
+// below one domain, or lots of TXT and NULL queries, each within a minute.
+// A flagged client stays flagged for Hold after the last sign.
+//
+// The domain of a name is taken to be its last two labels, so the part of
+// name below it is where tunnels put their data.
+type TunnelDetector struct {
+	MaxLabel   int     // longest label that isn't suspicious
+	Entropy    float64 // bits per character above which the part below the domain is suspicious
+	Subdomains int     // distinct names below one domain per client and minute
+	TXTRate    int     // TXT and NULL queries per client and minute
+	Hold       time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*tunnelClient
+	sweep   time.Time
+}
+
+type tunnelClient struct {
+	window  time.Time                  // start of the current window
+	names   map[string]map[string]bool // distinct subdomain parts by domain, this window
+	tracked int
+	labels  int // names with suspicious labels, this window
+	txt     int // TXT and NULL queries, this window
+	until   time.Time
+	reason  string
+	seen    time.Time
+}
+
+// NewTunnelDetector returns a detector with the thresholds of -tunnel-*.
+func NewTunnelDetector(maxLabel int, entropy float64, subdomains, txtRate int, hold time.Duration) *TunnelDetector {
+	return &TunnelDetector{MaxLabel: maxLabel, Entropy: entropy, Subdomains: subdomains, TXTRate: txtRate, Hold: hold, clients: make(map[string]*tunnelClient)}
+}
+
+// same reports whether d has the thresholds of other, so a reload can keep
+// the flagged clients of d.
+func (d *TunnelDetector) same(other *TunnelDetector) bool {
+	return d.MaxLabel == other.MaxLabel && d.Entropy == other.Entropy && d.Subdomains == other.Subdomains &&
+		d.TXTRate == other.TXTRate && d.Hold == other.Hold
+}
+
+// Check counts the question of client and reports whether the client is
+// flagged, and why; fresh is true for the query that flagged it.
+func (d *TunnelDetector) Check(client string, question DNSQuestion, now time.Time) (flagged bool, reason string, fresh bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expire(now)
+	c, ok := d.clients[client]
+	if !ok {
+		c = &tunnelClient{}
+		d.clients[client] = c
+	}
+	c.seen = now
+	if now.Sub(c.window) >= tunnelWindow {
+		c.window, c.names, c.tracked, c.labels, c.txt = now, make(map[string]map[string]bool), 0, 0, 0
+	}
+
+	sign := ""
+	if question.Type == TypeTXT || question.Type == TypeNULL {
+		if c.txt++; c.txt > d.TXTRate {
+			sign = fmt.Sprintf("more than %d TXT and NULL queries in %s", d.TXTRate, tunnelWindow)
+		}
+	}
+	labels := strings.Split(canonicalName(domainName(question.Name)), ".")
+	if len(labels) > 2 {
+		domain := strings.Join(labels[len(labels)-2:], ".")
+		sub := labels[:len(labels)-2]
+		if d.suspicious(sub) {
+			if c.labels++; c.labels >= tunnelLabelHits {
+				sign = fmt.Sprintf("%d names with long or high entropy labels in %s, e.g. below %s", c.labels, tunnelWindow, domain)
+			}
+		}
+		names := c.names[domain]
+		if names == nil && c.tracked < tunnelMaxTracked {
+			names = make(map[string]bool)
+			c.names[domain] = names
+		}
+		part := strings.Join(sub, ".")
+		if names != nil && !names[part] && len(names) <= d.Subdomains && c.tracked < tunnelMaxTracked {
+			names[part] = true
+			c.tracked++
+		}
+		if len(names) > d.Subdomains {
+			sign = fmt.Sprintf("more than %d distinct names below %s in %s", d.Subdomains, domain, tunnelWindow)
+		}
+	}
+
+	wasFlagged := now.Before(c.until)
+	if sign != "" {
+		c.until, c.reason = now.Add(d.Hold), sign
+	}
+	if !now.Before(c.until) {
+		return false, "", false
+	}
+	return true, c.reason, !wasFlagged
+}
+
+// suspicious reports whether the labels below the domain of a name look like
+// encoded data: one longer than MaxLabel, or all of them together long and
+// random enough.
+func (d *TunnelDetector) suspicious(labels []string) bool {
+	for _, label := range labels {
+		if len(label) > d.MaxLabel {
+			return true
+		}
+	}
+	data := strings.Join(labels, "")
+	return len(data) >= tunnelEntropyLength && shannonEntropy(data) > d.Entropy
+}
+
+// shannonEntropy returns the entropy of the bytes of s in bits per byte.
+func shannonEntropy(s string) float64 {
+	var counts [256]int
+	for i := 0; i < len(s); i++ {
+		counts[s[i]]++
+	}
+	entropy := 0.0
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / float64(len(s))
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
+
+// expire forgets the clients that are neither flagged nor seen within the
+// last window.
+func (d *TunnelDetector) expire(now time.Time) {
+	if now.Sub(d.sweep) < tunnelWindow {
+		return
+	}
+	d.sweep = now
+	for client, c := range d.clients {
+		if now.Sub(c.seen) > tunnelWindow && !now.Before(c.until) {
+			delete(d.clients, client)
+		}
+	}
+}
+
+// FlaggedClient is a client flagged as tunneling, for the admin API.
+type FlaggedClient struct {
+	Client string    `json:"client"`
+	Reason string    `json:"reason"`
+	Until  time.Time `json:"until"`
+}
+
+// Flagged returns the clients flagged at now, the latest flagged first.
+func (d *TunnelDetector) Flagged(now time.Time) []FlaggedClient {
+	flagged := make([]FlaggedClient, 0)
+	if d == nil {
+		return flagged
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for client, c := range d.clients {
+		if now.Before(c.until) {
+			flagged = append(flagged, FlaggedClient{Client: client, Reason: c.reason, Until: c.until})
+		}
+	}
+	sort.Slice(flagged, func(i, j int) bool { return flagged[i].Until.After(flagged[j].Until) })
+	return flagged
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tunnelData returns the i-th label of encoded data, 52 characters of
+// base32 as tunnels like iodine and dnscat2 send them.
+func tunnelData(i int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprint(i)))
+	return strings.ToLower(strings.TrimRight(base32.StdEncoding.EncodeToString(sum[:]), "="))
+}
+
+func tunnelQuestion(t *testing.T, name string, qtype uint16) DNSQuestion {
+	t.Helper()
+	wire, err := encodeDomainName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return DNSQuestion{Name: wire, Type: qtype, Class: ClassIN}
+}
+
+func TestShannonEntropy(t *testing.T) {
+	tests := []struct {
+		s    string
+		want float64
+	}{
+		{"", 0},
+		{"aaaaaaaa", 0},
+		{"abababab", 1},
+		{"abcdefghijklmnop", 4},
+		{"0123456789abcdef0123456789abcdef", 4}, // hex never goes above 4
+	}
+	for _, tt := range tests {
+		if got := shannonEntropy(tt.s); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("entropy of %q: %g, want %g", tt.s, got, tt.want)
+		}
+	}
+	if e := shannonEntropy(tunnelData(0)); e <= 4 {
+		t.Errorf("entropy of base32 data %g, want above 4", e)
+	}
+}
+
+func TestTunnelDetectorThresholds(t *testing.T) {
+	type query struct {
+		name  string
+		qtype uint16
+	}
+	repeat := func(n int, f func(i int) query) []query {
+		queries := make([]query, n)
+		for i := range queries {
+			queries[i] = f(i)
+		}
+		return queries
+	}
+	tests := []struct {
+		name    string
+		queries []query
+		flagged int // index of the query that flags the client, -1 for none
+		reason  string
+	}{
+		{
+			"clean browsing",
+			repeat(200, func(i int) query {
+				names := []string{"www.example.com", "mail.google.com", "example.org", "cdn.a1b2c3d4.example.net", "api.github.com"}
+				return query{names[i%len(names)], []uint16{TypeA, TypeAAAA, TypeMX}[i%3]}
+			}),
+			-1, "",
+		},
+		{
+			"long but readable labels",
+			repeat(20, func(i int) query {
+				return query{fmt.Sprintf("this-is-a-long-but-quite-readable-name-%d.example.com", i), TypeA}
+			}),
+			-1, "",
+		},
+		{"hashed names below the limit", repeat(tunnelLabelHits-1, func(i int) query { return query{tunnelData(i) + ".cdn.example", TypeA} }), -1, ""},
+		{"encoded labels", repeat(10, func(i int) query { return query{tunnelData(i) + ".t.example", TypeA} }), tunnelLabelHits - 1, "names with long or high entropy labels in 1m0s, e.g. below t.example"},
+		{"overlong labels", repeat(10, func(i int) query { return query{strings.Repeat("a", 51) + fmt.Sprint(i) + ".t.example", TypeA} }), tunnelLabelHits - 1, "names with long or high entropy labels"},
+		{"TXT at the rate", repeat(10, func(int) query { return query{"example.com", TypeTXT} }), -1, ""},
+		{"TXT over the rate", repeat(12, func(i int) query { return query{"example.com", []uint16{TypeTXT, TypeNULL}[i%2]} }), 10, "more than 10 TXT and NULL queries in 1m0s"},
+		{"same names again", repeat(100, func(i int) query { return query{fmt.Sprintf("h%d.example.com", i%20), TypeA} }), -1, ""},
+		{"subdomains at the limit", repeat(20, func(i int) query { return query{fmt.Sprintf("h%d.example.com", i), TypeA} }), -1, ""},
+		{"subdomains over the limit", repeat(25, func(i int) query { return query{fmt.Sprintf("h%d.example.com", i), TypeA} }), 20, "more than 20 distinct names below example.com in 1m0s"},
+		{"subdomains over several domains", repeat(40, func(i int) query { return query{fmt.Sprintf("h%d.example%d.com", i/2, i%2), TypeA} }), -1, ""},
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewTunnelDetector(50, 4, 20, 10, 10*time.Minute)
+			for i, q := range tt.queries {
+				flagged, reason, fresh := d.Check("192.0.2.1", tunnelQuestion(t, q.name, q.qtype), start.Add(time.Duration(i)*time.Millisecond))
+				if want := tt.flagged >= 0 && i >= tt.flagged; flagged != want || fresh != (i == tt.flagged) {
+					t.Fatalf("query %d, %s: flagged %v, fresh %v, want %v", i, q.name, flagged, fresh, want)
+				}
+				if flagged && !strings.Contains(reason, tt.reason) {
+					t.Errorf("reason %q, want %q", reason, tt.reason)
+				}
+			}
+		})
+	}
+}
+
+func TestTunnelDetectorWindowAndHold(t *testing.T) {
+	d := NewTunnelDetector(50, 4, 100, 3, 5*time.Minute)
+	txt := tunnelQuestion(t, "example.com", TypeTXT)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// three TXT queries a minute for ever stay under the rate: the counts
+	// start over with each window
+	for minute := 0; minute < 5; minute++ {
+		for i := 0; i < 3; i++ {
+			if flagged, _, _ := d.Check("192.0.2.1", txt, now.Add(time.Duration(minute)*tunnelWindow+time.Duration(i)*time.Second)); flagged {
+				t.Fatalf("flagged at minute %d", minute)
+			}
+		}
+	}
+
+	now = now.Add(time.Hour)
+	for i := 0; i < 4; i++ {
+		d.Check("192.0.2.1", txt, now)
+	}
+	// a clean client isn't caught up in it
+	if flagged, _, _ := d.Check("192.0.2.2", txt, now); flagged {
+		t.Error("another client flagged")
+	}
+	// flagged, and no longer fresh, until the hold runs out
+	www := tunnelQuestion(t, "www.example.com", TypeA)
+	if flagged, _, fresh := d.Check("192.0.2.1", www, now.Add(5*time.Minute-time.Second)); !flagged || fresh {
+		t.Errorf("within the hold: flagged %v, fresh %v, want flagged again", flagged, fresh)
+	}
+	if got := d.Flagged(now.Add(time.Minute)); len(got) != 1 || got[0].Client != "192.0.2.1" || !got[0].Until.Equal(now.Add(5*time.Minute)) {
+		t.Errorf("Flagged %+v, want 192.0.2.1 until the hold runs out", got)
+	}
+	if flagged, _, _ := d.Check("192.0.2.1", www, now.Add(5*time.Minute)); flagged {
+		t.Error("still flagged after the hold")
+	}
+	if got := d.Flagged(now.Add(5 * time.Minute)); len(got) != 0 {
+		t.Errorf("Flagged %+v after the hold, want none", got)
+	}
+
+	// each new sign extends the hold
+	later := now.Add(time.Hour)
+	for i := 0; i < 4; i++ {
+		d.Check("192.0.2.1", txt, later)
+	}
+	d.Check("192.0.2.1", txt, later.Add(30*time.Second))
+	if flagged, _, _ := d.Check("192.0.2.1", www, later.Add(5*time.Minute+15*time.Second)); !flagged {
+		t.Error("hold not extended by the fifth TXT query")
+	}
+}
+
+func TestTunnelStage(t *testing.T) {
+	for _, tt := range []struct {
+		action  string
+		replies int // to a flagged client
+		rcode   Rcode
+	}{
+		{"log", 1, RcodeSuccess},
+		{"refuse", 1, RcodeRefused},
+		{"drop", 0, 0},
+	} {
+		t.Run(tt.action, func(t *testing.T) {
+			srv := newTestServer(t, "-tunnel-detect", "-tunnel-action", tt.action, "-tunnel-txt-rate", "2")
+			srv.Zone("test").AddTXT("t", "hello", 60)
+			ask := func(client string) [][]byte {
+				var query Msg
+				query.SetQuestion("t.test", TypeTXT)
+				var replies [][]byte
+				from := &net.UDPAddr{IP: net.ParseIP(client), Port: 53000}
+				srv.handle(context.Background(), query.Pack(), from, listenEndpoint{}, func(response []byte) error {
+					replies = append(replies, append([]byte(nil), response...))
+					return nil
+				})
+				return replies
+			}
+			for i := 0; i < 2; i++ {
+				if replies := ask("192.0.2.1"); len(replies) != 1 || rcodeOf(t, replies[0]) != RcodeSuccess {
+					t.Fatalf("query %d under the rate not answered", i)
+				}
+			}
+			for i := 0; i < 2; i++ {
+				replies := ask("192.0.2.1")
+				if len(replies) != tt.replies || tt.replies > 0 && rcodeOf(t, replies[0]) != tt.rcode {
+					t.Errorf("flagged client: %d replies, want %d with %v", len(replies), tt.replies, tt.rcode)
+				}
+			}
+			if replies := ask("192.0.2.2"); len(replies) != 1 || rcodeOf(t, replies[0]) != RcodeSuccess {
+				t.Error("clean client not answered")
+			}
+		})
+	}
+}
+
+func rcodeOf(t *testing.T, response []byte) Rcode {
+	t.Helper()
+	r, _, err := parseDNSResponse(nil, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r.Header.Rcode()
+}
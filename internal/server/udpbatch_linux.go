@@ -0,0 +1,260 @@
+//go:build linux && (amd64 || arm64)
+
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/codecrafters-io/dns-server-starter-go/internal/slog"
+)
+
+// udpBatchSupported reports whether serveUDPBatch is available.
+const udpBatchSupported = true
+
+// mmsghdr is struct mmsghdr of recvmmsg(2) and sendmmsg(2).
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+	_   [4]byte
+}
+
+func recvmmsg(fd uintptr, msgs []mmsghdr) (int, error) {
+	n, _, errno := syscall.Syscall6(syscall.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&msgs[0])), uintptr(len(msgs)), 0, 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+func sendmmsg(fd uintptr, msgs []mmsghdr) (int, error) {
+	n, _, errno := syscall.Syscall6(sysSendmmsg, fd, uintptr(unsafe.Pointer(&msgs[0])), uintptr(len(msgs)), 0, 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+// udpReply is an answer waiting in the queue of a udpWriter. buf comes from
+// messageBuffers unless the answer was too large for one.
+type udpReply struct {
+	buf     *[]byte
+	addr    syscall.RawSockaddrAny
+	addrLen uint32
+}
+
+// udpWriter queues the answers of a socket so they are sent in batches.
+// Queries answered after the socket stopped serving get net.ErrClosed.
+type udpWriter struct {
+	mu     sync.RWMutex
+	closed bool
+	queue  chan udpReply
+}
+
+func (w *udpWriter) send(response []byte, addr *syscall.RawSockaddrAny, addrLen uint32) error {
+	buf := getBuffer()
+	if len(response) > cap(*buf) {
+		large := make([]byte, len(response))
+		buf = &large
+	}
+	*buf = (*buf)[:copy((*buf)[:cap(*buf)], response)]
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return net.ErrClosed
+	}
+	w.queue <- udpReply{buf: buf, addr: *addr, addrLen: addrLen}
+	return nil
+}
+
+func (w *udpWriter) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	close(w.queue)
+}
+
+// serveUDPBatch is serveUDP reading up to size queries per recvmmsg call and
+// writing the answers with sendmmsg, from a goroutine of their own.
+func (s *server) serveUDPBatch(conn *net.UDPConn, size int) {
+	defer s.serving.Done()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		slog.Error("error receiving data", "addr", conn.LocalAddr().String(), "err", err)
+		return
+	}
+
+	endpoint := s.listenerEndpoints[listenerKey("udp", conn.LocalAddr())]
+	writer := &udpWriter{queue: make(chan udpReply, 4*size)}
+	s.inflight.Add(1)
+	go s.writeUDPBatches(conn, raw, writer, size)
+	var pending sync.WaitGroup // queries read but not answered yet
+	defer func() {
+		// stop the writer once the last answer is queued
+		s.inflight.Add(1)
+		go func() {
+			defer s.inflight.Done()
+			pending.Wait()
+			writer.close()
+		}()
+	}()
+
+	msgs := make([]mmsghdr, size)
+	iovs := make([]syscall.Iovec, size)
+	addrs := make([]syscall.RawSockaddrAny, size)
+	bufs := make([]*[]byte, size)
+	defer func() {
+		for _, buf := range bufs {
+			if buf != nil {
+				putBuffer(buf)
+			}
+		}
+	}()
+	for {
+		limit := s.reload.current.Load().opts.maxUDPSize
+		for i := range msgs {
+			// the buffers handed to queries are replaced, and the others
+			// when -max-udp-size changed
+			if bufs[i] != nil && len(*bufs[i]) != limit {
+				putBuffer(bufs[i])
+				bufs[i] = nil
+			}
+			if bufs[i] == nil {
+				bufs[i] = getSizedBuffer(limit)
+			}
+			iovs[i].Base = &(*bufs[i])[0]
+			iovs[i].SetLen(len(*bufs[i]))
+			msgs[i] = mmsghdr{}
+			msgs[i].hdr.Name = (*byte)(unsafe.Pointer(&addrs[i]))
+			msgs[i].hdr.Namelen = syscall.SizeofSockaddrAny
+			msgs[i].hdr.Iov = &iovs[i]
+			msgs[i].hdr.Iovlen = 1
+		}
+		var n int
+		var recvErr error
+		err := raw.Read(func(fd uintptr) bool {
+			n, recvErr = recvmmsg(fd, msgs)
+			return recvErr != syscall.EAGAIN
+		})
+		if err == nil {
+			err = recvErr
+		}
+		if err != nil {
+			if !s.stopping.Load() {
+				slog.Error("error receiving data", "addr", conn.LocalAddr().String(), "err", err)
+			}
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			buf := bufs[i]
+			bufs[i] = nil
+			msg := (*buf)[:msgs[i].len]
+			addr, addrLen := addrs[i], msgs[i].hdr.Namelen
+			source := sockaddrUDP(&addr)
+			reply := func(response []byte) error {
+				return writer.send(response, &addr, addrLen)
+			}
+			if source != nil && msgs[i].hdr.Flags&syscall.MSG_TRUNC != 0 {
+				s.answerTruncated(msg, source, reply)
+				putBuffer(buf)
+				continue
+			}
+			if source == nil || !s.admit(msg, source, reply) {
+				putBuffer(buf)
+				continue
+			}
+			pending.Add(1)
+			s.inflight.Add(1)
+			go func() {
+				defer s.inflight.Done()
+				defer pending.Done()
+				defer s.release()
+				defer putBuffer(buf)
+				s.handle(context.Background(), msg, source, endpoint, reply)
+			}()
+		}
+	}
+}
+
+// writeUDPBatches sends the queued answers, as many per sendmmsg call as are
+// waiting, up to size, until the writer is closed.
+func (s *server) writeUDPBatches(conn *net.UDPConn, raw syscall.RawConn, writer *udpWriter, size int) {
+	defer s.inflight.Done()
+	msgs := make([]mmsghdr, size)
+	iovs := make([]syscall.Iovec, size)
+	replies := make([]udpReply, 0, size)
+	for first := range writer.queue {
+		replies = append(replies[:0], first)
+	drain:
+		for len(replies) < size {
+			select {
+			case reply, ok := <-writer.queue:
+				if !ok {
+					break drain
+				}
+				replies = append(replies, reply)
+			default:
+				break drain
+			}
+		}
+
+		for i := range replies {
+			iovs[i].Base = &(*replies[i].buf)[0]
+			iovs[i].SetLen(len(*replies[i].buf))
+			msgs[i] = mmsghdr{}
+			msgs[i].hdr.Name = (*byte)(unsafe.Pointer(&replies[i].addr))
+			msgs[i].hdr.Namelen = replies[i].addrLen
+			msgs[i].hdr.Iov = &iovs[i]
+			msgs[i].hdr.Iovlen = 1
+		}
+		for sent := 0; sent < len(replies); {
+			var n int
+			var sendErr error
+			err := raw.Write(func(fd uintptr) bool {
+				n, sendErr = sendmmsg(fd, msgs[sent:len(replies)])
+				return sendErr != syscall.EAGAIN
+			})
+			if err == nil {
+				err = sendErr
+			}
+			if err != nil {
+				// sendmmsg only fails on its first message, skip that one
+				client := sockaddrUDP(&replies[sent].addr)
+				slog.Error("failed to send response", "addr", conn.LocalAddr().String(), "client", client.String(), "err", err)
+				n = 1
+			}
+			sent += n
+		}
+		for _, reply := range replies {
+			putBuffer(reply.buf)
+		}
+	}
+}
+
+// sockaddrUDP converts a socket address filled in by the kernel, or returns
+// nil for a family other than IPv4 and IPv6.
+func sockaddrUDP(sa *syscall.RawSockaddrAny) *net.UDPAddr {
+	switch sa.Addr.Family {
+	case syscall.AF_INET:
+		inet4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		port := (*[2]byte)(unsafe.Pointer(&inet4.Port))
+		return &net.UDPAddr{IP: net.IPv4(inet4.Addr[0], inet4.Addr[1], inet4.Addr[2], inet4.Addr[3]), Port: int(port[0])<<8 | int(port[1])}
+	case syscall.AF_INET6:
+		inet6 := (*syscall.RawSockaddrInet6)(unsafe.Pointer(sa))
+		port := (*[2]byte)(unsafe.Pointer(&inet6.Port))
+		addr := &net.UDPAddr{IP: make(net.IP, net.IPv6len), Port: int(port[0])<<8 | int(port[1])}
+		copy(addr.IP, inet6.Addr[:])
+		if inet6.Scope_id != 0 {
+			if iface, err := net.InterfaceByIndex(int(inet6.Scope_id)); err == nil {
+				addr.Zone = iface.Name
+			}
+		}
+		return addr
+	}
+	return nil
+}
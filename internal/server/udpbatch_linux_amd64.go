@@ -0,0 +1,5 @@
+package server
+
+// sysSendmmsg is the number of sendmmsg(2), which package syscall leaves out
+// on amd64.
+const sysSendmmsg = 307
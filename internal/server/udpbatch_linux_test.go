@@ -0,0 +1,87 @@
+//go:build linux && (amd64 || arm64)
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPBatch(t *testing.T) {
+	for _, listen := range []string{"127.0.0.1:0", "[::1]:0"} {
+		t.Run(listen, func(t *testing.T) {
+			if probe, err := net.ListenPacket("udp", listen); err != nil {
+				t.Skipf("no loopback for %s: %v", listen, err)
+			} else {
+				probe.Close()
+			}
+			srv := newTestServer(t, "-listen", listen, "-udp-batch", "8", "-max-udp-size", "512", "-record", "host.lan A 10.0.0.1")
+			addr := startTestServer(t, srv)
+
+			// several clients each sending a burst, so reads return
+			// several datagrams and answers queue up for sendmmsg
+			const clients, queries = 4, 32
+			conns := make([]net.Conn, clients)
+			for c := range conns {
+				conn, err := net.Dial("udp", addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				conns[c] = conn
+			}
+			for i := 0; i < queries; i++ {
+				for c, conn := range conns {
+					var query Msg
+					query.SetQuestion("host.lan", TypeA)
+					query.Header.ID = uint16(c<<8 | i)
+					if _, err := conn.Write(query.Pack()); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			// one query over -max-udp-size, cut by the kernel, is asked to
+			// retry over TCP
+			var large Msg
+			large.SetQuestion("host.lan", TypeA)
+			large.Header.ID = 0xFFFF
+			conns[0].Write(append(large.Pack(), make([]byte, 600)...))
+
+			for c, conn := range conns {
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				seen := make(map[uint16]bool)
+				want := queries
+				if c == 0 {
+					want++
+				}
+				buf := make([]byte, 512)
+				for len(seen) < want {
+					n, err := conn.Read(buf)
+					if err != nil {
+						t.Fatalf("client %d: %d of %d answers, then %v", c, len(seen), want, err)
+					}
+					r, _, err := parseDNSResponse(nil, buf[:n])
+					if err != nil {
+						t.Fatalf("client %d: answer %x: %v", c, buf[:n], err)
+					}
+					id := r.Header.ID
+					if seen[id] {
+						t.Errorf("client %d: query %#04x answered twice", c, id)
+					}
+					seen[id] = true
+					switch {
+					case id == 0xFFFF && c == 0:
+						if r.Header.Flags&flagTC == 0 {
+							t.Errorf("oversized query answered %s without TC", flagNames(r.Header.Flags))
+						}
+					case int(id>>8) != c || int(id&0xFF) >= queries:
+						t.Errorf("client %d: answer to query %#04x of another client", c, id)
+					case len(r.Answers) != 1 || !net.IP(r.Answers[0].RData).Equal(net.IPv4(10, 0, 0, 1)):
+						t.Errorf("client %d: query %#04x answered %v", c, id, r.Answers)
+					}
+				}
+			}
+		})
+	}
+}
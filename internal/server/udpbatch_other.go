@@ -0,0 +1,13 @@
+//go:build !linux || !(amd64 || arm64)
+
+package server
+
+import "net"
+
+// udpBatchSupported is false where recvmmsg and sendmmsg are not wired up,
+// the sockets are then read one datagram at a time.
+const udpBatchSupported = false
+
+func (s *server) serveUDPBatch(conn *net.UDPConn, size int) {
+	s.serveUDP(conn)
+}
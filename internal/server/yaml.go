@@ -0,0 +1,358 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// yamlLine is a line of a YAML document without its comment and indentation.
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+// parseYAML decodes the subset of YAML configuration files like
+// AdGuardHome.yaml are written in: block mappings and sequences, flow
+// sequences, plain and quoted scalars, and literal or folded block scalars.
+// Mappings decode to map[string]any, sequences to []any and scalars to
+// strings, or nil for null. Anchors, tags and multiple documents are not
+// supported.
+func parseYAML(data string) (any, error) {
+	p := &yamlParser{}
+	raw := strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n")
+	for i := 0; i < len(raw); i++ {
+		text := strings.TrimRight(raw[i], " \t")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed[0] == '#' || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+		line := yamlLine{number: i + 1, indent: len(text) - len(trimmed), text: trimmed}
+		if p.blockScalar(trimmed) {
+			// the lines of a block scalar are kept whole, comments and all
+			p.lines = append(p.lines, line)
+			for i+1 < len(raw) {
+				next := strings.TrimRight(raw[i+1], " \t")
+				if next != "" && len(next)-len(strings.TrimLeft(next, " ")) <= line.indent {
+					break
+				}
+				i++
+				indent := len(next) - len(strings.TrimLeft(next, " "))
+				if next == "" {
+					indent = line.indent + 1
+				}
+				p.lines = append(p.lines, yamlLine{number: i + 1, indent: indent, text: "\x00" + next})
+			}
+			continue
+		}
+		line.text = yamlStripComment(trimmed)
+		p.lines = append(p.lines, line)
+	}
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+	value, err := p.block(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, p.errorf("unexpected indentation")
+	}
+	return value, nil
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func (p *yamlParser) errorf(format string, args ...any) error {
+	line := 0
+	if p.pos < len(p.lines) {
+		line = p.lines[p.pos].number
+	} else if len(p.lines) > 0 {
+		line = p.lines[len(p.lines)-1].number
+	}
+	return fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+// blockScalar reports whether a line ends in the | or > that starts a block
+// scalar.
+func (p *yamlParser) blockScalar(text string) bool {
+	text = yamlStripComment(text)
+	for _, indicator := range []string{"|", "|-", "|+", ">", ">-", ">+"} {
+		if text == indicator || strings.HasSuffix(text, ": "+indicator) || strings.HasSuffix(text, "- "+indicator) {
+			return true
+		}
+	}
+	return false
+}
+
+// block parses the sequence or mapping whose lines are indented by indent.
+func (p *yamlParser) block(indent int) (any, error) {
+	line := p.lines[p.pos]
+	if line.text == "-" || strings.HasPrefix(line.text, "- ") {
+		return p.sequence(indent)
+	}
+	if _, _, ok := yamlKey(line.text); ok {
+		return p.mapping(indent)
+	}
+	p.pos++
+	return yamlScalar(line.text)
+}
+
+func (p *yamlParser) sequence(indent int) ([]any, error) {
+	items := []any{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent != indent || !(line.text == "-" || strings.HasPrefix(line.text, "- ")) {
+			break
+		}
+		content := strings.TrimSpace(strings.TrimPrefix(line.text, "-"))
+		if content == "" {
+			p.pos++
+			value, err := p.nested(indent, true)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, value)
+			continue
+		}
+		// the item continues on this line: parse it as a block indented to
+		// where its content starts
+		offset := len(line.text) - len(strings.TrimLeft(line.text[1:], " "))
+		p.lines[p.pos] = yamlLine{number: line.number, indent: indent + offset, text: content}
+		value, err := p.item(indent + offset)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, value)
+	}
+	return items, nil
+}
+
+// item parses a sequence item that starts on the line of its dash.
+func (p *yamlParser) item(indent int) (any, error) {
+	line := p.lines[p.pos]
+	if _, _, ok := yamlKey(line.text); ok {
+		return p.mapping(indent)
+	}
+	if strings.HasPrefix(line.text, "- ") || line.text == "-" {
+		return p.sequence(indent)
+	}
+	p.pos++
+	if p.blockScalar(line.text) {
+		return p.scalarLines(line.text, indent-2)
+	}
+	return yamlScalar(line.text)
+}
+
+func (p *yamlParser) mapping(indent int) (map[string]any, error) {
+	values := map[string]any{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent != indent || line.text == "-" || strings.HasPrefix(line.text, "- ") {
+			break
+		}
+		key, rest, ok := yamlKey(line.text)
+		if !ok {
+			return nil, p.errorf("expected key: value, got %q", line.text)
+		}
+		if _, dup := values[key]; dup {
+			return nil, p.errorf("duplicate key %q", key)
+		}
+		p.pos++
+		var value any
+		var err error
+		switch {
+		case rest == "":
+			value, err = p.nested(indent, false)
+		case p.blockScalar(rest):
+			value, err = p.scalarLines(rest, indent)
+		default:
+			value, err = yamlScalar(rest)
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// nested parses the value on the lines after a key or a dash at indent:
+// a block indented further, a sequence at the same indentation after a key,
+// or nothing.
+func (p *yamlParser) nested(indent int, inSequence bool) (any, error) {
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+	next := p.lines[p.pos]
+	if next.indent > indent {
+		return p.block(next.indent)
+	}
+	if !inSequence && next.indent == indent && (next.text == "-" || strings.HasPrefix(next.text, "- ")) {
+		return p.sequence(indent)
+	}
+	return nil, nil
+}
+
+// scalarLines joins the lines of a block scalar, kept as newlines after |
+// and folded into spaces after >.
+func (p *yamlParser) scalarLines(indicator string, indent int) (string, error) {
+	var lines []string
+	for p.pos < len(p.lines) && strings.HasPrefix(p.lines[p.pos].text, "\x00") && p.lines[p.pos].indent > indent {
+		lines = append(lines, p.lines[p.pos].text[1:])
+		p.pos++
+	}
+	margin := -1
+	for _, line := range lines {
+		if trimmed := strings.TrimLeft(line, " "); trimmed != "" && (margin < 0 || len(line)-len(trimmed) < margin) {
+			margin = len(line) - len(trimmed)
+		}
+	}
+	for i, line := range lines {
+		if len(line) >= margin && margin > 0 {
+			lines[i] = line[margin:]
+		} else {
+			lines[i] = strings.TrimLeft(line, " ")
+		}
+	}
+	separator := "\n"
+	if strings.Contains(indicator, ">") {
+		separator = " "
+	}
+	text := strings.Join(lines, separator)
+	if !strings.HasSuffix(indicator, "-") {
+		text += "\n"
+	}
+	return text, nil
+}
+
+// yamlKey splits "key: value" or "key:", with the key plain or quoted.
+func yamlKey(text string) (string, string, bool) {
+	if text == "" || text[0] == '[' || text[0] == '{' {
+		return "", "", false
+	}
+	if text[0] == '"' || text[0] == '\'' {
+		end := yamlQuoteEnd(text)
+		if end < 0 || end+1 >= len(text) || text[end+1] != ':' {
+			return "", "", false
+		}
+		key, err := yamlScalar(text[:end+1])
+		if err != nil {
+			return "", "", false
+		}
+		rest := text[end+2:]
+		if rest != "" && rest[0] != ' ' {
+			return "", "", false
+		}
+		return key.(string), strings.TrimSpace(rest), true
+	}
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// yamlQuoteEnd returns the index of the quote closing the string text starts
+// with, -1 if there is none.
+func yamlQuoteEnd(text string) int {
+	quote := text[0]
+	for i := 1; i < len(text); i++ {
+		switch {
+		case quote == '"' && text[i] == '\\':
+			i++
+		case quote == '\'' && text[i] == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			i++
+		case text[i] == quote:
+			return i
+		}
+	}
+	return -1
+}
+
+// yamlStripComment removes a comment, a # at the start or after a space
+// outside quotes.
+func yamlStripComment(text string) string {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || strings.IndexByte(" [{,:-", text[i-1]) >= 0 {
+				quote = c
+			}
+		case c == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return strings.TrimRight(text[:i], " \t")
+		}
+	}
+	return text
+}
+
+// yamlScalar decodes a scalar or a flow sequence.
+func yamlScalar(text string) (any, error) {
+	text = strings.TrimSpace(text)
+	switch {
+	case text == "" || text == "~" || text == "null":
+		return nil, nil
+	case text == "{}":
+		return map[string]any{}, nil
+	case text[0] == '[':
+		if !strings.HasSuffix(text, "]") {
+			return nil, fmt.Errorf("unterminated flow sequence %q", text)
+		}
+		items := []any{}
+		rest := strings.TrimSpace(text[1 : len(text)-1])
+		for rest != "" {
+			end := len(rest)
+			if rest[0] == '"' || rest[0] == '\'' {
+				if end = yamlQuoteEnd(rest); end < 0 {
+					return nil, fmt.Errorf("unterminated string in %q", text)
+				}
+				end++
+			} else if comma := strings.IndexByte(rest, ','); comma >= 0 {
+				end = comma
+			}
+			item, err := yamlScalar(rest[:end])
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+			rest = strings.TrimSpace(rest[end:])
+			rest = strings.TrimSpace(strings.TrimPrefix(rest, ","))
+		}
+		return items, nil
+	case text[0] == '{':
+		return nil, fmt.Errorf("flow mappings are not supported: %q", text)
+	case text[0] == '\'':
+		if yamlQuoteEnd(text) != len(text)-1 {
+			return nil, fmt.Errorf("invalid quoted string %q", text)
+		}
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+	case text[0] == '"':
+		if yamlQuoteEnd(text) != len(text)-1 {
+			return nil, fmt.Errorf("invalid quoted string %q", text)
+		}
+		value, err := strconv.Unquote(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quoted string %q", text)
+		}
+		return value, nil
+	case text[0] == '&' || text[0] == '*' || text[0] == '!':
+		return nil, fmt.Errorf("anchors, aliases and tags are not supported: %q", text)
+	}
+	return text, nil
+}
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// maxCNAMEChain bounds the aliases followed within a zone for one answer.
+const maxCNAMEChain = 8
+
+// Zone holds records registered at runtime by a program embedding the
+// server, answered authoritatively without zone files or the control API:
+//
+//	zone := s.Zone("lab.local")
+//	zone.AddA("host", net.IPv4(10, 0, 0, 1), 300)
+//	zone.AddCNAME("www", "host", 300)
+//
+// Hosts are relative to the zone, "@" or "" being the zone itself, unless
+// they end with a dot. A Zone is a Handler; Zone registers it on the mux of
+// the server, and records may be added and removed while it serves.
+type Zone struct {
+	name Name
+
+	mu      sync.RWMutex
+	records map[Name][]DNSResourceRecord // by owner, in the order added
+}
+
+// NewZone returns an empty zone for name, to be registered with
+// ServeMux.Handle. ServeMux.Zone does both. It panics if name isn't valid.
+func NewZone(name string) *Zone {
+	return &Zone{name: mustParseName(name), records: make(map[Name][]DNSResourceRecord)}
+}
+
+// Name returns the name of the zone.
+func (z *Zone) Name() Name { return z.name }
+
+// Zone returns the zone of name registered on m, registering an empty one
+// the first time. It panics if another handler is registered for name.
+func (m *ServeMux) Zone(name string) *Zone {
+	zone := NewZone(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if h, ok := m.zones[zone.name]; ok {
+		registered, ok := h.(*Zone)
+		if !ok {
+			panic(fmt.Sprintf("zone %s is handled by a %T", name, h))
+		}
+		return registered
+	}
+	m.zones[zone.name] = zone
+	return zone
+}
+
+// Zone returns the zone of name answered by the server, see ServeMux.Zone.
+func (s *server) Zone(name string) *Zone {
+	return s.mux.Zone(name)
+}
+
+// owner returns the name of host in the zone, in presentation format.
+func (z *Zone) owner(host string) (string, error) {
+	name, err := z.target(host)
+	if err != nil {
+		return "", err
+	}
+	if !mustParseName(name).IsSubdomainOf(z.name) {
+		return "", fmt.Errorf("%s is not in zone %s", host, z.name)
+	}
+	return name, nil
+}
+
+// target returns the name in presentation format of host, relative to the
+// zone unless it ends with a dot, such as the name a CNAME, MX or PTR record
+// of the zone points to.
+func (z *Zone) target(host string) (string, error) {
+	var name string
+	switch {
+	case host == "" || host == "@":
+		return z.name.ASCII(), nil
+	case strings.HasSuffix(host, ".") || z.name == RootName:
+		name = host
+	default:
+		name = host + "." + z.name.ASCII()
+	}
+	if _, err := ParseName(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// Add adds a record. Its owner must be in the zone.
+func (z *Zone) Add(record DNSResourceRecord) error {
+	name := NameFromWire(record.Name)
+	if !name.IsSubdomainOf(z.name) {
+		return fmt.Errorf("%s is not in zone %s", name, z.name)
+	}
+	record.RDLength = uint16(len(record.RData))
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.records[name] = append(z.records[name], record)
+	return nil
+}
+
+// AddA adds an A record for host.
+func (z *Zone) AddA(host string, ip net.IP, ttl uint32) error {
+	if ip.To4() == nil {
+		return fmt.Errorf("%s is not an IPv4 address", ip)
+	}
+	name, err := z.owner(host)
+	if err != nil {
+		return err
+	}
+	return z.Add(A(name, ip, ttl))
+}
+
+// AddAAAA adds an AAAA record for host.
+func (z *Zone) AddAAAA(host string, ip net.IP, ttl uint32) error {
+	if ip.To16() == nil || ip.To4() != nil {
+		return fmt.Errorf("%s is not an IPv6 address", ip)
+	}
+	name, err := z.owner(host)
+	if err != nil {
+		return err
+	}
+	return z.Add(AAAA(name, ip, ttl))
+}
+
+// AddCNAME makes host an alias of target.
+func (z *Zone) AddCNAME(host, target string, ttl uint32) error {
+	name, err := z.owner(host)
+	if err != nil {
+		return err
+	}
+	to, err := z.target(target)
+	if err != nil {
+		return err
+	}
+	return z.Add(CNAME(name, to, ttl))
+}
+
+// AddMX adds a mail exchanger for host.
+func (z *Zone) AddMX(host string, preference uint16, exchange string, ttl uint32) error {
+	name, err := z.owner(host)
+	if err != nil {
+		return err
+	}
+	to, err := z.target(exchange)
+	if err != nil {
+		return err
+	}
+	return z.Add(MX(name, preference, to, ttl))
+}
+
+// AddPTR adds a PTR record for host, in a reverse zone such as
+// 168.192.in-addr.arpa.
+func (z *Zone) AddPTR(host, target string, ttl uint32) error {
+	name, err := z.owner(host)
+	if err != nil {
+		return err
+	}
+	to, err := z.target(target)
+	if err != nil {
+		return err
+	}
+	return z.Add(PTR(name, to, ttl))
+}
+
+// AddTXT adds a TXT record for host.
+func (z *Zone) AddTXT(host, text string, ttl uint32) error {
+	name, err := z.owner(host)
+	if err != nil {
+		return err
+	}
+	return z.Add(TXT(name, text, ttl))
+}
+
+// Remove removes the records of host of type rrtype, or all of them for
+// TypeANY, and returns how many there were.
+func (z *Zone) Remove(host string, rrtype uint16) int {
+	owner, err := z.owner(host)
+	if err != nil {
+		return 0
+	}
+	name := mustParseName(owner)
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	kept := z.records[name][:0]
+	removed := 0
+	for _, record := range z.records[name] {
+		if rrtype == TypeANY || record.Type == rrtype {
+			removed++
+			continue
+		}
+		kept = append(kept, record)
+	}
+	if len(kept) == 0 {
+		delete(z.records, name)
+	} else {
+		z.records[name] = kept
+	}
+	return removed
+}
+
+// Records returns a copy of the records of the zone.
+func (z *Zone) Records() []DNSResourceRecord {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	var records []DNSResourceRecord
+	for _, owned := range z.records {
+		records = append(records, owned...)
+	}
+	return records
+}
+
+// ServeDNS answers the first question from the records of the zone: the
+// records of its type, of any type for ANY, or the CNAME of the name
+// followed within the zone. A name without records gets NXDOMAIN, unless
+// names below it have some, RFC 8020.
+func (z *Zone) ServeDNS(w ResponseWriter, r *Msg) {
+	var m Msg
+	m.SetReply(r).SetAuthoritative(true)
+	if len(r.Question) != 1 {
+		w.WriteMsg(m.SetRcode(RcodeFormErr))
+		return
+	}
+	z.answer(&m, r.Question[0])
+	w.WriteMsg(&m)
+}
+
+// answer adds the answer to question to m.
+func (z *Zone) answer(m *Msg, question DNSQuestion) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	name := NameFromWire(question.Name)
+	owner := question.Name // answers keep the case the client asked in
+	for hop := 0; hop < maxCNAMEChain; hop++ {
+		owned, ok := z.records[name]
+		if !ok {
+			if hop == 0 && !z.hasBelow(name) {
+				m.SetRcode(RcodeNXDomain)
+			}
+			return
+		}
+		found := false
+		var alias *DNSResourceRecord
+		for i, record := range owned {
+			switch {
+			case record.Type == question.Type || question.Type == TypeANY:
+				record.Name = owner
+				m.AddAnswer(record)
+				found = true
+			case record.Type == TypeCNAME:
+				alias = &owned[i]
+			}
+		}
+		if found || alias == nil {
+			return
+		}
+		cname := *alias
+		cname.Name = owner
+		m.AddAnswer(cname)
+		res, err := cname.Resource()
+		if err != nil {
+			return
+		}
+		target := res.(*CNAMEResource).Target
+		name, owner = mustParseName(target), labelSequence(target)
+		if !name.IsSubdomainOf(z.name) {
+			return // the client resolves the rest
+		}
+	}
+}
+
+// hasBelow reports whether a name below name has records, making name an
+// empty non-terminal.
+func (z *Zone) hasBelow(name Name) bool {
+	for owner := range z.records {
+		if owner != name && owner.IsSubdomainOf(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestZoneAnswers(t *testing.T) {
+	srv := newTestServer(t)
+	zone := srv.Zone("lab.local")
+	for _, err := range []error{
+		zone.AddA("host", net.IPv4(10, 0, 0, 1), 300),
+		zone.AddCNAME("www", "host", 300),
+		zone.AddCNAME("cdn", "edge.example.", 300),
+		zone.AddMX("@", 10, "host", 300),
+		zone.AddA("a.deep", net.IPv4(10, 0, 0, 2), 300),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range []struct {
+		name  string
+		qtype uint16
+		rcode Rcode
+		want  []string
+	}{
+		{"host.lab.local", TypeA, RcodeSuccess, []string{"host.lab.local.\t300\tIN\tA\t10.0.0.1"}},
+		{"WWW.lab.local", TypeA, RcodeSuccess, []string{"WWW.lab.local.\t300\tIN\tCNAME\thost.lab.local.", "host.lab.local.\t300\tIN\tA\t10.0.0.1"}},
+		{"cdn.lab.local", TypeA, RcodeSuccess, []string{"cdn.lab.local.\t300\tIN\tCNAME\tedge.example."}},
+		{"lab.local", TypeMX, RcodeSuccess, []string{"lab.local.\t300\tIN\tMX\t10 host.lab.local."}},
+		{"host.lab.local", TypeAAAA, RcodeSuccess, nil},
+		{"deep.lab.local", TypeA, RcodeSuccess, nil}, // empty non-terminal
+		{"missing.lab.local", TypeA, RcodeNXDomain, nil},
+	} {
+		var query Msg
+		query.SetQuestion(tt.name, tt.qtype)
+		r := srv.exchangeTest(t, &query)
+		if r.Header.Rcode() != tt.rcode || r.Header.Flags&flagAA == 0 {
+			t.Errorf("%s %s: rcode %v, AA %v, want %v and AA", tt.name, typeName(tt.qtype), r.Header.Rcode(), r.Header.Flags&flagAA != 0, tt.rcode)
+		}
+		var got []string
+		for _, record := range r.Answers {
+			got = append(got, record.String())
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s %s: answers %q, want %q", tt.name, typeName(tt.qtype), got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s %s: answer %d is %q, want %q", tt.name, typeName(tt.qtype), i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestZoneRejectsNamesOutside(t *testing.T) {
+	zone := NewZone("lab.local")
+	if err := zone.AddA("host.other.", net.IPv4(10, 0, 0, 1), 60); err == nil {
+		t.Error("added a record outside the zone")
+	}
+	if err := zone.AddA("host", net.ParseIP("fd00::1"), 60); err == nil {
+		t.Error("added an IPv6 address as an A record")
+	}
+	if n := len(zone.Records()); n != 0 {
+		t.Errorf("%d records after failed adds, want 0", n)
+	}
+}
+
+func TestZoneRemove(t *testing.T) {
+	srv := newTestServer(t)
+	zone := srv.Zone("lab.local")
+	zone.AddA("host", net.IPv4(10, 0, 0, 1), 60)
+	zone.AddA("host", net.IPv4(10, 0, 0, 2), 60)
+	zone.AddTXT("host", "v=1", 60)
+	if n := zone.Remove("host", TypeA); n != 2 {
+		t.Errorf("removed %d A records, want 2", n)
+	}
+	var query Msg
+	query.SetQuestion("host.lab.local", TypeA)
+	if r := srv.exchangeTest(t, &query); r.Header.Rcode() != RcodeSuccess || len(r.Answers) != 0 {
+		t.Errorf("host A after removal: rcode %v, %d answers, want NOERROR without answers", r.Header.Rcode(), len(r.Answers))
+	}
+	if n := zone.Remove("host", TypeANY); n != 1 {
+		t.Errorf("removed %d remaining records, want 1", n)
+	}
+	if r := srv.exchangeTest(t, &query); r.Header.Rcode() != RcodeNXDomain {
+		t.Errorf("host A after removing everything: rcode %v, want NXDOMAIN", r.Header.Rcode())
+	}
+	if srv.Zone("lab.local") != zone {
+		t.Error("Zone registered a second zone for the same name")
+	}
+}
@@ -0,0 +1,431 @@
+package server
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// writeZoneFile writes records as a master file of RFC 1035 for the zone
+// origin, for backup or to move the zone to another server: an $ORIGIN line,
+// then a record per line with its absolute owner, TTL and class, in
+// canonical order of the owners, then by type, so two exports diff well.
+// The zones of the server have no SOA unless one was added, which other
+// servers want at the apex before they load the file.
+func writeZoneFile(w io.Writer, origin Name, records []DNSResourceRecord) error {
+	sorted := append([]DNSResourceRecord(nil), records...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := NameFromWire(sorted[i].Name), NameFromWire(sorted[j].Name)
+		if c := a.Compare(b); c != 0 {
+			return c < 0
+		}
+		// the SOA leads the apex
+		if (sorted[i].Type == TypeSOA) != (sorted[j].Type == TypeSOA) {
+			return sorted[i].Type == TypeSOA
+		}
+		return sorted[i].Type < sorted[j].Type
+	})
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "$ORIGIN %s\n", origin.ASCII())
+	for _, record := range sorted {
+		fmt.Fprintln(bw, record)
+	}
+	return bw.Flush()
+}
+
+// parseZoneFile reads the records of a master file, RFC 1035 5.1, as
+// writeZoneFile writes them and other servers export them: $ORIGIN and $TTL
+// lines, owners relative to the origin, @ or left blank for the one before,
+// TTL and class in either order, data continued over lines in parentheses,
+// and the generic data of RFC 3597 for any type. origin applies until an
+// $ORIGIN line; $INCLUDE isn't supported.
+func parseZoneFile(r io.Reader, origin Name) ([]DNSResourceRecord, error) {
+	var (
+		records []DNSResourceRecord
+		owner   []byte
+		ttl     uint32 = defaultRecordTTL
+		tokens  []zoneToken
+		blank   bool // the entry starts with a blank, it has no owner
+		depth   int  // of the parentheses open
+		line    int
+		start   int // line of the entry
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if depth == 0 {
+			tokens, start = tokens[:0], line
+			blank = text != "" && (text[0] == ' ' || text[0] == '\t')
+		}
+		var err error
+		if tokens, err = splitZoneLine(text, tokens, &depth); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if depth > 0 || len(tokens) == 0 {
+			continue
+		}
+
+		if first := tokens[0]; !blank && !first.quoted && strings.HasPrefix(first.text, "$") {
+			if len(tokens) != 2 {
+				return nil, fmt.Errorf("line %d: %s wants one argument", start, first.text)
+			}
+			switch strings.ToUpper(first.text) {
+			case "$ORIGIN":
+				sequence, err := encodeDomainName(zoneName(tokens[1].text, origin))
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", start, err)
+				}
+				origin = NameFromWire(sequence)
+			case "$TTL":
+				value, err := strconv.ParseUint(tokens[1].text, 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid TTL %q", start, tokens[1].text)
+				}
+				ttl = uint32(value)
+			default:
+				return nil, fmt.Errorf("line %d: unsupported directive %s", start, first.text)
+			}
+			continue
+		}
+
+		fields := tokens
+		if !blank {
+			if owner, err = encodeDomainName(zoneName(fields[0].text, origin)); err != nil {
+				return nil, fmt.Errorf("line %d: %w", start, err)
+			}
+			fields = fields[1:]
+		} else if owner == nil {
+			return nil, fmt.Errorf("line %d: record without an owner", start)
+		}
+		record := DNSResourceRecord{Name: owner, Class: ClassIN, TTL: ttl}
+		for typed := false; !typed; fields = fields[1:] {
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("line %d: record without a type", start)
+			}
+			field := fields[0].text
+			if value, err := strconv.ParseUint(field, 10, 32); err == nil {
+				record.TTL, ttl = uint32(value), uint32(value)
+			} else if class, err := parseClass(field); err == nil {
+				record.Class = class
+			} else if record.Type, err = parseType(field); err == nil {
+				typed = true
+			} else {
+				return nil, fmt.Errorf("line %d: %w", start, err)
+			}
+		}
+		if record.RData, err = parseZoneRData(record.Type, fields, origin); err != nil {
+			return nil, fmt.Errorf("line %d: %s record: %w", start, typeName(record.Type), err)
+		}
+		record.RDLength = uint16(len(record.RData))
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if depth > 0 {
+		return nil, fmt.Errorf("line %d: parenthesis not closed", start)
+	}
+	return records, nil
+}
+
+// zoneToken is a field of a master file as written, escapes kept, without
+// the quotes of a quoted one.
+type zoneToken struct {
+	text   string
+	quoted bool
+}
+
+// splitZoneLine appends the fields of a line of a master file to tokens,
+// dropping the comment and tracking the parentheses open in depth.
+func splitZoneLine(line string, tokens []zoneToken, depth *int) ([]zoneToken, error) {
+	for i := 0; i < len(line); {
+		switch c := line[i]; c {
+		case ' ', '\t', '\r':
+			i++
+		case ';':
+			return tokens, nil
+		case '(':
+			*depth++
+			i++
+		case ')':
+			if *depth == 0 {
+				return tokens, fmt.Errorf("unbalanced parenthesis")
+			}
+			*depth--
+			i++
+		case '"':
+			end := i + 1
+			for ; end < len(line) && line[end] != '"'; end++ {
+				if line[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(line) {
+				return tokens, fmt.Errorf("unterminated quoted string")
+			}
+			tokens = append(tokens, zoneToken{text: line[i+1 : end], quoted: true})
+			i = end + 1
+		default:
+			end := i
+			for ; end < len(line) && strings.IndexByte(" \t\r;()\"", line[end]) < 0; end++ {
+				if line[end] == '\\' {
+					end++
+				}
+			}
+			if end > len(line) {
+				end = len(line)
+			}
+			tokens = append(tokens, zoneToken{text: line[i:end]})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// zoneName returns name of a master file as an absolute name: @ is the
+// origin, and names without the trailing dot are relative to it.
+func zoneName(name string, origin Name) string {
+	switch {
+	case name == "@":
+		return origin.ASCII()
+	case strings.HasSuffix(name, ".") && (len(name)-len(strings.TrimRight(name[:len(name)-1], "\\")))%2 == 1:
+		return name // the dot isn't escaped
+	case origin == RootName:
+		return name + "."
+	}
+	return name + "." + origin.ASCII()
+}
+
+// parseZoneRData packs the data of a record of type rrtype from its fields
+// in a master file.
+func parseZoneRData(rrtype uint16, fields []zoneToken, origin Name) ([]byte, error) {
+	if len(fields) > 0 && fields[0].text == `\#` && !fields[0].quoted {
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("generic data without its length")
+		}
+		length, err := strconv.ParseUint(fields[1].text, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid length %q of generic data", fields[1].text)
+		}
+		var digits strings.Builder
+		for _, field := range fields[2:] {
+			digits.WriteString(field.text)
+		}
+		rdata, err := hex.DecodeString(digits.String())
+		if err != nil || len(rdata) != int(length) {
+			return nil, fmt.Errorf("generic data not %d bytes in hex", length)
+		}
+		return rdata, nil
+	}
+
+	texts := make([]string, len(fields))
+	for i, field := range fields {
+		texts[i] = field.text
+	}
+	want := func(n int, what string) error {
+		if len(fields) != n {
+			return fmt.Errorf("invalid data %q, want %s", strings.Join(texts, " "), what)
+		}
+		return nil
+	}
+	res := newResource(rrtype)
+	switch res := res.(type) {
+	case *AResource, *AAAAResource:
+		if err := want(1, "an address"); err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(texts[0])
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", texts[0])
+		}
+		if a, ok := res.(*AResource); ok {
+			a.IP = ip
+		} else {
+			res.(*AAAAResource).IP = ip
+		}
+	case *NSResource, *CNAMEResource, *DNAMEResource, *PTRResource:
+		if err := want(1, "a name"); err != nil {
+			return nil, err
+		}
+		name := zoneName(texts[0], origin)
+		switch res := res.(type) {
+		case *NSResource:
+			res.Host = name
+		case *CNAMEResource:
+			res.Target = name
+		case *DNAMEResource:
+			res.Target = name
+		case *PTRResource:
+			res.Target = name
+		}
+	case *MXResource:
+		if err := want(2, "preference and exchange"); err != nil {
+			return nil, err
+		}
+		numbers, ok := parseNumbers(texts[:1], 16)
+		if !ok {
+			return nil, fmt.Errorf("invalid preference %q", texts[0])
+		}
+		res.Preference, res.Exchange = uint16(numbers[0]), zoneName(texts[1], origin)
+	case *SRVResource:
+		if err := want(4, "priority, weight, port and target"); err != nil {
+			return nil, err
+		}
+		numbers, ok := parseNumbers(texts[:3], 16)
+		if !ok {
+			return nil, fmt.Errorf("invalid data %q, want priority, weight, port and target", strings.Join(texts, " "))
+		}
+		res.Priority, res.Weight, res.Port = uint16(numbers[0]), uint16(numbers[1]), uint16(numbers[2])
+		res.Target = zoneName(texts[3], origin)
+	case *SOAResource:
+		if err := want(7, "mname, rname, serial, refresh, retry, expire and minimum"); err != nil {
+			return nil, err
+		}
+		numbers, ok := parseNumbers(texts[2:], 32)
+		if !ok {
+			return nil, fmt.Errorf("invalid data %q, want mname, rname, serial, refresh, retry, expire and minimum", strings.Join(texts, " "))
+		}
+		res.MName, res.RName = zoneName(texts[0], origin), zoneName(texts[1], origin)
+		res.Serial, res.Refresh, res.Retry = uint32(numbers[0]), uint32(numbers[1]), uint32(numbers[2])
+		res.Expire, res.Minimum = uint32(numbers[3]), uint32(numbers[4])
+	case *TXTResource:
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("no strings")
+		}
+		for _, s := range texts {
+			text, err := unescapeCharacterString(s)
+			if err != nil {
+				return nil, err
+			}
+			res.Text = append(res.Text, text)
+		}
+	default:
+		return nil, fmt.Errorf("data of type %s only in the generic form \\# of RFC 3597", typeName(rrtype))
+	}
+	rdata, err := res.Pack(nil)
+	if err == nil && len(rdata) > 0xFFFF {
+		err = fmt.Errorf("%d bytes of data", len(rdata))
+	}
+	return rdata, err
+}
+
+// parseNumbers parses the unsigned decimal numbers of bits bits in texts.
+func parseNumbers(texts []string, bits int) ([]uint64, bool) {
+	numbers := make([]uint64, len(texts))
+	for i, text := range texts {
+		value, err := strconv.ParseUint(text, 10, bits)
+		if err != nil {
+			return nil, false
+		}
+		numbers[i] = value
+	}
+	return numbers, true
+}
+
+// unescapeCharacterString undoes the escapes of quoteCharacterString: \DDD is
+// a byte in decimal, a backslash before anything else that character.
+func unescapeCharacterString(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' {
+			switch {
+			case i+3 < len(s) && isDigits(s[i+1:i+4]):
+				value, _ := strconv.Atoi(s[i+1 : i+4])
+				if value > 255 {
+					return "", fmt.Errorf("invalid escape in %q", s)
+				}
+				c = byte(value)
+				i += 3
+			case i+1 < len(s):
+				c = s[i+1]
+				i++
+			default:
+				return "", fmt.Errorf("invalid escape in %q", s)
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), nil
+}
+
+// WriteTo writes the records of the zone as a master file, see
+// writeZoneFile.
+func (z *Zone) WriteTo(w io.Writer) (int64, error) {
+	counter := &countingWriter{w: w}
+	err := writeZoneFile(counter, z.name, z.Records())
+	return counter.n, err
+}
+
+// ReadFrom adds the records of a master file to the zone, names relative to
+// the zone until an $ORIGIN line, see parseZoneFile. Nothing is added unless
+// every record parses and is in the zone.
+func (z *Zone) ReadFrom(r io.Reader) (int64, error) {
+	counter := &countingReader{r: r}
+	records, err := parseZoneFile(counter, z.name)
+	if err != nil {
+		return counter.n, err
+	}
+	for _, record := range records {
+		if name := NameFromWire(record.Name); !name.IsSubdomainOf(z.name) {
+			return counter.n, fmt.Errorf("%s is not in zone %s", name, z.name)
+		}
+	}
+	for _, record := range records {
+		z.Add(record)
+	}
+	return counter.n, nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// zoneRecords returns the records the server answers for names in zone: the
+// records of the Zone registered for it on mux, if any, and the local
+// records in it. It reports false when there are none.
+func zoneRecords(zone Name, mux *ServeMux, local LocalRecords) ([]DNSResourceRecord, bool) {
+	var records []DNSResourceRecord
+	found := false
+	if mux != nil {
+		mux.mu.RLock()
+		h := mux.zones[zone]
+		mux.mu.RUnlock()
+		if z, ok := h.(*Zone); ok {
+			records, found = append(records, z.Records()...), true
+		}
+	}
+	for _, record := range local {
+		if NameFromWire(record.Name).IsSubdomainOf(zone) {
+			records, found = append(records, record), true
+		}
+	}
+	return records, found
+}
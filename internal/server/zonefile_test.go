@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// recordKey identifies a record by what its wire form holds.
+func recordKey(record DNSResourceRecord) string {
+	return fmt.Sprintf("%s %d %d %d %x", NameFromWire(record.Name).ASCII(), record.Type, record.Class, record.TTL, record.RData)
+}
+
+func TestZoneFileRoundTrip(t *testing.T) {
+	zone := NewZone("lab.example")
+	for _, tt := range []struct {
+		owner string
+		ttl   uint32
+		res   Resource
+	}{
+		{"host.lab.example", 300, &AResource{IP: net.IPv4(192, 0, 2, 1)}},
+		{"lab.example", 600, &NSResource{Host: "ns.lab.example."}},
+		{"lab.example", 3600, &SOAResource{MName: "ns.lab.example.", RName: "hostmaster.lab.example.", Serial: 2024030101, Refresh: 7200, Retry: 3600, Expire: 1209600, Minimum: 300}},
+		{"lab.example", 300, &MXResource{Preference: 10, Exchange: "host.lab.example."}},
+		{"host.lab.example", 300, &AAAAResource{IP: net.ParseIP("2001:db8::1")}},
+		{"_sip._udp.lab.example", 60, &SRVResource{Priority: 1, Weight: 2, Port: 5060, Target: "host.lab.example."}},
+		{"old.lab.example", 300, &DNAMEResource{Target: "new.example."}},
+		{"www.lab.example", 300, &CNAMEResource{Target: "host.lab.example."}},
+		{"lab.example", 300, &TXTResource{Text: []string{`say "hi" \ bye`, "tab\there; (not a comment)", "\x00\xff", ""}}},
+		{`a\.b.lab.example`, 300, &TXTResource{Text: []string{"dot in a label"}}},
+		{`semi\;colon\ space.lab.example`, 300, &PTRResource{Target: `odd\(name\).example.`}},
+		{`\$dollar.lab.example`, 300, &AResource{IP: net.IPv4(192, 0, 2, 2)}},
+		{`\@.lab.example`, 300, &AResource{IP: net.IPv4(192, 0, 2, 3)}},
+		{`\"quoted\".lab.example`, 300, &AResource{IP: net.IPv4(192, 0, 2, 4)}},
+		{"lab.example", 300, &UnknownResource{RRType: 65280, Data: []byte{0xde, 0xad, 0xbe, 0xef}}},
+		{"empty.lab.example", 300, &UnknownResource{RRType: 65281}},
+	} {
+		record, err := NewRecord(tt.owner, tt.ttl, tt.res)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.owner, err)
+		}
+		if err := zone.Add(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var file bytes.Buffer
+	if _, err := zone.WriteTo(&file); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(file.String(), "\n")
+	if lines[0] != "$ORIGIN lab.example." || !strings.HasPrefix(lines[1], "lab.example.\t3600\tIN\tSOA\t") {
+		t.Errorf("export starts %q, want $ORIGIN then the SOA of the apex", lines[:2])
+	}
+
+	records, err := parseZoneFile(bytes.NewReader(file.Bytes()), RootName)
+	if err != nil {
+		t.Fatalf("export doesn't parse: %v\n%s", err, file.String())
+	}
+	want := map[string]int{}
+	for _, record := range zone.Records() {
+		want[recordKey(record)]++
+	}
+	for _, record := range records {
+		key := recordKey(record)
+		if want[key] == 0 {
+			t.Errorf("parsed %s, not exported", record)
+		}
+		want[key]--
+	}
+	if len(records) != len(zone.Records()) {
+		t.Errorf("parsed %d records, exported %d", len(records), len(zone.Records()))
+	}
+
+	// a zone read from the export exports the same file
+	copied := NewZone("lab.example")
+	if _, err := copied.ReadFrom(bytes.NewReader(file.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	var again bytes.Buffer
+	copied.WriteTo(&again)
+	if again.String() != file.String() {
+		t.Errorf("export of the copy\n%s\nwant\n%s", again.String(), file.String())
+	}
+}
+
+func TestParseZoneFile(t *testing.T) {
+	file := `$TTL 3600 ; for records without a TTL
+@	IN SOA ns hostmaster (
+		2024030101 ; serial
+		7200 3600 1209600 300 )
+	NS	ns.lab.example.
+ns	60 A	192.0.2.53
+	IN 120 AAAA 2001:db8::53
+mail.example.	MX	10 @
+txt TXT "two words" unquoted "\"\\\065"
+$ORIGIN sub
+www CNAME ns.lab.example.
+raw TYPE65280 \# 3 ab ( cd
+	ef )
+`
+	records, err := parseZoneFile(strings.NewReader(file), mustParseName("lab.example"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"lab.example.\t3600\tIN\tSOA\tns.lab.example. hostmaster.lab.example. 2024030101 7200 3600 1209600 300",
+		"lab.example.\t3600\tIN\tNS\tns.lab.example.",
+		"ns.lab.example.\t60\tIN\tA\t192.0.2.53",
+		"ns.lab.example.\t120\tIN\tAAAA\t2001:db8::53",
+		"mail.example.\t120\tIN\tMX\t10 lab.example.",
+		`txt.lab.example.	120	IN	TXT	"two words" "unquoted" "\"\\A"`,
+		"www.sub.lab.example.\t120\tIN\tCNAME\tns.lab.example.",
+		`raw.sub.lab.example.	120	IN	TYPE65280	\# 3 abcdef`,
+	}
+	if len(records) != len(want) {
+		t.Fatalf("%d records, want %d: %v", len(records), len(want), records)
+	}
+	for i, record := range records {
+		if record.String() != want[i] {
+			t.Errorf("record %d is %q, want %q", i, record.String(), want[i])
+		}
+	}
+
+	for _, file := range []string{
+		"\tA 192.0.2.1",                        // no owner yet
+		"host A 192.0.2.1 192.0.2.2",           // one address too many
+		"host A 2001:db8::1",                   // not IPv4
+		"host MX mail",                         // no preference
+		"host TXT \"open",                      // unterminated
+		"host NS ( ns",                         // unclosed
+		"host NS ns )",                         // unopened
+		"host TYPE65280 ab",                    // unknown type in text
+		"host TYPE65280 \\# 2 abcdef",          // length differs
+		"host BOGUS data",                      // no such type
+		"host TXT " + strings.Repeat("x", 256), // string too long
+		"$INCLUDE other.zone",
+		"$TTL forever",
+		"bad..name A 192.0.2.1",
+	} {
+		if records, err := parseZoneFile(strings.NewReader(file), mustParseName("lab.example")); err == nil {
+			t.Errorf("%q parsed as %v", file, records)
+		}
+	}
+
+	zone := NewZone("lab.example")
+	if _, err := zone.ReadFrom(strings.NewReader("host A 192.0.2.1\nother.example. A 192.0.2.2\n")); err == nil {
+		t.Error("a record outside the zone was read")
+	}
+	if records := zone.Records(); len(records) != 0 {
+		t.Errorf("records %v added from a file that failed", records)
+	}
+}
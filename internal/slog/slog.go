@@ -0,0 +1,323 @@
+// Package slog is the part of the standard library's log/slog the server
+// uses: leveled records of key-value pairs written as text or JSON lines. It
+// exists because the Go 1.19 toolchain the server is built with predates
+// log/slog; the names match so the call sites read the same.
+package slog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// Level is the importance of a record, higher is more severe.
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+var levelNames = []struct {
+	level Level
+	name  string
+}{{LevelDebug, "DEBUG"}, {LevelInfo, "INFO"}, {LevelWarn, "WARN"}, {LevelError, "ERROR"}}
+
+// String returns the level name, with an offset from the nearest lower named
+// level for the ones in between, such as INFO+2.
+func (l Level) String() string {
+	base := levelNames[0]
+	for _, named := range levelNames {
+		if l >= named.level {
+			base = named
+		}
+	}
+	if l == base.level {
+		return base.name
+	}
+	return fmt.Sprintf("%s%+d", base.name, l-base.level)
+}
+
+// Level makes a Level its own Leveler.
+func (l Level) Level() Level { return l }
+
+// MarshalText encodes the level as its name.
+func (l Level) MarshalText() ([]byte, error) { return []byte(l.String()), nil }
+
+// UnmarshalText parses a level name, in any case, with an optional offset.
+func (l *Level) UnmarshalText(data []byte) error {
+	s := strings.ToUpper(string(data))
+	offset := 0
+	if i := strings.IndexAny(s, "+-"); i > 0 {
+		n, err := strconv.Atoi(s[i:])
+		if err != nil {
+			return fmt.Errorf("slog: invalid level %q", data)
+		}
+		s, offset = s[:i], n
+	}
+	for _, named := range levelNames {
+		if s == named.name {
+			*l = named.level + Level(offset)
+			return nil
+		}
+	}
+	return fmt.Errorf("slog: unknown level %q", data)
+}
+
+// Leveler provides the minimum level a handler writes.
+type Leveler interface {
+	Level() Level
+}
+
+// LevelVar is a Level that may be changed while handlers use it.
+type LevelVar struct {
+	level atomic.Int64
+}
+
+// Level returns the current level.
+func (v *LevelVar) Level() Level { return Level(v.level.Load()) }
+
+// Set changes the level.
+func (v *LevelVar) Set(l Level) { v.level.Store(int64(l)) }
+
+func (v *LevelVar) String() string { return fmt.Sprintf("LevelVar(%s)", v.Level()) }
+
+// UnmarshalText sets the level from its name.
+func (v *LevelVar) UnmarshalText(data []byte) error {
+	var l Level
+	if err := l.UnmarshalText(data); err != nil {
+		return err
+	}
+	v.Set(l)
+	return nil
+}
+
+// Record is one log entry, Args holding alternating keys and values.
+type Record struct {
+	Time    time.Time
+	Level   Level
+	Message string
+	Args    []any
+}
+
+// attrs calls f for each key-value pair of the record. A value without a key
+// is given the key !BADKEY, as log/slog does.
+func (r Record) attrs(f func(key string, value any)) {
+	args := r.Args
+	for len(args) > 0 {
+		key, ok := args[0].(string)
+		if !ok || len(args) == 1 {
+			f("!BADKEY", args[0])
+			args = args[1:]
+			continue
+		}
+		f(key, args[1])
+		args = args[2:]
+	}
+}
+
+// Handler writes records somewhere.
+type Handler interface {
+	Enabled(level Level) bool
+	Handle(r Record) error
+}
+
+// HandlerOptions configure the text and JSON handlers. A nil Level writes
+// records of level info and up.
+type HandlerOptions struct {
+	Level Leveler
+}
+
+func (o *HandlerOptions) enabled(level Level) bool {
+	minimum := LevelInfo
+	if o != nil && o.Level != nil {
+		minimum = o.Level.Level()
+	}
+	return level >= minimum
+}
+
+// lineWriter writes each record with a single Write, so the lines of handlers
+// sharing an output do not interleave.
+type lineWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lineWriter) write(line []byte) error {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	_, err := lw.w.Write(line)
+	return err
+}
+
+// TextHandler writes records as lines of key=value pairs.
+type TextHandler struct {
+	opts *HandlerOptions
+	out  lineWriter
+}
+
+// NewTextHandler returns a handler writing to w.
+func NewTextHandler(w io.Writer, opts *HandlerOptions) *TextHandler {
+	return &TextHandler{opts: opts, out: lineWriter{w: w}}
+}
+
+func (h *TextHandler) Enabled(level Level) bool { return h.opts.enabled(level) }
+
+func (h *TextHandler) Handle(r Record) error {
+	buf := []byte("time=")
+	buf = r.Time.AppendFormat(buf, time.RFC3339Nano)
+	buf = append(buf, " level="...)
+	buf = append(buf, r.Level.String()...)
+	buf = append(buf, " msg="...)
+	buf = appendTextValue(buf, r.Message)
+	r.attrs(func(key string, value any) {
+		buf = append(buf, ' ')
+		buf = appendTextValue(buf, key)
+		buf = append(buf, '=')
+		buf = appendTextValue(buf, textValue(value))
+	})
+	buf = append(buf, '\n')
+	return h.out.write(buf)
+}
+
+func textValue(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprintf("%+v", value)
+}
+
+// appendTextValue quotes s if it would otherwise be ambiguous in a key=value
+// line.
+func appendTextValue(buf []byte, s string) []byte {
+	if needsQuoting(s) {
+		return strconv.AppendQuote(buf, s)
+	}
+	return append(buf, s...)
+}
+
+func needsQuoting(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, r := range s {
+		if r == '=' || r == '"' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// JSONHandler writes records as JSON objects, one per line.
+type JSONHandler struct {
+	opts *HandlerOptions
+	out  lineWriter
+}
+
+// NewJSONHandler returns a handler writing to w.
+func NewJSONHandler(w io.Writer, opts *HandlerOptions) *JSONHandler {
+	return &JSONHandler{opts: opts, out: lineWriter{w: w}}
+}
+
+func (h *JSONHandler) Enabled(level Level) bool { return h.opts.enabled(level) }
+
+func (h *JSONHandler) Handle(r Record) error {
+	buf := []byte(`{"time":`)
+	buf = appendJSON(buf, r.Time)
+	buf = append(buf, `,"level":`...)
+	buf = appendJSON(buf, r.Level.String())
+	buf = append(buf, `,"msg":`...)
+	buf = appendJSON(buf, r.Message)
+	r.attrs(func(key string, value any) {
+		buf = append(buf, ',')
+		buf = appendJSON(buf, key)
+		buf = append(buf, ':')
+		switch v := value.(type) {
+		case error:
+			value = v.Error()
+		case time.Duration:
+			value = int64(v)
+		}
+		buf = appendJSON(buf, value)
+	})
+	buf = append(buf, "}\n"...)
+	return h.out.write(buf)
+}
+
+func appendJSON(buf []byte, value any) []byte {
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprintf("!ERROR:%v", err))
+	}
+	return append(buf, data...)
+}
+
+// Logger sends records to a handler.
+type Logger struct {
+	handler Handler
+}
+
+// New returns a logger writing to h.
+func New(h Handler) *Logger { return &Logger{handler: h} }
+
+// Enabled reports whether records of level are written. The context is unused,
+// it is there to match log/slog.
+func (l *Logger) Enabled(ctx context.Context, level Level) bool {
+	return l.handler.Enabled(level)
+}
+
+// Log writes a record of any level.
+func (l *Logger) Log(ctx context.Context, level Level, msg string, args ...any) {
+	if !l.handler.Enabled(level) {
+		return
+	}
+	l.handler.Handle(Record{Time: time.Now(), Level: level, Message: msg, Args: args})
+}
+
+func (l *Logger) Debug(msg string, args ...any) {
+	l.Log(context.Background(), LevelDebug, msg, args...)
+}
+func (l *Logger) Info(msg string, args ...any) { l.Log(context.Background(), LevelInfo, msg, args...) }
+func (l *Logger) Warn(msg string, args ...any) { l.Log(context.Background(), LevelWarn, msg, args...) }
+func (l *Logger) Error(msg string, args ...any) {
+	l.Log(context.Background(), LevelError, msg, args...)
+}
+
+var defaultLogger atomic.Pointer[Logger]
+
+func init() {
+	defaultLogger.Store(New(NewTextHandler(os.Stderr, nil)))
+}
+
+// Default returns the logger the package level functions use.
+func Default() *Logger { return defaultLogger.Load() }
+
+// SetDefault replaces the logger the package level functions use.
+func SetDefault(l *Logger) { defaultLogger.Store(l) }
+
+func Debug(msg string, args ...any) { Default().Debug(msg, args...) }
+func Info(msg string, args ...any)  { Default().Info(msg, args...) }
+func Warn(msg string, args ...any)  { Default().Warn(msg, args...) }
+func Error(msg string, args ...any) { Default().Error(msg, args...) }
+
+// Log writes a record of any level with the default logger.
+func Log(ctx context.Context, level Level, msg string, args ...any) {
+	Default().Log(ctx, level, msg, args...)
+}
@@ -0,0 +1,82 @@
+package slog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLevelText(t *testing.T) {
+	for _, tt := range []struct {
+		text string
+		want Level
+	}{
+		{"debug", LevelDebug},
+		{"INFO", LevelInfo},
+		{"Warn", LevelWarn},
+		{"error", LevelError},
+		{"info+2", LevelInfo + 2},
+		{"ERROR-1", LevelError - 1},
+	} {
+		var l Level
+		if err := l.UnmarshalText([]byte(tt.text)); err != nil {
+			t.Errorf("UnmarshalText(%q): %v", tt.text, err)
+			continue
+		}
+		if l != tt.want {
+			t.Errorf("UnmarshalText(%q) = %v, want %v", tt.text, l, tt.want)
+		}
+	}
+	for _, bad := range []string{"", "verbose", "info+x"} {
+		var l Level
+		if err := l.UnmarshalText([]byte(bad)); err == nil {
+			t.Errorf("UnmarshalText(%q) = %v, want an error", bad, l)
+		}
+	}
+	if got := (LevelInfo + 2).String(); got != "INFO+2" {
+		t.Errorf("String() = %q, want INFO+2", got)
+	}
+}
+
+func TestTextHandler(t *testing.T) {
+	var buf bytes.Buffer
+	level := &LevelVar{}
+	logger := New(NewTextHandler(&buf, &HandlerOptions{Level: level}))
+	logger.Debug("hidden")
+	logger.Info("query answered", "client", "127.0.0.1:53", "took", 3*time.Millisecond, "err", errors.New("no such host"), "odd")
+	line := buf.String()
+	for _, want := range []string{` level=INFO msg="query answered" `, ` client=127.0.0.1:53 `, ` took=3ms `, ` err="no such host" `, ` !BADKEY=odd` + "\n"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("line %q does not contain %q", line, want)
+		}
+	}
+	if strings.Contains(line, "hidden") {
+		t.Errorf("debug record written at level info: %q", line)
+	}
+
+	buf.Reset()
+	level.Set(LevelDebug)
+	logger.Debug("shown")
+	if !strings.Contains(buf.String(), "msg=shown") {
+		t.Errorf("debug record not written after lowering the level: %q", buf.String())
+	}
+}
+
+func TestJSONHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(NewJSONHandler(&buf, nil))
+	logger.Warn("slow upstream", "upstream", "1.1.1.1:53", "took", time.Second, "err", errors.New("timeout"))
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("invalid JSON line %q: %v", buf.String(), err)
+	}
+	want := map[string]any{"level": "WARN", "msg": "slow upstream", "upstream": "1.1.1.1:53", "took": float64(time.Second), "err": "timeout"}
+	for key, value := range want {
+		if record[key] != value {
+			t.Errorf("%s = %v, want %v", key, record[key], value)
+		}
+	}
+}